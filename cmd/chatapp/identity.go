@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// identity is what the chatapp remembers about an account between runs, so
+// a returning user keeps their ID and does not have to log in again while
+// their token is valid.
+type identity struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+// identityFile holds the identities of everyone who used the chatapp on this
+// machine, keyed by lower-cased username, and which of them was used last.
+type identityFile struct {
+	Last       string               `json:"last"`
+	Identities map[string]*identity `json:"identities"`
+}
+
+func defaultIdentityPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "snapp-chat", "identity.json")
+}
+
+// loadIdentities reads the identity file at path. A missing file is not an
+// error.
+func loadIdentities(path string) (*identityFile, error) {
+	f := &identityFile{Identities: map[string]*identity{}}
+	if path == "" {
+		return f, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	if f.Identities == nil {
+		f.Identities = map[string]*identity{}
+	}
+	return f, nil
+}
+
+// lookup returns the saved identity for username, or the last used one if
+// username is empty.
+func (f *identityFile) lookup(username string) *identity {
+	if username == "" {
+		username = f.Last
+	}
+	return f.Identities[strings.ToLower(username)]
+}
+
+// remember records id as the last used identity. previous is the username it
+// was saved under before, if it has since been renamed.
+func (f *identityFile) remember(id *identity, previous string) {
+	if previous != "" {
+		delete(f.Identities, strings.ToLower(previous))
+	}
+	key := strings.ToLower(id.Username)
+	f.Identities[key] = id
+	f.Last = key
+}
+
+// save writes the file to path, readable only by the current user since it
+// contains tokens.
+func (f *identityFile) save(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
@@ -7,18 +7,22 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/amirhlashgari/snapp-chat/internal/client"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
 	pb "github.com/amirhlashgari/snapp-chat/proto"
 
-	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 const menu = `
@@ -27,17 +31,39 @@ Chat Application Menu:
 2. List Rooms
 3. Join Room
 4. Leave Room
-5. Exit
+5. Create Room
+6. Update Room
+7. Delete Room
+8. View Profile
+9. Edit Profile
+10. Set Presence
+11. Invite to Room
+12. Accept Invitation
+13. Review Join Requests
+14. Notifications
+15. Exit
+Or type /msg <username> <message> to send a direct message.
 Enter your choice: `
 
+const (
+	historyPageSize      = 20
+	notificationPageSize = 20
+)
+
 func main() {
-	username := flag.String("user", "", "Username for chat")
+	username := flag.String("user", "", "Username for chat (defaults to the last one used)")
+	password := flag.String("password", os.Getenv("CHAT_PASSWORD"), "Password (defaults to $CHAT_PASSWORD, prompted if empty)")
+	register := flag.Bool("register", false, "Create a new account instead of logging in")
 	natsURL := flag.String("nats", nats.DefaultURL, "NATS server URL")
 	serviceAddr := flag.String("service", "localhost:50051", "Chat service address")
+	awayAfter := flag.Duration("away-after", 5*time.Minute, "Show as away after this long without input (0 to disable)")
+	identityPath := flag.String("identity", defaultIdentityPath(), "File that remembers logged-in users between runs (empty to disable)")
 	flag.Parse()
 
-	if *username == "" {
-		log.Fatal("Username is required")
+	identities, err := loadIdentities(*identityPath)
+	if err != nil {
+		log.Printf("Ignoring identity file: %v", err)
+		identities, _ = loadIdentities("")
 	}
 
 	nc, err := nats.Connect(*natsURL)
@@ -53,11 +79,31 @@ func main() {
 
 	service := pb.NewChatServiceClient(conn)
 
-	userID := uuid.New().String()
-	client, err := client.NewClient(userID, *username, nc, service)
-	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+	scanner := bufio.NewScanner(os.Stdin)
+	client := client.NewClient(nc, service)
+
+	saved := identities.lookup(*username)
+	if *register || saved == nil || client.Resume(saved.Token) != nil {
+		if *username == "" {
+			log.Fatal("Username is required")
+		}
+		if *password == "" {
+			fmt.Print("Password: ")
+			scanner.Scan()
+			*password = strings.TrimSpace(scanner.Text())
+		}
+
+		if *register {
+			err = client.Register(*username, *password)
+		} else {
+			err = client.Login(*username, *password)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
+	rememberSession(client, identities, *identityPath, "")
+	client.SetAutoAway(*awayAfter)
 	defer client.Close()
 
 	sigChan := make(chan os.Signal, 1)
@@ -68,15 +114,28 @@ func main() {
 		os.Exit(0)
 	}()
 
+	if notices, hasMore, err := client.Notifications(0, notificationPageSize); err == nil && len(notices) > 0 {
+		count := "once"
+		switch {
+		case hasMore:
+			count = fmt.Sprintf("%d+ times", len(notices))
+		case len(notices) > 1:
+			count = fmt.Sprintf("%d times", len(notices))
+		}
+		fmt.Printf("You were mentioned %s while away (menu option 14 to read)\n", count)
+	}
+
 	go receiveMessages(client)
+	go receiveEvents(client)
+	go receiveTyping(client)
 
-	scanner := bufio.NewScanner(os.Stdin)
 	for {
 		fmt.Print(menu)
 		if !scanner.Scan() {
 			break
 		}
 
+		client.Touch()
 		choice := strings.TrimSpace(scanner.Text())
 		switch choice {
 		case "1":
@@ -88,9 +147,31 @@ func main() {
 		case "4":
 			leaveRoom(client)
 		case "5":
+			createRoom(client, scanner)
+		case "6":
+			updateRoom(client, scanner)
+		case "7":
+			deleteRoom(client, scanner)
+		case "8":
+			viewProfile(client, scanner)
+		case "9":
+			editProfile(client, scanner, identities, *identityPath)
+		case "10":
+			setPresence(client, scanner)
+		case "11":
+			inviteToRoom(client, scanner)
+		case "12":
+			acceptInvite(client, scanner)
+		case "13":
+			reviewJoinRequests(client, scanner)
+		case "14":
+			showNotifications(client, scanner)
+		case "15":
 			return
 		default:
-			fmt.Println("Invalid choice. Please try again.")
+			if !sendDirect(client, choice) {
+				fmt.Println("Invalid choice. Please try again.")
+			}
 		}
 	}
 }
@@ -100,7 +181,22 @@ func listUsers(client *client.Client, scanner *bufio.Scanner) {
 	scanner.Scan()
 	filter := strings.TrimSpace(scanner.Text())
 
-	users, err := client.ListUsers(filter)
+	fmt.Print("Only show presence, e.g. online,away (or press Enter for all): ")
+	scanner.Scan()
+	var presence []pb.User_Presence
+	for _, name := range strings.Split(scanner.Text(), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		p, ok := parsePresence(name)
+		if !ok {
+			fmt.Printf("Unknown presence %q\n", name)
+			return
+		}
+		presence = append(presence, p)
+	}
+
+	users, err := client.ListUsers(filter, presence...)
 	if err != nil {
 		fmt.Printf("Error listing users: %v\n", err)
 		return
@@ -108,7 +204,134 @@ func listUsers(client *client.Client, scanner *bufio.Scanner) {
 
 	fmt.Println("\nUsers:")
 	for i, user := range users {
-		fmt.Printf("%d. %s (%s)\n", i+1, user.Username, user.Status)
+		if user.Bot {
+			fmt.Printf("%d. %s (bot)\n", i+1, user.Username)
+			continue
+		}
+		fmt.Printf("%d. %s (%s)\n", i+1, user.Username, describePresence(user))
+	}
+}
+
+func viewProfile(client *client.Client, scanner *bufio.Scanner) {
+	fmt.Print("Enter username (or press Enter for your own): ")
+	scanner.Scan()
+	username := strings.TrimSpace(scanner.Text())
+
+	user, err := client.GetUser(username)
+	if err != nil {
+		fmt.Printf("Error loading profile: %v\n", err)
+		return
+	}
+
+	fmt.Printf("\nUsername:     %s\n", user.Username)
+	fmt.Printf("Display name: %s\n", user.DisplayName)
+	fmt.Printf("Bio:          %s\n", user.Bio)
+	fmt.Printf("Avatar:       %s\n", user.AvatarUrl)
+	fmt.Printf("Timezone:     %s\n", user.Timezone)
+	fmt.Printf("Presence:     %s\n", describePresence(user))
+}
+
+func setPresence(client *client.Client, scanner *bufio.Scanner) {
+	fmt.Print("Presence (online/away/busy/invisible, or press Enter to keep it): ")
+	scanner.Scan()
+	if name := strings.TrimSpace(scanner.Text()); name != "" {
+		presence, ok := parsePresence(name)
+		if !ok || presence == pb.User_OFFLINE {
+			fmt.Println("Invalid presence")
+			return
+		}
+		if _, err := client.SetPresence(presence); err != nil {
+			fmt.Printf("Error setting presence: %v\n", err)
+			return
+		}
+	}
+
+	fmt.Print("Status text (press Enter to keep it, - to clear it): ")
+	scanner.Scan()
+	text := strings.TrimSpace(scanner.Text())
+	if text == "" {
+		return
+	}
+	if text == "-" {
+		text = ""
+	}
+
+	var ttl time.Duration
+	if text != "" {
+		fmt.Print("Clear it after, e.g. 30m or 2h (or press Enter to keep it): ")
+		scanner.Scan()
+		if value := strings.TrimSpace(scanner.Text()); value != "" {
+			var err error
+			if ttl, err = time.ParseDuration(value); err != nil || ttl < time.Second {
+				fmt.Println("Invalid duration")
+				return
+			}
+		}
+	}
+
+	user, err := client.SetStatus(text, ttl)
+	if err != nil {
+		fmt.Printf("Error setting status: %v\n", err)
+		return
+	}
+	fmt.Printf("You are %s\n", describePresence(user))
+}
+
+func parsePresence(name string) (pb.User_Presence, bool) {
+	value, ok := pb.User_Presence_value[strings.ToUpper(name)]
+	return pb.User_Presence(value), ok
+}
+
+// describePresence renders a user's presence and status text, e.g.
+// "away: at lunch".
+func describePresence(user *pb.User) string {
+	presence := strings.ToLower(user.Presence.String())
+	if user.StatusText == "" {
+		return presence
+	}
+	return presence + ": " + user.StatusText
+}
+
+func editProfile(client *client.Client, scanner *bufio.Scanner, identities *identityFile, identityPath string) {
+	fmt.Println("Press Enter to keep a field, or enter - to clear it.")
+	ask := func(prompt string) *string {
+		fmt.Printf("%s: ", prompt)
+		scanner.Scan()
+		value := strings.TrimSpace(scanner.Text())
+		switch value {
+		case "":
+			return nil
+		case "-":
+			value = ""
+		}
+		return &value
+	}
+
+	req := &pb.UpdateProfileRequest{
+		Username:    ask("New username"),
+		DisplayName: ask("Display name"),
+		Bio:         ask("Bio"),
+		AvatarUrl:   ask("Avatar URL"),
+		Timezone:    ask("Timezone (e.g. Asia/Tehran)"),
+	}
+
+	_, previous, _ := client.Session()
+	user, err := client.UpdateProfile(req)
+	if err != nil {
+		fmt.Printf("Error updating profile: %v\n", err)
+		return
+	}
+	rememberSession(client, identities, identityPath, previous)
+	fmt.Printf("Updated profile of %s\n", user.Username)
+}
+
+// rememberSession saves the client's session to the identity file. previous
+// is the username the session was saved under before a rename.
+func rememberSession(client *client.Client, identities *identityFile, path, previous string) {
+	userID, username, token := client.Session()
+	identities.remember(&identity{UserID: userID, Username: username, Token: token}, previous)
+	if err := identities.save(path); err != nil {
+		log.Printf("Failed to save identity: %v", err)
 	}
 }
 
@@ -117,7 +340,7 @@ func listRooms(client *client.Client, scanner *bufio.Scanner) {
 	scanner.Scan()
 	filter := strings.TrimSpace(scanner.Text())
 
-	rooms, err := client.ListRooms(filter)
+	rooms, unread, err := client.ListRooms(filter)
 	if err != nil {
 		fmt.Printf("Error listing rooms: %v\n", err)
 		return
@@ -125,42 +348,371 @@ func listRooms(client *client.Client, scanner *bufio.Scanner) {
 
 	fmt.Println("\nRooms:")
 	for i, room := range rooms {
-		fmt.Printf("%d. %s (%d members)\n", i+1, room.Name, len(room.Members))
+		if room.Direct {
+			fmt.Printf("%d. %s (direct)%s\n", i+1, room.Name, unreadSuffix(unread[room.Id]))
+			continue
+		}
+		fmt.Printf("%d. %s (%d members)%s\n", i+1, roomLabel(room), len(room.Members), unreadSuffix(unread[room.Id]))
 	}
 }
 
-func joinRoom(client *client.Client, scanner *bufio.Scanner) {
-	rooms, err := client.ListRooms("")
+// roomLabel is a room's name, marked if not everyone can join it.
+func roomLabel(room *pb.ChatRoom) string {
+	switch room.Visibility {
+	case pb.ChatRoom_PRIVATE:
+		return room.Name + " [private]"
+	case pb.ChatRoom_REQUEST:
+		return room.Name + " [approval needed]"
+	}
+	return room.Name
+}
+
+// parseVisibility reads a room visibility as typed by the user, where
+// "invite" is short for private.
+func parseVisibility(name string) (pb.ChatRoom_Visibility, bool) {
+	if strings.EqualFold(name, "invite") {
+		return pb.ChatRoom_PRIVATE, true
+	}
+	value, ok := pb.ChatRoom_Visibility_value[strings.ToUpper(name)]
+	return pb.ChatRoom_Visibility(value), ok
+}
+
+func unreadSuffix(unread uint64) string {
+	if unread == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d unread)", unread)
+}
+
+// chooseRoom lists all rooms and asks the user to pick one. It returns nil
+// if listing fails or the choice is invalid.
+func chooseRoom(client *client.Client, scanner *bufio.Scanner, action string) *pb.ChatRoom {
+	rooms, unread, err := client.ListRooms("")
 	if err != nil {
 		fmt.Printf("Error listing rooms: %v\n", err)
-		return
+		return nil
 	}
 
 	fmt.Println("\nAvailable Rooms:")
 	for i, room := range rooms {
-		fmt.Printf("%d. %s\n", i+1, room.Name)
+		fmt.Printf("%d. %s%s\n", i+1, roomLabel(room), unreadSuffix(unread[room.Id]))
 	}
 
-	fmt.Print("Enter room number to join: ")
+	fmt.Printf("Enter room number to %s: ", action)
 	scanner.Scan()
 	choice := strings.TrimSpace(scanner.Text())
 
 	idx, err := strconv.Atoi(choice)
 	if err != nil || idx < 1 || idx > len(rooms) {
 		fmt.Println("Invalid room number")
+		return nil
+	}
+
+	return rooms[idx-1]
+}
+
+func joinRoom(client *client.Client, scanner *bufio.Scanner) {
+	room := chooseRoom(client, scanner, "join")
+	if room == nil {
+		return
+	}
+
+	userID, _, _ := client.Session()
+	switch {
+	case slices.Contains(room.Invited, userID):
+		if _, err := client.AcceptInvite(room.Id, ""); err != nil {
+			fmt.Printf("Error accepting invitation: %s\n", describeError(err))
+			return
+		}
+	case room.Visibility == pb.ChatRoom_REQUEST && !slices.Contains(room.Members, userID):
+		if err := client.RequestJoin(room.Id); err != nil {
+			fmt.Printf("Error requesting to join: %s\n", describeError(err))
+			return
+		}
+		fmt.Printf("Asked the owner of %s to let you in\n", room.Name)
+		return
+	}
+
+	if err := client.JoinRoom(room.Id); err != nil {
+		fmt.Printf("Error joining room: %s\n", describeError(err))
+		return
+	}
+
+	fmt.Printf("Joined room: %s\n", room.Name)
+	if room.Topic != "" {
+		fmt.Printf("Topic: %s\n", room.Topic)
+	}
+	chatMode(client, scanner)
+}
+
+func inviteToRoom(client *client.Client, scanner *bufio.Scanner) {
+	room := chooseRoom(client, scanner, "invite to")
+	if room == nil {
 		return
 	}
 
-	room := rooms[idx-1]
+	fmt.Print("Enter username to invite (or press Enter to create an invite code): ")
+	scanner.Scan()
+	if username := strings.TrimSpace(scanner.Text()); username != "" {
+		if err := client.Invite(room.Id, username); err != nil {
+			fmt.Printf("Error inviting %s: %v\n", username, err)
+			return
+		}
+		fmt.Printf("Invited %s to %s\n", username, room.Name)
+		return
+	}
+
+	fmt.Print("Expire after, e.g. 24h (or press Enter for a week): ")
+	scanner.Scan()
+	var ttl time.Duration
+	if value := strings.TrimSpace(scanner.Text()); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < time.Second {
+			fmt.Println("Invalid duration")
+			return
+		}
+	}
+
+	fmt.Print("Maximum uses (or press Enter for unlimited): ")
+	scanner.Scan()
+	maxUses := 0
+	if value := strings.TrimSpace(scanner.Text()); value != "" {
+		var err error
+		if maxUses, err = strconv.Atoi(value); err != nil || maxUses < 1 {
+			fmt.Println("Invalid number")
+			return
+		}
+	}
+
+	invite, err := client.CreateInviteCode(room.Id, ttl, maxUses)
+	if err != nil {
+		fmt.Printf("Error creating invite code: %v\n", err)
+		return
+	}
+	fmt.Printf("Invite code for %s: %s (valid until %s)\n", room.Name, invite.Code, time.Unix(invite.ExpiresAt, 0).Format(time.RFC3339))
+}
+
+func acceptInvite(client *client.Client, scanner *bufio.Scanner) {
+	fmt.Print("Enter invite code (or press Enter to pick an invitation): ")
+	scanner.Scan()
+	code := strings.TrimSpace(scanner.Text())
+
+	roomID := ""
+	if code == "" {
+		rooms, _, err := client.ListRooms("")
+		if err != nil {
+			fmt.Printf("Error listing rooms: %v\n", err)
+			return
+		}
+		userID, _, _ := client.Session()
+		var invitations []*pb.ChatRoom
+		for _, room := range rooms {
+			if slices.Contains(room.Invited, userID) {
+				invitations = append(invitations, room)
+			}
+		}
+		if len(invitations) == 0 {
+			fmt.Println("You have no invitations")
+			return
+		}
+
+		fmt.Println("\nInvitations:")
+		for i, room := range invitations {
+			fmt.Printf("%d. %s\n", i+1, roomLabel(room))
+		}
+		fmt.Print("Enter room number to accept: ")
+		scanner.Scan()
+		idx, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil || idx < 1 || idx > len(invitations) {
+			fmt.Println("Invalid room number")
+			return
+		}
+		roomID = invitations[idx-1].Id
+	}
+
+	room, err := client.AcceptInvite(roomID, code)
+	if err != nil {
+		fmt.Printf("Error accepting invitation: %s\n", describeError(err))
+		return
+	}
 	if err := client.JoinRoom(room.Id); err != nil {
-		fmt.Printf("Error joining room: %v\n", err)
+		fmt.Printf("Error joining room: %s\n", describeError(err))
 		return
 	}
 
 	fmt.Printf("Joined room: %s\n", room.Name)
+	if room.Topic != "" {
+		fmt.Printf("Topic: %s\n", room.Topic)
+	}
 	chatMode(client, scanner)
 }
 
+func reviewJoinRequests(client *client.Client, scanner *bufio.Scanner) {
+	rooms, _, err := client.ListRooms("")
+	if err != nil {
+		fmt.Printf("Error listing rooms: %v\n", err)
+		return
+	}
+	users, err := client.ListUsers("")
+	if err != nil {
+		fmt.Printf("Error listing users: %v\n", err)
+		return
+	}
+	usernames := map[string]string{}
+	for _, user := range users {
+		usernames[user.Id] = user.Username
+	}
+
+	userID, _, _ := client.Session()
+	pending := false
+	for _, room := range rooms {
+		if room.OwnerId != userID {
+			continue
+		}
+		for _, requester := range room.JoinRequests {
+			pending = true
+			fmt.Printf("Let %s join %s? (y/n, or press Enter to decide later): ", usernames[requester], room.Name)
+			scanner.Scan()
+			answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+			if answer != "y" && answer != "n" {
+				continue
+			}
+			if err := client.ApproveJoin(room.Id, requester, answer == "y"); err != nil {
+				fmt.Printf("Error answering request: %v\n", err)
+			}
+		}
+	}
+	if !pending {
+		fmt.Println("No pending join requests")
+	}
+}
+
+func showNotifications(client *client.Client, scanner *bufio.Scanner) {
+	var shown []uint64
+	var after uint64
+	for {
+		notices, hasMore, err := client.Notifications(after, notificationPageSize)
+		if err != nil {
+			fmt.Printf("Error listing notifications: %v\n", err)
+			return
+		}
+		if after == 0 && len(notices) == 0 {
+			fmt.Println("No notifications")
+			return
+		}
+		for _, notice := range notices {
+			fmt.Printf("[%s] %s\n", time.Unix(notice.Timestamp, 0).Format("2006-01-02 15:04"), describeNotification(notice))
+			after = notice.Seq
+			shown = append(shown, notice.Seq)
+		}
+		if !hasMore {
+			break
+		}
+		fmt.Print("Press Enter for more, or q to stop: ")
+		scanner.Scan()
+		if strings.TrimSpace(scanner.Text()) == "q" {
+			break
+		}
+	}
+
+	// Only the notifications shown are dismissed; new ones may have come in
+	// meanwhile.
+	fmt.Print("Dismiss these notifications? (y/n): ")
+	scanner.Scan()
+	if strings.ToLower(strings.TrimSpace(scanner.Text())) != "y" {
+		return
+	}
+	for _, seq := range shown {
+		if err := client.AckNotification(seq); err != nil {
+			fmt.Printf("Error dismissing notification: %v\n", err)
+			return
+		}
+	}
+}
+
+func describeNotification(notice *pb.Notification) string {
+	where := notice.GetRoomName()
+	if notice.GetThreadSeq() != 0 {
+		where += fmt.Sprintf(" (thread #%d)", notice.GetThreadSeq())
+	}
+	return fmt.Sprintf("%s mentioned you in %s, #%d: %s", notice.GetFromUsername(), where, notice.GetMessageSeq(), notice.GetExcerpt())
+}
+
+func createRoom(client *client.Client, scanner *bufio.Scanner) {
+	fmt.Print("Enter room name: ")
+	scanner.Scan()
+	name := strings.TrimSpace(scanner.Text())
+
+	fmt.Print("Enter room description: ")
+	scanner.Scan()
+	description := strings.TrimSpace(scanner.Text())
+
+	fmt.Print("Who can join: public, private (invite only) or request (or press Enter for public): ")
+	scanner.Scan()
+	visibility := pb.ChatRoom_PUBLIC
+	if value := strings.TrimSpace(scanner.Text()); value != "" {
+		var ok bool
+		if visibility, ok = parseVisibility(value); !ok {
+			fmt.Println("Invalid visibility")
+			return
+		}
+	}
+
+	room, err := client.CreateRoom(name, description, visibility)
+	if err != nil {
+		fmt.Printf("Error creating room: %v\n", err)
+		return
+	}
+	fmt.Printf("Created room: %s\n", room.Name)
+}
+
+func updateRoom(client *client.Client, scanner *bufio.Scanner) {
+	room := chooseRoom(client, scanner, "update")
+	if room == nil {
+		return
+	}
+
+	fmt.Print("Enter new name (or press Enter to keep it): ")
+	scanner.Scan()
+	name := strings.TrimSpace(scanner.Text())
+
+	fmt.Print("Enter new description (or press Enter to keep it): ")
+	scanner.Scan()
+	description := strings.TrimSpace(scanner.Text())
+
+	fmt.Print("Who can join: public, private or request (or press Enter to keep it): ")
+	scanner.Scan()
+	var visibility *pb.ChatRoom_Visibility
+	if value := strings.TrimSpace(scanner.Text()); value != "" {
+		v, ok := parseVisibility(value)
+		if !ok {
+			fmt.Println("Invalid visibility")
+			return
+		}
+		visibility = &v
+	}
+
+	updated, err := client.UpdateRoom(room.Id, name, description, visibility)
+	if err != nil {
+		fmt.Printf("Error updating room: %v\n", err)
+		return
+	}
+	fmt.Printf("Updated room: %s\n", updated.Name)
+}
+
+func deleteRoom(client *client.Client, scanner *bufio.Scanner) {
+	room := chooseRoom(client, scanner, "delete")
+	if room == nil {
+		return
+	}
+
+	if err := client.DeleteRoom(room.Id); err != nil {
+		fmt.Printf("Error deleting room: %v\n", err)
+		return
+	}
+	fmt.Printf("Deleted room: %s\n", room.Name)
+}
+
 func leaveRoom(client *client.Client) {
 	if err := client.LeaveRoom(""); err != nil {
 		fmt.Printf("Error leaving room: %v\n", err)
@@ -170,25 +722,689 @@ func leaveRoom(client *client.Client) {
 }
 
 func chatMode(client *client.Client, scanner *bufio.Scanner) {
-	fmt.Println("\nChat Mode (type /exit to leave):")
+	fmt.Println("\nChat Mode (type /history for older messages, /typing to show you are typing, /msg <username> <message> to message someone directly, /exit to leave):")
+	fmt.Println("Use /reply <#> <message> to reply to a message in its thread and /thread <#> to read a thread.")
+	fmt.Println("Use /edit <#> <message> and /delete <#> to change your messages, numbered as shown, and /react <#> <emoji> or /unreact <#> <emoji> to react to one.")
+	fmt.Println("Moderators can also /kick <user>, /ban <user> [duration], /unban <user>, /mute <user> [duration], /unmute <user>, and owners /role <user> <member|moderator|owner>.")
+	fmt.Println("Moderators can set up content filters with /filter; /filters lists them.")
+	fmt.Println("Moderators can send the room's events to HTTP endpoints with /webhook; /webhooks lists them.")
+	fmt.Println("Other commands, such as /who, /topic, /me and those of bots, run on the server; /help lists them. Start a message with // to send it with a single /.")
+	historyToken := ""
 	for scanner.Scan() {
+		client.Touch()
 		input := strings.TrimSpace(scanner.Text())
 		if input == "/exit" {
+			if err := client.StopTyping(); err != nil {
+				fmt.Printf("Error stopping typing: %v\n", err)
+			}
 			return
 		}
 
-		if err := client.SendMessage(input); err != nil {
-			fmt.Printf("Error sending message: %v\n", err)
-			return
+		if input == "/typing" {
+			if err := client.StartTyping(); err != nil {
+				fmt.Printf("Error sending typing indicator: %v\n", err)
+			}
+			continue
+		}
+
+		if input == "/history" {
+			historyToken = showHistory(client, historyToken)
+			continue
+		}
+
+		if input == "" || sendDirect(client, input) || threadCommand(client, input) || reviseMessage(client, input) || react(client, input) || moderate(client, input) || filterCommand(client, input) || webhookCommand(client, input) {
+			continue
+		}
+
+		output, err := client.SendMessage(input)
+		if err != nil {
+			fmt.Printf("Error sending message: %s\n", describeError(err))
+		}
+		if output != "" {
+			fmt.Println(output)
+		}
+	}
+}
+
+// describeError leaves out the gRPC details of rate limit errors, whose
+// message already says when to try again.
+func describeError(err error) string {
+	if st, ok := status.FromError(err); ok && st.Code() == codes.ResourceExhausted {
+		return st.Message()
+	}
+	return err.Error()
+}
+
+// sendDirect handles "/msg <username> <message>", reporting whether input
+// was such a command.
+func sendDirect(client *client.Client, input string) bool {
+	command, rest, _ := strings.Cut(input, " ")
+	if command != "/msg" {
+		return false
+	}
+
+	username, content, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	if username == "" || strings.TrimSpace(content) == "" {
+		fmt.Println("Usage: /msg <username> <message>")
+		return true
+	}
+
+	if _, err := client.SendDirectMessage(username, content); err != nil {
+		fmt.Printf("Error sending direct message: %s\n", describeError(err))
+		return true
+	}
+	fmt.Printf("-> %s: %s\n", username, content)
+	return true
+}
+
+// threadCommand handles "/reply <#> <message>" and "/thread <#>", reporting
+// whether input was one of them.
+func threadCommand(client *client.Client, input string) bool {
+	command, rest, _ := strings.Cut(input, " ")
+	if command != "/reply" && command != "/thread" {
+		return false
+	}
+
+	number, content, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	seq, err := strconv.ParseUint(strings.TrimPrefix(number, "#"), 10, 64)
+	reply := command == "/reply"
+	if err != nil || reply != (strings.TrimSpace(content) != "") {
+		fmt.Println("Usage: /reply <#> <message> or /thread <#>")
+		return true
+	}
+
+	if reply {
+		output, err := client.Reply(seq, content)
+		if err != nil {
+			fmt.Printf("Error sending reply: %s\n", describeError(err))
+		}
+		if output != "" {
+			fmt.Println(output)
+		}
+		return true
+	}
+
+	root, replies, next, err := client.Thread(seq, historyPageSize, "")
+	if err != nil {
+		fmt.Printf("Error loading thread: %v\n", err)
+		return true
+	}
+	fmt.Println("\n-- thread --")
+	printMessage(root)
+	for {
+		for _, reply := range replies {
+			printMessage(reply)
+		}
+		if next == "" {
+			break
+		}
+		if _, replies, next, err = client.Thread(seq, historyPageSize, next); err != nil {
+			fmt.Printf("Error loading thread: %v\n", err)
+			return true
+		}
+	}
+	fmt.Println("-- end of thread --")
+	return true
+}
+
+// reviseMessage handles "/edit <#> <message>" and "/delete <#>", reporting
+// whether input was one of them.
+func reviseMessage(client *client.Client, input string) bool {
+	command, rest, _ := strings.Cut(input, " ")
+	if command != "/edit" && command != "/delete" {
+		return false
+	}
+
+	number, content, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	seq, err := strconv.ParseUint(strings.TrimPrefix(number, "#"), 10, 64)
+	edit := command == "/edit"
+	if err != nil || edit != (strings.TrimSpace(content) != "") {
+		fmt.Println("Usage: /edit <#> <message> or /delete <#>")
+		return true
+	}
+
+	if edit {
+		err = client.EditMessage(seq, content)
+	} else {
+		err = client.DeleteMessage(seq)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	return true
+}
+
+// react handles "/react <#> <emoji>" and "/unreact <#> <emoji>", reporting
+// whether input was one of them.
+func react(client *client.Client, input string) bool {
+	fields := strings.Fields(input)
+	if len(fields) == 0 || (fields[0] != "/react" && fields[0] != "/unreact") {
+		return false
+	}
+
+	usage := fmt.Sprintf("Usage: %s <#> <emoji>, e.g. %s 12 :thumbsup:", fields[0], fields[0])
+	if len(fields) != 3 {
+		fmt.Println(usage)
+		return true
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "#"), 10, 64)
+	if err != nil {
+		fmt.Println(usage)
+		return true
+	}
+
+	if fields[0] == "/react" {
+		_, err = client.AddReaction(seq, fields[2])
+	} else {
+		_, err = client.RemoveReaction(seq, fields[2])
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	return true
+}
+
+// moderate handles the moderation commands of chat mode, reporting whether
+// input was one of them.
+func moderate(client *client.Client, input string) bool {
+	fields := strings.Fields(input)
+	usage := map[string]string{
+		"/kick":   "/kick <username>",
+		"/ban":    "/ban <username> [duration, e.g. 1h]",
+		"/unban":  "/unban <username>",
+		"/mute":   "/mute <username> [duration, e.g. 10m]",
+		"/unmute": "/unmute <username>",
+		"/role":   "/role <username> <member|moderator|owner>",
+	}[fields[0]]
+	if usage == "" {
+		return false
+	}
+
+	command := fields[0]
+	maxArgs := 2
+	if command == "/kick" || command == "/unban" || command == "/unmute" {
+		maxArgs = 1
+	}
+	if len(fields) < 2 || len(fields)-1 > maxArgs || (command == "/role" && len(fields) != 3) {
+		fmt.Println("Usage: " + usage)
+		return true
+	}
+
+	room := client.CurrentRoom()
+	if room == nil {
+		fmt.Println("Not in any room")
+		return true
+	}
+	user, err := client.GetUser(fields[1])
+	if err != nil {
+		fmt.Printf("Error finding user: %v\n", err)
+		return true
+	}
+
+	var duration time.Duration
+	if len(fields) == 3 && command != "/role" {
+		duration, err = time.ParseDuration(fields[2])
+		if err != nil || duration <= 0 {
+			fmt.Println("Usage: " + usage)
+			return true
 		}
 	}
+
+	switch command {
+	case "/kick":
+		err = client.Kick(room.Id, user.Id)
+	case "/ban":
+		err = client.Ban(room.Id, user.Id, duration)
+	case "/unban":
+		err = client.Unban(room.Id, user.Id)
+	case "/mute":
+		err = client.Mute(room.Id, user.Id, duration)
+	case "/unmute":
+		err = client.Unmute(room.Id, user.Id)
+	case "/role":
+		role, ok := pb.ChatRoom_Role_value[strings.ToUpper(fields[2])]
+		if !ok {
+			fmt.Println("Usage: " + usage)
+			return true
+		}
+		err = client.SetRole(room.Id, user.Id, pb.ChatRoom_Role(role))
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	return true
+}
+
+const filterUsage = `Usage: /filters, /filter clear, /filter remove <#>, or
+  /filter add <mask|reject|flag|allow> blocklist <word,word,...>
+  /filter add <mask|reject|flag|allow> regex <pattern>
+  /filter add <mask|reject|flag|allow> links <allow|deny> <domain,domain,...>
+  /filter add <mask|reject|flag|allow> pii`
+
+// filterCommand handles "/filters" and "/filter ...", which show and change
+// the current room's content filters, reporting whether input was one of
+// them.
+func filterCommand(client *client.Client, input string) bool {
+	fields := strings.Fields(input)
+	if fields[0] != "/filters" && fields[0] != "/filter" {
+		return false
+	}
+
+	current := client.CurrentRoom()
+	if current == nil {
+		fmt.Println("Not in any room")
+		return true
+	}
+	// The room the client joined may be out of date.
+	rooms, _, err := client.ListRooms("")
+	if err != nil {
+		fmt.Printf("Error listing rooms: %v\n", err)
+		return true
+	}
+	i := slices.IndexFunc(rooms, func(room *pb.ChatRoom) bool { return room.Id == current.Id })
+	if i < 0 {
+		fmt.Println("Not in any room")
+		return true
+	}
+	filters := rooms[i].Filters
+
+	if fields[0] == "/filters" {
+		if len(filters) == 0 {
+			fmt.Println("This room has no filters")
+		}
+		for i, f := range filters {
+			fmt.Printf("%d. %s\n", i+1, describeFilter(f))
+		}
+		return true
+	}
+
+	switch {
+	case len(fields) == 2 && fields[1] == "clear":
+		filters = nil
+	case len(fields) == 3 && fields[1] == "remove":
+		n, err := strconv.Atoi(strings.TrimPrefix(fields[2], "#"))
+		if err != nil || n < 1 || n > len(filters) {
+			fmt.Println("No such filter; /filters lists them")
+			return true
+		}
+		filters = slices.Delete(slices.Clone(filters), n-1, n)
+	case len(fields) >= 4 && fields[1] == "add":
+		f, ok := parseFilter(fields[2], fields[3], fields[4:])
+		if !ok {
+			fmt.Println(filterUsage)
+			return true
+		}
+		filters = append(slices.Clone(filters), f)
+	default:
+		fmt.Println(filterUsage)
+		return true
+	}
+
+	if _, err := client.SetRoomFilters(current.Id, filters); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	return true
+}
+
+// parseFilter builds a filter from the words after "/filter add".
+func parseFilter(action, kind string, args []string) (*pb.ContentFilter, bool) {
+	value, ok := pb.ContentFilter_Action_value[strings.ToUpper(action)]
+	if !ok {
+		return nil, false
+	}
+	f := &pb.ContentFilter{Action: pb.ContentFilter_Action(value)}
+	switch {
+	case kind == "blocklist" && len(args) > 0:
+		f.Rule = &pb.ContentFilter_Blocklist_{Blocklist: &pb.ContentFilter_Blocklist{
+			Words: strings.Split(strings.Join(args, " "), ","),
+		}}
+	case kind == "regex" && len(args) > 0:
+		f.Rule = &pb.ContentFilter_Regex_{Regex: &pb.ContentFilter_Regex{
+			Pattern: strings.Join(args, " "),
+		}}
+	case kind == "links" && len(args) == 2 && (args[0] == "allow" || args[0] == "deny"):
+		links := &pb.ContentFilter_Links{}
+		if args[0] == "allow" {
+			links.Allow = strings.Split(args[1], ",")
+		} else {
+			links.Deny = strings.Split(args[1], ",")
+		}
+		f.Rule = &pb.ContentFilter_Links_{Links: links}
+	case kind == "pii" && len(args) == 0:
+		f.Rule = &pb.ContentFilter_Pii_{Pii: &pb.ContentFilter_Pii{}}
+	default:
+		return nil, false
+	}
+	return f, true
+}
+
+func describeFilter(f *pb.ContentFilter) string {
+	var rule string
+	switch {
+	case f.GetBlocklist() != nil:
+		rule = "blocked words: " + strings.Join(f.GetBlocklist().GetWords(), ", ")
+	case f.GetRegex() != nil:
+		rule = "pattern " + f.GetRegex().GetPattern()
+	case len(f.GetLinks().GetAllow()) > 0:
+		rule = "links other than to " + strings.Join(f.GetLinks().GetAllow(), ", ")
+	case f.GetLinks() != nil:
+		rule = "links to " + strings.Join(f.GetLinks().GetDeny(), ", ")
+	case f.GetPii() != nil:
+		rule = "e-mail addresses and phone numbers"
+	}
+	return fmt.Sprintf("%s %s", strings.ToLower(f.GetAction().String()), rule)
+}
+
+const webhookUsage = `Usage: /webhooks, /webhook remove <#>, /webhook deliveries <#>, or
+  /webhook add <url> [event,event,...], e.g. /webhook add https://example.com/hook message_sent`
+
+// webhookCommand handles "/webhooks" and "/webhook ...", which show and change
+// the current room's webhooks, reporting whether input was one of them.
+func webhookCommand(client *client.Client, input string) bool {
+	fields := strings.Fields(input)
+	if fields[0] != "/webhooks" && fields[0] != "/webhook" {
+		return false
+	}
+
+	current := client.CurrentRoom()
+	if current == nil {
+		fmt.Println("Not in any room")
+		return true
+	}
+
+	if len(fields) >= 3 && fields[0] == "/webhook" && fields[1] == "add" {
+		var events []pb.Event_Type
+		if len(fields) == 4 {
+			for _, name := range strings.Split(fields[3], ",") {
+				value, ok := pb.Event_Type_value[strings.ToUpper(name)]
+				if !ok {
+					fmt.Printf("Unknown event %q\n", name)
+					return true
+				}
+				events = append(events, pb.Event_Type(value))
+			}
+		} else if len(fields) > 4 {
+			fmt.Println(webhookUsage)
+			return true
+		}
+		hook, err := client.CreateWebhook(current.Id, fields[2], events...)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return true
+		}
+		fmt.Printf("Webhook added. Its requests are signed with this secret, which is not shown again:\n%s\n", hook.Secret)
+		return true
+	}
+
+	hooks, err := client.ListWebhooks(current.Id)
+	if err != nil {
+		fmt.Printf("Error listing webhooks: %s\n", describeError(err))
+		return true
+	}
+
+	if fields[0] == "/webhooks" {
+		if len(hooks) == 0 {
+			fmt.Println("This room has no webhooks")
+		}
+		for i, hook := range hooks {
+			fmt.Printf("%d. %s (%s)\n", i+1, hook.Url, describeEventTypes(hook.Events))
+		}
+		return true
+	}
+
+	if len(fields) != 3 || (fields[1] != "remove" && fields[1] != "deliveries") {
+		fmt.Println(webhookUsage)
+		return true
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(fields[2], "#"))
+	if err != nil || n < 1 || n > len(hooks) {
+		fmt.Println("No such webhook; /webhooks lists them")
+		return true
+	}
+	hook := hooks[n-1]
+
+	if fields[1] == "remove" {
+		if err := client.DeleteWebhook(current.Id, hook.Id); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return true
+	}
+
+	deliveries, err := client.WebhookDeliveries(current.Id, hook.Id, 0)
+	if err != nil {
+		fmt.Printf("Error listing deliveries: %s\n", describeError(err))
+		return true
+	}
+	if len(deliveries) == 0 {
+		fmt.Println("Nothing was delivered yet")
+	}
+	for _, d := range deliveries {
+		attempts := fmt.Sprintf("%d attempts", d.Attempts)
+		if d.Attempts == 1 {
+			attempts = "1 attempt"
+		}
+		line := fmt.Sprintf("%s %s: %s after %s",
+			time.Unix(d.CreatedAt, 0).Format("Jan 2 15:04:05"), d.EventType, strings.ToLower(d.State.String()), attempts)
+		if d.Error != "" {
+			line += " (" + d.Error + ")"
+		}
+		if d.NextAttemptAt != 0 {
+			line += ", retrying at " + time.Unix(d.NextAttemptAt, 0).Format("15:04:05")
+		}
+		fmt.Println(line)
+	}
+	return true
+}
+
+func describeEventTypes(types []pb.Event_Type) string {
+	if len(types) == 0 {
+		return "all events"
+	}
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = strings.ToLower(t.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// describeModeration turns a moderation event into a line for the chat.
+func describeModeration(ev *pb.Event) string {
+	action := ev.GetModeration()
+	until := ""
+	if action.GetUntil() != 0 {
+		until = " until " + time.Unix(action.GetUntil(), 0).Format("Jan 2 15:04")
+	}
+
+	switch ev.Type {
+	case pb.Event_USER_KICKED:
+		return fmt.Sprintf("%s was kicked by %s", action.GetUsername(), action.GetModeratorUsername())
+	case pb.Event_USER_BANNED:
+		return fmt.Sprintf("%s was banned by %s%s", action.GetUsername(), action.GetModeratorUsername(), until)
+	case pb.Event_USER_UNBANNED:
+		return fmt.Sprintf("%s was unbanned by %s", action.GetUsername(), action.GetModeratorUsername())
+	case pb.Event_USER_MUTED:
+		return fmt.Sprintf("%s was muted by %s%s", action.GetUsername(), action.GetModeratorUsername(), until)
+	case pb.Event_USER_UNMUTED:
+		return fmt.Sprintf("%s was unmuted by %s", action.GetUsername(), action.GetModeratorUsername())
+	}
+	return fmt.Sprintf("%s is now %s", action.GetUsername(), strings.ToLower(action.GetRole().String()))
+}
+
+// showHistory prints the page of history before pageToken, oldest message
+// first, and returns the token for the page before it.
+func showHistory(client *client.Client, pageToken string) string {
+	messages, next, err := client.History(historyPageSize, pageToken)
+	if err != nil {
+		fmt.Printf("Error loading history: %v\n", err)
+		return pageToken
+	}
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		printMessage(messages[i])
+	}
+	if next == "" {
+		fmt.Println("-- start of history --")
+	}
+	return next
 }
 
 func receiveMessages(client *client.Client) {
-	for msg := range client.MessageChannel() {
-		unixTimeUTC := time.Unix(msg.Timestamp, 0)
-		unitTimeInRFC3339 := unixTimeUTC.Format(time.RFC3339)
+	messages := client.MessageChannel()
+	for msg := range messages {
+		printMessage(msg)
+
+		// Mark messages as read once a burst, such as the backlog shown on
+		// joining, has been printed.
+		if len(messages) == 0 {
+			if _, err := client.MarkRead(msg.RoomId, msg.Seq); err != nil {
+				log.Printf("Failed to mark messages as read: %v", err)
+			}
+		}
+	}
+}
+
+func receiveEvents(client *client.Client) {
+	for ev := range client.EventChannel() {
+		switch ev.Type {
+		case pb.Event_USER_JOINED:
+			fmt.Printf("\n* %s joined the room\n", ev.GetUser().GetUsername())
+		case pb.Event_USER_LEFT:
+			fmt.Printf("\n* %s left the room\n", ev.GetUser().GetUsername())
+		case pb.Event_ROOM_CREATED:
+			fmt.Printf("\n* Room %s was created\n", ev.GetRoom().GetName())
+		case pb.Event_ROOM_UPDATED:
+			fmt.Printf("\n* Room %s was updated\n", ev.GetRoom().GetName())
+		case pb.Event_ROOM_DELETED:
+			fmt.Printf("\n* Room %s was deleted\n", ev.GetRoom().GetName())
+		case pb.Event_PRESENCE_CHANGED:
+			fmt.Printf("\n* %s is now %s\n", ev.GetUser().GetUsername(), describePresence(ev.GetUser()))
+		case pb.Event_INVITED:
+			fmt.Printf("\n* You were invited to %s (menu option 12 to accept)\n", ev.GetRoom().GetName())
+		case pb.Event_JOIN_REQUESTED:
+			fmt.Printf("\n* %s asks to join one of your rooms (menu option 13 to answer)\n", ev.GetUser().GetUsername())
+		case pb.Event_JOIN_APPROVED:
+			fmt.Printf("\n* You were let into %s\n", ev.GetRoom().GetName())
+		case pb.Event_JOIN_DECLINED:
+			fmt.Printf("\n* Your request to join %s was declined\n", ev.GetRoom().GetName())
+		case pb.Event_MESSAGE_EDITED, pb.Event_MESSAGE_DELETED:
+			printMessage(ev.GetMessage())
+		case pb.Event_REACTION_ADDED, pb.Event_REACTION_REMOVED:
+			reaction := ev.GetReaction()
+			verb := "reacted to"
+			if ev.Type == pb.Event_REACTION_REMOVED {
+				verb = "took back a reaction to"
+			}
+			fmt.Printf("\n* %s %s #%d with %s\n", reaction.GetUsername(), verb, reaction.GetSeq(), reaction.GetEmoji())
+			if len(reaction.GetReactions()) > 0 {
+				fmt.Printf("    #%d: %s\n", reaction.GetSeq(), reactionTallies(reaction.GetReactions()))
+			}
+		case pb.Event_CONTENT_FLAGGED:
+			flag := ev.GetFlag()
+			fmt.Printf("\n* Flagged (%s): #%d [%s]: %s\n", strings.Join(flag.GetReasons(), ", "), flag.GetMessage().GetSeq(), flag.GetMessage().GetUsername(), flag.GetMessage().GetContent())
+		case pb.Event_MENTIONED:
+			fmt.Printf("\n* %s\n", describeNotification(ev.GetNotification()))
+		case pb.Event_USER_KICKED, pb.Event_USER_BANNED, pb.Event_USER_UNBANNED,
+			pb.Event_USER_MUTED, pb.Event_USER_UNMUTED, pb.Event_ROLE_CHANGED:
+			fmt.Printf("\n* %s\n", describeModeration(ev))
+		}
+	}
+}
+
+// receiveTyping keeps track of who is typing in the current room and prints
+// a line whenever that changes.
+func receiveTyping(c *client.Client) {
+	typing := map[string]time.Time{} // username -> when their indicator expires
+	var shown string
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case ind, ok := <-c.TypingChannel():
+			if !ok {
+				return
+			}
+			if ind.Typing {
+				typing[ind.Username] = time.Now().Add(client.TypingTimeout)
+			} else {
+				delete(typing, ind.Username)
+			}
+		case now := <-ticker.C:
+			for username, expires := range typing {
+				if now.After(expires) {
+					delete(typing, username)
+				}
+			}
+		}
+
+		line := typingLine(typing)
+		if line != shown && line != "" {
+			fmt.Printf("\n* %s\n", line)
+		}
+		shown = line
+	}
+}
+
+// typingLine describes who is typing, e.g. "alice and bob are typing…".
+func typingLine(typing map[string]time.Time) string {
+	names := make([]string, 0, len(typing))
+	for username := range typing {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0] + " is typing…"
+	case 2:
+		return names[0] + " and " + names[1] + " are typing…"
+	default:
+		return fmt.Sprintf("%s and %d others are typing…", names[0], len(names)-1)
+	}
+}
+
+// printMessage prints msg prefixed with its sequence number, which /edit and
+// /delete refer to.
+func printMessage(msg *pb.Message) {
+	unixTimeUTC := time.Unix(msg.Timestamp, 0)
+	unitTimeInRFC3339 := unixTimeUTC.Format(time.RFC3339)
+
+	content := msg.Content
+	switch {
+	case msg.Deleted:
+		content = "[deleted]"
+	case msg.EditedAt != 0:
+		content += " (edited)"
+	}
+
+	number := fmt.Sprintf("#%d", msg.Seq)
+	if msg.ThreadSeq != 0 {
+		number += fmt.Sprintf(" (reply to #%d)", msg.ThreadSeq)
+	}
+
+	switch {
+	case msg.Action && !msg.Deleted:
+		fmt.Printf("\n%s * %s %s - [%s]\n", number, msg.Username, content, unitTimeInRFC3339)
+	case store.IsDirectRoom(msg.RoomId):
+		fmt.Printf("\n%s [DM from %s] - [%s]: %s \n", number, msg.Username, unitTimeInRFC3339, content)
+	default:
+		fmt.Printf("\n%s [%s] - [%s]: %s \n", number, msg.Username, unitTimeInRFC3339, content)
+	}
+	if len(msg.Reactions) > 0 {
+		fmt.Printf("    %s\n", reactionTallies(msg.Reactions))
+	}
+	if msg.ReplyCount > 0 {
+		fmt.Printf("    %d replies (/thread %d to read them)\n", msg.ReplyCount, msg.Seq)
+	}
+}
 
-		fmt.Printf("\n[%s] - [%s]: %s \n", msg.Username, unitTimeInRFC3339, msg.Content)
+// reactionTallies formats reaction counts as e.g. ":thumbsup: 2  :tada: 1".
+func reactionTallies(counts []*pb.ReactionCount) string {
+	var tallies []string
+	for _, count := range counts {
+		tallies = append(tallies, fmt.Sprintf("%s %d", count.Emoji, count.Count))
 	}
+	return strings.Join(tallies, "  ")
 }
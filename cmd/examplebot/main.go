@@ -0,0 +1,72 @@
+// Command examplebot is a small bot showing how to extend the chat with
+// pkg/bot. It rolls dice and greets people who say hello to it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/amirhlashgari/snapp-chat/pkg/bot"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"github.com/nats-io/nats.go"
+)
+
+func main() {
+	natsURL := flag.String("nats", nats.DefaultURL, "NATS server URL")
+	name := flag.String("name", "dice", "Name of the bot, which it also posts under")
+	flag.Parse()
+
+	nc, err := nats.Connect(*natsURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	b := bot.New(nc, *name, "Rolls dice")
+	b.Command("roll", "[sides]", "roll a die, six-sided unless you say otherwise", func(cmd *pb.BotCommand) *pb.BotReply {
+		sides, ok := parseSides(cmd.Args)
+		if !ok {
+			return bot.Errorf("Usage: /roll [sides], with 2-1000 sides")
+		}
+		return bot.Reply(fmt.Sprintf("%s rolled %d (d%d)", cmd.Username, rand.IntN(sides)+1, sides))
+	})
+	b.Command("secretroll", "[sides]", "roll a die only you see", func(cmd *pb.BotCommand) *pb.BotReply {
+		sides, ok := parseSides(cmd.Args)
+		if !ok {
+			return bot.Errorf("Usage: /secretroll [sides], with 2-1000 sides")
+		}
+		return bot.Private(fmt.Sprintf("You rolled %d (d%d)", rand.IntN(sides)+1, sides))
+	})
+	b.OnMessage(func(msg *pb.Message) {
+		if !strings.EqualFold(strings.TrimSpace(msg.Content), "hello "+*name) {
+			return
+		}
+		if _, err := b.PostReply(msg.RoomId, msg.Seq, "Hello "+msg.Username+"! Try /roll."); err != nil {
+			log.Printf("Error greeting %s: %v", msg.Username, err)
+		}
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	log.Printf("Bot %s is running", *name)
+	if err := b.Run(ctx); err != nil {
+		log.Fatalf("Bot stopped: %v", err)
+	}
+}
+
+// parseSides reads the number of sides of a die, six if none is given.
+func parseSides(args string) (int, bool) {
+	if args == "" {
+		return 6, true
+	}
+	sides, err := strconv.Atoi(args)
+	return sides, err == nil && sides >= 2 && sides <= 1000
+}
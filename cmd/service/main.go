@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
 	"github.com/amirhlashgari/snapp-chat/internal/service"
 	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
 	pb "github.com/amirhlashgari/snapp-chat/proto"
@@ -17,8 +24,32 @@ import (
 func main() {
 	port := flag.Int("port", 50051, "The server port")
 	natsURL := flag.String("nats", nats.DefaultURL, "NATS server URL")
+	seedFile := flag.String("seed", "config/rooms.yaml", "YAML or JSON file of rooms to create at startup (empty to skip)")
+	tokenKey := flag.String("token-key", os.Getenv("CHAT_TOKEN_KEY"), "Key for signing auth tokens, shared by all replicas (defaults to $CHAT_TOKEN_KEY)")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "Lifetime of issued auth tokens")
+	presenceWindow := flag.Duration("presence-window", service.DefaultPresenceWindow, "How long users stay online without a heartbeat")
+	limits := service.DefaultRateLimits
+	flag.Var(&limits.UserMessages, "user-message-limit", "Messages each user may send, as <count>/<duration> (0 for no limit)")
+	flag.Var(&limits.RoomMessages, "room-message-limit", "Messages each room may receive, as <count>/<duration> (0 for no limit)")
+	flag.Var(&limits.Joins, "join-limit", "Rooms each user may join or ask to join, as <count>/<duration> (0 for no limit)")
+	privateWebhooks := flag.Bool("webhooks-allow-private", false, "Let webhooks reach loopback, private and link-local addresses, e.g. a local test receiver")
 	flag.Parse()
 
+	key := []byte(*tokenKey)
+	if len(key) == 0 {
+		// Without a configured key, tokens stop working when this process
+		// exits and are rejected by every other replica.
+		log.Printf("No token key configured, generating a random one")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Failed to generate token key: %v", err)
+		}
+	}
+	tokens, err := auth.NewTokenManager(key, *tokenTTL)
+	if err != nil {
+		log.Fatalf("Invalid token key: %v", err)
+	}
+
 	// Create a listener on TCP (clients connect through grpc)
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
@@ -36,13 +67,46 @@ func main() {
 		log.Fatalf("Failed to create JetStream store: %v", err)
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(auth.UnaryServerInterceptor(tokens, service.PublicMethods...)),
+		grpc.StreamInterceptor(auth.StreamServerInterceptor(tokens, service.PublicMethods...)),
+	)
 
-	chatService := service.NewChatService(jetStreamStore)
+	chatService := service.NewChatService(jetStreamStore, tokens, *presenceWindow)
+	chatService.SetRateLimits(limits)
+	chatService.AllowPrivateWebhooks(*privateWebhooks)
+	if *seedFile != "" {
+		if err := chatService.SeedRooms(*seedFile); err != nil {
+			log.Fatalf("Failed to seed rooms: %v", err)
+		}
+	}
 	pb.RegisterChatServiceServer(s, chatService)
+	stopBots, err := chatService.ServeBots()
+	if err != nil {
+		log.Fatalf("Failed to serve bots: %v", err)
+	}
+	defer stopBots()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go chatService.RunPresenceReaper(ctx)
+	webhooksDone := make(chan struct{})
+	go func() {
+		defer close(webhooksDone)
+		chatService.RunWebhooks(ctx)
+	}()
+	go func() {
+		<-ctx.Done()
+		log.Printf("Shutting down")
+		// Subscriptions never end by themselves, so there is no waiting
+		// for them.
+		s.Stop()
+	}()
 
 	log.Printf("Starting gRPC server on port %d", *port)
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+	// Webhook attempts cut short are retried once their claim lapses.
+	<-webhooksDone
 }
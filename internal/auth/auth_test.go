@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestTokenRoundTrip(t *testing.T) {
+	tokens, err := NewTokenManager(testKey, time.Hour)
+	require.NoError(t, err)
+
+	token, err := tokens.Issue(Identity{UserID: "u1", Username: "alice"})
+	require.NoError(t, err)
+
+	id, err := tokens.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, Identity{UserID: "u1", Username: "alice"}, id)
+
+	_, err = tokens.Verify(token + "x")
+	assert.Error(t, err, "Tampered tokens should be rejected")
+
+	other, err := NewTokenManager([]byte("fedcba9876543210fedcba9876543210"), time.Hour)
+	require.NoError(t, err)
+	_, err = other.Verify(token)
+	assert.Error(t, err, "Tokens signed with another key should be rejected")
+}
+
+func TestTokenExpiry(t *testing.T) {
+	tokens, err := NewTokenManager(testKey, -time.Minute)
+	require.NoError(t, err)
+
+	token, err := tokens.Issue(Identity{UserID: "u1"})
+	require.NoError(t, err)
+	_, err = tokens.Verify(token)
+	assert.Error(t, err)
+}
+
+func TestNewTokenManagerRejectsShortKey(t *testing.T) {
+	_, err := NewTokenManager([]byte("short"), time.Hour)
+	assert.Error(t, err)
+}
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	require.NoError(t, err)
+	assert.True(t, CheckPassword(hash, "correct horse"))
+	assert.False(t, CheckPassword(hash, "wrong horse"))
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	tokens, err := NewTokenManager(testKey, time.Hour)
+	require.NoError(t, err)
+	interceptor := UnaryServerInterceptor(tokens, "/chat.ChatService/Login")
+
+	var got Identity
+	handler := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		got, _ = FromContext(ctx)
+		return nil, nil
+	}
+	call := func(ctx context.Context, method string) error {
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	err = call(context.Background(), "/chat.ChatService/JoinRoom")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	assert.NoError(t, call(context.Background(), "/chat.ChatService/Login"), "Public methods should not need a token")
+
+	token, err := tokens.Issue(Identity{UserID: "u1", Username: "alice"})
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetadataKey, "Bearer "+token))
+	require.NoError(t, call(ctx, "/chat.ChatService/JoinRoom"))
+	assert.Equal(t, "u1", got.UserID)
+}
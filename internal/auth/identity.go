@@ -0,0 +1,22 @@
+package auth
+
+import "context"
+
+// Identity is the authenticated caller of an RPC.
+type Identity struct {
+	UserID   string
+	Username string
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx by the interceptors.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const issuer = "snapp-chat"
+
+// TokenManager issues and verifies HMAC-signed JWTs. Every replica of the
+// service must be configured with the same key.
+type TokenManager struct {
+	key []byte
+	ttl time.Duration
+}
+
+type claims struct {
+	Username string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+func NewTokenManager(key []byte, ttl time.Duration) (*TokenManager, error) {
+	if len(key) < 32 {
+		return nil, errors.New("token key must be at least 32 bytes")
+	}
+	return &TokenManager{key: key, ttl: ttl}, nil
+}
+
+// Issue returns a signed token for id that expires after the manager's TTL.
+func (m *TokenManager) Issue(id Identity) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		Username: id.Username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   id.UserID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.ttl)),
+		},
+	})
+	return token.SignedString(m.key)
+}
+
+// Verify checks a token's signature and expiry and returns its identity.
+func (m *TokenManager) Verify(token string) (Identity, error) {
+	var c claims
+	_, err := jwt.ParseWithClaims(token, &c, func(*jwt.Token) (interface{}, error) {
+		return m.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid token: %v", err)
+	}
+	if c.Subject == "" {
+		return Identity{}, errors.New("invalid token: missing subject")
+	}
+
+	return Identity{UserID: c.Subject, Username: c.Username}, nil
+}
@@ -7,64 +7,308 @@ import (
 	"sync"
 	"time"
 
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
 	pb "github.com/amirhlashgari/snapp-chat/proto"
-	"github.com/google/uuid"
 
 	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 )
 
+// backlogSize is how many recent messages are shown when joining a room.
+const backlogSize = 50
+
+// defaultHeartbeatInterval is used until the service suggests an interval.
+const defaultHeartbeatInterval = 30 * time.Second
+
+const (
+	// TypingTimeout is how long a user should be shown as typing after their
+	// last indicator, in case the indicator that they stopped is lost.
+	TypingTimeout = 6 * time.Second
+	// typingRefresh is how often a typing indicator is repeated while the
+	// user keeps typing, comfortably within TypingTimeout.
+	typingRefresh = 3 * time.Second
+	// maxTyping stops typing indicators that were never stopped explicitly.
+	maxTyping = time.Minute
+)
+
 type Client struct {
 	userID      string
 	username    string
+	token       string
 	nc          *nats.Conn
-	js          nats.JetStreamContext
 	currentRoom *pb.ChatRoom
 	service     pb.ChatServiceClient
 	msgChan     chan *pb.Message
+	eventChan   chan *pb.Event
+	typingChan  chan *pb.TypingIndicator
 	done        chan struct{}
+	stop        chan struct{}
+	background  sync.Once // starts heartbeats and the inbox
 	mu          sync.RWMutex
+
+	presenceMu sync.Mutex
+	presence   pb.User_Presence
+	autoAway   time.Duration // 0 disables auto-away
+	lastActive time.Time
+	away       bool // presence was set to AWAY by auto-away
+
+	typingMu   sync.Mutex
+	typingRoom string
+	typingStop chan struct{} // nil unless the user is typing
 }
 
-func NewClient(userID, username string, nc *nats.Conn, service pb.ChatServiceClient) (*Client, error) {
-	js, err := nc.JetStream()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create jetstream context: %v", err)
+// NewClient returns a client that is not logged in yet; call Register or
+// Login before anything else.
+func NewClient(nc *nats.Conn, service pb.ChatServiceClient) *Client {
+	return &Client{
+		nc:         nc,
+		service:    service,
+		msgChan:    make(chan *pb.Message, 100),
+		eventChan:  make(chan *pb.Event, 100),
+		typingChan: make(chan *pb.TypingIndicator, 100),
+		done:       make(chan struct{}),
+		stop:       make(chan struct{}),
 	}
+}
 
-	client := &Client{
-		userID:   userID,
-		username: username,
-		nc:       nc,
-		js:       js,
-		service:  service,
-		msgChan:  make(chan *pb.Message, 100),
-		done:     make(chan struct{}),
+// Register creates an account and logs in with it.
+func (c *Client) Register(username, password string) error {
+	resp, err := c.service.Register(context.Background(), &pb.RegisterRequest{
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to register: %s", resp.Error)
 	}
 
-	// Save/update user in store
-	user := &pb.User{
-		Id:       userID,
+	c.startSession(resp)
+	return nil
+}
+
+func (c *Client) Login(username, password string) error {
+	resp, err := c.service.Login(context.Background(), &pb.LoginRequest{
 		Username: username,
-		Status:   "online",
-		LastSeen: time.Now().Unix(),
+		Password: password,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to log in: %s", resp.Error)
 	}
 
-	data, err := proto.Marshal(user)
+	c.startSession(resp)
+	return nil
+}
+
+// Resume continues a session from a token saved by an earlier run, checking
+// with the server that it is still valid.
+func (c *Client) Resume(token string) error {
+	resp, err := c.service.GetUser(auth.WithToken(context.Background(), token), &pb.GetUserRequest{})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to resume session: %v", err)
+	}
+
+	c.startSession(&pb.AuthResponse{
+		Token: token,
+		User:  resp.User,
+	})
+	return nil
+}
+
+func (c *Client) startSession(resp *pb.AuthResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.userID = resp.User.Id
+	c.username = resp.User.Username
+	c.token = resp.Token
+
+	c.presenceMu.Lock()
+	c.presence = resp.User.Presence
+	c.lastActive = time.Now()
+	c.presenceMu.Unlock()
+
+	c.background.Do(func() {
+		go c.heartbeat()
+		go c.watchInbox()
+	})
+}
+
+// heartbeat keeps the user online until the client is closed. The service
+// marks users offline once their heartbeats stop, e.g. if the process dies.
+func (c *Client) heartbeat() {
+	interval := defaultHeartbeatInterval
+	for {
+		resp, err := c.service.Heartbeat(c.ctx(), &pb.HeartbeatRequest{})
+		if err != nil {
+			log.Printf("Heartbeat failed: %v", err)
+		} else if resp.IntervalSeconds > 0 {
+			interval = time.Duration(resp.IntervalSeconds) * time.Second
+		}
+		c.checkIdle()
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// watchInbox delivers direct messages, invitations and other events sent to
+// the user until the client is closed, whichever room they are in.
+func (c *Client) watchInbox() {
+	ctx, cancel := context.WithCancel(c.ctx())
+	defer cancel()
+	go func() {
+		<-c.stop
+		cancel()
+	}()
+
+	stream, err := c.service.Subscribe(ctx, &pb.SubscribeRequest{Inbox: true})
+	if err != nil {
+		log.Printf("Failed to subscribe to direct messages: %v", err)
+		return
+	}
+
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Direct message subscription ended: %v", err)
+			}
+			return
+		}
+
+		msg := ev.GetMessage()
+		if msg == nil {
+			c.eventChan <- ev
+			continue
+		}
+		// The room's own subscription delivers messages and changes to
+		// them while the conversation is open.
+		c.mu.RLock()
+		watching := c.currentRoom != nil && c.currentRoom.Id == msg.RoomId
+		c.mu.RUnlock()
+		switch {
+		case watching:
+		case ev.Type == pb.Event_MESSAGE_SENT:
+			c.msgChan <- msg
+		default:
+			c.eventChan <- ev
+		}
+	}
+}
+
+// SetAutoAway makes the client switch from online to away once Touch has not
+// been called for idle, and back on the next Touch. Zero disables it.
+func (c *Client) SetAutoAway(idle time.Duration) {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+
+	c.autoAway = idle
+}
+
+// Touch records user activity for auto-away.
+func (c *Client) Touch() {
+	c.presenceMu.Lock()
+	c.lastActive = time.Now()
+	away := c.away
+	c.presenceMu.Unlock()
+
+	if away {
+		if _, err := c.SetPresence(pb.User_ONLINE); err != nil {
+			log.Printf("Failed to clear auto-away: %v", err)
+		}
+	}
+}
+
+// checkIdle switches an online user to away after the auto-away delay.
+func (c *Client) checkIdle() {
+	c.presenceMu.Lock()
+	idle := c.autoAway > 0 && c.presence == pb.User_ONLINE && time.Since(c.lastActive) >= c.autoAway
+	c.presenceMu.Unlock()
+	if !idle {
+		return
+	}
+
+	presence := pb.User_AWAY
+	if _, err := c.setPresence(&pb.SetPresenceRequest{Presence: &presence}); err != nil {
+		log.Printf("Failed to set auto-away: %v", err)
+		return
 	}
 
-	if _, err := js.Publish("chat.users."+userID, data); err != nil {
+	c.presenceMu.Lock()
+	c.away = true
+	c.presenceMu.Unlock()
+}
+
+// SetPresence changes how the user appears to others. It cancels auto-away.
+func (c *Client) SetPresence(presence pb.User_Presence) (*pb.User, error) {
+	return c.setPresence(&pb.SetPresenceRequest{Presence: &presence})
+}
+
+// SetStatus sets the custom status text, which is cleared after ttl unless
+// ttl is zero. An empty text clears it now.
+func (c *Client) SetStatus(text string, ttl time.Duration) (*pb.User, error) {
+	return c.setPresence(&pb.SetPresenceRequest{
+		StatusText:       &text,
+		StatusTtlSeconds: int64(ttl / time.Second),
+	})
+}
+
+func (c *Client) setPresence(req *pb.SetPresenceRequest) (*pb.User, error) {
+	resp, err := c.service.SetPresence(c.ctx(), req)
+	if err != nil {
 		return nil, err
 	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to set presence: %s", resp.Error)
+	}
+
+	c.presenceMu.Lock()
+	c.presence = resp.User.Presence
+	if req.Presence != nil {
+		c.away = false
+	}
+	c.presenceMu.Unlock()
 
-	return client, nil
+	return resp.User, nil
 }
 
-func (c *Client) ListUsers(filter string) ([]*pb.User, error) {
-	resp, err := c.service.ListUsers(context.Background(), &pb.ListUsersRequest{
-		Filter: filter,
+// Session returns the logged-in user's ID, username and token.
+func (c *Client) Session() (userID, username, token string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.userID, c.username, c.token
+}
+
+// ctx returns a context that authenticates calls as the logged-in user.
+func (c *Client) ctx() context.Context {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.lockedCtx()
+}
+
+// lockedCtx is ctx for callers that hold c.mu.
+func (c *Client) lockedCtx() context.Context {
+	return auth.WithToken(context.Background(), c.token)
+}
+
+// ListUsers returns the users whose name contains filter and, if any are
+// given, whose presence is one of presence.
+func (c *Client) ListUsers(filter string, presence ...pb.User_Presence) ([]*pb.User, error) {
+	resp, err := c.service.ListUsers(c.ctx(), &pb.ListUsersRequest{
+		Filter:   filter,
+		Presence: presence,
 	})
 	if err != nil {
 		return nil, err
@@ -72,23 +316,369 @@ func (c *Client) ListUsers(filter string) ([]*pb.User, error) {
 	return resp.Users, nil
 }
 
-func (c *Client) ListRooms(filter string) ([]*pb.ChatRoom, error) {
-	resp, err := c.service.ListRooms(context.Background(), &pb.ListRoomsRequest{
+// GetUser looks up a user by username, or returns the logged-in user's own
+// profile if username is empty.
+func (c *Client) GetUser(username string) (*pb.User, error) {
+	resp, err := c.service.GetUser(c.ctx(), &pb.GetUserRequest{
+		Username: username,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.User, nil
+}
+
+// UpdateProfile changes the fields set in req and returns the updated user.
+func (c *Client) UpdateProfile(req *pb.UpdateProfileRequest) (*pb.User, error) {
+	resp, err := c.service.UpdateProfile(c.ctx(), req)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to update profile: %s", resp.Error)
+	}
+
+	c.mu.Lock()
+	c.username = resp.User.Username
+	c.mu.Unlock()
+
+	return resp.User, nil
+}
+
+// ListRooms returns the rooms whose name contains filter, along with the
+// number of unread messages in each room the user is in or has read before.
+func (c *Client) ListRooms(filter string) ([]*pb.ChatRoom, map[string]uint64, error) {
+	resp, err := c.service.ListRooms(c.ctx(), &pb.ListRoomsRequest{
 		Filter: filter,
 	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Rooms, resp.Unread, nil
+}
+
+// MarkRead records that the user has read roomID up to the message with
+// sequence seq, or everything if seq is 0, and returns how many messages
+// remain unread.
+func (c *Client) MarkRead(roomID string, seq uint64) (uint64, error) {
+	resp, err := c.service.MarkRead(c.ctx(), &pb.MarkReadRequest{
+		RoomId: roomID,
+		Seq:    seq,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Success {
+		return 0, fmt.Errorf("failed to mark as read: %s", resp.Error)
+	}
+	return resp.Unread, nil
+}
+
+func (c *Client) CreateRoom(name, description string, visibility pb.ChatRoom_Visibility) (*pb.ChatRoom, error) {
+	resp, err := c.service.CreateRoom(c.ctx(), &pb.CreateRoomRequest{
+		Name:        name,
+		Description: description,
+		Visibility:  visibility,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to create room: %s", resp.Error)
+	}
+	return resp.Room, nil
+}
+
+// UpdateRoom changes a room's name, description and visibility. Empty values
+// and a nil visibility leave the corresponding field unchanged.
+func (c *Client) UpdateRoom(roomID, name, description string, visibility *pb.ChatRoom_Visibility) (*pb.ChatRoom, error) {
+	req := &pb.UpdateRoomRequest{
+		RoomId:     roomID,
+		Visibility: visibility,
+	}
+	if name != "" {
+		req.Name = &name
+	}
+	if description != "" {
+		req.Description = &description
+	}
+
+	resp, err := c.service.UpdateRoom(c.ctx(), req)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to update room: %s", resp.Error)
+	}
+	return resp.Room, nil
+}
+
+func (c *Client) DeleteRoom(roomID string) error {
+	resp, err := c.service.DeleteRoom(c.ctx(), &pb.DeleteRoomRequest{
+		RoomId: roomID,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to delete room: %s", resp.Error)
+	}
+	return nil
+}
+
+// Invite invites username to a room. They join it with AcceptInvite.
+func (c *Client) Invite(roomID, username string) error {
+	resp, err := c.service.Invite(c.ctx(), &pb.InviteRequest{
+		RoomId:   roomID,
+		Username: username,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to invite: %s", resp.Error)
+	}
+	return nil
+}
+
+// CreateInviteCode creates a code anyone can join a room with, valid for ttl
+// (a week if zero) and maxUses times (unlimited if zero).
+func (c *Client) CreateInviteCode(roomID string, ttl time.Duration, maxUses int) (*pb.InviteCode, error) {
+	resp, err := c.service.Invite(c.ctx(), &pb.InviteRequest{
+		RoomId:     roomID,
+		TtlSeconds: int64(ttl / time.Second),
+		MaxUses:    int32(maxUses),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to create invite code: %s", resp.Error)
+	}
+	return resp.Invite, nil
+}
+
+// AcceptInvite joins a room with an invite code, or with a personal
+// invitation to roomID if code is empty. Call JoinRoom afterwards to enter
+// the room.
+func (c *Client) AcceptInvite(roomID, code string) (*pb.ChatRoom, error) {
+	resp, err := c.service.AcceptInvite(c.ctx(), &pb.AcceptInviteRequest{
+		RoomId: roomID,
+		Code:   code,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to accept invite: %s", resp.Error)
+	}
+	return resp.Room, nil
+}
+
+// RequestJoin asks the owner of a room that needs approval to let the user
+// in.
+func (c *Client) RequestJoin(roomID string) error {
+	resp, err := c.service.RequestJoin(c.ctx(), &pb.RequestJoinRequest{
+		RoomId: roomID,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to request to join: %s", resp.Error)
+	}
+	return nil
+}
+
+// ApproveJoin answers a request to join a room the user owns.
+func (c *Client) ApproveJoin(roomID, userID string, approve bool) error {
+	resp, err := c.service.ApproveJoin(c.ctx(), &pb.ApproveJoinRequest{
+		RoomId:  roomID,
+		UserId:  userID,
+		Approve: approve,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to answer join request: %s", resp.Error)
+	}
+	return nil
+}
+
+// SetRoomFilters replaces the content filters of a room the user moderates.
+func (c *Client) SetRoomFilters(roomID string, filters []*pb.ContentFilter) (*pb.ChatRoom, error) {
+	resp, err := c.service.SetRoomFilters(c.ctx(), &pb.SetRoomFiltersRequest{
+		RoomId:  roomID,
+		Filters: filters,
+	})
 	if err != nil {
 		return nil, err
 	}
-	return resp.Rooms, nil
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to set filters: %s", resp.Error)
+	}
+	return resp.Room, nil
+}
+
+// CreateWebhook adds a webhook that receives the given events of a room the
+// user moderates, or all of them if none are given. Only the returned
+// webhook carries the secret its requests are signed with.
+func (c *Client) CreateWebhook(roomID, url string, events ...pb.Event_Type) (*pb.Webhook, error) {
+	resp, err := c.service.CreateWebhook(c.ctx(), &pb.CreateWebhookRequest{
+		RoomId: roomID,
+		Url:    url,
+		Events: events,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to create webhook: %s", resp.Error)
+	}
+	return resp.Webhook, nil
+}
+
+// ListWebhooks returns the webhooks of a room the user moderates, oldest
+// first.
+func (c *Client) ListWebhooks(roomID string) ([]*pb.Webhook, error) {
+	resp, err := c.service.ListWebhooks(c.ctx(), &pb.ListWebhooksRequest{
+		RoomId: roomID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Webhooks, nil
+}
+
+func (c *Client) DeleteWebhook(roomID, webhookID string) error {
+	resp, err := c.service.DeleteWebhook(c.ctx(), &pb.DeleteWebhookRequest{
+		RoomId:    roomID,
+		WebhookId: webhookID,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to delete webhook: %s", resp.Error)
+	}
+	return nil
+}
+
+// WebhookDeliveries returns up to limit of a webhook's recent deliveries,
+// newest first.
+func (c *Client) WebhookDeliveries(roomID, webhookID string, limit int) ([]*pb.WebhookDelivery, error) {
+	resp, err := c.service.ListWebhookDeliveries(c.ctx(), &pb.ListWebhookDeliveriesRequest{
+		RoomId:    roomID,
+		WebhookId: webhookID,
+		Limit:     int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Deliveries, nil
+}
+
+// SetRole makes userID a member, moderator or owner of a room the user owns.
+// Handing over ownership leaves the user a moderator.
+func (c *Client) SetRole(roomID, userID string, role pb.ChatRoom_Role) error {
+	resp, err := c.service.SetRole(c.ctx(), &pb.SetRoleRequest{
+		RoomId: roomID,
+		UserId: userID,
+		Role:   role,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to change role: %s", resp.Error)
+	}
+	return nil
+}
+
+// Kick removes userID from a room the user moderates. They may join again.
+func (c *Client) Kick(roomID, userID string) error {
+	resp, err := c.service.Kick(c.ctx(), &pb.KickRequest{
+		RoomId: roomID,
+		UserId: userID,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to kick: %s", resp.Error)
+	}
+	return nil
+}
+
+// Ban removes userID from a room the user moderates and keeps them out for d,
+// or until unbanned if d is zero.
+func (c *Client) Ban(roomID, userID string, d time.Duration) error {
+	resp, err := c.service.Ban(c.ctx(), &pb.BanRequest{
+		RoomId:          roomID,
+		UserId:          userID,
+		DurationSeconds: int64(d / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to ban: %s", resp.Error)
+	}
+	return nil
+}
+
+func (c *Client) Unban(roomID, userID string) error {
+	resp, err := c.service.Unban(c.ctx(), &pb.UnbanRequest{
+		RoomId: roomID,
+		UserId: userID,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to unban: %s", resp.Error)
+	}
+	return nil
+}
+
+// Mute stops userID from sending messages to a room the user moderates for
+// d, or until unmuted if d is zero.
+func (c *Client) Mute(roomID, userID string, d time.Duration) error {
+	resp, err := c.service.Mute(c.ctx(), &pb.MuteRequest{
+		RoomId:          roomID,
+		UserId:          userID,
+		DurationSeconds: int64(d / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to mute: %s", resp.Error)
+	}
+	return nil
+}
+
+func (c *Client) Unmute(roomID, userID string) error {
+	resp, err := c.service.Unmute(c.ctx(), &pb.UnmuteRequest{
+		RoomId: roomID,
+		UserId: userID,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to unmute: %s", resp.Error)
+	}
+	return nil
 }
 
 func (c *Client) JoinRoom(roomID string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	resp, err := c.service.JoinRoom(context.Background(), &pb.JoinRoomRequest{
+	resp, err := c.service.JoinRoom(c.lockedCtx(), &pb.JoinRoomRequest{
 		RoomId: roomID,
-		UserId: c.userID,
 	})
 	if err != nil {
 		return err
@@ -99,40 +689,157 @@ func (c *Client) JoinRoom(roomID string) error {
 
 	// Unsubscribe from previous room if any
 	if c.currentRoom != nil {
-		c.LeaveRoom(c.currentRoom.Id)
+		if c.currentRoom.Id == roomID {
+			c.currentRoom = resp.Room
+			return nil
+		}
+		if err := c.leaveRoom(c.currentRoom.Id); err != nil {
+			return err
+		}
 	}
 
 	c.currentRoom = resp.Room
-	sub, err := c.js.Subscribe(
-		fmt.Sprintf("chat.messages.%s", roomID),
-		func(msg *nats.Msg) {
-			var pbMsg pb.Message
-			if err := proto.Unmarshal(msg.Data, &pbMsg); err != nil {
-				log.Printf("Error unmarshaling message: %v", err)
-				return
-			}
-			c.msgChan <- &pbMsg
-		},
-	)
+	return c.watchRoom(roomID)
+}
+
+// watchRoom replays the room's recent history and then streams its live
+// events from the service until the room is left. The caller must hold c.mu.
+func (c *Client) watchRoom(roomID string) error {
+	// The callbacks below run without c.mu, so they use a copy.
+	me := c.userID
+	ctx, cancel := context.WithCancel(c.lockedCtx())
+
+	stream, err := c.service.Subscribe(ctx, &pb.SubscribeRequest{RoomIds: []string{roomID}})
+	if err == nil {
+		// The service sends headers once the subscription is live, so the
+		// history loaded below cannot miss anything sent in between.
+		_, err = stream.Header()
+	}
 	if err != nil {
+		cancel()
 		return fmt.Errorf("failed to subscribe to room: %v", err)
 	}
 
+	// Typing indicators are not worth a round trip through the service, so
+	// they are read straight from their core NATS subject.
+	typingSub, err := c.nc.Subscribe(store.TypingSubject(roomID), func(m *nats.Msg) {
+		var ind pb.TypingIndicator
+		if err := proto.Unmarshal(m.Data, &ind); err != nil || ind.UserId == me {
+			return
+		}
+		select {
+		case c.typingChan <- &ind:
+		default:
+		}
+	})
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to subscribe to typing indicators: %v", err)
+	}
+	stopWatching := func() {
+		typingSub.Unsubscribe()
+		cancel()
+	}
+
+	history, err := c.service.GetHistory(ctx, &pb.GetHistoryRequest{
+		RoomId:      roomID,
+		Limit:       backlogSize,
+		NewestFirst: true,
+	})
+	if err != nil {
+		stopWatching()
+		return fmt.Errorf("failed to load history: %v", err)
+	}
+
+	var lastSeq uint64
+	for i := len(history.Messages) - 1; i >= 0; i-- {
+		c.msgChan <- history.Messages[i]
+		lastSeq = history.Messages[i].Seq
+	}
+
+	done := c.done
 	go func() {
-		<-c.done
-		sub.Unsubscribe()
+		<-done
+		stopWatching()
+	}()
+
+	go func() {
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Room subscription ended: %v", err)
+				}
+				return
+			}
+
+			if msg := ev.GetMessage(); ev.Type == pb.Event_MESSAGE_SENT && msg != nil {
+				if msg.Seq > lastSeq {
+					c.msgChan <- msg
+				}
+				continue
+			}
+
+			// Moderation of the user reaches them through the inbox, which
+			// also covers rooms they are not watching.
+			if action := ev.GetModeration(); action != nil && action.UserId == me {
+				if ev.Type == pb.Event_USER_KICKED || ev.Type == pb.Event_USER_BANNED {
+					c.removedFrom(roomID)
+					stopWatching()
+				}
+				continue
+			}
+			c.eventChan <- ev
+		}
 	}()
 
 	return nil
 }
 
+// removedFrom forgets roomID as the current room after the user was kicked
+// or banned from it; the service has ended the subscription already.
+func (c *Client) removedFrom(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.currentRoom == nil || c.currentRoom.Id != roomID {
+		return
+	}
+	if stop, _ := c.takeTyping(); stop != nil {
+		close(stop)
+	}
+	close(c.done)
+	c.done = make(chan struct{})
+	c.currentRoom = nil
+}
+
+// CurrentRoom returns the room the user is in, or nil.
+func (c *Client) CurrentRoom() *pb.ChatRoom {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.currentRoom
+}
+
 func (c *Client) LeaveRoom(roomID string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	resp, err := c.service.LeaveRoom(context.Background(), &pb.LeaveRoomRequest{
+	return c.leaveRoom(roomID)
+}
+
+// leaveRoom leaves roomID, or the current room if roomID is empty. The
+// caller must hold c.mu.
+func (c *Client) leaveRoom(roomID string) error {
+	if roomID == "" && c.currentRoom != nil {
+		roomID = c.currentRoom.Id
+	}
+	if err := c.stopTyping(c.lockedCtx()); err != nil {
+		log.Printf("Failed to stop typing: %v", err)
+	}
+
+	resp, err := c.service.LeaveRoom(c.lockedCtx(), &pb.LeaveRoomRequest{
 		RoomId: roomID,
-		UserId: c.userID,
 	})
 	if err != nil {
 		return err
@@ -147,58 +854,343 @@ func (c *Client) LeaveRoom(roomID string) error {
 	return nil
 }
 
-func (c *Client) SendMessage(content string) error {
+// SendMessage sends content to the current room. Content starting with "/"
+// runs a command instead, and what the command had to say to us alone is
+// returned.
+func (c *Client) SendMessage(content string) (string, error) {
+	return c.sendMessage(content, 0)
+}
+
+// Reply sends content to the current room as a reply in the thread of the
+// message with sequence seq. Like SendMessage, it returns command output.
+func (c *Client) Reply(seq uint64, content string) (string, error) {
+	return c.sendMessage(content, seq)
+}
+
+func (c *Client) sendMessage(content string, replyTo uint64) (string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	if c.currentRoom == nil {
-		return fmt.Errorf("not in any room")
+		return "", fmt.Errorf("not in any room")
+	}
+
+	resp, err := c.service.SendMessage(c.lockedCtx(), &pb.SendMessageRequest{
+		RoomId:     c.currentRoom.Id,
+		Content:    content,
+		ReplyToSeq: replyTo,
+	})
+	if err != nil {
+		return "", err
+	}
+	if !resp.Success {
+		return "", fmt.Errorf("failed to send message: %s", resp.Error)
 	}
 
-	msg := &pb.Message{
-		Id:        uuid.New().String(),
-		RoomId:    c.currentRoom.Id,
-		UserId:    c.userID,
-		Username:  c.username,
-		Content:   content,
-		Timestamp: time.Now().Unix(),
+	// The service announces that we stopped typing along with the message.
+	if stop, _ := c.takeTyping(); stop != nil {
+		close(stop)
 	}
+	return resp.Output, nil
+}
 
-	data, err := proto.Marshal(msg)
+// EditMessage replaces the content of the message with sequence seq in the
+// current room. Users can edit their own messages, moderators anyone's.
+func (c *Client) EditMessage(seq uint64, content string) error {
+	roomID, err := c.currentRoomID()
 	if err != nil {
 		return err
 	}
 
-	_, err = c.js.Publish(fmt.Sprintf("chat.messages.%s", c.currentRoom.Id), data)
-	return err
+	resp, err := c.service.EditMessage(c.ctx(), &pb.EditMessageRequest{
+		RoomId:  roomID,
+		Seq:     seq,
+		Content: content,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to edit message: %s", resp.Error)
+	}
+	return nil
 }
 
-func (c *Client) MessageChannel() <-chan *pb.Message {
-	return c.msgChan
+// DeleteMessage removes the content of the message with sequence seq in the
+// current room, leaving a tombstone in its place.
+func (c *Client) DeleteMessage(seq uint64) error {
+	roomID, err := c.currentRoomID()
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.service.DeleteMessage(c.ctx(), &pb.DeleteMessageRequest{
+		RoomId: roomID,
+		Seq:    seq,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to delete message: %s", resp.Error)
+	}
+	return nil
 }
 
-func (c *Client) Close() error {
-	if c.currentRoom != nil {
-		if err := c.LeaveRoom(c.currentRoom.Id); err != nil {
-			return err
-		}
+// AddReaction reacts to the message with sequence seq in the current room,
+// returning the message's tallies afterwards.
+func (c *Client) AddReaction(seq uint64, emoji string) ([]*pb.ReactionCount, error) {
+	return c.react(c.service.AddReaction, seq, emoji)
+}
+
+// RemoveReaction takes back a reaction made with AddReaction.
+func (c *Client) RemoveReaction(seq uint64, emoji string) ([]*pb.ReactionCount, error) {
+	return c.react(c.service.RemoveReaction, seq, emoji)
+}
+
+func (c *Client) react(call func(context.Context, *pb.ReactionRequest, ...grpc.CallOption) (*pb.ReactionResponse, error), seq uint64, emoji string) ([]*pb.ReactionCount, error) {
+	roomID, err := c.currentRoomID()
+	if err != nil {
+		return nil, err
 	}
 
-	user := &pb.User{
-		Id:       c.userID,
-		Username: c.username,
-		Status:   "offline",
-		LastSeen: time.Now().Unix(),
+	resp, err := call(c.ctx(), &pb.ReactionRequest{
+		RoomId: roomID,
+		Seq:    seq,
+		Emoji:  emoji,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to react: %s", resp.Error)
+	}
+	return resp.Reactions, nil
+}
+
+func (c *Client) currentRoomID() (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.currentRoom == nil {
+		return "", fmt.Errorf("not in any room")
+	}
+	return c.currentRoom.Id, nil
+}
+
+// SendDirectMessage sends content to username in a direct conversation,
+// which is created on the first message between the two users.
+func (c *Client) SendDirectMessage(username, content string) (*pb.Message, error) {
+	resp, err := c.service.SendDirectMessage(c.ctx(), &pb.SendDirectMessageRequest{
+		RecipientUsername: username,
+		Content:           content,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("failed to send direct message: %s", resp.Error)
+	}
+	return resp.Message, nil
+}
+
+// StartTyping shows the user as typing in the current room until StopTyping
+// or SendMessage is called, or for at most a minute. Calling it again while
+// typing does nothing, so it can be called on every keystroke.
+func (c *Client) StartTyping() error {
+	c.mu.RLock()
+	room := c.currentRoom
+	c.mu.RUnlock()
+	if room == nil {
+		return fmt.Errorf("not in any room")
+	}
+
+	c.typingMu.Lock()
+	if c.typingStop != nil {
+		c.typingMu.Unlock()
+		return nil
+	}
+	stop := make(chan struct{})
+	c.typingRoom, c.typingStop = room.Id, stop
+	c.typingMu.Unlock()
+
+	if err := c.setTyping(c.ctx(), room.Id, true); err != nil {
+		c.takeTyping()
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(typingRefresh)
+		defer ticker.Stop()
+		deadline := time.After(maxTyping)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-deadline:
+				if err := c.StopTyping(); err != nil {
+					log.Printf("Failed to stop typing: %v", err)
+				}
+				return
+			case <-ticker.C:
+				if err := c.setTyping(c.ctx(), room.Id, true); err != nil {
+					log.Printf("Failed to refresh typing indicator: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// StopTyping stops showing the user as typing.
+func (c *Client) StopTyping() error {
+	return c.stopTyping(c.ctx())
+}
+
+// stopTyping is StopTyping for callers that hold c.mu, which pass the
+// context to authenticate with.
+func (c *Client) stopTyping(ctx context.Context) error {
+	stop, roomID := c.takeTyping()
+	if stop == nil {
+		return nil
 	}
+	close(stop)
+	return c.setTyping(ctx, roomID, false)
+}
 
-	data, err := proto.Marshal(user)
+// takeTyping clears the typing state and returns what it was.
+func (c *Client) takeTyping() (chan struct{}, string) {
+	c.typingMu.Lock()
+	defer c.typingMu.Unlock()
+
+	stop, roomID := c.typingStop, c.typingRoom
+	c.typingStop, c.typingRoom = nil, ""
+	return stop, roomID
+}
+
+func (c *Client) setTyping(ctx context.Context, roomID string, typing bool) error {
+	resp, err := c.service.SetTyping(ctx, &pb.SetTypingRequest{
+		RoomId: roomID,
+		Typing: typing,
+	})
 	if err != nil {
 		return err
 	}
+	if !resp.Success {
+		return fmt.Errorf("failed to set typing: %s", resp.Error)
+	}
+	return nil
+}
+
+// History returns a page of the current room's messages, newest first, along
+// with the token for the next, older page. An empty pageToken starts from the
+// newest message; an empty returned token means the start was reached.
+func (c *Client) History(limit int, pageToken string) ([]*pb.Message, string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	if _, err := c.js.Publish("chat.users."+c.userID, data); err != nil {
+	if c.currentRoom == nil {
+		return nil, "", fmt.Errorf("not in any room")
+	}
+
+	resp, err := c.service.GetHistory(c.lockedCtx(), &pb.GetHistoryRequest{
+		RoomId:      c.currentRoom.Id,
+		Limit:       int32(limit),
+		NewestFirst: true,
+		PageToken:   pageToken,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Messages, resp.NextPageToken, nil
+}
+
+// Thread returns the root of the thread the message with sequence seq in the
+// current room belongs to and a page of its replies, oldest first, along
+// with the token for the next page. An empty token starts from the first
+// reply.
+func (c *Client) Thread(seq uint64, limit int, pageToken string) (*pb.Message, []*pb.Message, string, error) {
+	roomID, err := c.currentRoomID()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	resp, err := c.service.GetThread(c.ctx(), &pb.GetThreadRequest{
+		RoomId:    roomID,
+		Seq:       seq,
+		Limit:     int32(limit),
+		PageToken: pageToken,
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return resp.Root, resp.Replies, resp.NextPageToken, nil
+}
+
+// Notifications returns up to limit of the user's notifications with a
+// sequence above afterSeq, oldest first, and whether there are more.
+func (c *Client) Notifications(afterSeq uint64, limit int) ([]*pb.Notification, bool, error) {
+	resp, err := c.service.ListNotifications(c.ctx(), &pb.ListNotificationsRequest{
+		AfterSeq: afterSeq,
+		Limit:    int32(limit),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return resp.Notifications, resp.HasMore, nil
+}
+
+// AckNotification removes the notification with sequence seq, or all of the
+// user's notifications if seq is 0.
+func (c *Client) AckNotification(seq uint64) error {
+	resp, err := c.service.AckNotification(c.ctx(), &pb.AckNotificationRequest{
+		Seq: seq,
+	})
+	if err != nil {
 		return err
 	}
+	if !resp.Success {
+		return fmt.Errorf("failed to acknowledge notification: %s", resp.Error)
+	}
+	return nil
+}
+
+// MessageChannel delivers the current room's messages, as well as direct
+// messages sent to the user from any conversation.
+func (c *Client) MessageChannel() <-chan *pb.Message {
+	return c.msgChan
+}
+
+// TypingChannel delivers other users' typing indicators for the current
+// room. Indicators are dropped if the channel is not drained.
+func (c *Client) TypingChannel() <-chan *pb.TypingIndicator {
+	return c.typingChan
+}
+
+// EventChannel delivers the current room's events other than new messages,
+// global room lifecycle and presence events, and events addressed to the
+// user such as invitations.
+func (c *Client) EventChannel() <-chan *pb.Event {
+	return c.eventChan
+}
+
+func (c *Client) Close() error {
+	if room := c.CurrentRoom(); room != nil {
+		if err := c.LeaveRoom(room.Id); err != nil {
+			return err
+		}
+	}
+
+	close(c.stop)
+	if _, _, token := c.Session(); token != "" {
+		resp, err := c.service.Logout(c.ctx(), &pb.LogoutRequest{})
+		if err != nil {
+			return err
+		}
+		if !resp.Success {
+			return fmt.Errorf("failed to log out: %s", resp.Error)
+		}
+	}
 
 	c.nc.Close()
 	return nil
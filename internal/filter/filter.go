@@ -0,0 +1,80 @@
+// Package filter screens chat messages before they are stored. A room's
+// filters form a pipeline that each message passes through in order.
+package filter
+
+import (
+	"fmt"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+// Verdict is what a filter decided about a message.
+type Verdict int
+
+const (
+	// Pass means the filter found nothing; the next filter decides.
+	Pass Verdict = iota
+	// Allow accepts the message without running the remaining filters.
+	Allow
+	// Modify accepts the message with changed content.
+	Modify
+	// Reject refuses the message.
+	Reject
+	// Flag accepts the message but reports it to moderators.
+	Flag
+)
+
+// Filter is one step of a pipeline.
+type Filter interface {
+	// Check returns its verdict on content, the content to continue with,
+	// and for anything but Pass and Allow, why.
+	Check(content string) (verdict Verdict, result, reason string)
+}
+
+// Result is the outcome of running a message through a pipeline.
+type Result struct {
+	// Content is the message as it should be stored.
+	Content string
+	// Rejected tells that the message must not be stored, for Reason.
+	Rejected bool
+	Reason   string
+	// Flags are the reasons moderators should look at the message.
+	Flags []string
+}
+
+// Pipeline runs filters in order.
+type Pipeline []Filter
+
+// Run passes content through the pipeline. It stops at the first filter that
+// allows or rejects it.
+func (p Pipeline) Run(content string) Result {
+	res := Result{Content: content}
+	for _, f := range p {
+		verdict, result, reason := f.Check(res.Content)
+		switch verdict {
+		case Allow:
+			return res
+		case Modify:
+			res.Content = result
+		case Reject:
+			res.Rejected, res.Reason = true, reason
+			return res
+		case Flag:
+			res.Flags = append(res.Flags, reason)
+		}
+	}
+	return res
+}
+
+// New builds the pipeline configs describe, in the same order.
+func New(configs []*pb.ContentFilter) (Pipeline, error) {
+	var p Pipeline
+	for i, cfg := range configs {
+		f, err := newRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %v", i+1, err)
+		}
+		p = append(p, f)
+	}
+	return p, nil
+}
@@ -0,0 +1,130 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func blocklist(action pb.ContentFilter_Action, words ...string) *pb.ContentFilter {
+	return &pb.ContentFilter{
+		Action: action,
+		Rule:   &pb.ContentFilter_Blocklist_{Blocklist: &pb.ContentFilter_Blocklist{Words: words}},
+	}
+}
+
+func regex(action pb.ContentFilter_Action, pattern, replacement string) *pb.ContentFilter {
+	return &pb.ContentFilter{
+		Action: action,
+		Rule:   &pb.ContentFilter_Regex_{Regex: &pb.ContentFilter_Regex{Pattern: pattern, Replacement: replacement}},
+	}
+}
+
+func links(action pb.ContentFilter_Action, allow, deny []string) *pb.ContentFilter {
+	return &pb.ContentFilter{
+		Action: action,
+		Rule:   &pb.ContentFilter_Links_{Links: &pb.ContentFilter_Links{Allow: allow, Deny: deny}},
+	}
+}
+
+func pii(action pb.ContentFilter_Action) *pb.ContentFilter {
+	return &pb.ContentFilter{
+		Action: action,
+		Rule:   &pb.ContentFilter_Pii_{Pii: &pb.ContentFilter_Pii{}},
+	}
+}
+
+func run(t *testing.T, content string, configs ...*pb.ContentFilter) Result {
+	p, err := New(configs)
+	require.NoError(t, err)
+	return p.Run(content)
+}
+
+func TestBlocklist(t *testing.T) {
+	res := run(t, "Darn it, DARN. Darned? darn", blocklist(pb.ContentFilter_MASK, "darn"))
+	assert.Equal(t, "**** it, ****. Darned? ****", res.Content, "Only whole words should be masked")
+	assert.False(t, res.Rejected)
+
+	res = run(t, "oh darn", blocklist(pb.ContentFilter_REJECT, "heck", "darn"))
+	assert.True(t, res.Rejected)
+	assert.Equal(t, "contains a blocked word", res.Reason)
+
+	res = run(t, "all good", blocklist(pb.ContentFilter_REJECT, "darn"))
+	assert.Equal(t, Result{Content: "all good"}, res)
+
+	res = run(t, "a (b) c", blocklist(pb.ContentFilter_MASK, "(b)"))
+	assert.Equal(t, "a *** c", res.Content, "Words should be matched literally")
+}
+
+func TestRegex(t *testing.T) {
+	res := run(t, "call 555 now", regex(pb.ContentFilter_MASK, `\d+`, ""))
+	assert.Equal(t, "call *** now", res.Content)
+
+	res = run(t, "ticket ABC-12", regex(pb.ContentFilter_MASK, `([A-Z]+)-(\d+)`, "$1-#"))
+	assert.Equal(t, "ticket ABC-#", res.Content)
+
+	res = run(t, "anything", regex(pb.ContentFilter_REJECT, `x*`, ""))
+	assert.False(t, res.Rejected, "Empty matches should not count")
+
+	_, err := New([]*pb.ContentFilter{regex(pb.ContentFilter_MASK, `(`, "")})
+	assert.ErrorContains(t, err, "filter 1: invalid pattern")
+}
+
+func TestLinks(t *testing.T) {
+	allowOnly := links(pb.ContentFilter_MASK, []string{"example.com"}, nil)
+	res := run(t, "see https://docs.example.com/x and www.evil.test, or http://example.com.evil.test.", allowOnly)
+	assert.Equal(t, "see https://docs.example.com/x and [link removed] or [link removed]", res.Content)
+
+	deny := links(pb.ContentFilter_FLAG, nil, []string{"*.evil.test"})
+	res = run(t, "https://good.test@evil.test/login", deny)
+	assert.Equal(t, []string{"links to a domain that is not allowed"}, res.Flags)
+	res = run(t, "https://good.test/evil.test", deny)
+	assert.Empty(t, res.Flags)
+
+	_, err := New([]*pb.ContentFilter{links(pb.ContentFilter_MASK, nil, nil)})
+	assert.Error(t, err)
+	_, err = New([]*pb.ContentFilter{links(pb.ContentFilter_MASK, []string{"not a domain"}, nil)})
+	assert.Error(t, err)
+}
+
+func TestPII(t *testing.T) {
+	res := run(t, "mail bob.smith+x@mail.example.org or call +1 (555) 123-4567, not @bob", pii(pb.ContentFilter_MASK))
+	assert.Equal(t, "mail [email hidden] or call [phone hidden], not @bob", res.Content)
+	res = run(t, "my number is 0912 345 6789.", pii(pb.ContentFilter_MASK))
+	assert.Equal(t, "my number is [phone hidden].", res.Content)
+
+	res = run(t, "meet on 2024-05-01, at 12:30, costs 1,000", pii(pb.ContentFilter_REJECT))
+	assert.False(t, res.Rejected, "Dates, times and amounts are not phone numbers")
+}
+
+func TestPipeline(t *testing.T) {
+	p, err := New([]*pb.ContentFilter{
+		regex(pb.ContentFilter_ALLOW, `^!announce`, ""),
+		pii(pb.ContentFilter_MASK),
+		{
+			Action: pb.ContentFilter_FLAG,
+			Rule:   &pb.ContentFilter_Blocklist_{Blocklist: &pb.ContentFilter_Blocklist{Words: []string{"refund"}}},
+			Reason: "possible scam",
+		},
+		blocklist(pb.ContentFilter_REJECT, "spam"),
+		blocklist(pb.ContentFilter_FLAG, "secret"),
+	})
+	require.NoError(t, err)
+
+	res := p.Run("refund to me@example.com")
+	assert.Equal(t, "refund to [email hidden]", res.Content, "Later filters should see earlier changes")
+	assert.Equal(t, []string{"possible scam"}, res.Flags)
+
+	res = p.Run("spam secret")
+	assert.True(t, res.Rejected)
+	assert.Empty(t, res.Flags, "Filters after a rejection should not run")
+
+	res = p.Run("!announce spam me@example.com")
+	assert.Equal(t, Result{Content: "!announce spam me@example.com"}, res, "Allowed messages skip the remaining filters")
+
+	_, err = New([]*pb.ContentFilter{{Action: pb.ContentFilter_MASK}})
+	assert.ErrorContains(t, err, "no rule given")
+}
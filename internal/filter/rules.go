@@ -0,0 +1,329 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+const (
+	// maxWords bounds a blocklist.
+	maxWords = 500
+	// maxPatternLength bounds regular expressions, in bytes. RE2 runs in
+	// linear time, but huge patterns still cost memory on every message.
+	maxPatternLength = 1000
+	// maxDomains bounds each of a link filter's lists.
+	maxDomains = 200
+)
+
+var (
+	// linkPattern finds web links, with or without a scheme.
+	linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+	// emailPattern finds e-mail addresses.
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	// phonePattern finds candidate phone numbers: digits with the usual
+	// separators. isPhoneNumber then checks how many digits there are.
+	phonePattern = regexp.MustCompile(`\+?\(?\d[\d\s().-]{5,}\d`)
+	// validDomain matches the domains link filters can list.
+	validDomain = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+)
+
+// rule is a filter that finds parts of a message and then takes its action.
+type rule struct {
+	action pb.ContentFilter_Action
+	reason string
+	// find returns the byte ranges of what the rule looks for.
+	find func(content string) [][]int
+	// mask replaces what find found. If nil, it is replaced by asterisks.
+	mask func(content string) string
+}
+
+func (r *rule) Check(content string) (Verdict, string, string) {
+	spans := r.find(content)
+	if len(spans) == 0 {
+		return Pass, content, ""
+	}
+
+	switch r.action {
+	case pb.ContentFilter_ALLOW:
+		return Allow, content, ""
+	case pb.ContentFilter_REJECT:
+		return Reject, content, r.reason
+	case pb.ContentFilter_FLAG:
+		return Flag, content, r.reason
+	}
+	if r.mask != nil {
+		return Modify, r.mask(content), r.reason
+	}
+	return Modify, replaceSpans(content, spans, func(part string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(part))
+	}), r.reason
+}
+
+// newRule builds the filter cfg describes.
+func newRule(cfg *pb.ContentFilter) (*rule, error) {
+	if _, ok := pb.ContentFilter_Action_name[int32(cfg.Action)]; !ok {
+		return nil, errors.New("unknown action")
+	}
+
+	var (
+		r   *rule
+		err error
+	)
+	switch kind := cfg.Rule.(type) {
+	case *pb.ContentFilter_Blocklist_:
+		r, err = blocklistRule(kind.Blocklist)
+	case *pb.ContentFilter_Regex_:
+		r, err = regexRule(kind.Regex)
+	case *pb.ContentFilter_Links_:
+		r, err = linksRule(kind.Links)
+	case *pb.ContentFilter_Pii_:
+		r = piiRule()
+	default:
+		return nil, errors.New("no rule given")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.action = cfg.Action
+	if cfg.Reason != "" {
+		r.reason = cfg.Reason
+	}
+	return r, nil
+}
+
+// blocklistRule finds whole words, ignoring case.
+func blocklistRule(cfg *pb.ContentFilter_Blocklist) (*rule, error) {
+	if len(cfg.Words) == 0 {
+		return nil, errors.New("the blocklist is empty")
+	}
+	if len(cfg.Words) > maxWords {
+		return nil, fmt.Errorf("blocklists can have at most %d words", maxWords)
+	}
+
+	alternatives := make([]string, 0, len(cfg.Words))
+	for _, word := range cfg.Words {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			return nil, errors.New("the blocklist has an empty word")
+		}
+		alternatives = append(alternatives, wordPattern(word))
+	}
+	re, err := regexp.Compile(`(?i)` + strings.Join(alternatives, "|"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &rule{
+		reason: "contains a blocked word",
+		find:   func(content string) [][]int { return re.FindAllStringIndex(content, -1) },
+	}, nil
+}
+
+// wordPattern matches word on its own rather than inside other words. RE2's
+// \b only knows ASCII, so other words are matched anywhere.
+func wordPattern(word string) string {
+	pattern := regexp.QuoteMeta(word)
+	first, _ := utf8.DecodeRuneInString(word)
+	last, _ := utf8.DecodeLastRuneInString(word)
+	if isASCIIWordChar(first) {
+		pattern = `\b` + pattern
+	}
+	if isASCIIWordChar(last) {
+		pattern += `\b`
+	}
+	return pattern
+}
+
+func isASCIIWordChar(r rune) bool {
+	return r < utf8.RuneSelf && (r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// regexRule finds matches of a regular expression.
+func regexRule(cfg *pb.ContentFilter_Regex) (*rule, error) {
+	if cfg.Pattern == "" {
+		return nil, errors.New("the pattern is empty")
+	}
+	if len(cfg.Pattern) > maxPatternLength {
+		return nil, fmt.Errorf("patterns can be at most %d bytes long", maxPatternLength)
+	}
+	re, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	r := &rule{
+		reason: "matches a forbidden pattern",
+		find: func(content string) [][]int {
+			// Patterns that match the empty string would find something
+			// in every message.
+			var spans [][]int
+			for _, span := range re.FindAllStringIndex(content, -1) {
+				if span[1] > span[0] {
+					spans = append(spans, span)
+				}
+			}
+			return spans
+		},
+	}
+	if cfg.Replacement != "" {
+		r.mask = func(content string) string { return re.ReplaceAllString(content, cfg.Replacement) }
+	}
+	return r, nil
+}
+
+// linksRule finds links to domains that are denied or, if there is an allow
+// list, not on it.
+func linksRule(cfg *pb.ContentFilter_Links) (*rule, error) {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 {
+		return nil, errors.New("link filters need domains to allow or deny")
+	}
+	allow, err := domains(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := domains(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	forbidden := func(link string) bool {
+		host := linkHost(link)
+		if inDomains(host, deny) {
+			return true
+		}
+		return len(allow) > 0 && !inDomains(host, allow)
+	}
+	return &rule{
+		reason: "links to a domain that is not allowed",
+		find: func(content string) [][]int {
+			var spans [][]int
+			for _, span := range linkPattern.FindAllStringIndex(content, -1) {
+				if forbidden(content[span[0]:span[1]]) {
+					spans = append(spans, span)
+				}
+			}
+			return spans
+		},
+		mask: func(content string) string {
+			return linkPattern.ReplaceAllStringFunc(content, func(link string) string {
+				if forbidden(link) {
+					return "[link removed]"
+				}
+				return link
+			})
+		},
+	}, nil
+}
+
+// domains normalizes the domains of a link filter.
+func domains(list []string) ([]string, error) {
+	if len(list) > maxDomains {
+		return nil, fmt.Errorf("link filters can list at most %d domains", maxDomains)
+	}
+	var normalized []string
+	for _, domain := range list {
+		domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "*.")
+		if !validDomain.MatchString(domain) {
+			return nil, fmt.Errorf("invalid domain %q", domain)
+		}
+		normalized = append(normalized, domain)
+	}
+	return normalized, nil
+}
+
+// linkHost returns the lowercase host name a link points at.
+func linkHost(link string) string {
+	// Links are often followed by punctuation that is not part of them.
+	link = strings.TrimRight(link, ".,;:!?)]}'")
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// inDomains reports whether host is one of domains or a subdomain of one.
+func inDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// piiRule finds e-mail addresses and phone numbers.
+func piiRule() *rule {
+	find := func(content string) [][]int {
+		spans := emailPattern.FindAllStringIndex(content, -1)
+		for _, span := range phonePattern.FindAllStringIndex(content, -1) {
+			if isPhoneNumber(content[span[0]:span[1]]) && !overlaps(span, spans) {
+				spans = append(spans, span)
+			}
+		}
+		return spans
+	}
+	return &rule{
+		reason: "contains an e-mail address or phone number",
+		find:   find,
+		mask: func(content string) string {
+			return replaceSpans(content, find(content), func(part string) string {
+				if strings.Contains(part, "@") {
+					return "[email hidden]"
+				}
+				return "[phone hidden]"
+			})
+		},
+	}
+}
+
+// isPhoneNumber reports whether a candidate has as many digits as phone
+// numbers do, which tells them apart from dates, times and small amounts.
+func isPhoneNumber(candidate string) bool {
+	digits := 0
+	for _, r := range candidate {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits >= 9 && digits <= 15
+}
+
+func overlaps(span []int, spans [][]int) bool {
+	for _, other := range spans {
+		if span[0] < other[1] && other[0] < span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceSpans replaces the given byte ranges of content, which may be in
+// any order but must not overlap, with what replace returns for them.
+func replaceSpans(content string, spans [][]int, replace func(part string) string) string {
+	sorted := make([][]int, len(spans))
+	copy(sorted, spans)
+	slices.SortFunc(sorted, func(a, b []int) int { return a[0] - b[0] })
+
+	var b strings.Builder
+	last := 0
+	for _, span := range sorted {
+		b.WriteString(content[last:span[0]])
+		b.WriteString(replace(content[span[0]:span[1]]))
+		last = span[1]
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
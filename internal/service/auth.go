@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores everything past 72 bytes.
+	maxPasswordLength = 72
+)
+
+// validUsername matches usernames that are safe to use as KV keys: NATS
+// refuses keys that start or end with '.' or have two in a row.
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// unknownUserHash is a bcrypt hash, at the cost passwords are stored with,
+// that logins to unknown usernames are checked against, so that they take as
+// long as logins to real ones and do not give away which names are taken.
+var unknownUserHash = []byte("$2a$10$dk5VKkAy2te3JCua9.tO/.o5ddboMDUarhxX8tw7jouwLFPp0xwEm")
+
+// isValidUsername reports whether name can be a username.
+func isValidUsername(name string) bool {
+	return len(name) >= 3 && len(name) <= 32 && validUsername.MatchString(name)
+}
+
+// PublicMethods are the RPCs that may be called without a token.
+var PublicMethods = []string{
+	pb.ChatService_Register_FullMethodName,
+	pb.ChatService_Login_FullMethodName,
+}
+
+func (s *ChatService) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.AuthResponse, error) {
+	if !isValidUsername(req.Username) {
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Username must be 3-32 letters, digits, '.', '_' or '-', and not start or end with '.'",
+		}, nil
+	}
+	if len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Password must be between 8 and 72 bytes long",
+		}, nil
+	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Failed to register",
+		}, nil
+	}
+
+	user := &pb.User{
+		Id:       uuid.New().String(),
+		Username: req.Username,
+		LastSeen: time.Now().Unix(),
+	}
+	creds := &pb.Credentials{
+		UserId:       user.Id,
+		Username:     user.Username,
+		PasswordHash: hash,
+	}
+
+	// Creating the credentials record claims the username.
+	_, err = s.store.CompareAndSaveCredentials(creds, 0)
+	if errors.Is(err, store.ErrConflict) {
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Username is already taken",
+		}, nil
+	}
+	if err == nil {
+		err = s.store.SaveUser(user)
+	}
+	if err != nil {
+		log.Printf("Error registering %s: %v", req.Username, err)
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Failed to register",
+		}, nil
+	}
+
+	return s.startSession(user)
+}
+
+func (s *ChatService) Login(ctx context.Context, req *pb.LoginRequest) (*pb.AuthResponse, error) {
+	creds, _, err := s.store.GetCredentials(req.Username)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("Error loading credentials for %s: %v", req.Username, err)
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Failed to log in",
+		}, nil
+	}
+	if err != nil {
+		auth.CheckPassword(unknownUserHash, req.Password)
+	}
+	if err != nil || !auth.CheckPassword(creds.PasswordHash, req.Password) {
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Invalid username or password",
+		}, nil
+	}
+
+	user, _, err := s.store.GetUser(creds.UserId)
+	if err != nil {
+		log.Printf("Error loading user %s: %v", creds.UserId, err)
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Failed to log in",
+		}, nil
+	}
+
+	return s.startSession(user)
+}
+
+func (s *ChatService) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.markOffline(me.UserID, time.Time{}); err != nil {
+		log.Printf("Error logging out %s: %v", me.UserID, err)
+		return &pb.LogoutResponse{
+			Success: false,
+			Error:   "Failed to log out",
+		}, nil
+	}
+
+	return &pb.LogoutResponse{
+		Success: true,
+	}, nil
+}
+
+// startSession marks user online and issues a token for them.
+func (s *ChatService) startSession(user *pb.User) (*pb.AuthResponse, error) {
+	if online, err := s.markOnline(user.Id); err == nil {
+		user = online
+	} else {
+		log.Printf("Error saving user %s: %v", user.Id, err)
+	}
+
+	token, err := s.tokens.Issue(auth.Identity{UserID: user.Id, Username: user.Username})
+	if err != nil {
+		log.Printf("Error issuing token: %v", err)
+		return &pb.AuthResponse{
+			Success: false,
+			Error:   "Failed to issue token",
+		}, nil
+	}
+
+	return &pb.AuthResponse{
+		Success: true,
+		Token:   token,
+		User:    visibleTo(user, user.Id),
+	}, nil
+}
+
+// caller returns the identity the auth interceptors attached to ctx.
+func caller(ctx context.Context) (auth.Identity, error) {
+	id, ok := auth.FromContext(ctx)
+	if !ok {
+		return auth.Identity{}, status.Error(codes.Unauthenticated, "not authenticated")
+	}
+	return id, nil
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	service := setupTestService(t)
+	ctx := context.Background()
+
+	regResp, err := service.Register(ctx, &pb.RegisterRequest{Username: "alice", Password: "correct horse"})
+	require.NoError(t, err)
+	require.True(t, regResp.Success)
+	assert.NotEmpty(t, regResp.Token)
+	assert.Equal(t, pb.User_ONLINE, regResp.User.Presence)
+
+	dupResp, err := service.Register(ctx, &pb.RegisterRequest{Username: "ALICE", Password: "another one"})
+	require.NoError(t, err)
+	assert.False(t, dupResp.Success, "Usernames should be unique regardless of case")
+
+	badResp, err := service.Login(ctx, &pb.LoginRequest{Username: "alice", Password: "wrong password"})
+	require.NoError(t, err)
+	assert.False(t, badResp.Success)
+
+	loginResp, err := service.Login(ctx, &pb.LoginRequest{Username: "alice", Password: "correct horse"})
+	require.NoError(t, err)
+	require.True(t, loginResp.Success)
+	assert.Equal(t, regResp.User.Id, loginResp.User.Id, "Logging in again should keep the same user ID")
+
+	id, err := service.tokens.Verify(loginResp.Token)
+	require.NoError(t, err)
+	assert.Equal(t, regResp.User.Id, id.UserID)
+}
+
+func TestRegisterRejectsInvalidUsernames(t *testing.T) {
+	service := setupTestService(t)
+
+	for _, name := range []string{"zed.", ".zed", "z..ed", "ze", "zed!"} {
+		resp, err := service.Register(context.Background(), &pb.RegisterRequest{Username: name, Password: "correct horse"})
+		require.NoError(t, err)
+		assert.False(t, resp.Success, "%q should not be accepted", name)
+	}
+	register(t, service, "z.ed")
+}
+
+func TestLoginWithInvalidKeyOnJetStream(t *testing.T) {
+	service := setupJetStreamService(t)
+
+	resp, err := service.Login(context.Background(), &pb.LoginRequest{Username: "bob.", Password: "correct horse"})
+	require.NoError(t, err)
+	assert.False(t, resp.Success)
+	assert.Equal(t, "Invalid username or password", resp.Error, "Names that aren't valid keys should be unknown users")
+}
+
+func TestUnknownUsersCostAsMuchAsKnownOnes(t *testing.T) {
+	cost, err := bcrypt.Cost(unknownUserHash)
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.DefaultCost, cost, "Logins to unknown users should hash at the cost passwords are stored with")
+
+	hash, err := auth.HashPassword("correct horse")
+	require.NoError(t, err)
+	stored, err := bcrypt.Cost(hash)
+	require.NoError(t, err)
+	assert.Equal(t, stored, cost)
+}
+
+func TestRPCsRequireToken(t *testing.T) {
+	service := setupTestService(t)
+	client := startTestServer(t, service)
+	ctx := context.Background()
+
+	_, err := client.JoinRoom(ctx, &pb.JoinRoomRequest{RoomId: "general"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.JoinRoom(auth.WithToken(ctx, "forged"), &pb.JoinRoomRequest{RoomId: "general"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	regResp, err := client.Register(ctx, &pb.RegisterRequest{Username: "bob", Password: "hunter2hunter2"})
+	require.NoError(t, err, "Register should not require a token")
+	require.True(t, regResp.Success)
+
+	joinResp, err := client.JoinRoom(auth.WithToken(ctx, regResp.Token), &pb.JoinRoomRequest{RoomId: "general"})
+	require.NoError(t, err)
+	require.True(t, joinResp.Success)
+	assert.Contains(t, joinResp.Room.Members, regResp.User.Id, "The caller's identity should come from the token")
+}
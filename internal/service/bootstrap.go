@@ -0,0 +1,169 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"gopkg.in/yaml.v3"
+)
+
+// seedFile is the layout of a room seed file. JSON is valid input too, since
+// it is parsed as YAML.
+type seedFile struct {
+	Rooms []struct {
+		ID          string `yaml:"id"`
+		Name        string `yaml:"name"`
+		Description string `yaml:"description"`
+		Owner       string `yaml:"owner"`
+	} `yaml:"rooms"`
+}
+
+// seedRoom is a room from a seed file and the username of its owner, if the
+// file names one.
+type seedRoom struct {
+	room  *pb.ChatRoom
+	owner string
+}
+
+// validRoomID matches IDs that are safe to use as KV keys and subject tokens.
+var validRoomID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// LoadSeedRooms reads and validates the rooms listed in a YAML or JSON seed
+// file.
+func LoadSeedRooms(path string) ([]*pb.ChatRoom, error) {
+	seeds, err := loadSeedFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make([]*pb.ChatRoom, len(seeds))
+	for i, seed := range seeds {
+		rooms[i] = seed.room
+	}
+	return rooms, nil
+}
+
+// loadSeedFile reads and validates a seed file, keeping the owner each room
+// is meant to have.
+func loadSeedFile(path string) ([]seedRoom, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file seedFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool)
+	var seeds []seedRoom
+	for i, r := range file.Rooms {
+		if !validRoomID.MatchString(r.ID) {
+			return nil, fmt.Errorf("room %d: invalid id %q", i+1, r.ID)
+		}
+		if store.IsDirectRoom(r.ID) {
+			return nil, fmt.Errorf("room %d: id %q is reserved for direct conversations", i+1, r.ID)
+		}
+		if seen[r.ID] {
+			return nil, fmt.Errorf("room %d: duplicate id %q", i+1, r.ID)
+		}
+		if problem := validateRoom(r.Name, r.Description); problem != "" {
+			return nil, fmt.Errorf("room %q: %s", r.ID, problem)
+		}
+		if r.Owner != "" && !isValidUsername(r.Owner) {
+			return nil, fmt.Errorf("room %q: invalid owner %q", r.ID, r.Owner)
+		}
+		seen[r.ID] = true
+
+		seeds = append(seeds, seedRoom{
+			room: &pb.ChatRoom{
+				Id:          r.ID,
+				Name:        r.Name,
+				Description: r.Description,
+				Members:     []string{},
+			},
+			owner: r.Owner,
+		})
+	}
+
+	return seeds, nil
+}
+
+// SeedRooms creates the rooms from the seed file at path that do not exist
+// yet, and hands those without an owner to the user the file names for them.
+// Nothing else about existing rooms is modified, so it is safe to run on
+// every startup and from several replicas at once.
+func (s *ChatService) SeedRooms(path string) error {
+	seeds, err := loadSeedFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, seed := range seeds {
+		room := seed.room
+		room.CreatedAt = time.Now().Unix()
+		_, err := s.store.CompareAndSaveRoom(room, 0)
+		switch {
+		case errors.Is(err, store.ErrConflict):
+		case err != nil:
+			return fmt.Errorf("failed to seed room %q: %v", room.Id, err)
+		default:
+			log.Printf("Seeded room %s (%s)", room.Name, room.Id)
+			s.publish(roomEvent(pb.Event_ROOM_CREATED, room))
+		}
+
+		if seed.owner != "" {
+			if err := s.claimSeedRoom(room.Id, seed.owner); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// claimSeedRoom makes the user named username the owner of the seeded room
+// roomID, unless it already has one. Users who have not registered yet are
+// skipped until the next startup.
+func (s *ChatService) claimSeedRoom(roomID, username string) error {
+	creds, _, err := s.store.GetCredentials(username)
+	if errors.Is(err, store.ErrNotFound) {
+		log.Printf("Owner %s of room %s has not registered yet", username, roomID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up owner of room %q: %v", roomID, err)
+	}
+
+	claimed := false
+	room, err := s.updateRoom(roomID, func(room *pb.ChatRoom) (bool, error) {
+		claimed = room.OwnerId == ""
+		if !claimed {
+			return false, nil
+		}
+		room.OwnerId = creds.UserId
+		delete(room.Banned, creds.UserId)
+		delete(room.Muted, creds.UserId)
+		if !isMember(room, creds.UserId) {
+			room.Members = append(room.Members, creds.UserId)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to give room %q to %s: %v", roomID, username, err)
+	}
+
+	if claimed {
+		log.Printf("Gave room %s to %s", roomID, username)
+		s.publish(roomEvent(pb.Event_ROOM_UPDATED, room))
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// botLease is how long a bot's registration lasts. Bots renew it well
+	// before then, so the commands of a bot that stopped are soon free.
+	botLease = time.Minute
+	// botTimeout bounds how long a command waits for a bot's reply.
+	botTimeout = 5 * time.Second
+
+	maxBotCommands          = 50
+	maxBotDescriptionLength = 200
+)
+
+var (
+	// validBotName matches bot names, which are also their usernames.
+	validBotName = regexp.MustCompile(`^[a-z0-9_-]{3,32}$`)
+	// validCommandName matches the names bots can give their commands.
+	validCommandName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+// ServeBots answers the registrations and posts of bots connected to the
+// store until stop is called.
+func (s *ChatService) ServeBots() (stop func(), err error) {
+	return s.store.ServeBots(s.handleBotRequest)
+}
+
+func (s *ChatService) handleBotRequest(req *pb.BotRequest) *pb.BotResponse {
+	switch request := req.Request.(type) {
+	case *pb.BotRequest_Register:
+		return s.registerBot(req.Bot, request.Register)
+	case *pb.BotRequest_Post_:
+		return s.botPost(req.Bot, request.Post)
+	}
+	return &pb.BotResponse{
+		Success: false,
+		Error:   "Unknown request",
+	}
+}
+
+// registerBot registers a bot or renews its registration. The first
+// registration creates the user the bot posts as.
+func (s *ChatService) registerBot(name string, reg *pb.BotRequest_Registration) *pb.BotResponse {
+	if problem := validateRegistration(name, reg); problem != "" {
+		return &pb.BotResponse{
+			Success: false,
+			Error:   problem,
+		}
+	}
+
+	// Replicas can still race, but then both bots' renewals fail until one
+	// of them gives up the command.
+	s.registering.Lock()
+	defer s.registering.Unlock()
+
+	bots, err := s.liveBots()
+	if err != nil {
+		log.Printf("Error loading bots: %v", err)
+		return &pb.BotResponse{
+			Success: false,
+			Error:   "Failed to register bot",
+		}
+	}
+	for _, other := range bots {
+		if other.Name == name {
+			continue
+		}
+		for _, cmd := range reg.Commands {
+			if slices.ContainsFunc(other.Commands, func(c *pb.BotCommandInfo) bool { return c.Name == cmd.Name }) {
+				return &pb.BotResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Command /%s belongs to %s", cmd.Name, other.Name),
+				}
+			}
+		}
+	}
+
+	bot, err := s.store.GetBot(name)
+	if errors.Is(err, store.ErrNotFound) {
+		bot, err = s.createBotUser(name)
+	}
+	if errors.As(err, new(validationError)) {
+		return &pb.BotResponse{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	if err == nil {
+		bot.Description = reg.Description
+		bot.Commands = reg.Commands
+		bot.ExpiresAt = time.Now().Add(botLease).Unix()
+		err = s.store.SaveBot(bot)
+	}
+	if err != nil {
+		log.Printf("Error registering bot %s: %v", name, err)
+		return &pb.BotResponse{
+			Success: false,
+			Error:   "Failed to register bot",
+		}
+	}
+
+	return &pb.BotResponse{
+		Success: true,
+		Bot:     bot,
+	}
+}
+
+// createBotUser creates the user a new bot posts as. It has no password,
+// so nobody can log in as it.
+func (s *ChatService) createBotUser(name string) (*pb.Bot, error) {
+	user := &pb.User{
+		Id:       uuid.New().String(),
+		Username: name,
+		Bot:      true,
+	}
+
+	_, err := s.store.CompareAndSaveCredentials(&pb.Credentials{UserId: user.Id, Username: name}, 0)
+	if errors.Is(err, store.ErrConflict) {
+		return nil, validationError("Username " + name + " is already taken")
+	}
+	if err == nil {
+		err = s.store.SaveUser(user)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Bot{Name: name, UserId: user.Id}, nil
+}
+
+// validateRegistration describes what is wrong with a bot's registration,
+// or returns "" if it can be used.
+func validateRegistration(name string, reg *pb.BotRequest_Registration) string {
+	if !validBotName.MatchString(name) {
+		return "Bot name must be 3-32 lowercase letters, digits, '_' or '-'"
+	}
+	if len(reg.Commands) > maxBotCommands {
+		return fmt.Sprintf("Bots can have at most %d commands", maxBotCommands)
+	}
+	texts := []string{reg.Description}
+	seen := make(map[string]bool)
+	for _, cmd := range reg.Commands {
+		if !validCommandName.MatchString(cmd.Name) {
+			return fmt.Sprintf("Invalid command name %q", cmd.Name)
+		}
+		if _, ok := builtinCommands[cmd.Name]; ok || seen[cmd.Name] {
+			return fmt.Sprintf("Command /%s is already taken", cmd.Name)
+		}
+		seen[cmd.Name] = true
+		texts = append(texts, cmd.Description, cmd.Usage)
+	}
+	for _, text := range texts {
+		if !utf8.ValidString(text) || utf8.RuneCountInString(text) > maxBotDescriptionLength {
+			return fmt.Sprintf("Descriptions and usages must be valid UTF-8 of at most %d characters", maxBotDescriptionLength)
+		}
+	}
+	return ""
+}
+
+// botPost posts a message for a registered bot. Bots can post in any room
+// except direct conversations, unless they are banned or muted there.
+func (s *ChatService) botPost(name string, post *pb.BotRequest_Post) *pb.BotResponse {
+	bot, err := s.liveBot(name)
+	if errors.Is(err, store.ErrNotFound) {
+		return &pb.BotResponse{
+			Success: false,
+			Error:   "Bot is not registered",
+		}
+	}
+	if err != nil {
+		log.Printf("Error loading bot %s: %v", name, err)
+		return &pb.BotResponse{
+			Success: false,
+			Error:   "Failed to retrieve bot",
+		}
+	}
+
+	if problem := validateContent(post.Content); problem != "" {
+		return &pb.BotResponse{
+			Success: false,
+			Error:   problem,
+		}
+	}
+
+	// Bots post only where their user could read, like anyone else.
+	room, _, err := s.store.GetRoom(post.RoomId)
+	if err == nil && (room.Direct || !canRead(room, bot.UserId)) {
+		err = store.ErrNotFound
+	}
+	if err == nil && (restricted(room.Banned, bot.UserId, time.Now()) || restricted(room.Muted, bot.UserId, time.Now())) {
+		err = validationError("The bot may not post in this room")
+	}
+	if err != nil {
+		return &pb.BotResponse{
+			Success: false,
+			Error:   roomError(post.RoomId, err),
+		}
+	}
+	if err := s.allow(context.Background(), userKey(bot.UserId, "messages"), s.limits.UserMessages, sendingTooFast); err != nil {
+		return &pb.BotResponse{
+			Success: false,
+			Error:   status.Convert(err).Message(),
+		}
+	}
+
+	var parent *pb.Message
+	if post.ReplyToSeq != 0 {
+		parent, err = s.store.GetMessage(room.Id, post.ReplyToSeq)
+		if err != nil || parent.Deleted {
+			return &pb.BotResponse{
+				Success: false,
+				Error:   "Message to reply to not found",
+			}
+		}
+	}
+
+	msg, problem := s.postMessage(room, bot.UserId, post.Content, parent, false)
+	if problem != "" {
+		return &pb.BotResponse{
+			Success: false,
+			Error:   problem,
+		}
+	}
+
+	return &pb.BotResponse{
+		Success: true,
+		Message: msg,
+	}
+}
+
+// runBotCommand passes call on to bot and acts on its reply.
+func (s *ChatService) runBotCommand(bot *pb.Bot, call *commandCall) *pb.SendMessageResponse {
+	// Tokens outlive renames, so the username comes from the store.
+	user, _, err := s.store.GetUser(call.me.UserID)
+	if err != nil {
+		log.Printf("Error loading user %s: %v", call.me.UserID, err)
+		return commandError("Unknown user")
+	}
+
+	cmd := &pb.BotCommand{
+		Command:  call.name,
+		Args:     call.args,
+		RoomId:   call.room.Id,
+		UserId:   user.Id,
+		Username: user.Username,
+	}
+	if call.parent != nil {
+		cmd.ReplyToSeq = call.parent.Seq
+	}
+
+	reply, err := s.store.CallBot(bot.Name, cmd, botTimeout)
+	if errors.Is(err, store.ErrNotFound) {
+		return commandError(bot.Name + " is not running")
+	}
+	if err != nil {
+		log.Printf("Error calling bot %s: %v", bot.Name, err)
+		return commandError(bot.Name + " did not answer")
+	}
+
+	if reply.Error != "" {
+		return commandError(reply.Error)
+	}
+	if reply.Text == "" {
+		return &pb.SendMessageResponse{
+			Success: true,
+		}
+	}
+	if problem := validateContent(reply.Text); problem != "" {
+		log.Printf("Bot %s answered /%s with an invalid reply: %s", bot.Name, call.name, problem)
+		return commandError(bot.Name + " sent an invalid reply")
+	}
+	// Bots are not members of direct conversations, so they answer there
+	// in private too.
+	if reply.Private || call.room.Direct {
+		return commandOutput(reply.Text)
+	}
+
+	msg, problem := s.postMessage(call.room, bot.UserId, reply.Text, call.parent, false)
+	if problem != "" {
+		return commandError(problem)
+	}
+
+	return &pb.SendMessageResponse{
+		Success: true,
+		Message: msg,
+	}
+}
+
+// liveBots returns the bots whose registration has not lapsed, sorted by
+// name.
+func (s *ChatService) liveBots() ([]*pb.Bot, error) {
+	bots, err := s.store.GetBots()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	bots = slices.DeleteFunc(bots, func(bot *pb.Bot) bool { return bot.ExpiresAt <= now })
+	slices.SortFunc(bots, func(a, b *pb.Bot) int { return strings.Compare(a.Name, b.Name) })
+	return bots, nil
+}
+
+// liveBot returns the bot called name, or ErrNotFound if its registration
+// has lapsed.
+func (s *ChatService) liveBot(name string) (*pb.Bot, error) {
+	bot, err := s.store.GetBot(name)
+	if err != nil {
+		return nil, err
+	}
+	if bot.ExpiresAt <= time.Now().Unix() {
+		return nil, store.ErrNotFound
+	}
+	return bot, nil
+}
+
+// botFor returns the live bot that registered command, or ErrNotFound.
+func (s *ChatService) botFor(command string) (*pb.Bot, error) {
+	bots, err := s.liveBots()
+	if err != nil {
+		return nil, err
+	}
+	for _, bot := range bots {
+		for _, cmd := range bot.Commands {
+			if cmd.Name == command {
+				return bot, nil
+			}
+		}
+	}
+	return nil, store.ErrNotFound
+}
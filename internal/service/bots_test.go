@@ -0,0 +1,100 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestBots(t *testing.T) {
+	service := setupTestService(t)
+	room, alice, _, carol, _ := moderatedRoom(t, service)
+	memory := service.store.(*store.MemoryStore)
+	stop, err := service.ServeBots()
+	require.NoError(t, err)
+	defer stop()
+
+	request := func(req *pb.BotRequest) *pb.BotResponse {
+		resp, err := memory.SendBotRequest(req)
+		require.NoError(t, err)
+		return resp
+	}
+	registration := func(bot string, commands ...string) *pb.BotRequest {
+		reg := &pb.BotRequest_Registration{Description: "Test bot"}
+		for _, name := range commands {
+			reg.Commands = append(reg.Commands, &pb.BotCommandInfo{Name: name, Usage: "<sides>", Description: "roll a die"})
+		}
+		return &pb.BotRequest{Bot: bot, Request: &pb.BotRequest_Register{Register: reg}}
+	}
+	send := func(content string) *pb.SendMessageResponse {
+		resp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: content})
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := request(registration("dice", "roll"))
+	require.True(t, resp.Success, resp.Error)
+	assert.NotEmpty(t, resp.Bot.UserId)
+	renewed := request(registration("dice", "roll"))
+	require.True(t, renewed.Success, "Bots should be able to renew")
+	assert.Equal(t, resp.Bot.UserId, renewed.Bot.UserId)
+	assert.False(t, request(registration("other", "roll")).Success, "Commands belong to one bot")
+	assert.False(t, request(registration("bad", "who")).Success, "Built-in commands cannot be taken")
+	assert.False(t, request(registration("alice", "flip")).Success, "Bots cannot take a user's name")
+
+	login, err := service.Login(asUser(""), &pb.LoginRequest{Username: "dice"})
+	require.NoError(t, err)
+	assert.False(t, login.Success, "Nobody can log in as a bot")
+
+	assert.Contains(t, send("/help").Output, "/roll <sides> - roll a die (dice)")
+	assert.Equal(t, "dice is not running", send("/roll 6").Error)
+
+	var got *pb.BotCommand
+	defer memory.HandleBotCommands("dice", func(cmd *pb.BotCommand) *pb.BotReply {
+		got = cmd
+		switch cmd.Args {
+		case "":
+			return &pb.BotReply{Error: "Usage: /roll <sides>"}
+		case "secret":
+			return &pb.BotReply{Text: "4", Private: true}
+		}
+		return &pb.BotReply{Text: cmd.Username + " rolled 4"}
+	})()
+
+	sent := send("/roll 6")
+	require.True(t, sent.Success, sent.Error)
+	assert.Equal(t, "6", got.Args)
+	assert.Equal(t, room.Id, got.RoomId)
+	assert.Equal(t, carol.Id, got.UserId)
+	assert.Equal(t, "carol rolled 4", sent.Message.Content)
+	assert.Equal(t, "dice", sent.Message.Username, "Replies should be posted as the bot")
+
+	sent = send("/roll secret")
+	require.True(t, sent.Success, sent.Error)
+	assert.Nil(t, sent.Message)
+	assert.Equal(t, "4", sent.Output)
+	assert.Equal(t, "Usage: /roll <sides>", send("/roll").Error)
+
+	post := func(roomID, content string) *pb.BotResponse {
+		return request(&pb.BotRequest{Bot: "dice", Request: &pb.BotRequest_Post_{Post: &pb.BotRequest_Post{RoomId: roomID, Content: content}}})
+	}
+	posted := post(room.Id, "Dice are back")
+	require.True(t, posted.Success, posted.Error)
+	assert.Equal(t, "Dice are back", posted.Message.Content)
+	assert.False(t, post(store.DirectRoomID(alice.Id, carol.Id), "hi").Success)
+
+	private, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Hideout", Visibility: pb.ChatRoom_PRIVATE})
+	require.NoError(t, err)
+	require.True(t, private.Success, private.Error)
+	assert.False(t, post(private.Room.Id, "hi").Success, "Bots cannot post to private rooms they are not in")
+	assert.False(t, request(&pb.BotRequest{Bot: "ghost", Request: &pb.BotRequest_Post_{Post: &pb.BotRequest_Post{RoomId: room.Id, Content: "boo"}}}).Success,
+		"Only registered bots can post")
+
+	dm, err := service.SendDirectMessage(asUser(carol.Id), &pb.SendDirectMessageRequest{RecipientUsername: "dice", Content: "hi"})
+	require.NoError(t, err)
+	assert.False(t, dm.Success)
+}
@@ -2,201 +2,246 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	"github.com/amirhlashgari/snapp-chat/internal/webhook"
 	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
 	pb "github.com/amirhlashgari/snapp-chat/proto"
-
-	"github.com/google/uuid"
 )
 
+// maxUpdateAttempts bounds how often a read-modify-write of a room is retried
+// after losing a compare-and-set race.
+const maxUpdateAttempts = 10
+
 type ChatService struct {
 	pb.UnimplementedChatServiceServer
-	store *store.JetStreamStore
-	rooms map[string]*pb.ChatRoom
-	users map[string]*pb.User
-	mu    sync.RWMutex
+	store  store.Store
+	tokens *auth.TokenManager
+	// presenceWindow is how long users stay online without a heartbeat.
+	presenceWindow time.Duration
+	typing         typingState
+	filters        filterCache
+	unread         unreadCache
+	limits         RateLimits
+	// registering serializes bot registrations, so two bots cannot claim
+	// the same command at once.
+	registering sync.Mutex
+	webhooks    *webhook.Dispatcher
 }
 
-func NewChatService(store *store.JetStreamStore) *ChatService {
+func NewChatService(store store.Store, tokens *auth.TokenManager, presenceWindow time.Duration) *ChatService {
 	return &ChatService{
-		store: store,
-		rooms: make(map[string]*pb.ChatRoom),
-		users: make(map[string]*pb.User),
+		store:          store,
+		tokens:         tokens,
+		presenceWindow: presenceWindow,
+		limits:         DefaultRateLimits,
+		webhooks:       webhook.NewDispatcher(store),
 	}
 }
 
 func (s *ChatService) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	users, err := s.store.GetUsers()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get users: %v", err)
 	}
 
-	if req.Filter != "" {
-		filteredUsers := []*pb.User{}
-		for _, user := range users {
-			if strings.Contains(strings.ToLower(user.Username), strings.ToLower(req.Filter)) {
-				filteredUsers = append(filteredUsers, user)
-			}
+	filteredUsers := []*pb.User{}
+	for _, user := range users {
+		user = visibleTo(user, me.UserID)
+		if req.Filter != "" && !strings.Contains(strings.ToLower(user.Username), strings.ToLower(req.Filter)) {
+			continue
+		}
+		if len(req.Presence) > 0 && !slices.Contains(req.Presence, user.Presence) {
+			continue
 		}
-		return &pb.ListUsersResponse{Users: filteredUsers}, nil
+		filteredUsers = append(filteredUsers, user)
 	}
 
-	return &pb.ListUsersResponse{Users: users}, nil
+	return &pb.ListUsersResponse{Users: filteredUsers}, nil
 }
 
 func (s *ChatService) ListRooms(ctx context.Context, req *pb.ListRoomsRequest) (*pb.ListRoomsResponse, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	rooms, err := s.store.GetRooms()
-	if err != nil || len(rooms) == 0 {
-		// Create default rooms if none exist
-		defaultRooms := []*pb.ChatRoom{
-			{
-				Id:          uuid.New().String(),
-				Name:        "Snapp",
-				Description: "Snapp discussion room",
-				Members:     []string{},
-				CreatedAt:   time.Now().Unix(),
-			},
-			{
-				Id:          uuid.New().String(),
-				Name:        "Quera",
-				Description: "Quera chat room",
-				Members:     []string{},
-				CreatedAt:   time.Now().Unix(),
-			},
-		}
-
-		for _, room := range defaultRooms {
-			if err := s.store.SaveRoom(room); err != nil {
-				log.Printf("Error saving default room: %v", err)
-			}
-			s.rooms[room.Id] = room
-		}
-
-		rooms = defaultRooms
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rooms: %v", err)
 	}
 
-	// Apply filter if provided
-	if req.Filter != "" {
-		filteredRooms := []*pb.ChatRoom{}
-		for _, room := range rooms {
-			if strings.Contains(strings.ToLower(room.Name), strings.ToLower(req.Filter)) {
-				filteredRooms = append(filteredRooms, room)
-			}
+	// Apply filter if provided, and hide rooms the caller may not know about
+	filteredRooms := []*pb.ChatRoom{}
+	for _, room := range rooms {
+		if !visibleInList(room, me.UserID) {
+			continue
+		}
+		if req.Filter != "" && !strings.Contains(strings.ToLower(room.Name), strings.ToLower(req.Filter)) {
+			continue
 		}
-		return &pb.ListRoomsResponse{Rooms: filteredRooms}, nil
+		filteredRooms = append(filteredRooms, redactRoom(room, me.UserID))
 	}
+	rooms = filteredRooms
 
-	return &pb.ListRoomsResponse{Rooms: rooms}, nil
+	return &pb.ListRoomsResponse{
+		Rooms:  rooms,
+		Unread: s.unreadCounts(rooms, me.UserID),
+	}, nil
 }
 
 func (s *ChatService) JoinRoom(ctx context.Context, req *pb.JoinRoomRequest) (*pb.JoinRoomResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	rooms, err := s.store.GetRooms()
+	me, err := caller(ctx)
 	if err != nil {
-		return &pb.JoinRoomResponse{
-			Success: false,
-			Error:   "Failed to retrieve rooms",
-		}, nil
+		return nil, err
+	}
+	if err := s.allow(ctx, userKey(me.UserID, "joins"), s.limits.Joins, joiningTooFast); err != nil {
+		return nil, err
 	}
 
-	var room *pb.ChatRoom
-	for _, r := range rooms {
-		if r.Id == req.RoomId {
-			room = r
-			break
+	joined := false
+	room, err := s.updateRoom(req.RoomId, func(room *pb.ChatRoom) (bool, error) {
+		// Check if user is already in the room
+		if isMember(room, me.UserID) {
+			joined = false
+			return false, nil
+		}
+		// Nobody else can join a direct conversation or private room, or
+		// learn that it exists
+		if !visibleInList(room, me.UserID) {
+			return false, store.ErrNotFound
+		}
+		if restricted(room.Banned, me.UserID, time.Now()) {
+			return false, errBanned
+		}
+		if room.Visibility != pb.ChatRoom_PUBLIC {
+			if slices.Contains(room.Invited, me.UserID) {
+				return false, validationError("You have been invited; accept the invitation to join")
+			}
+			return false, validationError("This room needs the owner's approval; request to join instead")
 		}
-	}
 
-	if room == nil {
+		admit(room, me.UserID)
+		joined = true
+		return true, nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
 		return &pb.JoinRoomResponse{
 			Success: false,
 			Error:   "Room not found",
 		}, nil
 	}
-
-	// Check if user is already in the room
-	for _, member := range room.Members {
-		if member == req.UserId {
-			return &pb.JoinRoomResponse{
-				Success: true,
-				Room:    room,
-			}, nil
-		}
+	if errors.As(err, new(validationError)) {
+		return &pb.JoinRoomResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, nil
 	}
-
-	room.Members = append(room.Members, req.UserId)
-
-	// Save updated room
-	if err := s.store.SaveRoom(room); err != nil {
+	if err != nil {
+		log.Printf("Error joining room %s: %v", req.RoomId, err)
 		return &pb.JoinRoomResponse{
 			Success: false,
 			Error:   "Failed to save room",
 		}, nil
 	}
 
+	if joined {
+		s.publish(s.userEvent(pb.Event_USER_JOINED, room.Id, me.UserID))
+	}
+
 	return &pb.JoinRoomResponse{
 		Success: true,
-		Room:    room,
+		Room:    redactRoom(room, me.UserID),
 	}, nil
 }
 
 func (s *ChatService) LeaveRoom(ctx context.Context, req *pb.LeaveRoomRequest) (*pb.LeaveRoomResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	rooms, err := s.store.GetRooms()
+	me, err := caller(ctx)
 	if err != nil {
-		return &pb.LeaveRoomResponse{
-			Success: false,
-			Error:   "Failed to retrieve rooms",
-		}, nil
+		return nil, err
 	}
 
-	var room *pb.ChatRoom
-	for _, r := range rooms {
-		if r.Id == req.RoomId {
-			room = r
-			break
+	left := false
+	_, err = s.updateRoom(req.RoomId, func(room *pb.ChatRoom) (bool, error) {
+		// Members of a direct conversation stay in it; leaving only stops
+		// watching it
+		if room.Direct {
+			return false, nil
 		}
-	}
 
-	if room == nil {
+		// Remove user from room
+		newMembers := []string{}
+		for _, member := range room.Members {
+			if member != me.UserID {
+				newMembers = append(newMembers, member)
+			}
+		}
+		left = len(newMembers) != len(room.Members)
+		room.Members = newMembers
+		return left, nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
 		return &pb.LeaveRoomResponse{
 			Success: false,
 			Error:   "Room not found",
 		}, nil
 	}
-
-	// Remove user from room
-	newMembers := []string{}
-	for _, member := range room.Members {
-		if member != req.UserId {
-			newMembers = append(newMembers, member)
-		}
-	}
-	room.Members = newMembers
-
-	if err := s.store.SaveRoom(room); err != nil {
+	if err != nil {
+		log.Printf("Error leaving room %s: %v", req.RoomId, err)
 		return &pb.LeaveRoomResponse{
 			Success: false,
 			Error:   "Failed to save room",
 		}, nil
 	}
 
+	if left {
+		s.publish(s.userEvent(pb.Event_USER_LEFT, req.RoomId, me.UserID))
+	}
+
 	return &pb.LeaveRoomResponse{
 		Success: true,
 	}, nil
 }
+
+// updateRoom applies mutate to the latest revision of a room and saves the
+// result with compare-and-set, so concurrent updates from other replicas are
+// never overwritten. On a conflict the room is re-read and mutate runs again.
+// mutate reports whether it changed the room; if not, nothing is written.
+func (s *ChatService) updateRoom(roomID string, mutate func(room *pb.ChatRoom) (bool, error)) (*pb.ChatRoom, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		room, revision, err := s.store.GetRoom(roomID)
+		if err != nil {
+			return nil, err
+		}
+
+		changed, err := mutate(room)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return room, nil
+		}
+
+		_, err = s.store.CompareAndSaveRoom(room, revision)
+		if err == nil {
+			return room, nil
+		}
+		if !errors.Is(err, store.ErrConflict) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("room %s: gave up after %d conflicting updates", roomID, maxUpdateAttempts)
+}
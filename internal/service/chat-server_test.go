@@ -2,33 +2,65 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
 	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
 	pb "github.com/amirhlashgari/snapp-chat/proto"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
-func setupTestService(t *testing.T) (*ChatService, *nats.Conn) {
-	nc, err := nats.Connect(nats.DefaultURL)
+func setupTestService(t *testing.T) *ChatService {
+	service := newTestService(t, store.NewMemoryStore())
+	require.NoError(t, service.SeedRooms("testdata/rooms.json"))
+	return service
+}
+
+func newTestService(t *testing.T, st store.Store) *ChatService {
+	tokens, err := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), time.Hour)
 	require.NoError(t, err)
+	return NewChatService(st, tokens, DefaultPresenceWindow)
+}
 
-	jetStreamStore, err := store.NewJetStreamStore(nc)
+// setupJetStreamService returns a service backed by the NATS server the store
+// tests use, for behaviour that depends on JetStream's key rules.
+func setupJetStreamService(t *testing.T) *ChatService {
+	nc, err := nats.Connect(nats.DefaultURL)
+	require.NoError(t, err, "Failed to connect to NATS")
+	t.Cleanup(nc.Close)
+
+	st, err := store.NewJetStreamStore(nc)
 	require.NoError(t, err)
+	return newTestService(t, st)
+}
 
-	return NewChatService(jetStreamStore), nc
+// asUser returns a context authenticated as userID, as the auth interceptors
+// would produce.
+func asUser(userID string) context.Context {
+	return auth.NewContext(context.Background(), auth.Identity{UserID: userID})
 }
 
 func TestJoinRoom(t *testing.T) {
-	service, nc := setupTestService(t)
-	defer nc.Close()
+	service := setupTestService(t)
 
 	// Get an existing room
-	roomsResp, err := service.ListRooms(context.Background(), &pb.ListRoomsRequest{})
+	roomsResp, err := service.ListRooms(asUser("user1"), &pb.ListRoomsRequest{})
 	require.NoError(t, err)
 	require.NotEmpty(t, roomsResp.Rooms)
 
@@ -36,29 +68,26 @@ func TestJoinRoom(t *testing.T) {
 	testUserID := uuid.New().String()
 
 	// Join room
-	joinResp, err := service.JoinRoom(context.Background(), &pb.JoinRoomRequest{
+	joinResp, err := service.JoinRoom(asUser(testUserID), &pb.JoinRoomRequest{
 		RoomId: testRoom.Id,
-		UserId: testUserID,
 	})
 	assert.NoError(t, err)
 	assert.True(t, joinResp.Success)
 	assert.Contains(t, joinResp.Room.Members, testUserID)
 
 	// Try joining again (should still succeed)
-	secondJoinResp, err := service.JoinRoom(context.Background(), &pb.JoinRoomRequest{
+	secondJoinResp, err := service.JoinRoom(asUser(testUserID), &pb.JoinRoomRequest{
 		RoomId: testRoom.Id,
-		UserId: testUserID,
 	})
 	assert.NoError(t, err)
 	assert.True(t, secondJoinResp.Success)
 }
 
 func TestLeaveRoom(t *testing.T) {
-	service, nc := setupTestService(t)
-	defer nc.Close()
+	service := setupTestService(t)
 
 	// Get an existing room
-	roomsResp, err := service.ListRooms(context.Background(), &pb.ListRoomsRequest{})
+	roomsResp, err := service.ListRooms(asUser("user1"), &pb.ListRoomsRequest{})
 	require.NoError(t, err)
 	require.NotEmpty(t, roomsResp.Rooms)
 
@@ -66,18 +95,325 @@ func TestLeaveRoom(t *testing.T) {
 	testUserID := uuid.New().String()
 
 	// First join the room
-	joinResp, err := service.JoinRoom(context.Background(), &pb.JoinRoomRequest{
+	joinResp, err := service.JoinRoom(asUser(testUserID), &pb.JoinRoomRequest{
 		RoomId: testRoom.Id,
-		UserId: testUserID,
 	})
 	require.NoError(t, err)
 	require.True(t, joinResp.Success)
 
 	// Now leave the room
-	leaveResp, err := service.LeaveRoom(context.Background(), &pb.LeaveRoomRequest{
+	leaveResp, err := service.LeaveRoom(asUser(testUserID), &pb.LeaveRoomRequest{
 		RoomId: testRoom.Id,
-		UserId: testUserID,
 	})
 	assert.NoError(t, err)
 	assert.True(t, leaveResp.Success)
 }
+
+func TestGetHistoryPaging(t *testing.T) {
+	service := setupTestService(t)
+
+	roomID := uuid.New().String()
+	require.NoError(t, service.store.SaveRoom(&pb.ChatRoom{Id: roomID, Name: "Paged"}))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, service.store.SaveMessage(&pb.Message{
+			Id:      uuid.New().String(),
+			RoomId:  roomID,
+			Content: fmt.Sprintf("msg-%d", i),
+		}))
+	}
+
+	var contents []string
+	req := &pb.GetHistoryRequest{RoomId: roomID, Limit: 2, NewestFirst: true}
+	for {
+		resp, err := service.GetHistory(asUser("user1"), req)
+		require.NoError(t, err)
+		for _, msg := range resp.Messages {
+			contents = append(contents, msg.Content)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req = &pb.GetHistoryRequest{RoomId: roomID, Limit: 2, PageToken: resp.NextPageToken}
+	}
+
+	assert.Equal(t, []string{"msg-4", "msg-3", "msg-2", "msg-1", "msg-0"}, contents)
+
+	_, err := service.GetHistory(asUser("user1"), &pb.GetHistoryRequest{RoomId: roomID, PageToken: "garbage"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestConcurrentJoinAcrossReplicas(t *testing.T) {
+	shared := store.NewMemoryStore()
+	replicas := []*ChatService{newTestService(t, shared), newTestService(t, shared)}
+
+	room := &pb.ChatRoom{Id: uuid.New().String(), Name: "Busy Room"}
+	require.NoError(t, shared.SaveRoom(room))
+
+	var wg sync.WaitGroup
+	userIDs := make([]string, 20)
+	for i := range userIDs {
+		userIDs[i] = uuid.New().String()
+		wg.Add(1)
+		go func(service *ChatService, userID string) {
+			defer wg.Done()
+			resp, err := service.JoinRoom(asUser(userID), &pb.JoinRoomRequest{
+				RoomId: room.Id,
+			})
+			assert.NoError(t, err)
+			assert.True(t, resp.Success)
+		}(replicas[i%len(replicas)], userIDs[i])
+	}
+	wg.Wait()
+
+	saved, _, err := shared.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, userIDs, saved.Members, "No membership change should be lost")
+}
+
+func TestSendMessage(t *testing.T) {
+	service := setupTestService(t)
+
+	user := &pb.User{Id: uuid.New().String(), Username: "alice"}
+	require.NoError(t, service.store.SaveUser(user))
+	room := &pb.ChatRoom{Id: uuid.New().String(), Name: "Test Room"}
+	require.NoError(t, service.store.SaveRoom(room))
+	ctx := asUser(user.Id)
+
+	// Sending before joining is rejected
+	resp, err := service.SendMessage(ctx, &pb.SendMessageRequest{
+		RoomId:  room.Id,
+		Content: "hello",
+	})
+	require.NoError(t, err)
+	assert.False(t, resp.Success)
+
+	joinResp, err := service.JoinRoom(ctx, &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.True(t, joinResp.Success)
+
+	for _, content := range []string{"", "   ", "\xff\xfe", strings.Repeat("a", MaxMessageLength+1)} {
+		resp, err := service.SendMessage(ctx, &pb.SendMessageRequest{
+			RoomId:  room.Id,
+			Content: content,
+		})
+		require.NoError(t, err)
+		assert.False(t, resp.Success, "Content %q should be rejected", content)
+	}
+
+	resp, err = service.SendMessage(ctx, &pb.SendMessageRequest{
+		RoomId:  room.Id,
+		Content: "hello",
+	})
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+	assert.NotEmpty(t, resp.Message.Id)
+	assert.NotZero(t, resp.Message.Timestamp)
+	assert.Equal(t, "alice", resp.Message.Username, "Username should come from the users store")
+
+	messages, err := service.store.GetMessages(room.Id, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, resp.Message.Id, messages[0].Id)
+}
+
+// startTestServer serves service over an in-memory listener, behind the auth
+// interceptors, and returns a client connected to it.
+func startTestServer(t *testing.T, service *ChatService) pb.ChatServiceClient {
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(auth.UnaryServerInterceptor(service.tokens, PublicMethods...)),
+		grpc.StreamInterceptor(auth.StreamServerInterceptor(service.tokens, PublicMethods...)),
+	)
+	pb.RegisterChatServiceServer(s, service)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewChatServiceClient(conn)
+}
+
+func TestSubscribeStreamsRoomEvents(t *testing.T) {
+	service := setupTestService(t)
+	client := startTestServer(t, service)
+
+	user := &pb.User{Id: uuid.New().String(), Username: "alice"}
+	require.NoError(t, service.store.SaveUser(user))
+	room := &pb.ChatRoom{Id: uuid.New().String(), Name: "Watched"}
+	require.NoError(t, service.store.SaveRoom(room))
+	other := &pb.ChatRoom{Id: uuid.New().String(), Name: "Ignored"}
+	require.NoError(t, service.store.SaveRoom(other))
+
+	token, err := service.tokens.Issue(auth.Identity{UserID: user.Id, Username: user.Username})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Subscribe(auth.WithToken(ctx, token), &pb.SubscribeRequest{RoomIds: []string{room.Id}})
+	require.NoError(t, err)
+	_, err = stream.Header()
+	require.NoError(t, err)
+
+	me := asUser(user.Id)
+	_, err = service.JoinRoom(me, &pb.JoinRoomRequest{RoomId: other.Id})
+	require.NoError(t, err)
+	_, err = service.JoinRoom(me, &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	_, err = service.SendMessage(me, &pb.SendMessageRequest{RoomId: room.Id, Content: "hi"})
+	require.NoError(t, err)
+	_, err = service.LeaveRoom(me, &pb.LeaveRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+
+	ev, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, pb.Event_USER_JOINED, ev.Type)
+	assert.Equal(t, room.Id, ev.RoomId)
+	assert.Equal(t, "alice", ev.GetUser().Username)
+
+	ev, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, pb.Event_MESSAGE_SENT, ev.Type)
+	assert.Equal(t, "hi", ev.GetMessage().Content)
+
+	ev, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, pb.Event_USER_LEFT, ev.Type)
+}
+
+func TestRoomLifecycle(t *testing.T) {
+	service := setupTestService(t)
+
+	var events []pb.Event_Type
+	cancel, err := service.store.SubscribeEvents(store.EventFilter{Global: true}, func(ev *pb.Event) {
+		events = append(events, ev.Type)
+	})
+	require.NoError(t, err)
+	defer cancel()
+
+	ownerID := uuid.New().String()
+	owner, stranger := asUser(ownerID), asUser(uuid.New().String())
+	createResp, err := service.CreateRoom(owner, &pb.CreateRoomRequest{Name: "  Gophers ", Description: "Go talk"})
+	require.NoError(t, err)
+	require.True(t, createResp.Success)
+	room := createResp.Room
+	assert.Equal(t, "Gophers", room.Name)
+	assert.Equal(t, ownerID, room.OwnerId)
+	assert.Contains(t, room.Members, ownerID)
+
+	resp, err := service.CreateRoom(owner, &pb.CreateRoomRequest{Name: " "})
+	require.NoError(t, err)
+	assert.False(t, resp.Success, "Blank names should be rejected")
+
+	newName := "Gopher Lounge"
+	updateResp, err := service.UpdateRoom(stranger, &pb.UpdateRoomRequest{RoomId: room.Id, Name: &newName})
+	require.NoError(t, err)
+	assert.False(t, updateResp.Success, "Only the owner may update a room")
+
+	updateResp, err = service.UpdateRoom(owner, &pb.UpdateRoomRequest{RoomId: room.Id, Name: &newName})
+	require.NoError(t, err)
+	require.True(t, updateResp.Success)
+	assert.Equal(t, "Gopher Lounge", updateResp.Room.Name)
+	assert.Equal(t, "Go talk", updateResp.Room.Description, "Unset fields should be kept")
+
+	updateResp, err = service.UpdateRoom(owner, &pb.UpdateRoomRequest{RoomId: room.Id, Name: &newName})
+	require.NoError(t, err)
+	require.True(t, updateResp.Success, "Updates that change nothing should succeed without an event")
+
+	require.NoError(t, service.store.SaveMessage(&pb.Message{Id: uuid.New().String(), RoomId: room.Id, Content: "bye"}))
+
+	deleteResp, err := service.DeleteRoom(stranger, &pb.DeleteRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.False(t, deleteResp.Success, "Only the owner may delete a room")
+
+	deleteResp, err = service.DeleteRoom(owner, &pb.DeleteRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.True(t, deleteResp.Success)
+
+	_, _, err = service.store.GetRoom(room.Id)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	messages, err := service.store.GetMessages(room.Id, 10)
+	require.NoError(t, err)
+	assert.Empty(t, messages, "Deleting a room should purge its messages")
+
+	assert.Equal(t, []pb.Event_Type{pb.Event_ROOM_CREATED, pb.Event_ROOM_UPDATED, pb.Event_ROOM_DELETED}, events)
+}
+
+func TestSeedRoomsIsIdempotent(t *testing.T) {
+	service := setupTestService(t)
+	ctx := asUser("user1")
+
+	resp, err := service.JoinRoom(ctx, &pb.JoinRoomRequest{RoomId: "general"})
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+
+	require.NoError(t, service.SeedRooms("testdata/rooms.json"))
+
+	roomsResp, err := service.ListRooms(ctx, &pb.ListRoomsRequest{})
+	require.NoError(t, err)
+	require.Len(t, roomsResp.Rooms, 2, "Seeding again should not duplicate rooms")
+	assert.Equal(t, "general", roomsResp.Rooms[0].Id)
+	assert.Equal(t, []string{"user1"}, roomsResp.Rooms[0].Members, "Seeding should not reset existing rooms")
+}
+
+func TestSeedRoomsGiveRoomsToTheirOwners(t *testing.T) {
+	service := newTestService(t, store.NewMemoryStore())
+	path := filepath.Join(t.TempDir(), "rooms.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("rooms:\n  - id: club\n    name: Club\n    owner: alice\n"), 0o644))
+
+	require.NoError(t, service.SeedRooms(path), "Owners who have not registered should not stop seeding")
+	room, _, err := service.store.GetRoom("club")
+	require.NoError(t, err)
+	assert.Empty(t, room.OwnerId)
+
+	alice := register(t, service, "alice")
+	require.NoError(t, service.SeedRooms(path))
+	room, _, err = service.store.GetRoom("club")
+	require.NoError(t, err)
+	assert.Equal(t, alice.Id, room.OwnerId)
+	assert.Contains(t, room.Members, alice.Id)
+
+	description := "Members only"
+	updateResp, err := service.UpdateRoom(asUser(alice.Id), &pb.UpdateRoomRequest{RoomId: "club", Description: &description})
+	require.NoError(t, err)
+	assert.True(t, updateResp.Success, "Owners of seeded rooms should be able to manage them: %s", updateResp.Error)
+
+	register(t, service, "bob")
+	require.NoError(t, os.WriteFile(path, []byte("rooms:\n  - id: club\n    name: Club\n    owner: bob\n"), 0o644))
+	require.NoError(t, service.SeedRooms(path))
+	room, _, err = service.store.GetRoom("club")
+	require.NoError(t, err)
+	assert.Equal(t, alice.Id, room.OwnerId, "Seeding should not take rooms from their owners")
+}
+
+func TestListRoomsDoesNotSeed(t *testing.T) {
+	service := newTestService(t, store.NewMemoryStore())
+
+	resp, err := service.ListRooms(asUser("user1"), &pb.ListRoomsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Rooms)
+}
+
+func TestLoadSeedRooms(t *testing.T) {
+	rooms, err := LoadSeedRooms("../../config/rooms.yaml")
+	require.NoError(t, err)
+	require.Len(t, rooms, 2)
+	assert.Equal(t, "snapp", rooms[0].Id)
+	assert.Equal(t, "Quera", rooms[1].Name)
+
+	path := filepath.Join(t.TempDir(), "rooms.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("rooms:\n  - id: a.b\n    name: Dotted\n"), 0o644))
+	_, err = LoadSeedRooms(path)
+	assert.Error(t, err, "IDs that are not valid subject tokens should be rejected")
+
+	require.NoError(t, os.WriteFile(path, []byte("rooms:\n  - id: dm-lobby\n    name: Lobby\n"), 0o644))
+	_, err = LoadSeedRooms(path)
+	assert.Error(t, err, "IDs of direct conversations should be rejected")
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+// maxTopicLength is the longest room topic accepted, in characters.
+const maxTopicLength = 200
+
+// commandCall is a slash command sent to a room.
+type commandCall struct {
+	me   auth.Identity
+	room *pb.ChatRoom
+	// name is the command without its slash, in lowercase.
+	name string
+	args string
+	// parent is set when the command was sent as a reply.
+	parent *pb.Message
+}
+
+// builtinCommand is a command the service runs itself.
+type builtinCommand struct {
+	usage       string
+	description string
+	run         func(s *ChatService, call *commandCall) *pb.SendMessageResponse
+}
+
+// builtinCommands are the commands of every room. Bots cannot register
+// commands with the same names.
+var builtinCommands map[string]builtinCommand
+
+func init() {
+	// Filled in here because /help lists the commands itself.
+	builtinCommands = map[string]builtinCommand{
+		"help": {
+			description: "list the commands",
+			run:         (*ChatService).helpCommand,
+		},
+		"who": {
+			description: "list the members of the room",
+			run:         (*ChatService).whoCommand,
+		},
+		"topic": {
+			usage:       "[topic|-]",
+			description: "show the topic, or set or clear it as a moderator",
+			run:         (*ChatService).topicCommand,
+		},
+		"me": {
+			usage:       "<action>",
+			description: "describe what you are doing",
+			run:         (*ChatService).meCommand,
+		},
+	}
+}
+
+// parseCommand splits a message such as "/topic Release day" into the
+// command's name, in lowercase, and its arguments. ok is false for messages
+// that are not commands, including those escaped with a second slash.
+func parseCommand(content string) (name, args string, ok bool) {
+	if !strings.HasPrefix(content, "/") || strings.HasPrefix(content, "//") {
+		return "", "", false
+	}
+	name = content[1:]
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, args = name[:i], name[i:]
+	}
+	if name == "" {
+		return "", "", false
+	}
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+// unescapeCommand turns a message escaped with "//" into the message
+// starting with a single slash that was meant.
+func unescapeCommand(content string) string {
+	if strings.HasPrefix(content, "//") {
+		return content[1:]
+	}
+	return content
+}
+
+// runCommand runs a built-in command, or passes it on to the bot that
+// registered it.
+func (s *ChatService) runCommand(call *commandCall) *pb.SendMessageResponse {
+	if cmd, ok := builtinCommands[call.name]; ok {
+		return cmd.run(s, call)
+	}
+
+	bot, err := s.botFor(call.name)
+	if errors.Is(err, store.ErrNotFound) {
+		return commandError(fmt.Sprintf("Unknown command /%s; /help lists them, and // sends a message starting with /", call.name))
+	}
+	if err != nil {
+		log.Printf("Error loading bots: %v", err)
+		return commandError("Failed to run command")
+	}
+	return s.runBotCommand(bot, call)
+}
+
+// commandOutput is the response to a command that has something to say to
+// the user who ran it and nobody else.
+func commandOutput(output string) *pb.SendMessageResponse {
+	return &pb.SendMessageResponse{
+		Success: true,
+		Output:  output,
+	}
+}
+
+func commandError(problem string) *pb.SendMessageResponse {
+	return &pb.SendMessageResponse{
+		Success: false,
+		Error:   problem,
+	}
+}
+
+func (s *ChatService) helpCommand(call *commandCall) *pb.SendMessageResponse {
+	names := make([]string, 0, len(builtinCommands))
+	for name := range builtinCommands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	lines := []string{"Commands:"}
+	for _, name := range names {
+		cmd := builtinCommands[name]
+		lines = append(lines, describeCommand(name, cmd.usage, cmd.description))
+	}
+
+	bots, err := s.liveBots()
+	if err != nil {
+		// The built-in commands are still worth showing.
+		log.Printf("Error loading bots: %v", err)
+	}
+	for _, bot := range bots {
+		for _, cmd := range bot.Commands {
+			lines = append(lines, describeCommand(cmd.Name, cmd.Usage, cmd.Description)+" ("+bot.Name+")")
+		}
+	}
+
+	return commandOutput(strings.Join(lines, "\n"))
+}
+
+func describeCommand(name, usage, description string) string {
+	line := "/" + name
+	if usage != "" {
+		line += " " + usage
+	}
+	if description != "" {
+		line += " - " + description
+	}
+	return line
+}
+
+func (s *ChatService) whoCommand(call *commandCall) *pb.SendMessageResponse {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		log.Printf("Error loading users: %v", err)
+		return commandError("Failed to retrieve users")
+	}
+	byID := make(map[string]*pb.User, len(users))
+	for _, user := range users {
+		byID[user.Id] = user
+	}
+
+	lines := []string{fmt.Sprintf("Members of %s:", call.room.Name)}
+	for _, id := range call.room.Members {
+		user, ok := byID[id]
+		if !ok {
+			continue
+		}
+		user = visibleTo(user, call.me.UserID)
+		line := fmt.Sprintf("%s - %s", user.Username, strings.ToLower(user.Presence.String()))
+		if user.StatusText != "" {
+			line += ": " + user.StatusText
+		}
+		if role := roleOf(call.room, id); role != pb.ChatRoom_MEMBER && !call.room.Direct {
+			line += " (" + strings.ToLower(role.String()) + ")"
+		}
+		lines = append(lines, line)
+	}
+
+	return commandOutput(strings.Join(lines, "\n"))
+}
+
+func (s *ChatService) topicCommand(call *commandCall) *pb.SendMessageResponse {
+	if call.args == "" {
+		if call.room.Topic == "" {
+			return commandOutput("No topic is set")
+		}
+		return commandOutput("Topic: " + call.room.Topic)
+	}
+
+	topic := call.args
+	if topic == "-" {
+		topic = ""
+	}
+	if utf8.RuneCountInString(topic) > maxTopicLength {
+		return commandError("Topic is too long")
+	}
+
+	changed := false
+	room, err := s.updateRoom(call.room.Id, func(room *pb.ChatRoom) (bool, error) {
+		if room.Direct {
+			return false, validationError("Direct conversations have no topic")
+		}
+		if roleOf(room, call.me.UserID) < pb.ChatRoom_MODERATOR {
+			return false, errNotModerator
+		}
+		changed = room.Topic != topic
+		room.Topic = topic
+		return changed, nil
+	})
+	if err != nil {
+		return commandError(roomError(call.room.Id, err))
+	}
+
+	if changed {
+		s.publish(roomEvent(pb.Event_ROOM_UPDATED, room))
+	}
+	if topic == "" {
+		return commandOutput("Topic cleared")
+	}
+	return commandOutput("Topic set to: " + topic)
+}
+
+func (s *ChatService) meCommand(call *commandCall) *pb.SendMessageResponse {
+	if call.args == "" {
+		return commandError("Usage: /me <action>")
+	}
+
+	msg, problem := s.postMessage(call.room, call.me.UserID, call.args, call.parent, true)
+	if problem != "" {
+		return commandError(problem)
+	}
+
+	return &pb.SendMessageResponse{
+		Success: true,
+		Message: msg,
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestParseCommand(t *testing.T) {
+	name, args, ok := parseCommand("/Topic  Release day ")
+	assert.True(t, ok)
+	assert.Equal(t, "topic", name)
+	assert.Equal(t, "Release day", args)
+
+	name, args, ok = parseCommand("/who")
+	assert.True(t, ok)
+	assert.Equal(t, "who", name)
+	assert.Empty(t, args)
+
+	for _, content := range []string{"hello", "//etc is a directory", "/ hello", " /who"} {
+		_, _, ok := parseCommand(content)
+		assert.False(t, ok, content)
+	}
+	assert.Equal(t, "/etc is a directory", unescapeCommand("//etc is a directory"))
+}
+
+func TestCommands(t *testing.T) {
+	service := setupTestService(t)
+	room, alice, bob, carol, _ := moderatedRoom(t, service)
+	var updates []string
+	cancel, err := service.store.SubscribeEvents(store.EventFilter{Global: true}, func(ev *pb.Event) {
+		if ev.Type == pb.Event_ROOM_UPDATED {
+			updates = append(updates, ev.GetRoom().Topic)
+		}
+	})
+	require.NoError(t, err)
+	defer cancel()
+
+	send := func(userID, content string) *pb.SendMessageResponse {
+		resp, err := service.SendMessage(asUser(userID), &pb.SendMessageRequest{RoomId: room.Id, Content: content})
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := send(carol.Id, "/help")
+	require.True(t, resp.Success, resp.Error)
+	assert.Nil(t, resp.Message, "Command output should not be posted")
+	assert.Contains(t, resp.Output, "/topic [topic|-] - ")
+
+	resp = send(carol.Id, "/who")
+	require.True(t, resp.Success, resp.Error)
+	assert.Contains(t, resp.Output, "alice - online (owner)")
+	assert.Contains(t, resp.Output, "bob - online (moderator)")
+
+	resp = send(carol.Id, "/nope")
+	assert.False(t, resp.Success)
+	assert.Contains(t, resp.Error, "Unknown command /nope")
+
+	resp = send(carol.Id, "//nope")
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, "/nope", resp.Message.Content)
+
+	resp = send(carol.Id, "/topic Release day")
+	assert.False(t, resp.Success, "Members cannot set the topic")
+	resp = send(bob.Id, "/topic Release day")
+	require.True(t, resp.Success, resp.Error)
+	stored, _, err := service.store.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "Release day", stored.Topic)
+	resp = send(carol.Id, "/topic")
+	assert.Equal(t, "Topic: Release day", resp.Output)
+	resp = send(alice.Id, "/topic -")
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, "No topic is set", send(carol.Id, "/topic").Output)
+
+	resp = send(carol.Id, "/me waves")
+	require.True(t, resp.Success, resp.Error)
+	assert.True(t, resp.Message.Action)
+	assert.Equal(t, "waves", resp.Message.Content)
+	assert.Equal(t, []string{"Release day", ""}, updates, "Topic changes should be announced")
+}
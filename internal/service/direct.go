@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func (s *ChatService) SendDirectMessage(ctx context.Context, req *pb.SendDirectMessageRequest) (*pb.SendDirectMessageResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := validateContent(req.Content); problem != "" {
+		return &pb.SendDirectMessageResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	recipient, err := s.findUser(req.RecipientId, req.RecipientUsername)
+	if errors.Is(err, store.ErrNotFound) {
+		return &pb.SendDirectMessageResponse{
+			Success: false,
+			Error:   "User not found",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error loading recipient of direct message: %v", err)
+		return &pb.SendDirectMessageResponse{
+			Success: false,
+			Error:   "Failed to retrieve user",
+		}, nil
+	}
+	if recipient.Id == me.UserID {
+		return &pb.SendDirectMessageResponse{
+			Success: false,
+			Error:   "Cannot send a direct message to yourself",
+		}, nil
+	}
+	if recipient.Bot {
+		return &pb.SendDirectMessageResponse{
+			Success: false,
+			Error:   "Bots do not read direct messages",
+		}, nil
+	}
+	if err := s.allow(ctx, userKey(me.UserID, "messages"), s.limits.UserMessages, sendingTooFast); err != nil {
+		return nil, err
+	}
+
+	room, err := s.directRoom(me.UserID, recipient)
+	if err != nil {
+		log.Printf("Error opening direct conversation with %s: %v", recipient.Id, err)
+		return &pb.SendDirectMessageResponse{
+			Success: false,
+			Error:   "Failed to save room",
+		}, nil
+	}
+
+	msg, problem := s.postMessage(room, me.UserID, req.Content, nil, false)
+	if problem != "" {
+		return &pb.SendDirectMessageResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	return &pb.SendDirectMessageResponse{
+		Success: true,
+		Message: msg,
+		Room:    redactRoom(room, me.UserID),
+	}, nil
+}
+
+// directRoom returns the direct conversation between userID and recipient,
+// creating it if this is their first message. Its ID is derived from both
+// user IDs, so concurrent first messages settle on the same room.
+func (s *ChatService) directRoom(userID string, recipient *pb.User) (*pb.ChatRoom, error) {
+	id := store.DirectRoomID(userID, recipient.Id)
+	room, _, err := s.store.GetRoom(id)
+	if !errors.Is(err, store.ErrNotFound) {
+		return room, err
+	}
+
+	sender, _, err := s.store.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	room = &pb.ChatRoom{
+		Id:        id,
+		Name:      sender.Username + ", " + recipient.Username,
+		Members:   []string{userID, recipient.Id},
+		CreatedAt: time.Now().Unix(),
+		Direct:    true,
+	}
+	_, err = s.store.CompareAndSaveRoom(room, 0)
+	if errors.Is(err, store.ErrConflict) {
+		room, _, err = s.store.GetRoom(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
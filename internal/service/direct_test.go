@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSendDirectMessage(t *testing.T) {
+	service := setupTestService(t)
+	client := startTestServer(t, service)
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+	carol := register(t, service, "carol")
+
+	token, err := service.tokens.Issue(auth.Identity{UserID: bob.Id, Username: bob.Username})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	inbox, err := client.Subscribe(auth.WithToken(ctx, token), &pb.SubscribeRequest{Inbox: true})
+	require.NoError(t, err)
+	_, err = inbox.Header()
+	require.NoError(t, err)
+
+	resp, err := service.SendDirectMessage(asUser(alice.Id), &pb.SendDirectMessageRequest{
+		RecipientUsername: "Bob",
+		Content:           "hi bob",
+	})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	room := resp.Room
+	assert.True(t, room.Direct)
+	assert.Equal(t, store.DirectRoomID(alice.Id, bob.Id), room.Id)
+	assert.ElementsMatch(t, []string{alice.Id, bob.Id}, room.Members)
+
+	ev, err := inbox.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, pb.Event_MESSAGE_SENT, ev.Type)
+	assert.Equal(t, bob.Id, ev.RecipientId)
+	assert.Equal(t, "hi bob", ev.GetMessage().Content)
+
+	// Replying by ID ends up in the same conversation.
+	resp, err = service.SendDirectMessage(asUser(bob.Id), &pb.SendDirectMessageRequest{
+		RecipientId: alice.Id,
+		Content:     "hi alice",
+	})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, room.Id, resp.Room.Id)
+
+	roomIDs := func(userID string) []string {
+		resp, err := service.ListRooms(asUser(userID), &pb.ListRoomsRequest{})
+		require.NoError(t, err)
+		var ids []string
+		for _, room := range resp.Rooms {
+			ids = append(ids, room.Id)
+		}
+		return ids
+	}
+	assert.Contains(t, roomIDs(alice.Id), room.Id)
+	assert.Contains(t, roomIDs(bob.Id), room.Id)
+	assert.NotContains(t, roomIDs(carol.Id), room.Id, "Direct conversations are hidden from everyone else")
+
+	history, err := service.GetHistory(asUser(alice.Id), &pb.GetHistoryRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.Len(t, history.Messages, 2)
+	assert.Equal(t, "hi alice", history.Messages[1].Content)
+
+	_, err = service.GetHistory(asUser(carol.Id), &pb.GetHistoryRequest{RoomId: room.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	joinResp, err := service.JoinRoom(asUser(carol.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.False(t, joinResp.Success, "Nobody else can join a direct conversation")
+
+	leaveResp, err := service.LeaveRoom(asUser(alice.Id), &pb.LeaveRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.True(t, leaveResp.Success)
+	stored, _, err := service.store.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.Len(t, stored.Members, 2, "Leaving a direct conversation keeps its members")
+
+	sendResp, err := service.SendMessage(asUser(bob.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "still here?"})
+	require.NoError(t, err)
+	assert.True(t, sendResp.Success, sendResp.Error)
+}
+
+func TestSendDirectMessageRejects(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+
+	for name, req := range map[string]*pb.SendDirectMessageRequest{
+		"yourself":     {RecipientId: alice.Id, Content: "hi"},
+		"unknown user": {RecipientUsername: "nobody", Content: "hi"},
+		"empty":        {RecipientUsername: "alice", Content: " "},
+	} {
+		resp, err := service.SendDirectMessage(asUser(alice.Id), req)
+		require.NoError(t, err, name)
+		assert.False(t, resp.Success, name)
+	}
+}
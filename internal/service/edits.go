@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func (s *ChatService) EditMessage(ctx context.Context, req *pb.EditMessageRequest) (*pb.EditMessageResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := validateContent(req.Content); problem != "" {
+		return &pb.EditMessageResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	msg, problem := s.reviseMessage(me.UserID, req.RoomId, req.Seq, req.Content, false)
+	if problem != "" {
+		return &pb.EditMessageResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	return &pb.EditMessageResponse{
+		Success: true,
+		Message: msg,
+	}, nil
+}
+
+func (s *ChatService) DeleteMessage(ctx context.Context, req *pb.DeleteMessageRequest) (*pb.DeleteMessageResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, problem := s.reviseMessage(me.UserID, req.RoomId, req.Seq, "", true); problem != "" {
+		return &pb.DeleteMessageResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	return &pb.DeleteMessageResponse{
+		Success: true,
+	}, nil
+}
+
+// reviseMessage stores an edit of, or tombstone for, the message with
+// sequence seq on behalf of userID, who must be its author or a moderator of
+// the room, and announces the result. On failure it describes the problem
+// instead.
+func (s *ChatService) reviseMessage(userID, roomID string, seq uint64, content string, deleted bool) (*pb.Message, string) {
+	room, _, err := s.store.GetRoom(roomID)
+	if err == nil && !canRead(room, userID) {
+		err = store.ErrNotFound
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, "Room not found"
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", roomID, err)
+		return nil, "Failed to retrieve room"
+	}
+
+	msg, err := s.store.GetMessage(roomID, seq)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, "Message not found"
+	}
+	if err != nil {
+		log.Printf("Error loading message %d in %s: %v", seq, roomID, err)
+		return nil, "Failed to retrieve message"
+	}
+
+	now := time.Now()
+	switch {
+	case msg.Deleted:
+		return nil, "Message has been deleted"
+	case restricted(room.Banned, userID, now):
+		return nil, errBanned.Error()
+	case msg.UserId != userID && roleOf(room, userID) < pb.ChatRoom_MODERATOR:
+		return nil, "Only the author or a moderator can change this message"
+	case !deleted && restricted(room.Muted, userID, now):
+		return nil, "You are muted in this room"
+	}
+
+	// Edits must not sneak past the filters the original went through.
+	var flags []string
+	if !deleted {
+		screened := s.screen(room, content)
+		if screened.Rejected {
+			return nil, "Message rejected: " + screened.Reason
+		}
+		content, flags = screened.Content, screened.Flags
+	}
+
+	rev := &pb.MessageRevision{
+		MessageId: msg.Id,
+		RoomId:    roomID,
+		UserId:    userID,
+		Content:   content,
+		Deleted:   deleted,
+		Timestamp: time.Now().Unix(),
+	}
+	if err := s.store.SaveRevision(rev); err != nil {
+		log.Printf("Error saving revision of message %s: %v", msg.Id, err)
+		return nil, "Failed to save message"
+	}
+	msg.Content, msg.Deleted, msg.EditedAt = rev.Content, rev.Deleted, rev.Timestamp
+
+	eventType := pb.Event_MESSAGE_EDITED
+	if deleted {
+		eventType = pb.Event_MESSAGE_DELETED
+	}
+	s.publishMessage(eventType, room, msg, userID)
+	if len(flags) > 0 {
+		s.reportFlagged(room, msg, flags)
+	}
+	return msg, ""
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestEditAndDeleteMessages(t *testing.T) {
+	service := setupTestService(t)
+	room, alice, bob, carol, _ := moderatedRoom(t, service)
+	bobsInbox := inbox(t, service, bob.Id)
+
+	var events []*pb.Event
+	cancel, err := service.store.SubscribeEvents(store.EventFilter{RoomIDs: []string{room.Id}}, func(ev *pb.Event) {
+		events = append(events, ev)
+	})
+	require.NoError(t, err)
+	t.Cleanup(cancel)
+
+	sendResp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "helo"})
+	require.NoError(t, err)
+	require.True(t, sendResp.Success, sendResp.Error)
+	seq := sendResp.Message.Seq
+
+	editResp, err := service.EditMessage(asUser(alice.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: seq, Content: "hello"})
+	require.NoError(t, err)
+	assert.True(t, editResp.Success, "The owner may edit anything: %s", editResp.Error)
+
+	editResp, err = service.EditMessage(asUser(carol.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: seq, Content: "hello!"})
+	require.NoError(t, err)
+	require.True(t, editResp.Success, editResp.Error)
+	assert.Equal(t, "hello!", editResp.Message.Content)
+	assert.NotZero(t, editResp.Message.EditedAt)
+
+	editResp, err = service.EditMessage(asUser(carol.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: seq, Content: " "})
+	require.NoError(t, err)
+	assert.False(t, editResp.Success, "Edits are validated like new messages")
+
+	editResp, err = service.EditMessage(asUser(carol.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: seq + 100, Content: "x"})
+	require.NoError(t, err)
+	assert.Equal(t, "Message not found", editResp.Error)
+
+	history, err := service.GetHistory(asUser(carol.Id), &pb.GetHistoryRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.Len(t, history.Messages, 1)
+	assert.Equal(t, "hello!", history.Messages[0].Content)
+
+	deleteResp, err := service.DeleteMessage(asUser(bob.Id), &pb.DeleteMessageRequest{RoomId: room.Id, Seq: seq})
+	require.NoError(t, err)
+	require.True(t, deleteResp.Success, "Moderators may delete messages: %s", deleteResp.Error)
+
+	editResp, err = service.EditMessage(asUser(carol.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: seq, Content: "undo"})
+	require.NoError(t, err)
+	assert.Equal(t, "Message has been deleted", editResp.Error)
+
+	history, err = service.GetHistory(asUser(carol.Id), &pb.GetHistoryRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.Len(t, history.Messages, 1, "Deleted messages stay as tombstones")
+	assert.True(t, history.Messages[0].Deleted)
+	assert.Empty(t, history.Messages[0].Content)
+
+	var types []pb.Event_Type
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	assert.Equal(t, []pb.Event_Type{
+		pb.Event_MESSAGE_SENT,
+		pb.Event_MESSAGE_EDITED,
+		pb.Event_MESSAGE_EDITED,
+		pb.Event_MESSAGE_DELETED,
+	}, types)
+	assert.Empty(t, *bobsInbox, "Only direct conversations copy edits to inboxes")
+}
+
+func TestOnlyAuthorsAndModeratorsChangeMessages(t *testing.T) {
+	service := setupTestService(t)
+	room, _, _, carol, dave := moderatedRoom(t, service)
+
+	sendResp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "mine"})
+	require.NoError(t, err)
+	seq := sendResp.Message.Seq
+
+	editResp, err := service.EditMessage(asUser(dave.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: seq, Content: "yours"})
+	require.NoError(t, err)
+	assert.False(t, editResp.Success)
+	assert.Equal(t, "Only the author or a moderator can change this message", editResp.Error)
+
+	deleteResp, err := service.DeleteMessage(asUser(dave.Id), &pb.DeleteMessageRequest{RoomId: room.Id, Seq: seq})
+	require.NoError(t, err)
+	assert.False(t, deleteResp.Success)
+
+	deleteResp, err = service.DeleteMessage(asUser(carol.Id), &pb.DeleteMessageRequest{RoomId: "elsewhere", Seq: seq})
+	require.NoError(t, err)
+	assert.Equal(t, "Room not found", deleteResp.Error)
+}
+
+func TestBannedAuthorsCannotChangeMessages(t *testing.T) {
+	service := setupTestService(t)
+	room, _, bob, carol, _ := moderatedRoom(t, service)
+
+	sendResp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "mine"})
+	require.NoError(t, err)
+	seq := sendResp.Message.Seq
+
+	banResp, err := service.Ban(asUser(bob.Id), &pb.BanRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	require.True(t, banResp.Success, banResp.Error)
+
+	editResp, err := service.EditMessage(asUser(carol.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: seq, Content: "still mine"})
+	require.NoError(t, err)
+	assert.Equal(t, errBanned.Error(), editResp.Error)
+
+	deleteResp, err := service.DeleteMessage(asUser(carol.Id), &pb.DeleteMessageRequest{RoomId: room.Id, Seq: seq})
+	require.NoError(t, err)
+	assert.Equal(t, errBanned.Error(), deleteResp.Error)
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// eventBuffer is how many events a Subscribe stream may fall behind before
+// further events are dropped for it.
+const eventBuffer = 256
+
+func (s *ChatService) Subscribe(req *pb.SubscribeRequest, stream grpc.ServerStreamingServer[pb.Event]) error {
+	me, err := caller(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	filter := store.EventFilter{UserID: me.UserID}
+	if !req.Inbox {
+		filter = store.EventFilter{RoomIDs: req.RoomIds, Global: true}
+	}
+
+	events := make(chan *pb.Event, eventBuffer)
+	cancel, err := s.store.SubscribeEvents(filter, func(ev *pb.Event) {
+		select {
+		case events <- ev:
+		default:
+			log.Printf("Dropping %s event for slow subscriber", ev.Type)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	// Access is checked once the subscription is live, so that losing it in
+	// between still shows up as an event below.
+	if !req.Inbox {
+		for _, roomID := range req.RoomIds {
+			visible, err := s.canSee(roomID, me.UserID)
+			if err != nil {
+				return fmt.Errorf("failed to subscribe: %v", err)
+			}
+			if !visible {
+				return status.Errorf(codes.NotFound, "room %s not found", roomID)
+			}
+		}
+	}
+
+	// Headers tell the client the subscription is live, so it can load
+	// history without missing anything sent in between.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			if !req.Inbox && s.lostAccess(ev, me.UserID, req.RoomIds) {
+				return status.Errorf(codes.PermissionDenied, "no longer allowed to read room %s", eventRoomID(ev))
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+			if removedFrom(ev, me.UserID) {
+				return status.Errorf(codes.PermissionDenied, "removed from room %s", ev.RoomId)
+			}
+		}
+	}
+}
+
+// lostAccess reports whether ev takes away userID's access to one of
+// roomIDs: they left a room only members can read, or the room stopped
+// being public. Kicks and bans are handled by removedFrom, after the user
+// has been told.
+func (s *ChatService) lostAccess(ev *pb.Event, userID string, roomIDs []string) bool {
+	switch ev.Type {
+	case pb.Event_USER_LEFT:
+		if ev.GetUser().GetId() != userID {
+			return false
+		}
+		visible, err := s.canSee(ev.RoomId, userID)
+		if err != nil {
+			log.Printf("Error checking access to room %s: %v", ev.RoomId, err)
+		}
+		return err != nil || !visible
+	case pb.Event_ROOM_UPDATED:
+		// Updates of public rooms are broadcast, so most are for rooms that
+		// were not subscribed to.
+		room := ev.GetRoom()
+		return slices.Contains(roomIDs, room.GetId()) && !canRead(room, userID)
+	}
+	return false
+}
+
+// eventRoomID returns the room ev belongs to, which room lifecycle events
+// only carry in their payload.
+func eventRoomID(ev *pb.Event) string {
+	if ev.RoomId != "" {
+		return ev.RoomId
+	}
+	return ev.GetRoom().GetId()
+}
+
+// publish stamps and broadcasts an event and hands it to the room's
+// webhooks. Failures are logged rather than returned: the change the event
+// describes has already been stored.
+func (s *ChatService) publish(ev *pb.Event) {
+	ev.Timestamp = time.Now().Unix()
+	if err := s.store.PublishEvent(ev); err != nil {
+		log.Printf("Error publishing %s event: %v", ev.Type, err)
+	}
+	s.webhooks.Dispatch(ev)
+}
+
+// userEvent builds a USER_JOINED or USER_LEFT event for a room.
+func (s *ChatService) userEvent(eventType pb.Event_Type, roomID, userID string) *pb.Event {
+	user, _, err := s.store.GetUser(userID)
+	if err != nil {
+		user = &pb.User{Id: userID}
+	}
+	return &pb.Event{
+		Type:    eventType,
+		RoomId:  roomID,
+		Payload: &pb.Event_User{User: visibleTo(user, "")},
+	}
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/amirhlashgari/snapp-chat/internal/filter"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxFilters is how many content filters a room can have.
+const maxFilters = 20
+
+func (s *ChatService) SetRoomFilters(ctx context.Context, req *pb.SetRoomFiltersRequest) (*pb.SetRoomFiltersResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := validateFilters(req.Filters); problem != "" {
+		return &pb.SetRoomFiltersResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	room, err := s.updateRoom(req.RoomId, func(room *pb.ChatRoom) (bool, error) {
+		if !visibleInList(room, me.UserID) {
+			return false, store.ErrNotFound
+		}
+		if room.Direct || roleOf(room, me.UserID) < pb.ChatRoom_MODERATOR {
+			return false, errNotModerator
+		}
+		room.Filters = req.Filters
+		return true, nil
+	})
+	if err != nil {
+		return &pb.SetRoomFiltersResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	s.publish(roomEvent(pb.Event_ROOM_UPDATED, room))
+
+	return &pb.SetRoomFiltersResponse{
+		Success: true,
+		Room:    redactRoom(room, me.UserID),
+	}, nil
+}
+
+// validateFilters describes what is wrong with a room's filters, or returns
+// "" if they can be used.
+func validateFilters(filters []*pb.ContentFilter) string {
+	if len(filters) > maxFilters {
+		return fmt.Sprintf("Rooms can have at most %d filters", maxFilters)
+	}
+	if _, err := filter.New(filters); err != nil {
+		return "Invalid " + err.Error()
+	}
+	return ""
+}
+
+// screen runs content through room's filters. Masks can make a message
+// blank or too long, so what they leave is validated again.
+func (s *ChatService) screen(room *pb.ChatRoom, content string) filter.Result {
+	pipeline, err := s.filters.pipeline(room)
+	if err != nil {
+		// Filters are checked when they are set, so this only happens if
+		// the rules got stricter since.
+		log.Printf("Error building filters of room %s: %v", room.Id, err)
+		return filter.Result{Content: content}
+	}
+
+	result := pipeline.Run(content)
+	if !result.Rejected && result.Content != content {
+		if problem := validateContent(result.Content); problem != "" {
+			result.Rejected = true
+			result.Reason = strings.ToLower(problem[:1]) + problem[1:] + " after filtering"
+		}
+	}
+	return result
+}
+
+// filterCache keeps the pipelines built from rooms' filters, so that their
+// patterns are not compiled again for every message.
+type filterCache struct {
+	mu    sync.Mutex
+	rooms map[string]builtFilters
+}
+
+// builtFilters is a room's pipeline along with the hash of the filters it
+// was built from.
+type builtFilters struct {
+	hash     [sha256.Size]byte
+	pipeline filter.Pipeline
+}
+
+// pipeline returns the pipeline of room's filters, building it again if
+// they changed since it was last asked for.
+func (c *filterCache) pipeline(room *pb.ChatRoom) (filter.Pipeline, error) {
+	if len(room.Filters) == 0 {
+		c.mu.Lock()
+		delete(c.rooms, room.Id)
+		c.mu.Unlock()
+		return nil, nil
+	}
+
+	hash, err := hashFilters(room.Filters)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	built, ok := c.rooms[room.Id]
+	c.mu.Unlock()
+	if ok && built.hash == hash {
+		return built.pipeline, nil
+	}
+
+	pipeline, err := filter.New(room.Filters)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rooms == nil {
+		c.rooms = make(map[string]builtFilters)
+	}
+	c.rooms[room.Id] = builtFilters{hash: hash, pipeline: pipeline}
+	return pipeline, nil
+}
+
+// hashFilters hashes the encoding of filters, each prefixed with its length
+// so that different lists cannot encode alike.
+func hashFilters(filters []*pb.ContentFilter) ([sha256.Size]byte, error) {
+	var buf []byte
+	for _, f := range filters {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(f)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		buf = protowire.AppendBytes(buf, data)
+	}
+	return sha256.Sum256(buf), nil
+}
+
+// reportFlagged tells room's owner and moderators why its filters flagged
+// msg.
+func (s *ChatService) reportFlagged(room *pb.ChatRoom, msg *pb.Message, reasons []string) {
+	flag := &pb.ContentFlag{
+		Message: msg,
+		Reasons: reasons,
+	}
+	for _, moderator := range append([]string{room.OwnerId}, room.Moderators...) {
+		if moderator == "" {
+			continue
+		}
+		s.publish(&pb.Event{
+			Type:        pb.Event_CONTENT_FLAGGED,
+			RoomId:      room.Id,
+			RecipientId: moderator,
+			Payload:     &pb.Event_Flag{Flag: flag},
+		})
+	}
+}
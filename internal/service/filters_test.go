@@ -0,0 +1,140 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestRoomFilters(t *testing.T) {
+	service := setupTestService(t)
+	room, alice, bob, carol, _ := moderatedRoom(t, service)
+
+	var flags []*pb.ContentFlag
+	cancel, err := service.store.SubscribeEvents(store.EventFilter{UserID: bob.Id}, func(ev *pb.Event) {
+		if ev.Type == pb.Event_CONTENT_FLAGGED {
+			flags = append(flags, ev.GetFlag())
+		}
+	})
+	require.NoError(t, err)
+	defer cancel()
+
+	filters := []*pb.ContentFilter{
+		{
+			Action: pb.ContentFilter_REJECT,
+			Rule:   &pb.ContentFilter_Blocklist_{Blocklist: &pb.ContentFilter_Blocklist{Words: []string{"spam"}}},
+		},
+		{
+			Action: pb.ContentFilter_MASK,
+			Rule:   &pb.ContentFilter_Pii_{Pii: &pb.ContentFilter_Pii{}},
+		},
+		{
+			Action: pb.ContentFilter_FLAG,
+			Rule:   &pb.ContentFilter_Links_{Links: &pb.ContentFilter_Links{Allow: []string{"example.com"}}},
+			Reason: "unknown link",
+		},
+	}
+
+	setResp, err := service.SetRoomFilters(asUser(carol.Id), &pb.SetRoomFiltersRequest{RoomId: room.Id, Filters: filters})
+	require.NoError(t, err)
+	assert.False(t, setResp.Success, "Members cannot set filters")
+
+	setResp, err = service.SetRoomFilters(asUser(bob.Id), &pb.SetRoomFiltersRequest{RoomId: room.Id, Filters: []*pb.ContentFilter{
+		{Rule: &pb.ContentFilter_Regex_{Regex: &pb.ContentFilter_Regex{Pattern: "("}}},
+	}})
+	require.NoError(t, err)
+	assert.False(t, setResp.Success)
+	assert.Contains(t, setResp.Error, "invalid pattern")
+
+	setResp, err = service.SetRoomFilters(asUser(bob.Id), &pb.SetRoomFiltersRequest{RoomId: room.Id, Filters: filters})
+	require.NoError(t, err)
+	require.True(t, setResp.Success, setResp.Error)
+	assert.Len(t, setResp.Room.Filters, 3)
+
+	send := func(content string) *pb.SendMessageResponse {
+		resp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: content})
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := send("buy spam now")
+	assert.False(t, resp.Success)
+	assert.Equal(t, "Message rejected: contains a blocked word", resp.Error)
+
+	resp = send("write to carol@example.com")
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, "write to [email hidden]", resp.Message.Content)
+	stored, err := service.store.GetMessage(room.Id, resp.Message.Seq)
+	require.NoError(t, err)
+	assert.Equal(t, "write to [email hidden]", stored.Content, "Masking should happen before the message is stored")
+	assert.Empty(t, flags)
+
+	resp = send("see https://example.org")
+	require.True(t, resp.Success, resp.Error)
+	require.Len(t, flags, 1, "Moderators should hear of flagged messages")
+	assert.Equal(t, resp.Message.Id, flags[0].Message.Id)
+	assert.Equal(t, []string{"unknown link"}, flags[0].Reasons)
+
+	editResp, err := service.EditMessage(asUser(carol.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: resp.Message.Seq, Content: "spam after all"})
+	require.NoError(t, err)
+	assert.False(t, editResp.Success, "Edits should be filtered too")
+
+	// Other rooms are not affected.
+	dm, err := service.SendDirectMessage(asUser(carol.Id), &pb.SendDirectMessageRequest{RecipientId: alice.Id, Content: "spam"})
+	require.NoError(t, err)
+	assert.True(t, dm.Success, dm.Error)
+
+	setResp, err = service.SetRoomFilters(asUser(alice.Id), &pb.SetRoomFiltersRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.True(t, setResp.Success, setResp.Error)
+	assert.True(t, send("spam").Success, "Removing the filters should allow everything again")
+
+	setResp, err = service.SetRoomFilters(asUser(alice.Id), &pb.SetRoomFiltersRequest{RoomId: room.Id, Filters: []*pb.ContentFilter{
+		{
+			Action: pb.ContentFilter_REJECT,
+			Rule:   &pb.ContentFilter_Blocklist_{Blocklist: &pb.ContentFilter_Blocklist{Words: []string{"eggs"}}},
+		},
+	}})
+	require.NoError(t, err)
+	require.True(t, setResp.Success, setResp.Error)
+	assert.True(t, send("spam").Success)
+	assert.False(t, send("green eggs").Success, "Changed filters should be used for the next message")
+}
+
+func TestMaskedMessagesAreValidatedAgain(t *testing.T) {
+	service := setupTestService(t)
+	room, _, bob, carol, _ := moderatedRoom(t, service)
+
+	setFilter := func(pattern, replacement string) {
+		resp, err := service.SetRoomFilters(asUser(bob.Id), &pb.SetRoomFiltersRequest{RoomId: room.Id, Filters: []*pb.ContentFilter{
+			{Rule: &pb.ContentFilter_Regex_{Regex: &pb.ContentFilter_Regex{Pattern: pattern, Replacement: replacement}}},
+		}})
+		require.NoError(t, err)
+		require.True(t, resp.Success, resp.Error)
+	}
+	send := func(content string) *pb.SendMessageResponse {
+		resp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: content})
+		require.NoError(t, err)
+		return resp
+	}
+
+	setFilter("x", "xxxx")
+	resp := send(strings.Repeat("x", MaxMessageLength/2))
+	assert.False(t, resp.Success, "Masks should not make messages longer than the limit")
+	assert.Equal(t, "Message rejected: message is too long after filtering", resp.Error)
+
+	setFilter(`\S+`, " ")
+	resp = send("gone")
+	assert.False(t, resp.Success, "Masks should not leave messages blank")
+	assert.Equal(t, "Message rejected: message is empty after filtering", resp.Error)
+
+	setFilter("x", "y")
+	resp = send("xyz")
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, "yyz", resp.Message.Content)
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// pageToken is the cursor behind GetHistoryResponse.NextPageToken. It is
+// serialized as base64 JSON and is opaque to clients.
+type pageToken struct {
+	RoomID      string `json:"r"`
+	ThreadID    string `json:"t,omitempty"`
+	NewestFirst bool   `json:"n,omitempty"`
+	BeforeSeq   uint64 `json:"bs,omitempty"`
+	AfterSeq    uint64 `json:"as,omitempty"`
+	BeforeTime  int64  `json:"bt,omitempty"`
+	AfterTime   int64  `json:"at,omitempty"`
+}
+
+func (t pageToken) encode() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageToken(s string) (pageToken, error) {
+	var t pageToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(data, &t)
+	return t, err
+}
+
+func (s *ChatService) GetHistory(ctx context.Context, req *pb.GetHistoryRequest) (*pb.GetHistoryResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.RoomId == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id is required")
+	}
+	visible, err := s.canSee(req.RoomId, me.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %v", err)
+	}
+	if !visible {
+		return nil, status.Error(codes.NotFound, "room not found")
+	}
+
+	cursor := pageToken{
+		RoomID:      req.RoomId,
+		NewestFirst: req.NewestFirst,
+		BeforeSeq:   req.BeforeSeq,
+		AfterSeq:    req.AfterSeq,
+		BeforeTime:  req.BeforeTime,
+		AfterTime:   req.AfterTime,
+	}
+	if req.PageToken != "" {
+		token, err := decodePageToken(req.PageToken)
+		if err != nil || token.RoomID != req.RoomId || token.ThreadID != "" {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+		cursor = token
+	}
+
+	messages, next, err := s.readPage(cursor, req.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %v", err)
+	}
+
+	return &pb.GetHistoryResponse{
+		Messages:      messages,
+		NextPageToken: next,
+	}, nil
+}
+
+// readPage reads the page of messages cursor points at, with their
+// reactions and reply counts, and returns it with the token for the page
+// after it.
+func (s *ChatService) readPage(cursor pageToken, limit int32) ([]*pb.Message, string, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	query := store.HistoryQuery{
+		RoomID:      cursor.RoomID,
+		ThreadID:    cursor.ThreadID,
+		Limit:       min(int(limit), maxHistoryLimit),
+		NewestFirst: cursor.NewestFirst,
+		BeforeSeq:   cursor.BeforeSeq,
+		AfterSeq:    cursor.AfterSeq,
+	}
+	if cursor.BeforeTime > 0 {
+		query.Before = time.Unix(cursor.BeforeTime, 0)
+	}
+	if cursor.AfterTime > 0 {
+		query.After = time.Unix(cursor.AfterTime, 0)
+	}
+
+	page, err := s.store.GetHistory(query)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.attachReactions(page.Messages); err != nil {
+		return nil, "", err
+	}
+	if cursor.ThreadID == "" {
+		if err := s.attachReplyCounts(cursor.RoomID, page.Messages...); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if !page.HasMore || len(page.Messages) == 0 {
+		return page.Messages, "", nil
+	}
+	last := page.Messages[len(page.Messages)-1]
+	if cursor.NewestFirst {
+		cursor.BeforeSeq = last.Seq
+	} else {
+		cursor.AfterSeq = last.Seq
+	}
+	return page.Messages, cursor.encode(), nil
+}
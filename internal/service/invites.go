@@ -0,0 +1,430 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+const (
+	defaultInviteTTL = 7 * 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+func (s *ChatService) Invite(ctx context.Context, req *pb.InviteRequest) (*pb.InviteResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room, _, err := s.store.GetRoom(req.RoomId)
+	if err == nil && !isMember(room, me.UserID) {
+		err = store.ErrNotFound
+		if visibleInList(room, me.UserID) {
+			err = validationError("Not a member of this room")
+		}
+	}
+	if err == nil && room.Direct {
+		err = validationError("Nobody can be invited to a direct conversation")
+	}
+	if err == nil && !mayInvite(room, me.UserID) {
+		err = errNotModerator
+	}
+	if err != nil {
+		return &pb.InviteResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	if req.UserId == "" && req.Username == "" {
+		invite, err := s.createInviteCode(room.Id, me.UserID, req.TtlSeconds, req.MaxUses)
+		if err != nil {
+			return &pb.InviteResponse{
+				Success: false,
+				Error:   roomError(req.RoomId, err),
+			}, nil
+		}
+		return &pb.InviteResponse{
+			Success: true,
+			Invite:  invite,
+		}, nil
+	}
+
+	invitee, err := s.findUser(req.UserId, req.Username)
+	if errors.Is(err, store.ErrNotFound) {
+		return &pb.InviteResponse{
+			Success: false,
+			Error:   "User not found",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error loading invitee: %v", err)
+		return &pb.InviteResponse{
+			Success: false,
+			Error:   "Failed to retrieve user",
+		}, nil
+	}
+
+	invited := false
+	room, err = s.updateRoom(room.Id, func(room *pb.ChatRoom) (bool, error) {
+		if !mayInvite(room, me.UserID) {
+			return false, errNotModerator
+		}
+		if isMember(room, invitee.Id) {
+			return false, validationError("Already a member of this room")
+		}
+		if restricted(room.Banned, invitee.Id, time.Now()) {
+			return false, validationError("That user is banned from this room")
+		}
+		invited = !slices.Contains(room.Invited, invitee.Id)
+		if invited {
+			room.Invited = append(room.Invited, invitee.Id)
+		}
+		return invited, nil
+	})
+	if err != nil {
+		return &pb.InviteResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	if invited {
+		s.publish(&pb.Event{
+			Type:        pb.Event_INVITED,
+			RoomId:      room.Id,
+			RecipientId: invitee.Id,
+			Payload:     &pb.Event_Room{Room: redactRoom(room, invitee.Id)},
+		})
+	}
+
+	return &pb.InviteResponse{
+		Success: true,
+	}, nil
+}
+
+// mayInvite reports whether userID may invite others to room or create
+// invite codes for it. Any member can bring people into a public room, but
+// only moderators can let them into the others without the owner's
+// approval.
+func mayInvite(room *pb.ChatRoom, userID string) bool {
+	if !isMember(room, userID) {
+		return false
+	}
+	return room.Visibility == pb.ChatRoom_PUBLIC || roleOf(room, userID) >= pb.ChatRoom_MODERATOR
+}
+
+// createInviteCode stores a new random invite code for roomID.
+func (s *ChatService) createInviteCode(roomID, userID string, ttlSeconds int64, maxUses int32) (*pb.InviteCode, error) {
+	ttl := time.Duration(ttlSeconds) * time.Second
+	switch {
+	case ttlSeconds < 0 || ttl > maxInviteTTL:
+		return nil, validationError("Invite codes can be valid for at most 30 days")
+	case maxUses < 0:
+		return nil, validationError("Usage limit must not be negative")
+	case ttl == 0:
+		ttl = defaultInviteTTL
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, err
+	}
+
+	invite := &pb.InviteCode{
+		Code:      code,
+		RoomId:    roomID,
+		CreatedBy: userID,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+		MaxUses:   maxUses,
+	}
+	if _, err := s.store.CompareAndSaveInvite(invite, 0); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// newInviteCode returns a random code that is hard to guess and safe to use
+// as a KV key.
+func newInviteCode() (string, error) {
+	b := make([]byte, 9)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (s *ChatService) AcceptInvite(ctx context.Context, req *pb.AcceptInviteRequest) (*pb.AcceptInviteResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.allow(ctx, userKey(me.UserID, "joins"), s.limits.Joins, joiningTooFast); err != nil {
+		return nil, err
+	}
+
+	roomID, counted := req.RoomId, false
+	if req.Code != "" {
+		roomID, counted, err = s.useInviteCode(req.Code, req.RoomId, me.UserID)
+		if err != nil {
+			return &pb.AcceptInviteResponse{
+				Success: false,
+				Error:   roomError(req.RoomId, err),
+			}, nil
+		}
+	}
+
+	joined := false
+	room, err := s.updateRoom(roomID, func(room *pb.ChatRoom) (bool, error) {
+		if isMember(room, me.UserID) {
+			return false, nil
+		}
+		if req.Code == "" && !slices.Contains(room.Invited, me.UserID) {
+			if !visibleInList(room, me.UserID) {
+				return false, store.ErrNotFound
+			}
+			return false, validationError("You have not been invited to this room")
+		}
+		if restricted(room.Banned, me.UserID, time.Now()) {
+			return false, errBanned
+		}
+		admit(room, me.UserID)
+		joined = true
+		return true, nil
+	})
+	if counted && (err != nil || !joined) {
+		// The code was not what let the user in after all.
+		s.releaseInviteCode(req.Code)
+	}
+	if err != nil {
+		return &pb.AcceptInviteResponse{
+			Success: false,
+			Error:   roomError(roomID, err),
+		}, nil
+	}
+
+	if joined {
+		s.publish(s.userEvent(pb.Event_USER_JOINED, room.Id, me.UserID))
+	}
+
+	return &pb.AcceptInviteResponse{
+		Success: true,
+		Room:    redactRoom(room, me.UserID),
+	}, nil
+}
+
+// useInviteCode counts one use of an invite code by userID and returns the
+// room it is for, and whether a use was counted: members of the room do not
+// use the code up. roomID, if set, must be the code's room.
+func (s *ChatService) useInviteCode(code, roomID, userID string) (string, bool, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		invite, revision, err := s.store.GetInvite(code)
+		if errors.Is(err, store.ErrNotFound) || (err == nil && roomID != "" && invite.RoomId != roomID) {
+			return "", false, validationError("Invalid invite code")
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if invite.ExpiresAt <= time.Now().Unix() {
+			return "", false, validationError("Invite code has expired")
+		}
+
+		room, _, err := s.store.GetRoom(invite.RoomId)
+		if err != nil {
+			return "", false, err
+		}
+		if isMember(room, userID) {
+			return room.Id, false, nil
+		}
+		if restricted(room.Banned, userID, time.Now()) {
+			return "", false, errBanned
+		}
+
+		if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+			return "", false, validationError("Invite code has been used up")
+		}
+		invite.Uses++
+		_, err = s.store.CompareAndSaveInvite(invite, revision)
+		if err == nil {
+			return room.Id, true, nil
+		}
+		if !errors.Is(err, store.ErrConflict) {
+			return "", false, err
+		}
+	}
+
+	return "", false, fmt.Errorf("invite %s: gave up after %d conflicting updates", code, maxUpdateAttempts)
+}
+
+// releaseInviteCode gives back a use of an invite code counted by
+// useInviteCode. Failures are logged: the worst outcome is a code that runs
+// out one use early.
+func (s *ChatService) releaseInviteCode(code string) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		invite, revision, err := s.store.GetInvite(code)
+		if err != nil {
+			log.Printf("Error releasing invite code: %v", err)
+			return
+		}
+		if invite.Uses == 0 {
+			return
+		}
+		invite.Uses--
+		_, err = s.store.CompareAndSaveInvite(invite, revision)
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, store.ErrConflict) {
+			log.Printf("Error releasing invite code: %v", err)
+			return
+		}
+	}
+	log.Printf("Error releasing invite code: gave up after %d conflicting updates", maxUpdateAttempts)
+}
+
+func (s *ChatService) RequestJoin(ctx context.Context, req *pb.RequestJoinRequest) (*pb.RequestJoinResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.allow(ctx, userKey(me.UserID, "joins"), s.limits.Joins, joiningTooFast); err != nil {
+		return nil, err
+	}
+
+	requested := false
+	room, err := s.updateRoom(req.RoomId, func(room *pb.ChatRoom) (bool, error) {
+		switch {
+		case !visibleInList(room, me.UserID):
+			return false, store.ErrNotFound
+		case isMember(room, me.UserID):
+			return false, validationError("Already a member of this room")
+		case restricted(room.Banned, me.UserID, time.Now()):
+			return false, errBanned
+		case slices.Contains(room.Invited, me.UserID):
+			return false, validationError("You are already invited; accept the invitation instead")
+		case room.Visibility == pb.ChatRoom_PUBLIC:
+			return false, validationError("This room is public; join it directly")
+		}
+
+		requested = !slices.Contains(room.JoinRequests, me.UserID)
+		if requested {
+			room.JoinRequests = append(room.JoinRequests, me.UserID)
+		}
+		return requested, nil
+	})
+	if err != nil {
+		return &pb.RequestJoinResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	if requested && room.OwnerId != "" {
+		ev := s.userEvent(pb.Event_JOIN_REQUESTED, room.Id, me.UserID)
+		ev.RecipientId = room.OwnerId
+		s.publish(ev)
+	}
+
+	return &pb.RequestJoinResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *ChatService) ApproveJoin(ctx context.Context, req *pb.ApproveJoinRequest) (*pb.ApproveJoinResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.updateRoom(req.RoomId, func(room *pb.ChatRoom) (bool, error) {
+		if room.OwnerId == "" || room.OwnerId != me.UserID {
+			return false, errNotOwner
+		}
+		if !slices.Contains(room.JoinRequests, req.UserId) {
+			return false, validationError("No pending request from this user")
+		}
+
+		if req.Approve && restricted(room.Banned, req.UserId, time.Now()) {
+			return false, errBanned
+		}
+
+		room.JoinRequests = slices.DeleteFunc(room.JoinRequests, func(id string) bool { return id == req.UserId })
+		if req.Approve {
+			admit(room, req.UserId)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return &pb.ApproveJoinResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	answer := pb.Event_JOIN_DECLINED
+	if req.Approve {
+		answer = pb.Event_JOIN_APPROVED
+		s.publish(s.userEvent(pb.Event_USER_JOINED, room.Id, req.UserId))
+	}
+	s.publish(&pb.Event{
+		Type:        answer,
+		RoomId:      room.Id,
+		RecipientId: req.UserId,
+		Payload:     &pb.Event_Room{Room: redactRoom(room, req.UserId)},
+	})
+
+	return &pb.ApproveJoinResponse{
+		Success: true,
+	}, nil
+}
+
+// admit makes userID a member of room, settling any pending invitation or
+// join request.
+func admit(room *pb.ChatRoom, userID string) {
+	isUser := func(id string) bool { return id == userID }
+	room.Invited = slices.DeleteFunc(room.Invited, isUser)
+	room.JoinRequests = slices.DeleteFunc(room.JoinRequests, isUser)
+	room.Members = append(room.Members, userID)
+}
+
+// visibleInList reports whether room is listed to userID. Private rooms and
+// direct conversations are only listed to their members and invitees.
+func visibleInList(room *pb.ChatRoom, userID string) bool {
+	if !room.Direct && room.Visibility != pb.ChatRoom_PRIVATE {
+		return true
+	}
+	return isMember(room, userID) || slices.Contains(room.Invited, userID)
+}
+
+// canSee reports whether userID may see a room's messages and events. Only
+// public rooms are open to everyone else.
+func (s *ChatService) canSee(roomID, userID string) (bool, error) {
+	room, _, err := s.store.GetRoom(roomID)
+	if errors.Is(err, store.ErrNotFound) {
+		// Some IDs are predictable, such as those of direct conversations
+		// and seeded rooms, so watching a room before it exists must not
+		// work: it might turn out to be private.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return canRead(room, userID), nil
+}
+
+// canRead reports whether userID may see the messages and events of room.
+func canRead(room *pb.ChatRoom, userID string) bool {
+	if room.Direct || room.Visibility != pb.ChatRoom_PUBLIC {
+		return isMember(room, userID)
+	}
+	return true
+}
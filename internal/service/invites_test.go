@@ -0,0 +1,314 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// inbox records the types of events addressed to userID.
+func inbox(t *testing.T, service *ChatService, userID string) *[]pb.Event_Type {
+	var events []pb.Event_Type
+	cancel, err := service.store.SubscribeEvents(store.EventFilter{UserID: userID}, func(ev *pb.Event) {
+		events = append(events, ev.Type)
+	})
+	require.NoError(t, err)
+	t.Cleanup(cancel)
+	return &events
+}
+
+func listed(t *testing.T, service *ChatService, userID, roomID string) bool {
+	resp, err := service.ListRooms(asUser(userID), &pb.ListRoomsRequest{})
+	require.NoError(t, err)
+	for _, room := range resp.Rooms {
+		if room.Id == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPrivateRoomInvitations(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+	carol := register(t, service, "carol")
+	bobsInbox := inbox(t, service, bob.Id)
+
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{
+		Name:       "Secret",
+		Visibility: pb.ChatRoom_PRIVATE,
+	})
+	require.NoError(t, err)
+	require.True(t, createResp.Success, createResp.Error)
+	room := createResp.Room
+
+	assert.True(t, listed(t, service, alice.Id, room.Id))
+	assert.False(t, listed(t, service, bob.Id, room.Id), "Private rooms are hidden from strangers")
+
+	joinResp, err := service.JoinRoom(asUser(bob.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.False(t, joinResp.Success)
+	assert.Equal(t, "Room not found", joinResp.Error)
+
+	_, err = service.GetHistory(asUser(bob.Id), &pb.GetHistoryRequest{RoomId: room.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = service.GetHistory(asUser(bob.Id), &pb.GetHistoryRequest{RoomId: "not-created-yet"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Rooms that do not exist yet might become private")
+
+	inviteResp, err := service.Invite(asUser(carol.Id), &pb.InviteRequest{RoomId: room.Id, Username: "bob"})
+	require.NoError(t, err)
+	assert.False(t, inviteResp.Success, "Only members may invite")
+
+	inviteResp, err = service.Invite(asUser(alice.Id), &pb.InviteRequest{RoomId: room.Id, Username: "bob"})
+	require.NoError(t, err)
+	require.True(t, inviteResp.Success, inviteResp.Error)
+	assert.Equal(t, []pb.Event_Type{pb.Event_INVITED}, *bobsInbox)
+
+	assert.True(t, listed(t, service, bob.Id, room.Id), "Invitees should see the room")
+
+	acceptResp, err := service.AcceptInvite(asUser(carol.Id), &pb.AcceptInviteRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.False(t, acceptResp.Success, "Only invitees may accept")
+
+	acceptResp, err = service.AcceptInvite(asUser(bob.Id), &pb.AcceptInviteRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.True(t, acceptResp.Success, acceptResp.Error)
+	assert.Contains(t, acceptResp.Room.Members, bob.Id)
+	assert.Empty(t, acceptResp.Room.Invited)
+
+	inviteResp, err = service.Invite(asUser(bob.Id), &pb.InviteRequest{RoomId: room.Id, Username: "carol"})
+	require.NoError(t, err)
+	assert.False(t, inviteResp.Success, "Only moderators may let others into private rooms")
+	assert.Equal(t, "Only moderators can do that", inviteResp.Error)
+}
+
+func TestLosingAccessEndsSubscriptions(t *testing.T) {
+	service := setupTestService(t)
+	client := startTestServer(t, service)
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+	carol := register(t, service, "carol")
+
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Closing"})
+	require.NoError(t, err)
+	require.True(t, createResp.Success, createResp.Error)
+	room := createResp.Room
+	joinResp, err := service.JoinRoom(asUser(bob.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.True(t, joinResp.Success, joinResp.Error)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	subscribe := func(user *pb.User) pb.ChatService_SubscribeClient {
+		token, err := service.tokens.Issue(auth.Identity{UserID: user.Id, Username: user.Username})
+		require.NoError(t, err)
+		stream, err := client.Subscribe(auth.WithToken(ctx, token), &pb.SubscribeRequest{RoomIds: []string{room.Id}})
+		require.NoError(t, err)
+		_, err = stream.Header()
+		require.NoError(t, err)
+		return stream
+	}
+	bobsStream, carolsStream := subscribe(bob), subscribe(carol)
+
+	private := pb.ChatRoom_PRIVATE
+	updateResp, err := service.UpdateRoom(asUser(alice.Id), &pb.UpdateRoomRequest{RoomId: room.Id, Visibility: &private})
+	require.NoError(t, err)
+	require.True(t, updateResp.Success, updateResp.Error)
+
+	_, err = carolsStream.Recv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "Non-members should stop hearing from rooms that became private")
+	ev, err := bobsStream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, pb.Event_ROOM_UPDATED, ev.Type)
+
+	leaveResp, err := service.LeaveRoom(asUser(bob.Id), &pb.LeaveRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.True(t, leaveResp.Success, leaveResp.Error)
+	_, err = bobsStream.Recv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "Members who left a private room should stop hearing from it")
+}
+
+func TestInviteCodes(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+	carol := register(t, service, "carol")
+
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{
+		Name:       "Secret",
+		Visibility: pb.ChatRoom_PRIVATE,
+	})
+	require.NoError(t, err)
+	room := createResp.Room
+
+	inviteResp, err := service.Invite(asUser(alice.Id), &pb.InviteRequest{RoomId: room.Id, TtlSeconds: -1})
+	require.NoError(t, err)
+	assert.False(t, inviteResp.Success, "Negative lifetimes should be rejected")
+
+	inviteResp, err = service.Invite(asUser(alice.Id), &pb.InviteRequest{RoomId: room.Id, MaxUses: 1})
+	require.NoError(t, err)
+	require.True(t, inviteResp.Success, inviteResp.Error)
+	code := inviteResp.Invite.Code
+	assert.NotEmpty(t, code)
+
+	acceptResp, err := service.AcceptInvite(asUser(bob.Id), &pb.AcceptInviteRequest{Code: "nonsense"})
+	require.NoError(t, err)
+	assert.False(t, acceptResp.Success)
+
+	acceptResp, err = service.AcceptInvite(asUser(bob.Id), &pb.AcceptInviteRequest{Code: code})
+	require.NoError(t, err)
+	require.True(t, acceptResp.Success, acceptResp.Error)
+	assert.Equal(t, room.Id, acceptResp.Room.Id)
+
+	acceptResp, err = service.AcceptInvite(asUser(bob.Id), &pb.AcceptInviteRequest{Code: code})
+	require.NoError(t, err)
+	assert.True(t, acceptResp.Success, "Members should not use codes up")
+
+	inviteResp, err = service.Invite(asUser(bob.Id), &pb.InviteRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.False(t, inviteResp.Success, "Only moderators may create codes for private rooms")
+
+	acceptResp, err = service.AcceptInvite(asUser(carol.Id), &pb.AcceptInviteRequest{Code: code})
+	require.NoError(t, err)
+	assert.False(t, acceptResp.Success)
+	assert.Equal(t, "Invite code has been used up", acceptResp.Error)
+
+	invite, revision, err := service.store.GetInvite(code)
+	require.NoError(t, err)
+	invite.MaxUses, invite.ExpiresAt = 0, 1
+	_, err = service.store.CompareAndSaveInvite(invite, revision)
+	require.NoError(t, err)
+
+	acceptResp, err = service.AcceptInvite(asUser(carol.Id), &pb.AcceptInviteRequest{Code: code})
+	require.NoError(t, err)
+	assert.Equal(t, "Invite code has expired", acceptResp.Error)
+}
+
+// failingRooms is a store that cannot save rooms.
+type failingRooms struct {
+	store.Store
+}
+
+func (failingRooms) CompareAndSaveRoom(*pb.ChatRoom, uint64) (uint64, error) {
+	return 0, errors.New("store unavailable")
+}
+
+func TestInviteCodeIsNotUsedUpByFailedJoins(t *testing.T) {
+	st := store.NewMemoryStore()
+	service := newTestService(t, failingRooms{st})
+	room := &pb.ChatRoom{Id: "hidden", Name: "Hidden", Visibility: pb.ChatRoom_PRIVATE, OwnerId: "alice", Members: []string{"alice"}}
+	require.NoError(t, st.SaveRoom(room))
+	_, err := st.CompareAndSaveInvite(&pb.InviteCode{Code: "once", RoomId: room.Id, ExpiresAt: time.Now().Add(time.Hour).Unix(), MaxUses: 1}, 0)
+	require.NoError(t, err)
+
+	acceptResp, err := service.AcceptInvite(asUser("bob"), &pb.AcceptInviteRequest{Code: "once"})
+	require.NoError(t, err)
+	assert.False(t, acceptResp.Success)
+
+	invite, _, err := st.GetInvite("once")
+	require.NoError(t, err)
+	assert.Zero(t, invite.Uses, "A join that failed should give the use back")
+}
+
+func TestRequestToJoin(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+	carol := register(t, service, "carol")
+	alicesInbox := inbox(t, service, alice.Id)
+	bobsInbox := inbox(t, service, bob.Id)
+	carolsInbox := inbox(t, service, carol.Id)
+
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Club"})
+	require.NoError(t, err)
+	room := createResp.Room
+
+	requestResp, err := service.RequestJoin(asUser(bob.Id), &pb.RequestJoinRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.False(t, requestResp.Success, "Public rooms are joined directly")
+
+	visibility := pb.ChatRoom_REQUEST
+	updateResp, err := service.UpdateRoom(asUser(alice.Id), &pb.UpdateRoomRequest{RoomId: room.Id, Visibility: &visibility})
+	require.NoError(t, err)
+	require.True(t, updateResp.Success, updateResp.Error)
+	assert.True(t, listed(t, service, bob.Id, room.Id), "Request-only rooms stay listed")
+
+	joinResp, err := service.JoinRoom(asUser(bob.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.False(t, joinResp.Success)
+
+	for _, user := range []*pb.User{bob, carol} {
+		requestResp, err = service.RequestJoin(asUser(user.Id), &pb.RequestJoinRequest{RoomId: room.Id})
+		require.NoError(t, err)
+		require.True(t, requestResp.Success, requestResp.Error)
+	}
+	assert.Equal(t, []pb.Event_Type{pb.Event_JOIN_REQUESTED, pb.Event_JOIN_REQUESTED}, *alicesInbox)
+
+	approveResp, err := service.ApproveJoin(asUser(carol.Id), &pb.ApproveJoinRequest{RoomId: room.Id, UserId: bob.Id, Approve: true})
+	require.NoError(t, err)
+	assert.False(t, approveResp.Success, "Only the owner may approve")
+
+	approveResp, err = service.ApproveJoin(asUser(alice.Id), &pb.ApproveJoinRequest{RoomId: room.Id, UserId: bob.Id, Approve: true})
+	require.NoError(t, err)
+	require.True(t, approveResp.Success, approveResp.Error)
+	approveResp, err = service.ApproveJoin(asUser(alice.Id), &pb.ApproveJoinRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	require.True(t, approveResp.Success, approveResp.Error)
+
+	stored, _, err := service.store.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.Contains(t, stored.Members, bob.Id)
+	assert.NotContains(t, stored.Members, carol.Id)
+	assert.Empty(t, stored.JoinRequests)
+	assert.Equal(t, []pb.Event_Type{pb.Event_JOIN_APPROVED}, *bobsInbox)
+	assert.Equal(t, []pb.Event_Type{pb.Event_JOIN_DECLINED}, *carolsInbox)
+
+	approveResp, err = service.ApproveJoin(asUser(alice.Id), &pb.ApproveJoinRequest{RoomId: room.Id, UserId: carol.Id, Approve: true})
+	require.NoError(t, err)
+	assert.False(t, approveResp.Success, "Answered requests cannot be approved again")
+}
+
+func TestBannedUsersCannotBeApproved(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Club", Visibility: pb.ChatRoom_REQUEST})
+	require.NoError(t, err)
+	room := createResp.Room
+
+	banResp, err := service.Ban(asUser(alice.Id), &pb.BanRequest{RoomId: room.Id, UserId: bob.Id})
+	require.NoError(t, err)
+	require.True(t, banResp.Success, banResp.Error)
+
+	// Bans clear pending requests, but one may have been stored alongside a
+	// ban by an older release.
+	_, err = service.updateRoom(room.Id, func(room *pb.ChatRoom) (bool, error) {
+		room.JoinRequests = append(room.JoinRequests, bob.Id)
+		return true, nil
+	})
+	require.NoError(t, err)
+
+	approveResp, err := service.ApproveJoin(asUser(alice.Id), &pb.ApproveJoinRequest{RoomId: room.Id, UserId: bob.Id, Approve: true})
+	require.NoError(t, err)
+	assert.Equal(t, errBanned.Error(), approveResp.Error, "Approving a request should not lift a ban")
+
+	stored, _, err := service.store.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.NotContains(t, stored.Members, bob.Id)
+
+	approveResp, err = service.ApproveJoin(asUser(alice.Id), &pb.ApproveJoinRequest{RoomId: room.Id, UserId: bob.Id})
+	require.NoError(t, err)
+	assert.True(t, approveResp.Success, "Requests from banned users can still be declined: %s", approveResp.Error)
+}
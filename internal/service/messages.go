@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"github.com/google/uuid"
+)
+
+// MaxMessageLength is the longest message content accepted, in characters.
+const MaxMessageLength = 2000
+
+func (s *ChatService) SendMessage(ctx context.Context, req *pb.SendMessageRequest) (*pb.SendMessageResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := validateContent(req.Content); problem != "" {
+		return &pb.SendMessageResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	room, _, err := s.store.GetRoom(req.RoomId)
+	if errors.Is(err, store.ErrNotFound) {
+		return &pb.SendMessageResponse{
+			Success: false,
+			Error:   "Room not found",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", req.RoomId, err)
+		return &pb.SendMessageResponse{
+			Success: false,
+			Error:   "Failed to retrieve room",
+		}, nil
+	}
+
+	if !isMember(room, me.UserID) {
+		return &pb.SendMessageResponse{
+			Success: false,
+			Error:   "Not a member of this room",
+		}, nil
+	}
+	if restricted(room.Muted, me.UserID, time.Now()) {
+		return &pb.SendMessageResponse{
+			Success: false,
+			Error:   "You are muted in this room",
+		}, nil
+	}
+	// The user's own limit comes first, so one user flooding a room does
+	// not use up everyone else's share of it.
+	if err := s.allow(ctx, userKey(me.UserID, "messages"), s.limits.UserMessages, sendingTooFast); err != nil {
+		return nil, err
+	}
+	if err := s.allow(ctx, roomKey(room.Id, "messages"), s.limits.RoomMessages, "This room is getting too many messages"); err != nil {
+		return nil, err
+	}
+
+	var parent *pb.Message
+	if req.ReplyToSeq != 0 {
+		parent, err = s.store.GetMessage(room.Id, req.ReplyToSeq)
+		if errors.Is(err, store.ErrNotFound) || (err == nil && parent.Deleted) {
+			return &pb.SendMessageResponse{
+				Success: false,
+				Error:   "Message to reply to not found",
+			}, nil
+		}
+		if err != nil {
+			log.Printf("Error loading message %d in %s: %v", req.ReplyToSeq, room.Id, err)
+			return &pb.SendMessageResponse{
+				Success: false,
+				Error:   "Failed to retrieve message",
+			}, nil
+		}
+	}
+
+	if name, args, ok := parseCommand(req.Content); ok {
+		return s.runCommand(&commandCall{
+			me:     me,
+			room:   room,
+			name:   name,
+			args:   args,
+			parent: parent,
+		}), nil
+	}
+
+	msg, problem := s.postMessage(room, me.UserID, unescapeCommand(req.Content), parent, false)
+	if problem != "" {
+		return &pb.SendMessageResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	return &pb.SendMessageResponse{
+		Success: true,
+		Message: msg,
+	}, nil
+}
+
+// postMessage runs a message from userID through room's filters, then
+// stores and announces it. If parent is set, the message is a reply in
+// parent's thread; action marks messages sent with /me. The caller has
+// checked that the user may post and the content is valid. On failure it
+// describes the problem instead.
+func (s *ChatService) postMessage(room *pb.ChatRoom, userID, content string, parent *pb.Message, action bool) (*pb.Message, string) {
+	user, _, err := s.store.GetUser(userID)
+	if err != nil {
+		log.Printf("Error loading user %s: %v", userID, err)
+		return nil, "Unknown user"
+	}
+
+	screened := s.screen(room, content)
+	if screened.Rejected {
+		return nil, "Message rejected: " + screened.Reason
+	}
+
+	msg := &pb.Message{
+		Id:        uuid.New().String(),
+		RoomId:    room.Id,
+		UserId:    user.Id,
+		Username:  user.Username,
+		Content:   screened.Content,
+		Timestamp: time.Now().Unix(),
+		Action:    action,
+	}
+	if parent != nil {
+		msg.ReplyTo = parent.Id
+		msg.ThreadId, msg.ThreadSeq = parent.ThreadId, parent.ThreadSeq
+		if msg.ThreadId == "" {
+			msg.ThreadId, msg.ThreadSeq = parent.Id, parent.Seq
+		}
+	}
+	if err := s.store.SaveMessage(msg); err != nil {
+		log.Printf("Error saving message: %v", err)
+		return nil, "Failed to save message"
+	}
+
+	s.publishMessage(pb.Event_MESSAGE_SENT, room, msg, user.Id)
+	s.stopTyping(room.Id, user)
+	s.notifyMentions(room, msg)
+	if len(screened.Flags) > 0 {
+		s.reportFlagged(room, msg, screened.Flags)
+	}
+
+	// Users have obviously read up to their own message. A reply may be to
+	// an old thread, which says nothing about the rest of the room.
+	if msg.ThreadId == "" {
+		if _, err := s.advanceReadMarker(room.Id, user.Id, msg.Seq); err != nil {
+			log.Printf("Error saving read marker of %s in %s: %v", user.Id, room.Id, err)
+		}
+	}
+
+	return msg, ""
+}
+
+// publishMessage announces msg, or a change to it, to the room. In direct
+// conversations the members other than userID may not be watching, so they
+// also get a copy in their inbox.
+func (s *ChatService) publishMessage(eventType pb.Event_Type, room *pb.ChatRoom, msg *pb.Message, userID string) {
+	s.publish(&pb.Event{
+		Type:    eventType,
+		RoomId:  msg.RoomId,
+		Payload: &pb.Event_Message{Message: msg},
+	})
+	if !room.Direct {
+		return
+	}
+	for _, member := range room.Members {
+		if member == userID {
+			continue
+		}
+		s.publish(&pb.Event{
+			Type:        eventType,
+			RoomId:      msg.RoomId,
+			RecipientId: member,
+			Payload:     &pb.Event_Message{Message: msg},
+		})
+	}
+}
+
+// validateContent describes what is wrong with a message body, or returns ""
+// if it can be sent.
+func validateContent(content string) string {
+	if !utf8.ValidString(content) {
+		return "Message is not valid UTF-8"
+	}
+	if strings.TrimSpace(content) == "" {
+		return "Message is empty"
+	}
+	if utf8.RuneCountInString(content) > MaxMessageLength {
+		return "Message is too long"
+	}
+	return ""
+}
+
+func isMember(room *pb.ChatRoom, userID string) bool {
+	for _, member := range room.Members {
+		if member == userID {
+			return true
+		}
+	}
+	return false
+}
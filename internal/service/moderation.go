@@ -0,0 +1,290 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"time"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+var (
+	// errNotModerator is returned from moderation attempted by plain
+	// members.
+	errNotModerator = errors.New("not a moderator")
+	errBanned       = validationError("You are banned from this room")
+)
+
+func (s *ChatService) SetRole(ctx context.Context, req *pb.SetRoleRequest) (*pb.SetRoleResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.moderate(me.UserID, req.RoomId, req.UserId, pb.Event_ROLE_CHANGED, 0, func(room *pb.ChatRoom) (bool, error) {
+		if roleOf(room, me.UserID) != pb.ChatRoom_OWNER {
+			return false, errNotOwner
+		}
+		if _, ok := pb.ChatRoom_Role_name[int32(req.Role)]; !ok {
+			return false, validationError("Unknown role")
+		}
+		if !isMember(room, req.UserId) {
+			return false, validationError("Not a member of this room")
+		}
+		if roleOf(room, req.UserId) == req.Role {
+			return false, nil
+		}
+
+		room.Moderators = slices.DeleteFunc(room.Moderators, func(id string) bool { return id == req.UserId })
+		switch req.Role {
+		case pb.ChatRoom_MODERATOR:
+			room.Moderators = append(room.Moderators, req.UserId)
+		case pb.ChatRoom_OWNER:
+			room.Moderators = append(room.Moderators, room.OwnerId)
+			room.OwnerId = req.UserId
+		}
+		return true, nil
+	})
+	if err != nil {
+		return &pb.SetRoleResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	return &pb.SetRoleResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *ChatService) Kick(ctx context.Context, req *pb.KickRequest) (*pb.KickResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.moderate(me.UserID, req.RoomId, req.UserId, pb.Event_USER_KICKED, 0, func(room *pb.ChatRoom) (bool, error) {
+		if !isMember(room, req.UserId) {
+			return false, validationError("Not a member of this room")
+		}
+		removeMember(room, req.UserId)
+		return true, nil
+	})
+	if err != nil {
+		return &pb.KickResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	return &pb.KickResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *ChatService) Ban(ctx context.Context, req *pb.BanRequest) (*pb.BanResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	until, err := restrictionEnd(req.DurationSeconds)
+	if err == nil {
+		_, err = s.moderate(me.UserID, req.RoomId, req.UserId, pb.Event_USER_BANNED, until, func(room *pb.ChatRoom) (bool, error) {
+			removeMember(room, req.UserId)
+			if room.Banned == nil {
+				room.Banned = make(map[string]int64)
+			}
+			room.Banned[req.UserId] = until
+			return true, nil
+		})
+	}
+	if err != nil {
+		return &pb.BanResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	return &pb.BanResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *ChatService) Unban(ctx context.Context, req *pb.UnbanRequest) (*pb.UnbanResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.moderate(me.UserID, req.RoomId, req.UserId, pb.Event_USER_UNBANNED, 0, func(room *pb.ChatRoom) (bool, error) {
+		if !restricted(room.Banned, req.UserId, time.Now()) {
+			return false, validationError("Not banned from this room")
+		}
+		delete(room.Banned, req.UserId)
+		return true, nil
+	})
+	if err != nil {
+		return &pb.UnbanResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	return &pb.UnbanResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *ChatService) Mute(ctx context.Context, req *pb.MuteRequest) (*pb.MuteResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	until, err := restrictionEnd(req.DurationSeconds)
+	if err == nil {
+		_, err = s.moderate(me.UserID, req.RoomId, req.UserId, pb.Event_USER_MUTED, until, func(room *pb.ChatRoom) (bool, error) {
+			if room.Muted == nil {
+				room.Muted = make(map[string]int64)
+			}
+			room.Muted[req.UserId] = until
+			return true, nil
+		})
+	}
+	if err != nil {
+		return &pb.MuteResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	return &pb.MuteResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *ChatService) Unmute(ctx context.Context, req *pb.UnmuteRequest) (*pb.UnmuteResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.moderate(me.UserID, req.RoomId, req.UserId, pb.Event_USER_UNMUTED, 0, func(room *pb.ChatRoom) (bool, error) {
+		if !restricted(room.Muted, req.UserId, time.Now()) {
+			return false, validationError("Not muted in this room")
+		}
+		delete(room.Muted, req.UserId)
+		return true, nil
+	})
+	if err != nil {
+		return &pb.UnmuteResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	return &pb.UnmuteResponse{
+		Success: true,
+	}, nil
+}
+
+// moderate applies act to a room on behalf of moderatorID, who must outrank
+// targetID, and announces the action if act changed the room.
+func (s *ChatService) moderate(moderatorID, roomID, targetID string, eventType pb.Event_Type, until int64, act func(room *pb.ChatRoom) (bool, error)) (*pb.ChatRoom, error) {
+	changed := false
+	room, err := s.updateRoom(roomID, func(room *pb.ChatRoom) (bool, error) {
+		role := roleOf(room, moderatorID)
+		switch {
+		case room.Direct || role < pb.ChatRoom_MODERATOR:
+			return false, errNotModerator
+		case targetID == moderatorID:
+			return false, validationError("You cannot moderate yourself")
+		case roleOf(room, targetID) >= role:
+			return false, validationError("You cannot moderate someone with the same or a higher role")
+		}
+
+		var err error
+		changed, err = act(room)
+		return changed, err
+	})
+	if err != nil || !changed {
+		return room, err
+	}
+
+	action := &pb.ModerationAction{
+		UserId:      targetID,
+		ModeratorId: moderatorID,
+		Until:       until,
+		Role:        roleOf(room, targetID),
+	}
+	if user, _, err := s.store.GetUser(targetID); err == nil {
+		action.Username = user.Username
+	}
+	if user, _, err := s.store.GetUser(moderatorID); err == nil {
+		action.ModeratorUsername = user.Username
+	}
+
+	// The affected user may not be watching the room, so they get a copy.
+	for _, recipient := range []string{"", targetID} {
+		s.publish(&pb.Event{
+			Type:        eventType,
+			RoomId:      room.Id,
+			RecipientId: recipient,
+			Payload:     &pb.Event_Moderation{Moderation: action},
+		})
+	}
+	return room, nil
+}
+
+// roleOf returns userID's role in room.
+func roleOf(room *pb.ChatRoom, userID string) pb.ChatRoom_Role {
+	switch {
+	case room.OwnerId != "" && room.OwnerId == userID:
+		return pb.ChatRoom_OWNER
+	case slices.Contains(room.Moderators, userID):
+		return pb.ChatRoom_MODERATOR
+	}
+	return pb.ChatRoom_MEMBER
+}
+
+// removeMember takes userID out of room along with any role, invitation or
+// join request they had there.
+func removeMember(room *pb.ChatRoom, userID string) {
+	isUser := func(id string) bool { return id == userID }
+	room.Members = slices.DeleteFunc(room.Members, isUser)
+	room.Moderators = slices.DeleteFunc(room.Moderators, isUser)
+	room.Invited = slices.DeleteFunc(room.Invited, isUser)
+	room.JoinRequests = slices.DeleteFunc(room.JoinRequests, isUser)
+}
+
+// restrictionEnd turns the duration of a ban or mute into the unix time it
+// ends, where 0 means never. Durations that would overflow never end either.
+func restrictionEnd(durationSeconds int64) (int64, error) {
+	if durationSeconds < 0 {
+		return 0, validationError("Duration must not be negative")
+	}
+	now := time.Now().Unix()
+	if durationSeconds == 0 || durationSeconds > math.MaxInt64-now {
+		return 0, nil
+	}
+	return now + durationSeconds, nil
+}
+
+// restricted reports whether userID is in a ban or mute list that has not
+// run out yet at now.
+func restricted(until map[string]int64, userID string, now time.Time) bool {
+	end, ok := until[userID]
+	return ok && (end == 0 || end > now.Unix())
+}
+
+// removedFrom reports whether ev tells that userID was taken out of the
+// room it belongs to.
+func removedFrom(ev *pb.Event, userID string) bool {
+	if ev.Type != pb.Event_USER_KICKED && ev.Type != pb.Event_USER_BANNED {
+		return false
+	}
+	return ev.RecipientId == "" && ev.GetModeration().GetUserId() == userID
+}
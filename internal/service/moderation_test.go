@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// moderatedRoom creates a room owned by alice that bob moderates and carol
+// and dave are members of.
+func moderatedRoom(t *testing.T, service *ChatService) (room *pb.ChatRoom, alice, bob, carol, dave *pb.User) {
+	alice = register(t, service, "alice")
+	bob = register(t, service, "bob")
+	carol = register(t, service, "carol")
+	dave = register(t, service, "dave")
+
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Moderated"})
+	require.NoError(t, err)
+	room = createResp.Room
+	for _, user := range []*pb.User{bob, carol, dave} {
+		joinResp, err := service.JoinRoom(asUser(user.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+		require.NoError(t, err)
+		require.True(t, joinResp.Success, joinResp.Error)
+	}
+
+	roleResp, err := service.SetRole(asUser(alice.Id), &pb.SetRoleRequest{RoomId: room.Id, UserId: bob.Id, Role: pb.ChatRoom_MODERATOR})
+	require.NoError(t, err)
+	require.True(t, roleResp.Success, roleResp.Error)
+	return room, alice, bob, carol, dave
+}
+
+func TestRoles(t *testing.T) {
+	service := setupTestService(t)
+	room, alice, bob, carol, _ := moderatedRoom(t, service)
+
+	roleResp, err := service.SetRole(asUser(bob.Id), &pb.SetRoleRequest{RoomId: room.Id, UserId: carol.Id, Role: pb.ChatRoom_MODERATOR})
+	require.NoError(t, err)
+	assert.False(t, roleResp.Success, "Only the owner may change roles")
+
+	kickResp, err := service.Kick(asUser(bob.Id), &pb.KickRequest{RoomId: room.Id, UserId: alice.Id})
+	require.NoError(t, err)
+	assert.False(t, kickResp.Success, "Moderators cannot act on the owner")
+
+	kickResp, err = service.Kick(asUser(carol.Id), &pb.KickRequest{RoomId: room.Id, UserId: bob.Id})
+	require.NoError(t, err)
+	assert.False(t, kickResp.Success, "Members cannot moderate")
+	assert.Equal(t, "Only moderators can do that", kickResp.Error)
+
+	roleResp, err = service.SetRole(asUser(alice.Id), &pb.SetRoleRequest{RoomId: room.Id, UserId: carol.Id, Role: pb.ChatRoom_OWNER})
+	require.NoError(t, err)
+	require.True(t, roleResp.Success, roleResp.Error)
+
+	stored, _, err := service.store.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.Equal(t, pb.ChatRoom_OWNER, roleOf(stored, carol.Id))
+	assert.Equal(t, pb.ChatRoom_MODERATOR, roleOf(stored, alice.Id), "The previous owner should become a moderator")
+	assert.Equal(t, pb.ChatRoom_MODERATOR, roleOf(stored, bob.Id))
+}
+
+func TestKickAndBan(t *testing.T) {
+	service := setupTestService(t)
+	client := startTestServer(t, service)
+	room, _, bob, carol, dave := moderatedRoom(t, service)
+	carolsInbox := inbox(t, service, carol.Id)
+
+	token, err := service.tokens.Issue(auth.Identity{UserID: carol.Id, Username: carol.Username})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Subscribe(auth.WithToken(ctx, token), &pb.SubscribeRequest{RoomIds: []string{room.Id}})
+	require.NoError(t, err)
+	_, err = stream.Header()
+	require.NoError(t, err)
+
+	kickResp, err := service.Kick(asUser(bob.Id), &pb.KickRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	require.True(t, kickResp.Success, kickResp.Error)
+	assert.Equal(t, []pb.Event_Type{pb.Event_USER_KICKED}, *carolsInbox)
+
+	ev, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, pb.Event_USER_KICKED, ev.Type)
+	assert.Equal(t, "carol", ev.GetModeration().Username)
+	assert.Equal(t, "bob", ev.GetModeration().ModeratorUsername)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "The stream should end for removed users")
+
+	joinResp, err := service.JoinRoom(asUser(carol.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.True(t, joinResp.Success, "Kicked users can come back")
+
+	banResp, err := service.Ban(asUser(bob.Id), &pb.BanRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	require.True(t, banResp.Success, banResp.Error)
+
+	joinResp, err = service.JoinRoom(asUser(carol.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.False(t, joinResp.Success)
+	assert.Equal(t, "You are banned from this room", joinResp.Error)
+
+	unbanResp, err := service.Unban(asUser(bob.Id), &pb.UnbanRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	require.True(t, unbanResp.Success, unbanResp.Error)
+	joinResp, err = service.JoinRoom(asUser(carol.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.True(t, joinResp.Success, joinResp.Error)
+
+	// A ban that has run out no longer applies.
+	banResp, err = service.Ban(asUser(bob.Id), &pb.BanRequest{RoomId: room.Id, UserId: dave.Id, DurationSeconds: 60})
+	require.NoError(t, err)
+	require.True(t, banResp.Success, banResp.Error)
+	_, err = service.updateRoom(room.Id, func(room *pb.ChatRoom) (bool, error) {
+		room.Banned[dave.Id] = time.Now().Add(-time.Second).Unix()
+		return true, nil
+	})
+	require.NoError(t, err)
+	joinResp, err = service.JoinRoom(asUser(dave.Id), &pb.JoinRoomRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	assert.True(t, joinResp.Success, joinResp.Error)
+}
+
+func TestMute(t *testing.T) {
+	service := setupTestService(t)
+	room, _, bob, carol, _ := moderatedRoom(t, service)
+
+	send := func() *pb.SendMessageResponse {
+		resp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "hi"})
+		require.NoError(t, err)
+		return resp
+	}
+
+	muteResp, err := service.Mute(asUser(bob.Id), &pb.MuteRequest{RoomId: room.Id, UserId: carol.Id, DurationSeconds: -5})
+	require.NoError(t, err)
+	assert.False(t, muteResp.Success, "Negative durations should be rejected")
+
+	muteResp, err = service.Mute(asUser(bob.Id), &pb.MuteRequest{RoomId: room.Id, UserId: carol.Id, DurationSeconds: math.MaxInt64})
+	require.NoError(t, err)
+	require.True(t, muteResp.Success, muteResp.Error)
+	assert.False(t, send().Success, "Durations too long to add up should mute for good")
+	saved, _, err := service.store.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.Zero(t, saved.Muted[carol.Id])
+	unmuteResp, err := service.Unmute(asUser(bob.Id), &pb.UnmuteRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	require.True(t, unmuteResp.Success, unmuteResp.Error)
+
+	muteResp, err = service.Mute(asUser(bob.Id), &pb.MuteRequest{RoomId: room.Id, UserId: carol.Id, DurationSeconds: 600})
+	require.NoError(t, err)
+	require.True(t, muteResp.Success, muteResp.Error)
+
+	resp := send()
+	assert.False(t, resp.Success)
+	assert.Equal(t, "You are muted in this room", resp.Error)
+
+	unmuteResp, err = service.Unmute(asUser(bob.Id), &pb.UnmuteRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	require.True(t, unmuteResp.Success, unmuteResp.Error)
+	assert.True(t, send().Success)
+
+	unmuteResp, err = service.Unmute(asUser(bob.Id), &pb.UnmuteRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	assert.False(t, unmuteResp.Success, "Users who are not muted cannot be unmuted")
+}
+
+func TestModerationStateIsHiddenFromMembers(t *testing.T) {
+	service := setupTestService(t)
+	room, alice, bob, carol, dave := moderatedRoom(t, service)
+
+	var updates []*pb.ChatRoom
+	cancel, err := service.store.SubscribeEvents(store.EventFilter{Global: true}, func(ev *pb.Event) {
+		if ev.Type == pb.Event_ROOM_UPDATED {
+			updates = append(updates, ev.GetRoom())
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(cancel)
+
+	banResp, err := service.Ban(asUser(bob.Id), &pb.BanRequest{RoomId: room.Id, UserId: dave.Id})
+	require.NoError(t, err)
+	require.True(t, banResp.Success, banResp.Error)
+	muteResp, err := service.Mute(asUser(bob.Id), &pb.MuteRequest{RoomId: room.Id, UserId: carol.Id})
+	require.NoError(t, err)
+	require.True(t, muteResp.Success, muteResp.Error)
+	setResp, err := service.SetRoomFilters(asUser(alice.Id), &pb.SetRoomFiltersRequest{RoomId: room.Id, Filters: []*pb.ContentFilter{
+		{Rule: &pb.ContentFilter_Blocklist_{Blocklist: &pb.ContentFilter_Blocklist{Words: []string{"spam"}}}},
+	}})
+	require.NoError(t, err)
+	require.True(t, setResp.Success, setResp.Error)
+
+	listedRoom := func(userID string) *pb.ChatRoom {
+		resp, err := service.ListRooms(asUser(userID), &pb.ListRoomsRequest{})
+		require.NoError(t, err)
+		for _, r := range resp.Rooms {
+			if r.Id == room.Id {
+				return r
+			}
+		}
+		require.FailNow(t, "Room not listed")
+		return nil
+	}
+
+	seen := listedRoom(bob.Id)
+	assert.Contains(t, seen.Banned, dave.Id, "Moderators should see bans")
+	assert.Contains(t, seen.Muted, carol.Id)
+	assert.Len(t, seen.Filters, 1)
+
+	seen = listedRoom(carol.Id)
+	assert.Empty(t, seen.Banned, "Members should not see who else is banned")
+	assert.Equal(t, map[string]int64{carol.Id: 0}, seen.Muted, "Members should see their own mute")
+	assert.Empty(t, seen.Filters, "Members should not see the filters they could work around")
+
+	require.Len(t, updates, 1)
+	assert.Empty(t, updates[0].Filters, "Broadcast updates should not carry filters")
+
+	stored, _, err := service.store.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.Len(t, stored.Filters, 1, "Redaction should not touch the stored room")
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+const (
+	defaultNotificationLimit = 50
+	maxNotificationLimit     = 200
+	// maxMentions is how many users one message can notify, so a message
+	// cannot be used to flood everyone's inbox.
+	maxMentions = 10
+	// excerptLength is how much of a message a notification quotes, in
+	// characters.
+	excerptLength = 100
+)
+
+// mentionPattern matches @username where the @ does not follow a character
+// that could be part of a username, so e-mail addresses are not mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.-])@([A-Za-z0-9_.-]{3,32})`)
+
+func (s *ChatService) ListNotifications(ctx context.Context, req *pb.ListNotificationsRequest) (*pb.ListNotificationsResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultNotificationLimit
+	}
+
+	notices, hasMore, err := s.store.GetNotifications(me.UserID, req.AfterSeq, min(limit, maxNotificationLimit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notifications: %v", err)
+	}
+
+	return &pb.ListNotificationsResponse{
+		Notifications: notices,
+		HasMore:       hasMore,
+	}, nil
+}
+
+func (s *ChatService) AckNotification(ctx context.Context, req *pb.AckNotificationRequest) (*pb.AckNotificationResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.DeleteNotifications(me.UserID, req.Seq)
+	if errors.Is(err, store.ErrNotFound) {
+		return &pb.AckNotificationResponse{
+			Success: false,
+			Error:   "Notification not found",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error deleting notifications of %s: %v", me.UserID, err)
+		return &pb.AckNotificationResponse{
+			Success: false,
+			Error:   "Failed to acknowledge notification",
+		}, nil
+	}
+
+	return &pb.AckNotificationResponse{
+		Success: true,
+	}, nil
+}
+
+// notifyMentions stores a notification for every user msg mentions who can
+// read room, and tells those who are online.
+func (s *ChatService) notifyMentions(room *pb.ChatRoom, msg *pb.Message) {
+	for _, user := range s.mentionedUsers(msg.Content) {
+		if user.Id == msg.UserId || !canRead(room, user.Id) {
+			continue
+		}
+
+		notice := &pb.Notification{
+			UserId:       user.Id,
+			RoomId:       room.Id,
+			RoomName:     room.Name,
+			MessageId:    msg.Id,
+			MessageSeq:   msg.Seq,
+			ThreadSeq:    msg.ThreadSeq,
+			FromUserId:   msg.UserId,
+			FromUsername: msg.Username,
+			Excerpt:      excerpt(msg.Content),
+			Timestamp:    msg.Timestamp,
+		}
+		if err := s.store.SaveNotification(notice); err != nil {
+			log.Printf("Error saving notification for %s: %v", user.Id, err)
+			continue
+		}
+
+		s.publish(&pb.Event{
+			Type:        pb.Event_MENTIONED,
+			RoomId:      room.Id,
+			RecipientId: user.Id,
+			Payload:     &pb.Event_Notification{Notification: notice},
+		})
+	}
+}
+
+// mentionedUsers resolves the @usernames in content to users, in order of
+// first mention and without repeats. Names of unknown users are ignored.
+func (s *ChatService) mentionedUsers(content string) []*pb.User {
+	var users []*pb.User
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if len(users) == maxMentions {
+			break
+		}
+
+		// Usernames never end in '.', so "Thanks @bob." mentions bob.
+		name := strings.TrimRight(strings.ToLower(match[1]), ".")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		user, err := s.findUser("", name)
+		if errors.Is(err, store.ErrNotFound) {
+			// "Ask @bob-" may end in a '-' that usernames can contain too.
+			if trimmed := strings.TrimRight(name, "-"); trimmed != name && !seen[trimmed] {
+				seen[trimmed] = true
+				user, err = s.findUser("", trimmed)
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				log.Printf("Error resolving mention of %s: %v", name, err)
+			}
+			continue
+		}
+		if !seen[user.Id] {
+			seen[user.Id] = true
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// excerpt returns the start of content, marking where it was cut.
+func excerpt(content string) string {
+	if utf8.RuneCountInString(content) <= excerptLength {
+		return content
+	}
+	return string([]rune(content)[:excerptLength]) + "…"
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"github.com/google/uuid"
+)
+
+func TestMentions(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+	carol := register(t, service, "carol")
+	bobsInbox := inbox(t, service, bob.Id)
+
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Lobby"})
+	require.NoError(t, err)
+	room := createResp.Room
+
+	send := func(roomID, content string) *pb.Message {
+		resp, err := service.SendMessage(asUser(alice.Id), &pb.SendMessageRequest{RoomId: roomID, Content: content})
+		require.NoError(t, err)
+		require.True(t, resp.Success, resp.Error)
+		return resp.Message
+	}
+	notifications := func(userID string) []*pb.Notification {
+		resp, err := service.ListNotifications(asUser(userID), &pb.ListNotificationsRequest{})
+		require.NoError(t, err)
+		return resp.Notifications
+	}
+
+	msg := send(room.Id, "@Bob and @bob, ask @carol. Mail bob@example.com, not @alice or @nobody")
+	assert.Equal(t, []pb.Event_Type{pb.Event_MENTIONED}, *bobsInbox)
+
+	notices := notifications(bob.Id)
+	require.Len(t, notices, 1, "Repeated mentions should notify once")
+	assert.Equal(t, room.Id, notices[0].RoomId)
+	assert.Equal(t, "Lobby", notices[0].RoomName)
+	assert.Equal(t, msg.Seq, notices[0].MessageSeq)
+	assert.Equal(t, "alice", notices[0].FromUsername)
+	assert.Len(t, notifications(carol.Id), 1, "Users outside public rooms should be told too")
+	assert.Empty(t, notifications(alice.Id), "Authors should not be notified of their own mentions")
+
+	privateResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Secret", Visibility: pb.ChatRoom_PRIVATE})
+	require.NoError(t, err)
+	send(privateResp.Room.Id, "@carol cannot read this")
+	assert.Len(t, notifications(carol.Id), 1, "Mentions should not leak private rooms")
+
+	send(room.Id, "@bob "+strings.Repeat("x", 200))
+	notices = notifications(bob.Id)
+	require.Len(t, notices, 2)
+	assert.Less(t, len([]rune(notices[1].Excerpt)), 110, "Long messages should be cut short")
+
+	ackResp, err := service.AckNotification(asUser(carol.Id), &pb.AckNotificationRequest{Seq: notices[0].Seq})
+	require.NoError(t, err)
+	assert.False(t, ackResp.Success, "Users can only acknowledge their own notifications")
+
+	ackResp, err = service.AckNotification(asUser(bob.Id), &pb.AckNotificationRequest{Seq: notices[0].Seq})
+	require.NoError(t, err)
+	require.True(t, ackResp.Success, ackResp.Error)
+	assert.Len(t, notifications(bob.Id), 1)
+
+	ackResp, err = service.AckNotification(asUser(bob.Id), &pb.AckNotificationRequest{})
+	require.NoError(t, err)
+	require.True(t, ackResp.Success, ackResp.Error)
+	assert.Empty(t, notifications(bob.Id))
+}
+
+func TestMentionsOnJetStream(t *testing.T) {
+	service := setupJetStreamService(t)
+	alice := register(t, service, "alice-"+uuid.New().String()[:8])
+	bob := register(t, service, "bob-"+uuid.New().String()[:8])
+
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Lobby"})
+	require.NoError(t, err)
+	resp, err := service.SendMessage(asUser(alice.Id), &pb.SendMessageRequest{
+		RoomId:  createResp.Room.Id,
+		Content: "Thanks @" + bob.Username + ".",
+	})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+
+	notices, err := service.ListNotifications(asUser(bob.Id), &pb.ListNotificationsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, notices.Notifications, 1, "Mentions followed by a full stop should resolve")
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultPresenceWindow is how long a user may go without a heartbeat before
+// they are considered offline.
+const DefaultPresenceWindow = 90 * time.Second
+
+// maxStatusTextLength bounds custom status messages, in runes.
+const maxStatusTextLength = 100
+
+func (s *ChatService) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.markOnline(me.UserID); err != nil {
+		return nil, err
+	}
+
+	return &pb.HeartbeatResponse{
+		IntervalSeconds: int32(s.heartbeatInterval() / time.Second),
+	}, nil
+}
+
+// heartbeatInterval is how often clients are asked to send heartbeats. It
+// leaves room for two to be lost before the user is reaped.
+func (s *ChatService) heartbeatInterval() time.Duration {
+	return max(s.presenceWindow/3, time.Second)
+}
+
+// RunPresenceReaper marks users offline once they have not sent a heartbeat
+// for the presence window, until ctx is cancelled. Every replica can run one:
+// the compare-and-set in markOffline ensures each transition is applied and
+// announced only once.
+func (s *ChatService) RunPresenceReaper(ctx context.Context) {
+	ticker := time.NewTicker(s.heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.reapPresence(now)
+		}
+	}
+}
+
+// reapPresence marks every user whose last heartbeat is older than the
+// presence window as offline.
+func (s *ChatService) reapPresence(now time.Time) {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		log.Printf("Error listing users for presence: %v", err)
+		return
+	}
+
+	cutoff := now.Add(-s.presenceWindow)
+	for _, user := range users {
+		if user.Presence == pb.User_OFFLINE || !time.Unix(user.LastSeen, 0).Before(cutoff) {
+			continue
+		}
+		if _, err := s.markOffline(user.Id, cutoff); err != nil {
+			log.Printf("Error marking %s offline: %v", user.Id, err)
+		}
+	}
+}
+
+func (s *ChatService) SetPresence(ctx context.Context, req *pb.SetPresenceRequest) (*pb.SetPresenceResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := validatePresence(req); problem != "" {
+		return &pb.SetPresenceResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	var before *pb.User
+	user, err := s.updateUser(me.UserID, func(user *pb.User) (bool, error) {
+		before = proto.Clone(user).(*pb.User)
+		if req.Presence != nil {
+			user.Presence = *req.Presence
+		}
+		if req.StatusText != nil {
+			user.StatusText = strings.TrimSpace(*req.StatusText)
+			user.StatusExpiresAt = 0
+			if user.StatusText != "" && req.StatusTtlSeconds > 0 {
+				user.StatusExpiresAt = time.Now().Unix() + req.StatusTtlSeconds
+			}
+		}
+		user.LastSeen = time.Now().Unix()
+		return true, nil
+	})
+	if err != nil {
+		return &pb.SetPresenceResponse{
+			Success: false,
+			Error:   profileError(me.UserID, err),
+		}, nil
+	}
+
+	s.publishPresence(before, user)
+	return &pb.SetPresenceResponse{
+		Success: true,
+		User:    visibleTo(user, me.UserID),
+	}, nil
+}
+
+// validatePresence describes what is wrong with req, or returns "" if it is
+// acceptable.
+func validatePresence(req *pb.SetPresenceRequest) string {
+	if req.Presence != nil {
+		if _, ok := pb.User_Presence_name[int32(*req.Presence)]; !ok {
+			return "Unknown presence"
+		}
+		if *req.Presence == pb.User_OFFLINE {
+			return "Use INVISIBLE to appear offline"
+		}
+	}
+	if req.StatusText != nil {
+		if !utf8.ValidString(*req.StatusText) {
+			return "Status text must be valid UTF-8"
+		}
+		if utf8.RuneCountInString(strings.TrimSpace(*req.StatusText)) > maxStatusTextLength {
+			return "Status text is too long"
+		}
+	}
+	if req.StatusTtlSeconds < 0 {
+		return "Status expiry must not be negative"
+	}
+	return ""
+}
+
+// markOnline records that the user was just seen, bringing them back online
+// if they were offline. Away, busy and invisible users keep their presence.
+func (s *ChatService) markOnline(userID string) (*pb.User, error) {
+	var before *pb.User
+	user, err := s.updateUser(userID, func(user *pb.User) (bool, error) {
+		before = proto.Clone(user).(*pb.User)
+		if user.Presence == pb.User_OFFLINE {
+			user.Presence = pb.User_ONLINE
+		}
+		user.LastSeen = time.Now().Unix()
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishPresence(before, user)
+	return user, nil
+}
+
+// markOffline marks the user offline and announces the change. If staleBefore
+// is set, the user is left alone unless they were last seen before it, so a
+// heartbeat that races with the reaper wins. LastSeen is then kept as the
+// time of the last heartbeat, which is when the user was really last seen.
+func (s *ChatService) markOffline(userID string, staleBefore time.Time) (*pb.User, error) {
+	var before *pb.User
+	user, err := s.updateUser(userID, func(user *pb.User) (bool, error) {
+		before = proto.Clone(user).(*pb.User)
+		if user.Presence == pb.User_OFFLINE {
+			return false, nil
+		}
+		if !staleBefore.IsZero() {
+			if !time.Unix(user.LastSeen, 0).Before(staleBefore) {
+				return false, nil
+			}
+		} else {
+			user.LastSeen = time.Now().Unix()
+		}
+		user.Presence = pb.User_OFFLINE
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishPresence(before, user)
+	return user, nil
+}
+
+// publishPresence announces a change from before to after, as other users see
+// it. Nothing is published if their view did not change, e.g. when an
+// invisible user goes offline.
+func (s *ChatService) publishPresence(before, after *pb.User) {
+	was, is := visibleTo(before, ""), visibleTo(after, "")
+	if was.Presence == is.Presence && was.StatusText == is.StatusText {
+		return
+	}
+
+	s.publish(&pb.Event{
+		Type:    pb.Event_PRESENCE_CHANGED,
+		Payload: &pb.Event_User{User: is},
+	})
+}
+
+// visibleTo returns a copy of user as viewerID may see it: expired status
+// text is dropped, and invisible users look offline to everyone else.
+func visibleTo(user *pb.User, viewerID string) *pb.User {
+	user = proto.Clone(user).(*pb.User)
+	if user.StatusExpiresAt != 0 && user.StatusExpiresAt <= time.Now().Unix() {
+		user.StatusText = ""
+		user.StatusExpiresAt = 0
+	}
+	if user.Presence == pb.User_INVISIBLE && user.Id != viewerID {
+		user.Presence = pb.User_OFFLINE
+		user.StatusText = ""
+		user.StatusExpiresAt = 0
+	}
+	return user
+}
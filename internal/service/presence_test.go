@@ -0,0 +1,158 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+// recordPresence collects the presence events published by service.
+func recordPresence(t *testing.T, service *ChatService) func() []string {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	cancel, err := service.store.SubscribeEvents(store.EventFilter{Global: true}, func(ev *pb.Event) {
+		if ev.Type == pb.Event_PRESENCE_CHANGED {
+			mu.Lock()
+			events = append(events, ev.GetUser().Username+" "+ev.GetUser().Presence.String())
+			mu.Unlock()
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(cancel)
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), events...)
+	}
+}
+
+func TestHeartbeatAndReaper(t *testing.T) {
+	service := setupTestService(t)
+	events := recordPresence(t, service)
+
+	alice := register(t, service, "alice")
+	ctx := asUser(alice.Id)
+
+	resp, err := service.Heartbeat(ctx, &pb.HeartbeatRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(DefaultPresenceWindow/3/time.Second), resp.IntervalSeconds)
+
+	// Within the window nothing changes.
+	service.reapPresence(time.Now().Add(DefaultPresenceWindow / 2))
+	user, _, err := service.store.GetUser(alice.Id)
+	require.NoError(t, err)
+	assert.Equal(t, pb.User_ONLINE, user.Presence)
+
+	// A silent client is reaped, with LastSeen left at its last heartbeat.
+	lastSeen := user.LastSeen
+	service.reapPresence(time.Now().Add(2 * DefaultPresenceWindow))
+	user, _, err = service.store.GetUser(alice.Id)
+	require.NoError(t, err)
+	assert.Equal(t, pb.User_OFFLINE, user.Presence)
+	assert.Equal(t, lastSeen, user.LastSeen)
+
+	// Reaping again is a no-op.
+	service.reapPresence(time.Now().Add(2 * DefaultPresenceWindow))
+
+	// The next heartbeat brings the user back.
+	_, err = service.Heartbeat(ctx, &pb.HeartbeatRequest{})
+	require.NoError(t, err)
+
+	_, err = service.Logout(ctx, &pb.LogoutRequest{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"alice ONLINE", "alice OFFLINE", "alice ONLINE", "alice OFFLINE"}, events())
+}
+
+func TestReaperSparesFreshHeartbeat(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+
+	// Simulate a heartbeat that lands after the reaper listed users but
+	// before it wrote: the stale check inside the compare-and-set wins.
+	cutoff := time.Now().Add(-time.Minute)
+	_, err := service.markOffline(alice.Id, cutoff)
+	require.NoError(t, err)
+
+	user, _, err := service.store.GetUser(alice.Id)
+	require.NoError(t, err)
+	assert.Equal(t, pb.User_ONLINE, user.Presence)
+}
+
+func TestSetPresence(t *testing.T) {
+	service := setupTestService(t)
+	events := recordPresence(t, service)
+
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+	ctx := asUser(alice.Id)
+
+	busy := pb.User_BUSY
+	resp, err := service.SetPresence(ctx, &pb.SetPresenceRequest{Presence: &busy, StatusText: ptr(" In a meeting ")})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, "In a meeting", resp.User.StatusText)
+
+	offline := pb.User_OFFLINE
+	resp, err = service.SetPresence(ctx, &pb.SetPresenceRequest{Presence: &offline})
+	require.NoError(t, err)
+	assert.False(t, resp.Success, "Users cannot set themselves offline")
+
+	// Heartbeats keep the chosen presence.
+	_, err = service.Heartbeat(ctx, &pb.HeartbeatRequest{})
+	require.NoError(t, err)
+
+	list, err := service.ListUsers(asUser(bob.Id), &pb.ListUsersRequest{Presence: []pb.User_Presence{pb.User_BUSY}})
+	require.NoError(t, err)
+	require.Len(t, list.Users, 1)
+	assert.Equal(t, "alice", list.Users[0].Username)
+
+	invisible := pb.User_INVISIBLE
+	resp, err = service.SetPresence(ctx, &pb.SetPresenceRequest{Presence: &invisible})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, pb.User_INVISIBLE, resp.User.Presence, "Users see their own presence")
+
+	seen, err := service.GetUser(asUser(bob.Id), &pb.GetUserRequest{UserId: alice.Id})
+	require.NoError(t, err)
+	assert.Equal(t, pb.User_OFFLINE, seen.User.Presence, "Invisible users look offline to others")
+	assert.Empty(t, seen.User.StatusText)
+
+	list, err = service.ListUsers(asUser(bob.Id), &pb.ListUsersRequest{Presence: []pb.User_Presence{pb.User_OFFLINE}})
+	require.NoError(t, err)
+	require.Len(t, list.Users, 1)
+	assert.Equal(t, "alice", list.Users[0].Username)
+
+	assert.Equal(t, []string{"alice ONLINE", "bob ONLINE", "alice BUSY", "alice OFFLINE"}, events())
+}
+
+func TestStatusTextExpires(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+
+	resp, err := service.SetPresence(asUser(alice.Id), &pb.SetPresenceRequest{StatusText: ptr("Back soon"), StatusTtlSeconds: 60})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, "Back soon", resp.User.StatusText)
+	assert.NotZero(t, resp.User.StatusExpiresAt)
+
+	// Move the expiry into the past rather than waiting for it.
+	user, rev, err := service.store.GetUser(alice.Id)
+	require.NoError(t, err)
+	user.StatusExpiresAt = time.Now().Add(-time.Second).Unix()
+	_, err = service.store.CompareAndSaveUser(user, rev)
+	require.NoError(t, err)
+
+	seen, err := service.GetUser(asUser(alice.Id), &pb.GetUserRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, seen.User.StatusText)
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 280
+	maxAvatarURLLength   = 512
+)
+
+var errUsernameTaken = errors.New("username taken")
+
+func (s *ChatService) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userID := req.UserId
+	if userID == "" && req.Username == "" {
+		userID = me.UserID
+	}
+
+	user, err := s.findUser(userID, req.Username)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+
+	return &pb.GetUserResponse{User: visibleTo(user, me.UserID)}, nil
+}
+
+// findUser looks a user up by ID, or by username if userID is empty.
+func (s *ChatService) findUser(userID, username string) (*pb.User, error) {
+	if userID == "" {
+		if !isValidUsername(username) {
+			return nil, store.ErrNotFound
+		}
+		creds, _, err := s.store.GetCredentials(username)
+		if err != nil {
+			return nil, err
+		}
+		userID = creds.UserId
+	}
+
+	user, _, err := s.store.GetUser(userID)
+	return user, err
+}
+
+func (s *ChatService) UpdateProfile(ctx context.Context, req *pb.UpdateProfileRequest) (*pb.UpdateProfileResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := validateProfile(req); problem != "" {
+		return &pb.UpdateProfileResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	var rename func(committed bool)
+	if req.Username != nil {
+		rename, err = s.claimUsername(me.UserID, *req.Username)
+		if err != nil {
+			return &pb.UpdateProfileResponse{
+				Success: false,
+				Error:   profileError(me.UserID, err),
+			}, nil
+		}
+	}
+
+	user, err := s.updateUser(me.UserID, func(user *pb.User) (bool, error) {
+		before := proto.Clone(user)
+		if req.Username != nil {
+			user.Username = *req.Username
+		}
+		if req.DisplayName != nil {
+			user.DisplayName = strings.TrimSpace(*req.DisplayName)
+		}
+		if req.Bio != nil {
+			user.Bio = strings.TrimSpace(*req.Bio)
+		}
+		if req.AvatarUrl != nil {
+			user.AvatarUrl = *req.AvatarUrl
+		}
+		if req.Timezone != nil {
+			user.Timezone = *req.Timezone
+		}
+		return !proto.Equal(before, user), nil
+	})
+	if rename != nil {
+		rename(err == nil)
+	}
+	if err != nil {
+		return &pb.UpdateProfileResponse{
+			Success: false,
+			Error:   profileError(me.UserID, err),
+		}, nil
+	}
+
+	return &pb.UpdateProfileResponse{
+		Success: true,
+		User:    visibleTo(user, me.UserID),
+	}, nil
+}
+
+// claimUsername reserves username for userID by moving their credentials
+// record to the new key, which fails with errUsernameTaken if someone else
+// holds it. The returned function must be called once the profile update has
+// been attempted: it releases the old username on success and the new one
+// otherwise, so exactly one of them stays claimed.
+func (s *ChatService) claimUsername(userID, username string) (func(committed bool), error) {
+	user, _, err := s.store.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	creds, revision, err := s.store.GetCredentials(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	if creds.UserId != userID {
+		return nil, fmt.Errorf("credentials for %s belong to %s", user.Username, creds.UserId)
+	}
+
+	oldUsername := creds.Username
+	if oldUsername == username {
+		return func(bool) {}, nil
+	}
+	creds.Username = username
+
+	if strings.EqualFold(oldUsername, username) {
+		// Only the case changes, so the key stays the same and nobody else
+		// can hold it; the record just has to follow the new spelling.
+		return func(committed bool) {
+			if !committed {
+				return
+			}
+			if _, err := s.store.CompareAndSaveCredentials(creds, revision); err != nil {
+				log.Printf("Error renaming credentials of %s: %v", userID, err)
+			}
+		}, nil
+	}
+
+	_, err = s.store.CompareAndSaveCredentials(creds, 0)
+	if errors.Is(err, store.ErrConflict) {
+		return nil, errUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func(committed bool) {
+		release := username
+		if committed {
+			release = oldUsername
+		}
+		if err := s.store.DeleteCredentials(release); err != nil {
+			log.Printf("Error releasing username %s: %v", release, err)
+		}
+	}, nil
+}
+
+// updateUser is the user counterpart of updateRoom.
+func (s *ChatService) updateUser(userID string, mutate func(user *pb.User) (bool, error)) (*pb.User, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		user, revision, err := s.store.GetUser(userID)
+		if err != nil {
+			return nil, err
+		}
+
+		changed, err := mutate(user)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return user, nil
+		}
+
+		_, err = s.store.CompareAndSaveUser(user, revision)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, store.ErrConflict) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("user %s: gave up after %d conflicting updates", userID, maxUpdateAttempts)
+}
+
+// validateProfile describes what is wrong with the fields set in req, or
+// returns "" if they are acceptable.
+func validateProfile(req *pb.UpdateProfileRequest) string {
+	if req.Username != nil && !isValidUsername(*req.Username) {
+		return "Username must be 3-32 letters, digits, '.', '_' or '-', and not start or end with '.'"
+	}
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		if !utf8.ValidString(name) {
+			return "Display name must be valid UTF-8"
+		}
+		if utf8.RuneCountInString(name) > maxDisplayNameLength {
+			return "Display name is too long"
+		}
+	}
+	if req.Bio != nil {
+		if !utf8.ValidString(*req.Bio) {
+			return "Bio must be valid UTF-8"
+		}
+		if utf8.RuneCountInString(strings.TrimSpace(*req.Bio)) > maxBioLength {
+			return "Bio is too long"
+		}
+	}
+	if req.AvatarUrl != nil && *req.AvatarUrl != "" {
+		u, err := url.Parse(*req.AvatarUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "Avatar must be an http or https URL"
+		}
+		if len(*req.AvatarUrl) > maxAvatarURLLength {
+			return "Avatar URL is too long"
+		}
+	}
+	if req.Timezone != nil && *req.Timezone != "" {
+		// "Local" would mean whatever zone the server happens to run in.
+		if _, err := time.LoadLocation(*req.Timezone); err != nil || *req.Timezone == "Local" {
+			return "Unknown timezone"
+		}
+	}
+	return ""
+}
+
+// profileError turns an error from a profile update into the message
+// returned to clients. Unexpected errors are logged and reported generically.
+func profileError(userID string, err error) string {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return "User not found"
+	case errors.Is(err, errUsernameTaken):
+		return "Username is already taken"
+	}
+	log.Printf("Error updating profile of %s: %v", userID, err)
+	return "Failed to save profile"
+}
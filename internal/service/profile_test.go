@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func register(t *testing.T, service *ChatService, username string) *pb.User {
+	resp, err := service.Register(context.Background(), &pb.RegisterRequest{Username: username, Password: "correct horse"})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	return resp.User
+}
+
+func TestUpdateProfile(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	ctx := asUser(alice.Id)
+
+	displayName, bio, timezone := " Alice A. ", "Hello!", "Asia/Tehran"
+	resp, err := service.UpdateProfile(ctx, &pb.UpdateProfileRequest{
+		DisplayName: &displayName,
+		Bio:         &bio,
+		Timezone:    &timezone,
+	})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, "Alice A.", resp.User.DisplayName)
+	assert.Equal(t, "Asia/Tehran", resp.User.Timezone)
+
+	avatar := "https://example.com/alice.png"
+	resp, err = service.UpdateProfile(ctx, &pb.UpdateProfileRequest{AvatarUrl: &avatar})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, "Hello!", resp.User.Bio, "Unset fields should be kept")
+
+	for _, req := range []*pb.UpdateProfileRequest{
+		{Timezone: ptr("Mars/Olympus_Mons")},
+		{Timezone: ptr("Local")},
+		{AvatarUrl: ptr("javascript:alert(1)")},
+		{Username: ptr("no spaces")},
+	} {
+		resp, err := service.UpdateProfile(ctx, req)
+		require.NoError(t, err)
+		assert.False(t, resp.Success, "%v should be rejected", req)
+	}
+
+	getResp, err := service.GetUser(asUser("someone-else"), &pb.GetUserRequest{Username: "ALICE"})
+	require.NoError(t, err)
+	assert.Equal(t, "Alice A.", getResp.User.DisplayName)
+	assert.Equal(t, avatar, getResp.User.AvatarUrl)
+
+	getResp, err = service.GetUser(ctx, &pb.GetUserRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, alice.Id, getResp.User.Id, "An empty request should return the caller")
+
+	_, err = service.GetUser(ctx, &pb.GetUserRequest{UserId: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestRenameKeepsUsernamesUnique(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	register(t, service, "bob")
+	ctx := asUser(alice.Id)
+
+	resp, err := service.UpdateProfile(ctx, &pb.UpdateProfileRequest{Username: ptr("Bob")})
+	require.NoError(t, err)
+	assert.False(t, resp.Success, "Taking another user's name should fail")
+
+	resp, err = service.UpdateProfile(ctx, &pb.UpdateProfileRequest{Username: ptr("alicia")})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, alice.Id, resp.User.Id, "Renaming should keep the user ID")
+
+	loginResp, err := service.Login(context.Background(), &pb.LoginRequest{Username: "alicia", Password: "correct horse"})
+	require.NoError(t, err)
+	require.True(t, loginResp.Success, "The new name should log in")
+	assert.Equal(t, alice.Id, loginResp.User.Id)
+
+	loginResp, err = service.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "correct horse"})
+	require.NoError(t, err)
+	assert.False(t, loginResp.Success, "The old name should be released")
+
+	carol := register(t, service, "alice")
+	assert.NotEqual(t, alice.Id, carol.Id, "A released name can be registered again")
+
+	resp, err = service.UpdateProfile(ctx, &pb.UpdateProfileRequest{Username: ptr("Alicia")})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	loginResp, err = service.Login(context.Background(), &pb.LoginRequest{Username: "alicia", Password: "correct horse"})
+	require.NoError(t, err)
+	require.True(t, loginResp.Success)
+	assert.Equal(t, "Alicia", loginResp.User.Username, "Changing only the case should be allowed")
+}
+
+func ptr(s string) *string { return &s }
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RetryAfterKey is the trailer that tells rate limited clients how many
+// seconds to wait before trying again. The status also carries a RetryInfo
+// detail with the exact delay.
+const RetryAfterKey = "retry-after"
+
+// Messages for users who hit a rate limit.
+const (
+	sendingTooFast = "You are sending messages too fast"
+	joiningTooFast = "You are joining rooms too fast"
+)
+
+// Limit allows Count actions per Per, in bursts of up to Count. The zero
+// Limit allows everything.
+type Limit struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseLimit parses limits written like "20/10s", or "0" for no limit.
+func ParseLimit(text string) (Limit, error) {
+	if text == "0" || text == "" {
+		return Limit{}, nil
+	}
+	count, per, ok := strings.Cut(text, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("limit %q is not of the form <count>/<duration>", text)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("invalid count in limit %q", text)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid duration in limit %q", text)
+	}
+	return Limit{Count: n, Per: d}, nil
+}
+
+func (l Limit) String() string {
+	if l.Count == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Count, l.Per)
+}
+
+// Set implements flag.Value.
+func (l *Limit) Set(text string) error {
+	limit, err := ParseLimit(text)
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// RateLimits are the limits the service enforces. Their state is kept in
+// the store, so every replica enforces the same budget.
+type RateLimits struct {
+	// UserMessages limits the messages each user sends, across all rooms
+	// and direct conversations.
+	UserMessages Limit
+	// RoomMessages limits the messages sent to each room by everyone.
+	RoomMessages Limit
+	// Joins limits how often each user joins rooms, asks to join them or
+	// accepts invitations.
+	Joins Limit
+}
+
+// DefaultRateLimits leave plenty of room for people typing, but not for
+// scripts.
+var DefaultRateLimits = RateLimits{
+	UserMessages: Limit{Count: 20, Per: 10 * time.Second},
+	RoomMessages: Limit{Count: 100, Per: 10 * time.Second},
+	Joins:        Limit{Count: 10, Per: time.Minute},
+}
+
+// SetRateLimits replaces the limits the service enforces. It must be called
+// before the service starts serving.
+func (s *ChatService) SetRateLimits(limits RateLimits) {
+	s.limits = limits
+}
+
+// allow takes a token from the bucket under key, or returns a
+// ResourceExhausted error saying when one is available again. what
+// describes the action to the user.
+func (s *ChatService) allow(ctx context.Context, key string, limit Limit, what string) error {
+	if limit.Count == 0 {
+		return nil
+	}
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		bucket, revision, err := s.store.GetTokenBucket(key)
+		if err != nil {
+			// A broken limiter should not take the chat down with it.
+			log.Printf("Error loading rate limit %s: %v", key, err)
+			return nil
+		}
+
+		if wait := take(bucket, limit, time.Now()); wait > 0 {
+			return rateLimited(ctx, what, wait)
+		}
+
+		_, err = s.store.CompareAndSaveTokenBucket(key, bucket, revision)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, store.ErrConflict) {
+			log.Printf("Error saving rate limit %s: %v", key, err)
+			return nil
+		}
+	}
+
+	// This many concurrent requests on one bucket are a flood themselves.
+	return rateLimited(ctx, what, limit.Per/time.Duration(limit.Count))
+}
+
+// take refills bucket for the time since it was last used and takes a token
+// from it. If there is none, it leaves bucket alone and returns how long
+// until there is.
+func take(bucket *pb.TokenBucket, limit Limit, now time.Time) time.Duration {
+	perToken := limit.Per / time.Duration(limit.Count)
+	tokens := float64(limit.Count)
+	if bucket.UpdatedAt != 0 {
+		// Replicas' clocks may disagree a little; never refill backwards.
+		elapsed := max(now.Sub(time.Unix(0, bucket.UpdatedAt)), 0)
+		tokens = min(tokens, bucket.Tokens+float64(elapsed)/float64(perToken))
+	}
+
+	if tokens < 1 {
+		return time.Duration((1 - tokens) * float64(perToken))
+	}
+	bucket.Tokens = tokens - 1
+	bucket.UpdatedAt = now.UnixNano()
+	return 0
+}
+
+// rateLimited returns the error for an action refused for wait.
+func rateLimited(ctx context.Context, what string, wait time.Duration) error {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	// Outside a gRPC call, as in tests, there is nowhere to put the trailer.
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(RetryAfterKey, strconv.FormatInt(seconds, 10)))
+
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("%s; try again in %ds", what, seconds))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// userKey and roomKey name the rate limit buckets of a user or room.
+func userKey(userID, action string) string {
+	return fmt.Sprintf("user.%s.%s", userID, action)
+}
+
+func roomKey(roomID, action string) string {
+	return fmt.Sprintf("room.%s.%s", roomID, action)
+}
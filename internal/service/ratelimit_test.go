@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("20/10s")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Count: 20, Per: 10 * time.Second}, limit)
+	assert.Equal(t, "20/10s", limit.String())
+
+	limit, err = ParseLimit("0")
+	require.NoError(t, err)
+	assert.Zero(t, limit)
+
+	for _, text := range []string{"20", "x/1s", "-1/1s", "5/0s", "5/soon"} {
+		_, err := ParseLimit(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestTake(t *testing.T) {
+	limit := Limit{Count: 2, Per: 10 * time.Second}
+	now := time.Now()
+	bucket := &pb.TokenBucket{}
+
+	assert.Zero(t, take(bucket, limit, now), "New buckets start full")
+	assert.Zero(t, take(bucket, limit, now))
+	assert.Equal(t, 5*time.Second, take(bucket, limit, now))
+	assert.Equal(t, 2*time.Second, take(bucket, limit, now.Add(3*time.Second)))
+
+	assert.Zero(t, take(bucket, limit, now.Add(5*time.Second)), "A token should be back after Per/Count")
+	assert.Zero(t, take(bucket, limit, now.Add(time.Hour)))
+	assert.Zero(t, take(bucket, limit, now.Add(time.Hour)))
+	assert.NotZero(t, take(bucket, limit, now.Add(time.Hour)), "Buckets should not fill beyond Count")
+}
+
+func TestRateLimits(t *testing.T) {
+	service := setupTestService(t)
+	service.SetRateLimits(RateLimits{
+		UserMessages: Limit{Count: 3, Per: time.Hour},
+		RoomMessages: Limit{Count: 4, Per: time.Hour},
+		Joins:        Limit{Count: 2, Per: time.Hour},
+	})
+	client := startTestServer(t, service)
+	room, alice, bob, _, _ := moderatedRoom(t, service)
+
+	token, err := service.tokens.Issue(auth.Identity{UserID: alice.Id, Username: alice.Username})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(auth.WithToken(context.Background(), token), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.SendMessage(ctx, &pb.SendMessageRequest{RoomId: room.Id, Content: "spam"})
+		require.NoError(t, err)
+		require.True(t, resp.Success, resp.Error)
+	}
+
+	var trailer metadata.MD
+	_, err = client.SendMessage(ctx, &pb.SendMessageRequest{RoomId: room.Id, Content: "spam"}, grpc.Trailer(&trailer))
+	st := status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Contains(t, st.Message(), "too fast")
+	require.Len(t, st.Details(), 1)
+	delay := st.Details()[0].(*errdetails.RetryInfo).RetryDelay.AsDuration()
+	assert.InDelta(t, 20*time.Minute, delay, float64(time.Minute))
+	assert.Equal(t, []string{"1200"}, trailer.Get(RetryAfterKey))
+
+	// Others have a budget of their own, but the room's is nearly used up.
+	resp, err := service.SendMessage(asUser(bob.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "hi"})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	_, err = service.SendMessage(asUser(bob.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "hi"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "Rooms should have a budget of their own")
+
+	_, err = service.SendDirectMessage(asUser(alice.Id), &pb.SendDirectMessageRequest{RecipientId: bob.Id, Content: "hi"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "Direct messages should count too")
+
+	// Joining the room while setting it up used one of bob's joins.
+	createResp, err := service.CreateRoom(asUser(alice.Id), &pb.CreateRoomRequest{Name: "Another"})
+	require.NoError(t, err)
+	_, err = service.JoinRoom(asUser(bob.Id), &pb.JoinRoomRequest{RoomId: createResp.Room.Id})
+	require.NoError(t, err)
+	_, err = service.RequestJoin(asUser(bob.Id), &pb.RequestJoinRequest{RoomId: createResp.Room.Id})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
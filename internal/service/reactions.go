@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+const (
+	// maxEmojiLength bounds a reaction, in characters, which leaves room
+	// for shortcodes such as :thumbsup: and multi-character emoji.
+	maxEmojiLength = 32
+	// maxReactionKinds is how many different emoji a message can collect.
+	maxReactionKinds = 20
+)
+
+func (s *ChatService) AddReaction(ctx context.Context, req *pb.ReactionRequest) (*pb.ReactionResponse, error) {
+	return s.react(ctx, req, true)
+}
+
+func (s *ChatService) RemoveReaction(ctx context.Context, req *pb.ReactionRequest) (*pb.ReactionResponse, error) {
+	return s.react(ctx, req, false)
+}
+
+// react adds or removes the caller's reaction and announces the message's
+// new tallies if that changed anything.
+func (s *ChatService) react(ctx context.Context, req *pb.ReactionRequest, add bool) (*pb.ReactionResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := validateEmoji(req.Emoji); problem != "" {
+		return &pb.ReactionResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	room, _, err := s.store.GetRoom(req.RoomId)
+	if err == nil && !canRead(room, me.UserID) {
+		err = store.ErrNotFound
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return &pb.ReactionResponse{
+			Success: false,
+			Error:   "Room not found",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", req.RoomId, err)
+		return &pb.ReactionResponse{
+			Success: false,
+			Error:   "Failed to retrieve room",
+		}, nil
+	}
+	switch {
+	case !isMember(room, me.UserID):
+		return &pb.ReactionResponse{
+			Success: false,
+			Error:   "Not a member of this room",
+		}, nil
+	case restricted(room.Muted, me.UserID, time.Now()):
+		return &pb.ReactionResponse{
+			Success: false,
+			Error:   "You are muted in this room",
+		}, nil
+	}
+
+	msg, err := s.store.GetMessage(req.RoomId, req.Seq)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && msg.Deleted) {
+		return &pb.ReactionResponse{
+			Success: false,
+			Error:   "Message not found",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error loading message %d in %s: %v", req.Seq, req.RoomId, err)
+		return &pb.ReactionResponse{
+			Success: false,
+			Error:   "Failed to retrieve message",
+		}, nil
+	}
+
+	reactions, changed, err := s.updateReactions(room.Id, msg.Id, func(reactions *pb.Reactions) (bool, error) {
+		if add {
+			return addReaction(reactions, req.Emoji, me.UserID)
+		}
+		return removeReaction(reactions, req.Emoji, me.UserID), nil
+	})
+	if err != nil {
+		problem := "Failed to save reaction"
+		if errors.As(err, new(validationError)) {
+			problem = err.Error()
+		} else {
+			log.Printf("Error saving reactions to message %s: %v", msg.Id, err)
+		}
+		return &pb.ReactionResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	counts := reactionCounts(reactions)
+	if changed {
+		eventType := pb.Event_REACTION_REMOVED
+		if add {
+			eventType = pb.Event_REACTION_ADDED
+		}
+		update := &pb.ReactionUpdate{
+			MessageId: msg.Id,
+			Seq:       msg.Seq,
+			UserId:    me.UserID,
+			Emoji:     req.Emoji,
+			Reactions: counts,
+		}
+		if user, _, err := s.store.GetUser(me.UserID); err == nil {
+			update.Username = user.Username
+		}
+		s.publish(&pb.Event{
+			Type:    eventType,
+			RoomId:  room.Id,
+			Payload: &pb.Event_Reaction{Reaction: update},
+		})
+	}
+
+	return &pb.ReactionResponse{
+		Success:   true,
+		Reactions: counts,
+	}, nil
+}
+
+// updateReactions applies mutate to the reactions to a message and saves
+// them, retrying on concurrent modification like updateRoom. It reports
+// whether mutate changed anything.
+func (s *ChatService) updateReactions(roomID, messageID string, mutate func(*pb.Reactions) (bool, error)) (*pb.Reactions, bool, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		reactions, revision, err := s.store.GetReactions(roomID, messageID)
+		if err != nil {
+			return nil, false, err
+		}
+
+		changed, err := mutate(reactions)
+		if err != nil || !changed {
+			return reactions, false, err
+		}
+
+		_, err = s.store.CompareAndSaveReactions(roomID, messageID, reactions, revision)
+		if err == nil {
+			return reactions, true, nil
+		}
+		if !errors.Is(err, store.ErrConflict) {
+			return nil, false, err
+		}
+	}
+
+	return nil, false, fmt.Errorf("reactions to %s: gave up after %d conflicting updates", messageID, maxUpdateAttempts)
+}
+
+// addReaction records userID's reaction with emoji, reporting whether it is
+// new.
+func addReaction(reactions *pb.Reactions, emoji, userID string) (bool, error) {
+	for _, reaction := range reactions.Reactions {
+		if reaction.Emoji != emoji {
+			continue
+		}
+		if slices.Contains(reaction.UserIds, userID) {
+			return false, nil
+		}
+		reaction.UserIds = append(reaction.UserIds, userID)
+		return true, nil
+	}
+
+	if len(reactions.Reactions) >= maxReactionKinds {
+		return false, validationError("This message has too many different reactions")
+	}
+	reactions.Reactions = append(reactions.Reactions, &pb.Reactions_Reaction{
+		Emoji:   emoji,
+		UserIds: []string{userID},
+	})
+	return true, nil
+}
+
+// removeReaction takes back userID's reaction with emoji, reporting whether
+// there was one. Emoji nobody reacts with any more are dropped.
+func removeReaction(reactions *pb.Reactions, emoji, userID string) bool {
+	removed := false
+	reactions.Reactions = slices.DeleteFunc(reactions.Reactions, func(reaction *pb.Reactions_Reaction) bool {
+		if reaction.Emoji != emoji {
+			return false
+		}
+		before := len(reaction.UserIds)
+		reaction.UserIds = slices.DeleteFunc(reaction.UserIds, func(id string) bool { return id == userID })
+		removed = len(reaction.UserIds) < before
+		return len(reaction.UserIds) == 0
+	})
+	return removed
+}
+
+func reactionCounts(reactions *pb.Reactions) []*pb.ReactionCount {
+	var counts []*pb.ReactionCount
+	for _, reaction := range reactions.Reactions {
+		counts = append(counts, &pb.ReactionCount{
+			Emoji: reaction.Emoji,
+			Count: int32(len(reaction.UserIds)),
+		})
+	}
+	return counts
+}
+
+// attachReactions fills in the reaction tallies of messages, reading those
+// of each room at once.
+func (s *ChatService) attachReactions(messages []*pb.Message) error {
+	byRoom := make(map[string][]string)
+	for _, msg := range messages {
+		if !msg.Deleted {
+			byRoom[msg.RoomId] = append(byRoom[msg.RoomId], msg.Id)
+		}
+	}
+
+	for roomID, messageIDs := range byRoom {
+		reactions, err := s.store.GetReactionsOf(roomID, messageIDs)
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			if r, ok := reactions[msg.Id]; ok && msg.RoomId == roomID && !msg.Deleted {
+				msg.Reactions = reactionCounts(r)
+			}
+		}
+	}
+	return nil
+}
+
+// validateEmoji describes what is wrong with a reaction, or returns "" if it
+// can be used.
+func validateEmoji(emoji string) string {
+	switch {
+	case emoji == "":
+		return "Reaction is empty"
+	case !utf8.ValidString(emoji):
+		return "Reaction is not valid UTF-8"
+	case utf8.RuneCountInString(emoji) > maxEmojiLength:
+		return "Reaction is too long"
+	case strings.IndexFunc(emoji, unicode.IsSpace) >= 0:
+		return "Reaction must not contain spaces"
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestReactions(t *testing.T) {
+	service := setupTestService(t)
+	room, alice, bob, carol, _ := moderatedRoom(t, service)
+	stranger := register(t, service, "stranger")
+
+	var updates []*pb.ReactionUpdate
+	cancel, err := service.store.SubscribeEvents(store.EventFilter{RoomIDs: []string{room.Id}}, func(ev *pb.Event) {
+		if ev.GetReaction() != nil {
+			updates = append(updates, ev.GetReaction())
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(cancel)
+
+	sendResp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "lunch?"})
+	require.NoError(t, err)
+	seq := sendResp.Message.Seq
+
+	react := func(userID, emoji string) *pb.ReactionResponse {
+		resp, err := service.AddReaction(asUser(userID), &pb.ReactionRequest{RoomId: room.Id, Seq: seq, Emoji: emoji})
+		require.NoError(t, err)
+		return resp
+	}
+
+	require.True(t, react(alice.Id, ":thumbsup:").Success)
+	require.True(t, react(bob.Id, ":thumbsup:").Success)
+	resp := react(bob.Id, ":tada:")
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, map[string]int32{":thumbsup:": 2, ":tada:": 1}, tallies(resp.Reactions))
+
+	resp = react(bob.Id, ":thumbsup:")
+	assert.True(t, resp.Success, "Reacting twice is harmless")
+	assert.Len(t, updates, 3, "Repeated reactions should not be announced")
+
+	assert.False(t, react(stranger.Id, ":thumbsup:").Success, "Only members may react")
+	assert.Equal(t, "Reaction must not contain spaces", react(alice.Id, "thumbs up").Error)
+
+	history, err := service.GetHistory(asUser(carol.Id), &pb.GetHistoryRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.Len(t, history.Messages, 1)
+	assert.Equal(t, map[string]int32{":thumbsup:": 2, ":tada:": 1}, tallies(history.Messages[0].Reactions))
+
+	removeResp, err := service.RemoveReaction(asUser(bob.Id), &pb.ReactionRequest{RoomId: room.Id, Seq: seq, Emoji: ":tada:"})
+	require.NoError(t, err)
+	require.True(t, removeResp.Success, removeResp.Error)
+	assert.Equal(t, map[string]int32{":thumbsup:": 2}, tallies(removeResp.Reactions))
+
+	require.Len(t, updates, 4)
+	last := updates[3]
+	assert.Equal(t, "bob", last.Username)
+	assert.Equal(t, ":tada:", last.Emoji)
+	assert.Equal(t, seq, last.Seq)
+	assert.Equal(t, map[string]int32{":thumbsup:": 2}, tallies(last.Reactions))
+
+	deleteResp, err := service.DeleteMessage(asUser(carol.Id), &pb.DeleteMessageRequest{RoomId: room.Id, Seq: seq})
+	require.NoError(t, err)
+	require.True(t, deleteResp.Success, deleteResp.Error)
+	assert.Equal(t, "Message not found", react(alice.Id, ":tada:").Error, "Deleted messages cannot be reacted to")
+}
+
+func tallies(counts []*pb.ReactionCount) map[string]int32 {
+	byEmoji := map[string]int32{}
+	for _, count := range counts {
+		byEmoji[count.Emoji] = count.Count
+	}
+	return byEmoji
+}
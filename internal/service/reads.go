@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func (s *ChatService) MarkRead(ctx context.Context, req *pb.MarkReadRequest) (*pb.MarkReadResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room, _, err := s.store.GetRoom(req.RoomId)
+	if errors.Is(err, store.ErrNotFound) {
+		return &pb.MarkReadResponse{
+			Success: false,
+			Error:   "Room not found",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", req.RoomId, err)
+		return &pb.MarkReadResponse{
+			Success: false,
+			Error:   "Failed to retrieve room",
+		}, nil
+	}
+
+	if !isMember(room, me.UserID) {
+		return &pb.MarkReadResponse{
+			Success: false,
+			Error:   "Not a member of this room",
+		}, nil
+	}
+
+	// Never move the marker past the newest message, so messages sent later
+	// are still counted as unread.
+	latest, err := s.store.GetHistory(store.HistoryQuery{RoomID: room.Id, Limit: 1, NewestFirst: true})
+	if err != nil {
+		log.Printf("Error loading history of %s: %v", room.Id, err)
+		return &pb.MarkReadResponse{
+			Success: false,
+			Error:   "Failed to mark as read",
+		}, nil
+	}
+	seq := req.Seq
+	if len(latest.Messages) == 0 {
+		seq = 0
+	} else if newest := latest.Messages[0].Seq; seq == 0 || seq > newest {
+		seq = newest
+	}
+
+	marker, err := s.advanceReadMarker(room.Id, me.UserID, seq)
+	if err != nil {
+		log.Printf("Error saving read marker of %s in %s: %v", me.UserID, room.Id, err)
+		return &pb.MarkReadResponse{
+			Success: false,
+			Error:   "Failed to mark as read",
+		}, nil
+	}
+
+	unread, err := s.store.CountMessages(room.Id, marker)
+	if err != nil {
+		log.Printf("Error counting unread messages in %s: %v", room.Id, err)
+	}
+
+	return &pb.MarkReadResponse{
+		Success: true,
+		Unread:  unread,
+	}, nil
+}
+
+// advanceReadMarker moves userID's read marker in roomID forward to seq with
+// compare-and-set. Markers never move backwards, so marking an old message
+// as read after a newer one is a no-op. It returns the resulting marker.
+func (s *ChatService) advanceReadMarker(roomID, userID string, seq uint64) (uint64, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		marker, revision, err := s.store.GetReadMarker(roomID, userID)
+		if err != nil {
+			return 0, err
+		}
+		if seq <= marker {
+			return marker, nil
+		}
+
+		_, err = s.store.CompareAndSaveReadMarker(roomID, userID, seq, revision)
+		if err == nil {
+			return seq, nil
+		}
+		if !errors.Is(err, store.ErrConflict) {
+			return 0, err
+		}
+	}
+
+	return 0, fmt.Errorf("read marker %s/%s: gave up after %d conflicting updates", roomID, userID, maxUpdateAttempts)
+}
+
+// unreadCounts returns how many unread messages userID has in each of rooms
+// they are a member of or have read before; the chatapp leaves rooms on exit,
+// and its users still want to see what they missed. Rooms whose count cannot
+// be determined are left out.
+//
+// The user's markers and the rooms' message totals are read in one go. Only
+// rooms the user has read part of need their messages after the marker
+// counted, and those counts are reused while the room and the marker stay
+// as they are.
+func (s *ChatService) unreadCounts(rooms []*pb.ChatRoom, userID string) map[string]uint64 {
+	unread := make(map[string]uint64)
+	markers, err := s.store.GetReadMarkers(userID)
+	if err != nil {
+		log.Printf("Error loading read markers of %s: %v", userID, err)
+		return unread
+	}
+
+	var roomIDs []string
+	for _, room := range rooms {
+		if _, read := markers[room.Id]; read || isMember(room, userID) {
+			roomIDs = append(roomIDs, room.Id)
+		}
+	}
+	if len(roomIDs) == 0 {
+		return unread
+	}
+	totals, err := s.store.CountRoomMessages(roomIDs)
+	if err != nil {
+		log.Printf("Error counting messages: %v", err)
+		return unread
+	}
+
+	now := time.Now()
+	for _, roomID := range roomIDs {
+		marker, total := markers[roomID], totals[roomID]
+		if marker == 0 || total == 0 {
+			unread[roomID] = total
+			continue
+		}
+
+		key := unreadKey{roomID: roomID, userID: userID}
+		if count, ok := s.unread.get(key, marker, total, now); ok {
+			unread[roomID] = count
+			continue
+		}
+		count, err := s.store.CountMessages(roomID, marker)
+		if err != nil {
+			log.Printf("Error counting unread messages in %s: %v", roomID, err)
+			continue
+		}
+		s.unread.put(key, unreadCount{marker: marker, total: total, unread: count, at: now})
+		unread[roomID] = count
+	}
+	return unread
+}
+
+// unreadTTL is how long an unread count is reused. A message expiring from
+// a room just as another arrives leaves its total as it was, so counts are
+// also refreshed every so often.
+const unreadTTL = time.Minute
+
+// unreadCache keeps the unread counts of users' rooms.
+type unreadCache struct {
+	mu     sync.Mutex
+	counts map[unreadKey]unreadCount
+	swept  time.Time
+}
+
+type unreadKey struct {
+	roomID, userID string
+}
+
+// unreadCount is an unread count along with the read marker and room total
+// it was counted at.
+type unreadCount struct {
+	marker, total, unread uint64
+	at                    time.Time
+}
+
+// get returns the count stored for key if the marker and total are still
+// those it was counted at.
+func (c *unreadCache) get(key unreadKey, marker, total uint64, now time.Time) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count, ok := c.counts[key]
+	if !ok || count.marker != marker || count.total != total || now.Sub(count.at) > unreadTTL {
+		return 0, false
+	}
+	return count.unread, true
+}
+
+// put stores count for key, dropping counts too old to be used.
+func (c *unreadCache) put(key unreadKey, count unreadCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[unreadKey]unreadCount)
+	}
+	if count.at.Sub(c.swept) > unreadTTL {
+		for k, old := range c.counts {
+			if count.at.Sub(old.at) > unreadTTL {
+				delete(c.counts, k)
+			}
+		}
+		c.swept = count.at
+	}
+	c.counts[key] = count
+}
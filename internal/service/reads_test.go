@@ -0,0 +1,71 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestReadMarkersAndUnreadCounts(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	bob := register(t, service, "bob")
+	aliceCtx, bobCtx := asUser(alice.Id), asUser(bob.Id)
+
+	_, err := service.JoinRoom(aliceCtx, &pb.JoinRoomRequest{RoomId: "general"})
+	require.NoError(t, err)
+	_, err = service.JoinRoom(bobCtx, &pb.JoinRoomRequest{RoomId: "general"})
+	require.NoError(t, err)
+
+	var sent []*pb.Message
+	for _, content := range []string{"one", "two", "three"} {
+		resp, err := service.SendMessage(aliceCtx, &pb.SendMessageRequest{RoomId: "general", Content: content})
+		require.NoError(t, err)
+		require.True(t, resp.Success)
+		sent = append(sent, resp.Message)
+	}
+
+	rooms, err := service.ListRooms(bobCtx, &pb.ListRoomsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"general": 3}, rooms.Unread, "Only rooms the caller is in should be counted")
+
+	rooms, err = service.ListRooms(aliceCtx, &pb.ListRoomsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), rooms.Unread["general"], "Sending a message marks everything before it as read")
+
+	resp, err := service.MarkRead(bobCtx, &pb.MarkReadRequest{RoomId: "general", Seq: sent[0].Seq})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, uint64(2), resp.Unread)
+
+	resp, err = service.MarkRead(bobCtx, &pb.MarkReadRequest{RoomId: "general", Seq: 0})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, uint64(0), resp.Unread, "Seq 0 marks everything as read")
+
+	// Markers never move backwards.
+	resp, err = service.MarkRead(bobCtx, &pb.MarkReadRequest{RoomId: "general", Seq: sent[0].Seq})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+	assert.Equal(t, uint64(0), resp.Unread)
+
+	rooms, err = service.ListRooms(bobCtx, &pb.ListRoomsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"general": 0}, rooms.Unread)
+
+	resp, err = service.MarkRead(bobCtx, &pb.MarkReadRequest{RoomId: "random"})
+	require.NoError(t, err)
+	assert.False(t, resp.Success, "Only members can mark a room as read")
+
+	// Rooms read before are still counted after leaving them.
+	_, err = service.LeaveRoom(bobCtx, &pb.LeaveRoomRequest{RoomId: "general"})
+	require.NoError(t, err)
+	_, err = service.SendMessage(aliceCtx, &pb.SendMessageRequest{RoomId: "general", Content: "four"})
+	require.NoError(t, err)
+	rooms, err = service.ListRooms(bobCtx, &pb.ListRoomsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"general": 1}, rooms.Unread)
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	maxRoomNameLength        = 100
+	maxRoomDescriptionLength = 500
+)
+
+// errNotOwner is returned from room mutations attempted by anyone but the
+// room's owner.
+var errNotOwner = errors.New("not the room owner")
+
+// validationError carries a client-facing explanation of rejected input out
+// of an updateRoom mutation.
+type validationError string
+
+func (e validationError) Error() string { return string(e) }
+
+func (s *ChatService) CreateRoom(ctx context.Context, req *pb.CreateRoomRequest) (*pb.CreateRoomResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(req.Name)
+	problem := validateRoom(name, req.Description)
+	if problem == "" {
+		problem = validateVisibility(req.Visibility)
+	}
+	if problem != "" {
+		return &pb.CreateRoomResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	room := &pb.ChatRoom{
+		Id:          uuid.New().String(),
+		Name:        name,
+		Description: req.Description,
+		Members:     []string{me.UserID},
+		CreatedAt:   time.Now().Unix(),
+		OwnerId:     me.UserID,
+		Visibility:  req.Visibility,
+	}
+	if _, err := s.store.CompareAndSaveRoom(room, 0); err != nil {
+		log.Printf("Error creating room: %v", err)
+		return &pb.CreateRoomResponse{
+			Success: false,
+			Error:   "Failed to save room",
+		}, nil
+	}
+
+	s.publish(roomEvent(pb.Event_ROOM_CREATED, room))
+
+	return &pb.CreateRoomResponse{
+		Success: true,
+		Room:    redactRoom(room, me.UserID),
+	}, nil
+}
+
+func (s *ChatService) UpdateRoom(ctx context.Context, req *pb.UpdateRoomRequest) (*pb.UpdateRoomResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	room, err := s.updateRoom(req.RoomId, func(room *pb.ChatRoom) (bool, error) {
+		if room.OwnerId == "" || room.OwnerId != me.UserID {
+			return false, errNotOwner
+		}
+
+		name, description := room.Name, room.Description
+		if req.Name != nil {
+			name = strings.TrimSpace(*req.Name)
+		}
+		if req.Description != nil {
+			description = *req.Description
+		}
+		if problem := validateRoom(name, description); problem != "" {
+			return false, validationError(problem)
+		}
+		visibility := room.Visibility
+		if req.Visibility != nil {
+			visibility = *req.Visibility
+		}
+		if problem := validateVisibility(visibility); problem != "" {
+			return false, validationError(problem)
+		}
+
+		changed = name != room.Name || description != room.Description || visibility != room.Visibility
+		room.Name, room.Description, room.Visibility = name, description, visibility
+		return changed, nil
+	})
+	if err != nil {
+		return &pb.UpdateRoomResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	if changed {
+		s.publish(roomEvent(pb.Event_ROOM_UPDATED, room))
+	}
+
+	return &pb.UpdateRoomResponse{
+		Success: true,
+		Room:    redactRoom(room, me.UserID),
+	}, nil
+}
+
+func (s *ChatService) DeleteRoom(ctx context.Context, req *pb.DeleteRoomRequest) (*pb.DeleteRoomResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.deleteRoom(req.RoomId, me.UserID)
+	if err != nil {
+		return &pb.DeleteRoomResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	s.publish(roomEvent(pb.Event_ROOM_DELETED, room))
+
+	return &pb.DeleteRoomResponse{
+		Success: true,
+	}, nil
+}
+
+// deleteRoom deletes roomID if userID owns it, checking ownership again if
+// the room changes in the meantime, and returns the deleted room.
+func (s *ChatService) deleteRoom(roomID, userID string) (*pb.ChatRoom, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		room, revision, err := s.store.GetRoom(roomID)
+		if err != nil {
+			return nil, err
+		}
+		if room.OwnerId == "" || room.OwnerId != userID {
+			return nil, errNotOwner
+		}
+
+		err = s.store.DeleteRoom(room.Id, revision)
+		if err == nil {
+			return room, nil
+		}
+		if !errors.Is(err, store.ErrConflict) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("room %s: gave up after %d conflicting updates", roomID, maxUpdateAttempts)
+}
+
+// validateRoom describes what is wrong with a room's name or description, or
+// returns "" if they are acceptable.
+func validateRoom(name, description string) string {
+	if !utf8.ValidString(name) || !utf8.ValidString(description) {
+		return "Room name and description must be valid UTF-8"
+	}
+	if name == "" {
+		return "Room name is required"
+	}
+	if utf8.RuneCountInString(name) > maxRoomNameLength {
+		return "Room name is too long"
+	}
+	if utf8.RuneCountInString(description) > maxRoomDescriptionLength {
+		return "Room description is too long"
+	}
+	return ""
+}
+
+// validateVisibility describes what is wrong with a room visibility, or
+// returns "" if it is known.
+func validateVisibility(visibility pb.ChatRoom_Visibility) string {
+	if _, ok := pb.ChatRoom_Visibility_name[int32(visibility)]; !ok {
+		return "Unknown room visibility"
+	}
+	return ""
+}
+
+// roomEvent builds a room lifecycle event. Private rooms are only announced
+// to their own subscribers, so they stay hidden from everyone else.
+func roomEvent(eventType pb.Event_Type, room *pb.ChatRoom) *pb.Event {
+	ev := &pb.Event{
+		Type:    eventType,
+		Payload: &pb.Event_Room{Room: redactRoom(room, "")},
+	}
+	if room.Visibility == pb.ChatRoom_PRIVATE {
+		ev.RoomId = room.Id
+	}
+	return ev
+}
+
+// redactRoom returns room as userID may see it. Only the owner and
+// moderators see who else is invited, asking to join, banned or muted, and
+// the room's filters; an empty userID sees none of them.
+func redactRoom(room *pb.ChatRoom, userID string) *pb.ChatRoom {
+	if userID != "" && roleOf(room, userID) >= pb.ChatRoom_MODERATOR {
+		return room
+	}
+
+	redacted := proto.Clone(room).(*pb.ChatRoom)
+	isOther := func(id string) bool { return id != userID }
+	redacted.Invited = slices.DeleteFunc(redacted.Invited, isOther)
+	redacted.JoinRequests = slices.DeleteFunc(redacted.JoinRequests, isOther)
+	maps.DeleteFunc(redacted.Banned, func(id string, _ int64) bool { return isOther(id) })
+	maps.DeleteFunc(redacted.Muted, func(id string, _ int64) bool { return isOther(id) })
+	redacted.Filters = nil
+	return redacted
+}
+
+// roomError turns an error from a room operation into the message returned
+// to clients. Unexpected errors are logged and reported generically.
+func roomError(roomID string, err error) string {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return "Room not found"
+	case errors.Is(err, errNotOwner):
+		return "Only the room owner can do that"
+	case errors.Is(err, errNotModerator):
+		return "Only moderators can do that"
+	case errors.As(err, new(validationError)):
+		return err.Error()
+	}
+	log.Printf("Error updating room %s: %v", roomID, err)
+	return "Failed to save room"
+}
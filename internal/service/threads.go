@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *ChatService) GetThread(ctx context.Context, req *pb.GetThreadRequest) (*pb.GetThreadResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.RoomId == "" || req.Seq == 0 {
+		return nil, status.Error(codes.InvalidArgument, "room_id and seq are required")
+	}
+	visible, err := s.canSee(req.RoomId, me.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread: %v", err)
+	}
+	if !visible {
+		return nil, status.Error(codes.NotFound, "room not found")
+	}
+
+	root, err := s.store.GetMessage(req.RoomId, req.Seq)
+	if err == nil && root.ThreadSeq != 0 {
+		root, err = s.store.GetMessage(req.RoomId, root.ThreadSeq)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "message not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread: %v", err)
+	}
+
+	cursor := pageToken{RoomID: req.RoomId, ThreadID: root.Id}
+	if req.PageToken != "" {
+		token, err := decodePageToken(req.PageToken)
+		if err != nil || token.RoomID != req.RoomId || token.ThreadID != root.Id {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+		cursor = token
+	}
+
+	replies, next, err := s.readPage(cursor, req.Limit)
+	if err == nil {
+		err = s.attachReactions([]*pb.Message{root})
+	}
+	if err == nil {
+		err = s.attachReplyCounts(req.RoomId, root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread: %v", err)
+	}
+
+	return &pb.GetThreadResponse{
+		Root:          root,
+		Replies:       replies,
+		NextPageToken: next,
+	}, nil
+}
+
+// attachReplyCounts fills in how many replies each of messages, all from
+// roomID, has.
+func (s *ChatService) attachReplyCounts(roomID string, messages ...*pb.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	counts, err := s.store.CountReplies(roomID)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		msg.ReplyCount = int32(counts[msg.Id])
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestThreads(t *testing.T) {
+	service := setupTestService(t)
+	room, alice, bob, carol, _ := moderatedRoom(t, service)
+	stranger := register(t, service, "stranger")
+
+	send := func(userID, content string, replyTo uint64) *pb.Message {
+		resp, err := service.SendMessage(asUser(userID), &pb.SendMessageRequest{RoomId: room.Id, Content: content, ReplyToSeq: replyTo})
+		require.NoError(t, err)
+		require.True(t, resp.Success, resp.Error)
+		return resp.Message
+	}
+
+	root := send(alice.Id, "lunch?", 0)
+	other := send(bob.Id, "unrelated", 0)
+	first := send(bob.Id, "pizza", root.Seq)
+	assert.Equal(t, root.Id, first.ThreadId)
+	assert.Equal(t, root.Seq, first.ThreadSeq)
+	assert.Equal(t, root.Id, first.ReplyTo)
+
+	second := send(carol.Id, "+1", first.Seq)
+	assert.Equal(t, root.Id, second.ThreadId, "Replies to replies stay in the same thread")
+	assert.Equal(t, first.Id, second.ReplyTo)
+	for i := 0; i < 3; i++ {
+		send(alice.Id, fmt.Sprintf("more %d", i), root.Seq)
+	}
+
+	history, err := service.GetHistory(asUser(carol.Id), &pb.GetHistoryRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.Len(t, history.Messages, 2, "Replies should stay out of the room's history")
+	assert.Equal(t, int32(5), history.Messages[0].ReplyCount)
+	assert.Zero(t, history.Messages[1].ReplyCount)
+	assert.Equal(t, other.Id, history.Messages[1].Id)
+
+	var replies []string
+	req := &pb.GetThreadRequest{RoomId: room.Id, Seq: second.Seq, Limit: 2}
+	for {
+		resp, err := service.GetThread(asUser(carol.Id), req)
+		require.NoError(t, err)
+		assert.Equal(t, root.Id, resp.Root.Id, "Any message in the thread leads to its root")
+		assert.Equal(t, int32(5), resp.Root.ReplyCount)
+		for _, reply := range resp.Replies {
+			replies = append(replies, reply.Content)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req = &pb.GetThreadRequest{RoomId: room.Id, Seq: root.Seq, Limit: 2, PageToken: resp.NextPageToken}
+	}
+	assert.Equal(t, []string{"pizza", "+1", "more 0", "more 1", "more 2"}, replies)
+
+	_, err = service.GetThread(asUser(carol.Id), &pb.GetThreadRequest{RoomId: room.Id, Seq: other.Seq, PageToken: req.PageToken})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Page tokens belong to their thread")
+
+	resp, err := service.SendMessage(asUser(bob.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "?", ReplyToSeq: root.Seq + 1000})
+	require.NoError(t, err)
+	assert.False(t, resp.Success)
+
+	unread, err := service.store.CountMessages(room.Id, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), unread, "Replies should not count as unread room messages")
+
+	visibility := pb.ChatRoom_PRIVATE
+	updateResp, err := service.UpdateRoom(asUser(alice.Id), &pb.UpdateRoomRequest{RoomId: room.Id, Visibility: &visibility})
+	require.NoError(t, err)
+	require.True(t, updateResp.Success, updateResp.Error)
+	_, err = service.GetThread(asUser(stranger.Id), &pb.GetThreadRequest{RoomId: room.Id, Seq: root.Seq})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+const (
+	// typingThrottle is the minimum gap between two "started typing"
+	// indicators forwarded for the same user and room. Clients repeat them
+	// while the user keeps typing.
+	typingThrottle = 2 * time.Second
+	// typingExpiry is how long a user counts as typing without a refresh.
+	// Receivers apply the same timeout, so a lost "stopped" indicator only
+	// leaves a stale line on screen briefly.
+	typingExpiry = 10 * time.Second
+)
+
+type typingKey struct {
+	roomID string
+	userID string
+}
+
+// typingState remembers when each user last had a typing indicator
+// forwarded. It is per replica: a client whose calls are spread over several
+// replicas is throttled less strictly, which is harmless for indicators.
+type typingState struct {
+	mu   sync.Mutex
+	last map[typingKey]time.Time
+}
+
+// start reports whether a "started typing" indicator should be forwarded.
+func (t *typingState) start(key typingKey, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.last == nil {
+		t.last = make(map[typingKey]time.Time)
+	}
+	if last, ok := t.last[key]; ok && now.Sub(last) < typingThrottle {
+		return false
+	}
+	for k, last := range t.last {
+		if now.Sub(last) > typingExpiry {
+			delete(t.last, k)
+		}
+	}
+	t.last[key] = now
+	return true
+}
+
+// stop reports whether a "stopped typing" indicator should be forwarded,
+// which is only the case if receivers may still show the user as typing.
+func (t *typingState) stop(key typingKey, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last, ok := t.last[key]
+	delete(t.last, key)
+	return ok && now.Sub(last) <= typingExpiry
+}
+
+func (s *ChatService) SetTyping(ctx context.Context, req *pb.SetTypingRequest) (*pb.SetTypingResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room, _, err := s.store.GetRoom(req.RoomId)
+	if errors.Is(err, store.ErrNotFound) {
+		return &pb.SetTypingResponse{
+			Success: false,
+			Error:   "Room not found",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", req.RoomId, err)
+		return &pb.SetTypingResponse{
+			Success: false,
+			Error:   "Failed to retrieve room",
+		}, nil
+	}
+
+	if !isMember(room, me.UserID) {
+		return &pb.SetTypingResponse{
+			Success: false,
+			Error:   "Not a member of this room",
+		}, nil
+	}
+
+	key := typingKey{roomID: room.Id, userID: me.UserID}
+	now := time.Now()
+	if req.Typing && !s.typing.start(key, now) {
+		return &pb.SetTypingResponse{
+			Success: true,
+		}, nil
+	}
+	if !req.Typing && !s.typing.stop(key, now) {
+		return &pb.SetTypingResponse{
+			Success: true,
+		}, nil
+	}
+
+	user, _, err := s.store.GetUser(me.UserID)
+	if err != nil {
+		log.Printf("Error loading user %s: %v", me.UserID, err)
+		return &pb.SetTypingResponse{
+			Success: false,
+			Error:   "Unknown user",
+		}, nil
+	}
+
+	s.publishTyping(room.Id, user, req.Typing)
+	return &pb.SetTypingResponse{
+		Success: true,
+	}, nil
+}
+
+// stopTyping announces that user stopped typing in roomID, if they were.
+func (s *ChatService) stopTyping(roomID string, user *pb.User) {
+	if s.typing.stop(typingKey{roomID: roomID, userID: user.Id}, time.Now()) {
+		s.publishTyping(roomID, user, false)
+	}
+}
+
+// publishTyping broadcasts a typing indicator. Failures are only logged, as
+// indicators are best effort.
+func (s *ChatService) publishTyping(roomID string, user *pb.User, typing bool) {
+	err := s.store.PublishTyping(&pb.TypingIndicator{
+		RoomId:    roomID,
+		UserId:    user.Id,
+		Username:  user.Username,
+		Typing:    typing,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Printf("Error publishing typing indicator: %v", err)
+	}
+}
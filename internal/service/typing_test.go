@@ -0,0 +1,73 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestSetTyping(t *testing.T) {
+	service := setupTestService(t)
+	alice := register(t, service, "alice")
+	ctx := asUser(alice.Id)
+
+	var (
+		mu         sync.Mutex
+		indicators []bool
+	)
+	cancel, err := service.store.SubscribeTyping("general", func(ind *pb.TypingIndicator) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "alice", ind.Username)
+		indicators = append(indicators, ind.Typing)
+	})
+	require.NoError(t, err)
+	defer cancel()
+
+	resp, err := service.SetTyping(ctx, &pb.SetTypingRequest{RoomId: "general", Typing: true})
+	require.NoError(t, err)
+	assert.False(t, resp.Success, "Only members may send typing indicators")
+
+	joinResp, err := service.JoinRoom(ctx, &pb.JoinRoomRequest{RoomId: "general"})
+	require.NoError(t, err)
+	require.True(t, joinResp.Success)
+
+	for i := 0; i < 3; i++ {
+		resp, err = service.SetTyping(ctx, &pb.SetTypingRequest{RoomId: "general", Typing: true})
+		require.NoError(t, err)
+		require.True(t, resp.Success)
+	}
+
+	_, err = service.SendMessage(ctx, &pb.SendMessageRequest{RoomId: "general", Content: "hi"})
+	require.NoError(t, err)
+
+	// Already stopped by sending the message, so nothing more is published.
+	resp, err = service.SetTyping(ctx, &pb.SetTypingRequest{RoomId: "general", Typing: false})
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []bool{true, false}, indicators, "Repeated starts should be throttled")
+}
+
+func TestTypingStateThrottles(t *testing.T) {
+	var state typingState
+	key := typingKey{roomID: "room", userID: "user"}
+	now := time.Now()
+
+	assert.True(t, state.start(key, now))
+	assert.False(t, state.start(key, now.Add(typingThrottle/2)))
+	assert.True(t, state.start(key, now.Add(typingThrottle)))
+
+	assert.True(t, state.stop(key, now.Add(typingThrottle)))
+	assert.False(t, state.stop(key, now.Add(typingThrottle)), "A second stop has nothing to announce")
+
+	assert.True(t, state.start(key, now))
+	assert.False(t, state.stop(key, now.Add(2*typingExpiry)), "Receivers have already expired the indicator")
+}
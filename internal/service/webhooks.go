@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	"github.com/amirhlashgari/snapp-chat/internal/webhook"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxWebhooks is how many webhooks a room can have.
+	maxWebhooks = 10
+	// maxWebhookURLLength bounds webhook URLs, in bytes.
+	maxWebhookURLLength = 2048
+
+	defaultDeliveriesLimit = 20
+	maxDeliveriesLimit     = 100
+)
+
+// RunWebhooks delivers room events to webhooks and retries the deliveries
+// that failed, until ctx is cancelled. Every replica can run it.
+func (s *ChatService) RunWebhooks(ctx context.Context) {
+	s.webhooks.Run(ctx)
+}
+
+// AllowPrivateWebhooks lets webhooks reach loopback, private and link-local
+// addresses, such as a receiver running next to the server for testing. By
+// default they are refused, so that room owners cannot probe the network the
+// server runs in. It must be called before the service handles requests.
+func (s *ChatService) AllowPrivateWebhooks(allow bool) {
+	s.webhooks.Client = webhook.NewClient(allow)
+}
+
+func (s *ChatService) CreateWebhook(ctx context.Context, req *pb.CreateWebhookRequest) (*pb.CreateWebhookResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := validateWebhook(req.Url, req.Events); problem != "" {
+		return &pb.CreateWebhookResponse{
+			Success: false,
+			Error:   problem,
+		}, nil
+	}
+
+	room, err := s.webhookRoom(me, req.RoomId)
+	var hooks []*pb.Webhook
+	if err == nil {
+		hooks, err = s.store.GetWebhooks(room.Id)
+	}
+	if err == nil && len(hooks) >= maxWebhooks {
+		err = validationError(fmt.Sprintf("Rooms can have at most %d webhooks", maxWebhooks))
+	}
+	if err != nil {
+		return &pb.CreateWebhookResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		log.Printf("Error generating webhook secret: %v", err)
+		return &pb.CreateWebhookResponse{
+			Success: false,
+			Error:   "Failed to create webhook",
+		}, nil
+	}
+	hook := &pb.Webhook{
+		Id:        uuid.New().String(),
+		RoomId:    room.Id,
+		Url:       req.Url,
+		Secret:    secret,
+		Events:    req.Events,
+		CreatedBy: me.UserID,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := s.store.SaveWebhook(hook); err != nil {
+		log.Printf("Error saving webhook for room %s: %v", room.Id, err)
+		return &pb.CreateWebhookResponse{
+			Success: false,
+			Error:   "Failed to create webhook",
+		}, nil
+	}
+	s.webhooks.Forget(room.Id)
+
+	return &pb.CreateWebhookResponse{
+		Success: true,
+		Webhook: hook,
+	}, nil
+}
+
+func (s *ChatService) ListWebhooks(ctx context.Context, req *pb.ListWebhooksRequest) (*pb.ListWebhooksResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.webhookRoom(me, req.RoomId)
+	if err != nil {
+		return nil, webhookStatus(err)
+	}
+	hooks, err := s.store.GetWebhooks(room.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %v", err)
+	}
+
+	// Secrets are only shown once, when the webhook is created.
+	for _, hook := range hooks {
+		hook.Secret = ""
+	}
+	return &pb.ListWebhooksResponse{Webhooks: hooks}, nil
+}
+
+func (s *ChatService) DeleteWebhook(ctx context.Context, req *pb.DeleteWebhookRequest) (*pb.DeleteWebhookResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.webhookRoom(me, req.RoomId)
+	if err == nil {
+		err = s.store.DeleteWebhook(room.Id, req.WebhookId)
+		if errors.Is(err, store.ErrNotFound) {
+			err = validationError("Webhook not found")
+		}
+	}
+	if err != nil {
+		return &pb.DeleteWebhookResponse{
+			Success: false,
+			Error:   roomError(req.RoomId, err),
+		}, nil
+	}
+	s.webhooks.Forget(room.Id)
+
+	return &pb.DeleteWebhookResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *ChatService) ListWebhookDeliveries(ctx context.Context, req *pb.ListWebhookDeliveriesRequest) (*pb.ListWebhookDeliveriesResponse, error) {
+	me, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.webhookRoom(me, req.RoomId)
+	if err != nil {
+		return nil, webhookStatus(err)
+	}
+	hooks, err := s.store.GetWebhooks(room.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %v", err)
+	}
+	found := false
+	for _, hook := range hooks {
+		found = found || hook.Id == req.WebhookId
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, "webhook not found")
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultDeliveriesLimit
+	}
+	limit = min(limit, maxDeliveriesLimit)
+
+	deliveries, err := s.store.GetDeliveries(req.WebhookId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deliveries: %v", err)
+	}
+	return &pb.ListWebhookDeliveriesResponse{Deliveries: deliveries}, nil
+}
+
+// webhookRoom returns roomID if me may manage its webhooks, which owners and
+// moderators of rooms other than direct conversations can.
+func (s *ChatService) webhookRoom(me auth.Identity, roomID string) (*pb.ChatRoom, error) {
+	room, _, err := s.store.GetRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !visibleInList(room, me.UserID) {
+		return nil, store.ErrNotFound
+	}
+	if room.Direct || roleOf(room, me.UserID) < pb.ChatRoom_MODERATOR {
+		return nil, errNotModerator
+	}
+	return room, nil
+}
+
+// webhookStatus turns an error from webhookRoom into a gRPC status.
+func webhookStatus(err error) error {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return status.Error(codes.NotFound, "room not found")
+	case errors.Is(err, errNotModerator):
+		return status.Error(codes.PermissionDenied, "only moderators can manage webhooks")
+	}
+	return fmt.Errorf("failed to get room: %v", err)
+}
+
+// validateWebhook describes what is wrong with a webhook's URL or events, or
+// returns "" if they can be used.
+func validateWebhook(rawURL string, events []pb.Event_Type) string {
+	if len(rawURL) > maxWebhookURLLength {
+		return "Webhook URL is too long"
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "Webhook URL must be an http or https URL"
+	}
+	for _, eventType := range events {
+		if _, ok := pb.Event_Type_name[int32(eventType)]; !ok || eventType == pb.Event_UNKNOWN {
+			return "Unknown event type"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/amirhlashgari/snapp-chat/internal/webhook"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestWebhooks(t *testing.T) {
+	service := setupTestService(t)
+	service.AllowPrivateWebhooks(true)
+	service.webhooks.Backoff = func(int) time.Duration { return time.Millisecond }
+	service.webhooks.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.RunWebhooks(ctx)
+	room, alice, bob, carol, _ := moderatedRoom(t, service)
+
+	var mu sync.Mutex
+	var secret string
+	var payloads []*pb.WebhookPayload
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if err := webhook.Verify(secret, r.Header.Get(webhook.SignatureHeader), body, time.Minute, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		payload := &pb.WebhookPayload{}
+		if err := protojson.Unmarshal(body, payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer receiver.Close()
+
+	create := func(userID, url string, events ...pb.Event_Type) *pb.CreateWebhookResponse {
+		resp, err := service.CreateWebhook(asUser(userID), &pb.CreateWebhookRequest{RoomId: room.Id, Url: url, Events: events})
+		require.NoError(t, err)
+		return resp
+	}
+
+	assert.False(t, create(carol.Id, receiver.URL).Success, "Members cannot add webhooks")
+	assert.False(t, create(bob.Id, "ftp://example.com/hook").Success)
+	assert.False(t, create(bob.Id, "http:///hook").Success)
+	assert.False(t, create(bob.Id, receiver.URL, pb.Event_UNKNOWN).Success)
+
+	createResp := create(bob.Id, receiver.URL, pb.Event_MESSAGE_SENT)
+	require.True(t, createResp.Success, createResp.Error)
+	hook := createResp.Webhook
+	assert.NotEmpty(t, hook.Secret, "The secret should be shown when the webhook is created")
+	assert.Equal(t, bob.Id, hook.CreatedBy)
+	mu.Lock()
+	secret = hook.Secret
+	mu.Unlock()
+
+	sendResp, err := service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "hello hooks"})
+	require.NoError(t, err)
+	require.True(t, sendResp.Success, sendResp.Error)
+	_, err = service.EditMessage(asUser(carol.Id), &pb.EditMessageRequest{RoomId: room.Id, Seq: sendResp.Message.Seq, Content: "edited"})
+	require.NoError(t, err)
+	service.webhooks.Wait()
+
+	mu.Lock()
+	require.Len(t, payloads, 1, "Only the events the webhook asked for should be sent")
+	assert.Equal(t, hook.Id, payloads[0].WebhookId)
+	assert.Equal(t, room.Id, payloads[0].RoomId)
+	assert.Equal(t, pb.Event_MESSAGE_SENT, payloads[0].Event.Type)
+	assert.Equal(t, "hello hooks", payloads[0].Event.GetMessage().Content)
+	mu.Unlock()
+
+	_, err = service.ListWebhooks(asUser(carol.Id), &pb.ListWebhooksRequest{RoomId: room.Id})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	listResp, err := service.ListWebhooks(asUser(alice.Id), &pb.ListWebhooksRequest{RoomId: room.Id})
+	require.NoError(t, err)
+	require.Len(t, listResp.Webhooks, 1)
+	assert.Equal(t, hook.Id, listResp.Webhooks[0].Id)
+	assert.Empty(t, listResp.Webhooks[0].Secret, "Secrets should not be listed")
+
+	deliveriesResp, err := service.ListWebhookDeliveries(asUser(bob.Id), &pb.ListWebhookDeliveriesRequest{RoomId: room.Id, WebhookId: hook.Id})
+	require.NoError(t, err)
+	require.Len(t, deliveriesResp.Deliveries, 1)
+	assert.Equal(t, pb.WebhookDelivery_DELIVERED, deliveriesResp.Deliveries[0].State)
+	assert.Equal(t, int32(1), deliveriesResp.Deliveries[0].Attempts)
+	_, err = service.ListWebhookDeliveries(asUser(bob.Id), &pb.ListWebhookDeliveriesRequest{RoomId: room.Id, WebhookId: "other"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	deleteResp, err := service.DeleteWebhook(asUser(carol.Id), &pb.DeleteWebhookRequest{RoomId: room.Id, WebhookId: hook.Id})
+	require.NoError(t, err)
+	assert.False(t, deleteResp.Success, "Members cannot remove webhooks")
+	deleteResp, err = service.DeleteWebhook(asUser(bob.Id), &pb.DeleteWebhookRequest{RoomId: room.Id, WebhookId: hook.Id})
+	require.NoError(t, err)
+	require.True(t, deleteResp.Success, deleteResp.Error)
+	deleteResp, err = service.DeleteWebhook(asUser(bob.Id), &pb.DeleteWebhookRequest{RoomId: room.Id, WebhookId: hook.Id})
+	require.NoError(t, err)
+	assert.Equal(t, "Webhook not found", deleteResp.Error)
+
+	_, err = service.SendMessage(asUser(carol.Id), &pb.SendMessageRequest{RoomId: room.Id, Content: "nobody listening"})
+	require.NoError(t, err)
+	service.webhooks.Wait()
+	mu.Lock()
+	assert.Len(t, payloads, 1, "Removed webhooks should get nothing")
+	mu.Unlock()
+
+	dm, err := service.SendDirectMessage(asUser(alice.Id), &pb.SendDirectMessageRequest{RecipientId: bob.Id, Content: "hi"})
+	require.NoError(t, err)
+	require.True(t, dm.Success, dm.Error)
+	directResp, err := service.CreateWebhook(asUser(alice.Id), &pb.CreateWebhookRequest{RoomId: dm.Message.RoomId, Url: receiver.URL})
+	require.NoError(t, err)
+	assert.False(t, directResp.Success, "Direct conversations cannot have webhooks")
+}
@@ -0,0 +1,575 @@
+// Package webhook delivers room events to HTTP endpoints. Every request is
+// signed with the webhook's secret, and failed deliveries are retried with
+// exponential backoff from a queue kept in the store, so they survive
+// restarts and are picked up by whichever replica is running. Their progress
+// is recorded in the store too, where room moderators can look it up.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Headers of webhook requests.
+const (
+	// SignatureHeader holds "t=<unix time>,v1=<signature>", where the
+	// signature is the hex HMAC-SHA256 of "<unix time>.<body>".
+	SignatureHeader = "X-Chat-Signature"
+	// DeliveryHeader holds the delivery ID, which stays the same when a
+	// delivery is retried.
+	DeliveryHeader = "X-Chat-Delivery"
+	// EventHeader holds the event type, e.g. MESSAGE_SENT.
+	EventHeader = "X-Chat-Event"
+)
+
+const (
+	// DefaultMaxAttempts is how often a delivery is tried before it is
+	// given up on. With the default backoff that takes about four minutes.
+	DefaultMaxAttempts = 8
+	// requestTimeout bounds a single attempt.
+	requestTimeout = 10 * time.Second
+	// claimTimeout is how long a replica has for an attempt before others
+	// take it that the replica stopped and make the attempt themselves.
+	claimTimeout = 3 * requestTimeout
+	// pollInterval is how often the retry queue is checked for deliveries
+	// that are due.
+	pollInterval = time.Second
+	// eventBuffer is how many events may wait for Run before further ones
+	// are dropped.
+	eventBuffer = 1024
+	// cacheTTL is how long a room's webhooks, or the lack of them, are
+	// cached. Webhooks added or removed through another replica are noticed
+	// here after at most this long; until then events keep going to removed
+	// webhooks, though not their retries.
+	cacheTTL = 10 * time.Second
+)
+
+// ErrPrivateAddress is returned for endpoints on loopback, private or
+// link-local addresses, which clients built by NewClient refuse to reach
+// unless told otherwise. Otherwise anyone who can create a room could use
+// webhooks to probe the network the server runs in.
+var ErrPrivateAddress = errors.New("address is not public")
+
+// blockedPrefixes are ranges that are not public but that netip does not
+// already recognize as such.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // shared by carrier-grade NATs
+}
+
+// NewClient returns the HTTP client webhooks are delivered with. It does
+// not follow redirects, which would turn POSTs into GETs or send them
+// somewhere nobody registered, and unless allowPrivate is set it only
+// connects to public addresses. The check is made on the address actually
+// dialed, so host names resolving to private addresses are refused too.
+func NewClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: requestTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublic(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, addrPort.Addr())
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the endpoint, so its address is
+	// all the check above would see.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       requestTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewSecret returns a random secret to sign a webhook's requests with.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the SignatureHeader value for body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + signature(secret, timestamp, body)
+}
+
+func signature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks that header, the SignatureHeader of a request, signs body
+// with secret and was made within tolerance of now, so that old requests
+// cannot be replayed. Receivers written in Go can use it as is.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp, sig string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			sig = value
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || sig == "" {
+		return errors.New("malformed signature header")
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature is too old")
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, timestamp, body))) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// DefaultBackoff waits two seconds after the first attempt and doubles the
+// wait after every further one, up to ten minutes, with some jitter so that
+// endpoints coming back up are not hit by every retry at once.
+func DefaultBackoff(attempt int) time.Duration {
+	wait := min(2*time.Second<<(attempt-1), 10*time.Minute)
+	return wait + time.Duration(mrand.Int64N(int64(wait/5)+1))
+}
+
+// Dispatcher delivers events to the webhooks of the rooms they belong to.
+// Its fields may be changed before Run is called.
+//
+// Each replica caches the webhooks of the rooms it sees events for, see
+// cacheTTL. Changes made through this replica take effect right away.
+type Dispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	// Backoff returns how long to wait after the given failed attempt,
+	// counting from 1.
+	Backoff func(attempt int) time.Duration
+	// PollInterval is how often the retry queue is checked for deliveries
+	// that are due.
+	PollInterval time.Duration
+
+	store  store.Store
+	events chan *pb.Event
+	// busy counts the events queued and the deliveries being attempted
+	// here.
+	busy atomic.Int64
+
+	mu    sync.Mutex
+	cache map[string]cachedHooks
+}
+
+type cachedHooks struct {
+	hooks   []*pb.Webhook
+	expires time.Time
+}
+
+func NewDispatcher(st store.Store) *Dispatcher {
+	return &Dispatcher{
+		Client:       NewClient(false),
+		MaxAttempts:  DefaultMaxAttempts,
+		Backoff:      DefaultBackoff,
+		PollInterval: pollInterval,
+		store:        st,
+		events:       make(chan *pb.Event, eventBuffer),
+		cache:        make(map[string]cachedHooks),
+	}
+}
+
+// Dispatch queues ev for the webhooks that want it. It never blocks: Run
+// looks the webhooks up and makes the deliveries, which may arrive in any
+// order.
+func (d *Dispatcher) Dispatch(ev *pb.Event) {
+	if eventRoom(ev) == "" {
+		return
+	}
+
+	d.busy.Add(1)
+	select {
+	case d.events <- proto.Clone(ev).(*pb.Event):
+	default:
+		d.busy.Add(-1)
+		log.Printf("Dropping %s event for webhooks: too many events waiting", ev.Type)
+	}
+}
+
+// Run looks up the webhooks of dispatched events, starts their deliveries
+// and retries those that are due, until ctx is cancelled. Every replica can
+// run one: retries are claimed with compare-and-set, so each attempt is made
+// by one of them.
+//
+// Attempts cut short by cancelling ctx are made again once their claim
+// lapses, so an endpoint may see a delivery twice; the DeliveryHeader tells
+// it so. Events dispatched but not routed yet are dropped.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var running sync.WaitGroup
+	defer running.Wait()
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-d.events:
+			d.route(ctx, ev, &running)
+			d.busy.Add(-1)
+		case <-ticker.C:
+			d.retryDue(ctx, &running)
+		}
+	}
+}
+
+// Forget drops the cached webhooks of roomID after they changed.
+func (d *Dispatcher) Forget(roomID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.cache, roomID)
+}
+
+// Wait blocks until every delivery dispatched here so far has succeeded or
+// been given up on, and the retry queue is empty. Run must be running. It is
+// meant for tests.
+func (d *Dispatcher) Wait() {
+	for {
+		if d.busy.Load() == 0 {
+			retries, err := d.store.GetRetries()
+			if err == nil && len(retries) == 0 {
+				return
+			}
+		}
+		time.Sleep(d.PollInterval)
+	}
+}
+
+func (d *Dispatcher) hooks(roomID string) ([]*pb.Webhook, error) {
+	d.mu.Lock()
+	cached, ok := d.cache[roomID]
+	d.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.hooks, nil
+	}
+
+	hooks, err := d.store.GetWebhooks(roomID)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.cache[roomID] = cachedHooks{hooks: hooks, expires: time.Now().Add(cacheTTL)}
+	d.mu.Unlock()
+	return hooks, nil
+}
+
+// eventRoom returns the room ev belongs to, or "" if it should not go to
+// any webhook. Events addressed to a single user are for them alone.
+func eventRoom(ev *pb.Event) string {
+	switch {
+	case ev.RecipientId != "":
+		return ""
+	case ev.RoomId != "":
+		return ev.RoomId
+	case ev.GetRoom() != nil:
+		// Public rooms' lifecycle events are broadcast to everyone.
+		return ev.GetRoom().Id
+	}
+	return ""
+}
+
+func containsType(types []pb.Event_Type, t pb.Event_Type) bool {
+	for _, other := range types {
+		if other == t {
+			return true
+		}
+	}
+	return false
+}
+
+// route starts a delivery of ev to each webhook of its room that wants it.
+func (d *Dispatcher) route(ctx context.Context, ev *pb.Event, running *sync.WaitGroup) {
+	roomID := eventRoom(ev)
+	hooks, err := d.hooks(roomID)
+	if err != nil {
+		log.Printf("Error loading webhooks of room %s: %v", roomID, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if len(hook.Events) > 0 && !containsType(hook.Events, ev.Type) {
+			continue
+		}
+		d.busy.Add(1)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer d.busy.Add(-1)
+			d.start(ctx, hook, ev)
+		}()
+	}
+}
+
+// start records a new delivery of ev to hook and makes its first attempt.
+func (d *Dispatcher) start(ctx context.Context, hook *pb.Webhook, ev *pb.Event) {
+	// Version 7 IDs sort by time, which is how deliveries are listed.
+	id, err := uuid.NewV7()
+	if err != nil {
+		log.Printf("Error creating delivery ID: %v", err)
+		return
+	}
+
+	now := time.Now()
+	retry := &pb.WebhookRetry{
+		Delivery: &pb.WebhookDelivery{
+			Id:            id.String(),
+			WebhookId:     hook.Id,
+			EventType:     ev.Type,
+			State:         pb.WebhookDelivery_PENDING,
+			CreatedAt:     now.Unix(),
+			UpdatedAt:     now.Unix(),
+			NextAttemptAt: now.Add(claimTimeout).Unix(),
+		},
+		RoomId: hook.RoomId,
+		Event:  ev,
+	}
+	// The retry is stored first, so that the delivery is made even if this
+	// replica stops before it is settled.
+	revision, err := d.store.CompareAndSaveRetry(retry, 0)
+	if err != nil {
+		log.Printf("Error queueing webhook delivery %s: %v", retry.Delivery.Id, err)
+		return
+	}
+	d.save(retry.Delivery)
+
+	d.attempt(ctx, hook, retry, revision)
+}
+
+// retryDue claims the retries that are due and attempts them.
+func (d *Dispatcher) retryDue(ctx context.Context, running *sync.WaitGroup) {
+	retries, err := d.store.GetRetries()
+	if err != nil {
+		log.Printf("Error loading webhook retries: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, retry := range retries {
+		if retry.GetDelivery().GetNextAttemptAt() > now.Unix() {
+			continue
+		}
+		retry, revision, ok := d.claim(retry.GetDelivery().GetId(), now)
+		if !ok {
+			continue
+		}
+
+		d.busy.Add(1)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer d.busy.Add(-1)
+			d.retry(ctx, retry, revision)
+		}()
+	}
+}
+
+// claim takes a due retry for this replica, reporting false if it is not
+// due anymore or another replica took it first.
+func (d *Dispatcher) claim(deliveryID string, now time.Time) (*pb.WebhookRetry, uint64, bool) {
+	retry, revision, err := d.store.GetRetry(deliveryID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("Error loading webhook retry %s: %v", deliveryID, err)
+		}
+		return nil, 0, false
+	}
+	if retry.GetDelivery().GetNextAttemptAt() > now.Unix() {
+		return nil, 0, false
+	}
+
+	retry.Delivery.NextAttemptAt = now.Add(claimTimeout).Unix()
+	revision, err = d.store.CompareAndSaveRetry(retry, revision)
+	if err != nil {
+		if !errors.Is(err, store.ErrConflict) {
+			log.Printf("Error claiming webhook retry %s: %v", deliveryID, err)
+		}
+		return nil, 0, false
+	}
+	return retry, revision, true
+}
+
+// retry makes the next attempt at a claimed delivery, unless its webhook
+// has been removed since.
+func (d *Dispatcher) retry(ctx context.Context, retry *pb.WebhookRetry, revision uint64) {
+	// The webhook is loaded afresh, so that removing it stops its retries
+	// right away.
+	hooks, err := d.store.GetWebhooks(retry.RoomId)
+	if err != nil {
+		log.Printf("Error loading webhooks of room %s: %v", retry.RoomId, err)
+		return
+	}
+	i := slices.IndexFunc(hooks, func(hook *pb.Webhook) bool { return hook.Id == retry.Delivery.WebhookId })
+	if i < 0 {
+		retry.Delivery.State = pb.WebhookDelivery_FAILED
+		retry.Delivery.Error = "webhook was removed"
+		retry.Delivery.UpdatedAt = time.Now().Unix()
+		retry.Delivery.NextAttemptAt = 0
+		d.settle(retry.Delivery)
+		return
+	}
+
+	d.attempt(ctx, hooks[i], retry, revision)
+}
+
+// attempt sends a claimed delivery to hook once, then records whether it
+// succeeded, was given up on or is to be retried.
+func (d *Dispatcher) attempt(ctx context.Context, hook *pb.Webhook, retry *pb.WebhookRetry, revision uint64) {
+	delivery := retry.Delivery
+	code, err := d.post(ctx, hook, retry)
+	if ctx.Err() != nil {
+		// Shutting down: the attempt is made again once the claim lapses.
+		return
+	}
+
+	delivery.Attempts++
+	delivery.StatusCode = int32(code)
+	delivery.UpdatedAt = time.Now().Unix()
+	delivery.NextAttemptAt = 0
+	delivery.Error = ""
+
+	switch {
+	case err == nil:
+		delivery.State = pb.WebhookDelivery_DELIVERED
+	case permanent(code) || errors.Is(err, ErrPrivateAddress) || delivery.Attempts >= int32(d.MaxAttempts):
+		delivery.State = pb.WebhookDelivery_FAILED
+		delivery.Error = err.Error()
+	default:
+		delivery.Error = err.Error()
+		delivery.NextAttemptAt = time.Now().Add(d.Backoff(int(delivery.Attempts))).Unix()
+		if _, err := d.store.CompareAndSaveRetry(retry, revision); err != nil {
+			// Another replica took over after the claim lapsed, and records
+			// the delivery from now on.
+			log.Printf("Error rescheduling webhook delivery %s: %v", delivery.Id, err)
+			return
+		}
+		d.save(delivery)
+		return
+	}
+
+	d.settle(delivery)
+}
+
+// post makes one attempt at a delivery and returns the response's status
+// code, if there was a response.
+func (d *Dispatcher) post(ctx context.Context, hook *pb.Webhook, retry *pb.WebhookRetry) (int, error) {
+	body, err := protojson.Marshal(&pb.WebhookPayload{
+		DeliveryId: retry.Delivery.Id,
+		WebhookId:  hook.Id,
+		RoomId:     retry.RoomId,
+		Event:      retry.Event,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to render %s event: %v", retry.Event.GetType(), err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, time.Now(), body))
+	req.Header.Set(DeliveryHeader, retry.Delivery.Id)
+	req.Header.Set(EventHeader, retry.Delivery.EventType.String())
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Reading the body lets the connection be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// permanent reports whether a response with status code means retrying
+// will not help: the endpoint is there, but rejects or redirects the
+// request.
+func permanent(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return code >= 300 && code < 500
+}
+
+// settle records the final state of a delivery and takes it out of the
+// retry queue. Should the second step fail, the delivery is only attempted
+// once more.
+func (d *Dispatcher) settle(delivery *pb.WebhookDelivery) {
+	d.save(delivery)
+	if err := d.store.DeleteRetry(delivery.Id); err != nil {
+		log.Printf("Error removing webhook retry %s: %v", delivery.Id, err)
+	}
+}
+
+func (d *Dispatcher) save(delivery *pb.WebhookDelivery) {
+	if err := d.store.SaveDelivery(delivery); err != nil {
+		log.Printf("Error saving webhook delivery %s: %v", delivery.Id, err)
+	}
+}
@@ -0,0 +1,227 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"event":{}}`)
+	header := Sign("secret", now, body)
+
+	assert.NoError(t, Verify("secret", header, body, time.Minute, now.Add(30*time.Second)))
+	assert.Error(t, Verify("other", header, body, time.Minute, now), "A different secret should not verify")
+	assert.Error(t, Verify("secret", header, []byte(`{"event":null}`), time.Minute, now), "A changed body should not verify")
+	assert.Error(t, Verify("secret", header, body, time.Minute, now.Add(2*time.Minute)), "Old signatures should not verify")
+	assert.Error(t, Verify("secret", "v1=abc", body, time.Minute, now))
+}
+
+// testDispatcher returns a running dispatcher that retries right away and
+// may reach the test servers, after applying options, and a function that
+// stops it.
+func testDispatcher(t *testing.T, st store.Store, options ...func(*Dispatcher)) (*Dispatcher, func()) {
+	d := NewDispatcher(st)
+	d.Client = NewClient(true)
+	d.Backoff = func(int) time.Duration { return time.Millisecond }
+	d.PollInterval = 10 * time.Millisecond
+	for _, option := range options {
+		option(d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		d.Run(ctx)
+	}()
+	stop := func() {
+		cancel()
+		<-stopped
+	}
+	t.Cleanup(stop)
+	return d, stop
+}
+
+func TestDispatcher(t *testing.T) {
+	st := store.NewMemoryStore()
+
+	var calls atomic.Int32
+	var received atomic.Pointer[http.Request]
+	var payload atomic.Pointer[pb.WebhookPayload]
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify("flaky-secret", r.Header.Get(SignatureHeader), body, time.Minute, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		p := &pb.WebhookPayload{}
+		if err := protojson.Unmarshal(body, p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received.Store(r)
+		payload.Store(p)
+	}))
+	defer flaky.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	defer gone.Close()
+
+	hooks := []*pb.Webhook{
+		{Id: "flaky", RoomId: "room", Url: flaky.URL, Secret: "flaky-secret", CreatedAt: 1},
+		{Id: "gone", RoomId: "room", Url: gone.URL, Secret: "gone-secret", CreatedAt: 2},
+		{Id: "edits", RoomId: "room", Url: gone.URL, Events: []pb.Event_Type{pb.Event_MESSAGE_EDITED}, CreatedAt: 3},
+	}
+	for _, hook := range hooks {
+		require.NoError(t, st.SaveWebhook(hook))
+	}
+
+	d, stop := testDispatcher(t, st)
+
+	d.Dispatch(&pb.Event{Type: pb.Event_MESSAGE_SENT, RoomId: "room", Payload: &pb.Event_Message{Message: &pb.Message{Content: "hi"}}})
+	// Events for a single user are not the room's.
+	d.Dispatch(&pb.Event{Type: pb.Event_MENTIONED, RoomId: "room", RecipientId: "someone"})
+	d.Dispatch(&pb.Event{Type: pb.Event_MESSAGE_SENT, RoomId: "elsewhere"})
+	d.Wait()
+
+	require.NotNil(t, payload.Load(), "The flaky endpoint should get the event once it recovers")
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Equal(t, "room", payload.Load().RoomId)
+	assert.Equal(t, "hi", payload.Load().Event.GetMessage().Content)
+	assert.Equal(t, "MESSAGE_SENT", received.Load().Header.Get(EventHeader))
+	assert.Equal(t, payload.Load().DeliveryId, received.Load().Header.Get(DeliveryHeader))
+
+	deliveries, err := st.GetDeliveries("flaky", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, pb.WebhookDelivery_DELIVERED, deliveries[0].State)
+	assert.Equal(t, int32(3), deliveries[0].Attempts)
+	assert.Equal(t, int32(http.StatusOK), deliveries[0].StatusCode)
+	assert.Empty(t, deliveries[0].Error)
+
+	deliveries, err = st.GetDeliveries("gone", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, pb.WebhookDelivery_FAILED, deliveries[0].State)
+	assert.Equal(t, int32(1), deliveries[0].Attempts, "A 404 should not be retried")
+	assert.Equal(t, int32(http.StatusNotFound), deliveries[0].StatusCode)
+
+	deliveries, err = st.GetDeliveries("edits", 10)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries, "Webhooks should only get the events they asked for")
+
+	stop()
+	d, _ = testDispatcher(t, st, func(d *Dispatcher) { d.MaxAttempts = 2 })
+	calls.Store(0)
+	payload.Store(nil)
+	d.Dispatch(&pb.Event{Type: pb.Event_MESSAGE_DELETED, RoomId: "room"})
+	d.Wait()
+	assert.Nil(t, payload.Load())
+	deliveries, err = st.GetDeliveries("flaky", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, pb.Event_MESSAGE_DELETED, deliveries[0].EventType, "The newest delivery should come first")
+	assert.Equal(t, pb.WebhookDelivery_FAILED, deliveries[0].State)
+	assert.Equal(t, int32(2), deliveries[0].Attempts)
+	assert.Contains(t, deliveries[0].Error, "503")
+}
+
+func TestPrivateAddressesAreRefused(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"::1":             false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+	} {
+		assert.Equal(t, public, isPublic(netip.MustParseAddr(addr)), addr)
+	}
+
+	var calls atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { calls.Add(1) }))
+	defer local.Close()
+
+	st := store.NewMemoryStore()
+	require.NoError(t, st.SaveWebhook(&pb.Webhook{Id: "local", RoomId: "room", Url: local.URL}))
+	d := NewDispatcher(st)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+	d.Dispatch(&pb.Event{Type: pb.Event_MESSAGE_SENT, RoomId: "room"})
+	d.Wait()
+
+	assert.Zero(t, calls.Load(), "Loopback endpoints should not be reached by default")
+	deliveries, err := st.GetDeliveries("local", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, pb.WebhookDelivery_FAILED, deliveries[0].State)
+	assert.Equal(t, int32(1), deliveries[0].Attempts, "Refused addresses should not be retried")
+	assert.Contains(t, deliveries[0].Error, "address is not public")
+}
+
+func TestDeliveriesSurviveRestarts(t *testing.T) {
+	st := store.NewMemoryStore()
+
+	block := make(chan struct{})
+	var calls atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// The first attempt hangs until the dispatcher has gone away.
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer endpoint.Close()
+	defer close(block)
+	require.NoError(t, st.SaveWebhook(&pb.Webhook{Id: "hook", RoomId: "room", Url: endpoint.URL}))
+
+	first, stop := testDispatcher(t, st)
+	first.Dispatch(&pb.Event{Type: pb.Event_MESSAGE_SENT, RoomId: "room"})
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	stop()
+
+	deliveries, err := st.GetDeliveries("hook", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, pb.WebhookDelivery_PENDING, deliveries[0].State, "Stopping should leave the delivery to be retried")
+
+	// Another replica, or this one after a restart, takes over once the
+	// claim lapses.
+	retry, revision, err := st.GetRetry(deliveries[0].Id)
+	require.NoError(t, err)
+	retry.Delivery.NextAttemptAt = time.Now().Unix()
+	_, err = st.CompareAndSaveRetry(retry, revision)
+	require.NoError(t, err)
+
+	second, _ := testDispatcher(t, st)
+	second.Wait()
+	deliveries, err = st.GetDeliveries("hook", 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, pb.WebhookDelivery_DELIVERED, deliveries[0].State)
+	assert.Equal(t, int32(1), deliveries[0].Attempts, "The attempt cut short should not count")
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,263 @@
+// Package bot lets Go programs add commands to the chat. A bot connects to
+// the NATS server the chat service uses, registers its commands, and answers
+// them when users run them in a room. It can also watch the messages sent to
+// rooms and post its own.
+//
+// Bots are trusted. Nothing proves who sent a request: a bot is whoever
+// names itself so, and anything that can connect to NATS can register a
+// bot, post as a running one, or answer its commands, and sees every room's
+// messages, private ones included. Only give NATS access to programs that
+// may do all of that.
+//
+// The service posts for a bot only in rooms its user could read, that is
+// public rooms. A user who runs a command waits for the bot's reply, for up
+// to five seconds.
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// renewInterval is how often a running bot renews its registration,
+	// well within the service's lease of a minute.
+	renewInterval = 20 * time.Second
+	// requestTimeout bounds a request to the chat service.
+	requestTimeout = 5 * time.Second
+)
+
+// Handler answers a command. It runs on its own goroutine for every call
+// and must return within the service's timeout of five seconds.
+type Handler func(cmd *pb.BotCommand) *pb.BotReply
+
+// Reply posts text in the room under the bot's name.
+func Reply(text string) *pb.BotReply {
+	return &pb.BotReply{Text: text}
+}
+
+// Private shows text only to the user who ran the command.
+func Private(text string) *pb.BotReply {
+	return &pb.BotReply{Text: text, Private: true}
+}
+
+// Errorf tells the user who ran the command that it failed.
+func Errorf(format string, args ...any) *pb.BotReply {
+	return &pb.BotReply{Error: fmt.Sprintf(format, args...)}
+}
+
+type Bot struct {
+	nc          *nats.Conn
+	name        string
+	description string
+	commands    []*pb.BotCommandInfo
+	handlers    map[string]Handler
+	onMessage   func(*pb.Message)
+
+	mu     sync.Mutex
+	userID string
+}
+
+// New returns a bot called name, which is also the username it posts
+// under. It must be 3-32 lowercase letters, digits, '_' or '-'.
+func New(nc *nats.Conn, name, description string) *Bot {
+	return &Bot{
+		nc:          nc,
+		name:        name,
+		description: description,
+		handlers:    make(map[string]Handler),
+	}
+}
+
+// Command adds the command /name, described in /help by usage, e.g.
+// "<sides>", and description. It must be called before Run.
+func (b *Bot) Command(name, usage, description string, handler Handler) {
+	b.commands = append(b.commands, &pb.BotCommandInfo{Name: name, Usage: usage, Description: description})
+	b.handlers[name] = handler
+}
+
+// OnMessage calls handler with every message sent to a room other than a
+// direct conversation, except the bot's own. When several instances of the
+// bot run, each message goes to one of them. It must be called before Run.
+func (b *Bot) OnMessage(handler func(*pb.Message)) {
+	b.onMessage = handler
+}
+
+// Run registers the bot and serves its commands until ctx is done, renewing
+// the registration as it goes. It only returns early if the first
+// registration fails.
+func (b *Bot) Run(ctx context.Context) error {
+	if err := b.register(); err != nil {
+		return err
+	}
+
+	var subs []*nats.Subscription
+	defer func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}()
+
+	// Every instance of a bot joins the same queue group, so each command
+	// is answered once.
+	sub, err := b.nc.QueueSubscribe(store.BotCommandsSubject(b.name), b.name, func(msg *nats.Msg) {
+		go b.handleCommand(msg)
+	})
+	if err != nil {
+		return err
+	}
+	subs = append(subs, sub)
+
+	if b.onMessage != nil {
+		sub, err := b.nc.QueueSubscribe(store.RoomEventsSubject, b.name, b.handleEvent)
+		if err != nil {
+			return err
+		}
+		subs = append(subs, sub)
+	}
+
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := b.register(); err != nil {
+				log.Printf("Error renewing registration of bot %s: %v", b.name, err)
+			}
+		}
+	}
+}
+
+// Post sends content to a room under the bot's name. Private rooms and
+// direct conversations are refused.
+func (b *Bot) Post(roomID, content string) (*pb.Message, error) {
+	return b.PostReply(roomID, 0, content)
+}
+
+// PostReply sends content to a room as a reply to the message with
+// sequence replyToSeq.
+func (b *Bot) PostReply(roomID string, replyToSeq uint64, content string) (*pb.Message, error) {
+	resp, err := b.request(&pb.BotRequest{
+		Bot: b.name,
+		Request: &pb.BotRequest_Post_{Post: &pb.BotRequest_Post{
+			RoomId:     roomID,
+			Content:    content,
+			ReplyToSeq: replyToSeq,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Message, nil
+}
+
+func (b *Bot) register() error {
+	resp, err := b.request(&pb.BotRequest{
+		Bot: b.name,
+		Request: &pb.BotRequest_Register{Register: &pb.BotRequest_Registration{
+			Description: b.description,
+			Commands:    b.commands,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register bot %s: %w", b.name, err)
+	}
+
+	b.mu.Lock()
+	b.userID = resp.Bot.UserId
+	b.mu.Unlock()
+	return nil
+}
+
+// request sends req to the chat service and turns an unsuccessful response
+// into an error.
+func (b *Bot) request(req *pb.BotRequest) (*pb.BotResponse, error) {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := b.nc.Request(store.BotRequestsSubject, data, requestTimeout)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, errors.New("the chat service is not running")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp pb.BotResponse
+	if err := proto.Unmarshal(msg.Data, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+func (b *Bot) handleCommand(msg *nats.Msg) {
+	var cmd pb.BotCommand
+	reply := Errorf("Invalid command")
+	if err := proto.Unmarshal(msg.Data, &cmd); err == nil {
+		reply = b.runHandler(&cmd)
+	}
+
+	data, err := proto.Marshal(reply)
+	if err != nil {
+		log.Printf("Error marshaling reply to /%s: %v", cmd.Command, err)
+		return
+	}
+	if err := msg.Respond(data); err != nil {
+		log.Printf("Error replying to /%s: %v", cmd.Command, err)
+	}
+}
+
+// runHandler runs the handler of cmd, turning a panic into an error for the
+// user rather than taking the bot down.
+func (b *Bot) runHandler(cmd *pb.BotCommand) (reply *pb.BotReply) {
+	handler, ok := b.handlers[cmd.Command]
+	if !ok {
+		return Errorf("%s has no command /%s", b.name, cmd.Command)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Command /%s panicked: %v", cmd.Command, r)
+			reply = Errorf("/%s failed", cmd.Command)
+		}
+	}()
+	if reply = handler(cmd); reply == nil {
+		reply = &pb.BotReply{}
+	}
+	return reply
+}
+
+func (b *Bot) handleEvent(msg *nats.Msg) {
+	var ev pb.Event
+	if err := proto.Unmarshal(msg.Data, &ev); err != nil {
+		log.Printf("Error unmarshaling event: %v", err)
+		return
+	}
+	if ev.Type != pb.Event_MESSAGE_SENT || store.IsDirectRoom(ev.RoomId) {
+		return
+	}
+
+	b.mu.Lock()
+	userID := b.userID
+	b.mu.Unlock()
+	if message := ev.GetMessage(); message != nil && message.UserId != userID {
+		b.onMessage(message)
+	}
+}
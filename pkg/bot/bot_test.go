@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/amirhlashgari/snapp-chat/internal/auth"
+	"github.com/amirhlashgari/snapp-chat/internal/service"
+	store "github.com/amirhlashgari/snapp-chat/pkg/nats"
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+// setupTestService runs a chat service serving bots against the local NATS
+// server.
+func setupTestService(t *testing.T) (*nats.Conn, *service.ChatService) {
+	nc, err := nats.Connect(nats.DefaultURL)
+	require.NoError(t, err, "Failed to connect to NATS")
+	t.Cleanup(nc.Close)
+
+	st, err := store.NewJetStreamStore(nc)
+	require.NoError(t, err)
+	tokens, err := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), time.Hour)
+	require.NoError(t, err)
+	chat := service.NewChatService(st, tokens, service.DefaultPresenceWindow)
+	// Waiting for the bot to register sends messages in a loop.
+	chat.SetRateLimits(service.RateLimits{})
+	stop, err := chat.ServeBots()
+	require.NoError(t, err)
+	t.Cleanup(stop)
+	return nc, chat
+}
+
+func TestBot(t *testing.T) {
+	nc, chat := setupTestService(t)
+	suffix := uuid.New().String()[:8]
+
+	reg, err := chat.Register(context.Background(), &pb.RegisterRequest{Username: "user-" + suffix, Password: "password123"})
+	require.NoError(t, err)
+	require.True(t, reg.Success, reg.Error)
+	ctx := auth.NewContext(context.Background(), auth.Identity{UserID: reg.User.Id})
+	created, err := chat.CreateRoom(ctx, &pb.CreateRoomRequest{Name: "Bots " + suffix})
+	require.NoError(t, err)
+	room := created.Room
+
+	b := New(nc, "echo-"+suffix, "Repeats things")
+	b.Command("echo"+suffix, "<text>", "repeat text", func(cmd *pb.BotCommand) *pb.BotReply {
+		if cmd.Args == "" {
+			return Errorf("Nothing to repeat")
+		}
+		return Reply(cmd.Username + " said " + cmd.Args)
+	})
+	heard := make(chan *pb.Message, 10)
+	b.OnMessage(func(msg *pb.Message) {
+		if msg.RoomId == room.Id {
+			heard <- msg
+		}
+	})
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Run(runCtx) }()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	send := func(content string) *pb.SendMessageResponse {
+		resp, err := chat.SendMessage(ctx, &pb.SendMessageRequest{RoomId: room.Id, Content: content})
+		require.NoError(t, err)
+		return resp
+	}
+
+	var resp *pb.SendMessageResponse
+	require.Eventually(t, func() bool {
+		resp = send("/echo" + suffix + " hi")
+		return resp.Success
+	}, 5*time.Second, 50*time.Millisecond, "The bot should register")
+	assert.Equal(t, "user-"+suffix+" said hi", resp.Message.Content)
+	assert.Equal(t, "echo-"+suffix, resp.Message.Username)
+	assert.Equal(t, "Nothing to repeat", send("/echo"+suffix).Error)
+
+	sent := send("hello bot")
+	require.True(t, sent.Success, sent.Error)
+	select {
+	case msg := <-heard:
+		assert.Equal(t, "hello bot", msg.Content, "The bot should not hear its own messages")
+	case <-time.After(5 * time.Second):
+		t.Fatal("The bot did not hear the message")
+	}
+
+	posted, err := b.PostReply(room.Id, sent.Message.Seq, "hello human")
+	require.NoError(t, err)
+	assert.Equal(t, sent.Message.Id, posted.ThreadId)
+
+	_, err = New(nc, "Not A Name", "").Post(room.Id, "hi")
+	assert.Error(t, err, "Unregistered bots cannot post")
+}
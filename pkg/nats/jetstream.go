@@ -1,7 +1,14 @@
 package store
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	pb "github.com/amirhlashgari/snapp-chat/proto"
@@ -10,8 +17,66 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	messagesStream = "MESSAGES"
+	// notificationsStream holds every user's notifications, on
+	// chat.inbox.<user>.
+	notificationsStream = "NOTIFICATIONS"
+
+	// scanBatch caps how many messages a single history fetch requests.
+	scanBatch = 256
+	// fetchWait bounds a fetch for messages the consumer reported as pending.
+	fetchWait = 5 * time.Second
+)
+
+// Names of the Key-Value buckets holding the latest state of every user and
+// room, keyed by their IDs.
+const (
+	UsersBucket       = "USERS"
+	RoomsBucket       = "ROOMS"
+	CredentialsBucket = "CREDENTIALS"
+	// ReadMarkersBucket is keyed by <room>.<user> instead.
+	ReadMarkersBucket = "READ_MARKERS"
+	// InvitesBucket is keyed by invite code.
+	InvitesBucket = "INVITES"
+	// ReactionsBucket is keyed by <room>.<message>.
+	ReactionsBucket = "REACTIONS"
+	// RateLimitsBucket is keyed by whatever the caller limits, e.g.
+	// user.<user>.messages.
+	RateLimitsBucket = "RATE_LIMITS"
+	// BotsBucket is keyed by bot name.
+	BotsBucket = "BOTS"
+	// WebhooksBucket is keyed by <room>.<webhook>.
+	WebhooksBucket = "WEBHOOKS"
+	// DeliveriesBucket is keyed by <webhook>.<delivery>.
+	DeliveriesBucket = "WEBHOOK_DELIVERIES"
+	// RetriesBucket is keyed by delivery ID.
+	RetriesBucket = "WEBHOOK_RETRIES"
+)
+
+const (
+	// rateLimitTTL is how long a rate limit bucket is kept after its last
+	// use. Buckets refill long before that, so a missing bucket is a full
+	// one.
+	rateLimitTTL = time.Hour
+	// deliveryTTL is how long a webhook delivery's status is kept.
+	deliveryTTL = 24 * 7 * time.Hour
+)
+
 type JetStreamStore struct {
-	js nats.JetStreamContext
+	nc        *nats.Conn
+	js        nats.JetStreamContext
+	users     nats.KeyValue
+	rooms     nats.KeyValue
+	creds     nats.KeyValue
+	reads     nats.KeyValue
+	invites   nats.KeyValue
+	reactions nats.KeyValue
+	limits    nats.KeyValue
+	bots      nats.KeyValue
+	webhooks  nats.KeyValue
+	delivered nats.KeyValue
+	retries   nats.KeyValue
 }
 
 func NewJetStreamStore(nc *nats.Conn) (*JetStreamStore, error) {
@@ -20,24 +85,70 @@ func NewJetStreamStore(nc *nats.Conn) (*JetStreamStore, error) {
 		return nil, fmt.Errorf("failed to create jetstream context: %v", err)
 	}
 
-	streams := map[string][]string{
-		"MESSAGES": {"chat.messages.>"},
-		"USERS":    {"chat.users.>"},
-		"ROOMS":    {"chat.rooms.>"},
+	streams := []*nats.StreamConfig{
+		{
+			Name:     messagesStream,
+			Subjects: []string{"chat.messages.>", "chat.dm.>", "chat.threads.>", "chat.revisions.>"},
+			MaxAge:   24 * 7 * time.Hour,
+		},
+		{
+			// Notifications are for users who were away, so they are kept
+			// longer than the messages they point at.
+			Name:     notificationsStream,
+			Subjects: []string{"chat.inbox.>"},
+			MaxAge:   24 * 30 * time.Hour,
+		},
+	}
+
+	for _, cfg := range streams {
+		_, err := js.AddStream(cfg)
+		if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+			// Streams created by an older version lack newer subjects.
+			_, err = js.UpdateStream(cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stream %s: %v", cfg.Name, err)
+		}
 	}
 
-	for stream, subjects := range streams {
-		_, err := js.AddStream(&nats.StreamConfig{
-			Name:     stream,
-			Subjects: subjects,
-			MaxAge:   24 * 7 * time.Hour,
-		})
+	buckets := make(map[string]nats.KeyValue)
+	for _, cfg := range []*nats.KeyValueConfig{
+		{Bucket: UsersBucket},
+		{Bucket: RoomsBucket},
+		{Bucket: CredentialsBucket},
+		{Bucket: ReadMarkersBucket},
+		{Bucket: InvitesBucket},
+		{Bucket: ReactionsBucket},
+		{Bucket: RateLimitsBucket, TTL: rateLimitTTL},
+		{Bucket: BotsBucket},
+		{Bucket: WebhooksBucket},
+		{Bucket: DeliveriesBucket, TTL: deliveryTTL},
+		// Retries are settled within hours; the TTL only clears those of
+		// webhooks nobody dispatches for anymore.
+		{Bucket: RetriesBucket, TTL: deliveryTTL},
+	} {
+		kv, err := js.CreateKeyValue(cfg)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create stream %s: %v", stream, err)
+			return nil, fmt.Errorf("failed to create bucket %s: %v", cfg.Bucket, err)
 		}
+		buckets[cfg.Bucket] = kv
 	}
 
-	return &JetStreamStore{js: js}, nil
+	return &JetStreamStore{
+		nc:        nc,
+		js:        js,
+		users:     buckets[UsersBucket],
+		rooms:     buckets[RoomsBucket],
+		creds:     buckets[CredentialsBucket],
+		reads:     buckets[ReadMarkersBucket],
+		invites:   buckets[InvitesBucket],
+		reactions: buckets[ReactionsBucket],
+		limits:    buckets[RateLimitsBucket],
+		bots:      buckets[BotsBucket],
+		webhooks:  buckets[WebhooksBucket],
+		delivered: buckets[DeliveriesBucket],
+		retries:   buckets[RetriesBucket],
+	}, nil
 }
 
 func (s *JetStreamStore) SaveMessage(msg *pb.Message) error {
@@ -46,37 +157,544 @@ func (s *JetStreamStore) SaveMessage(msg *pb.Message) error {
 		return err
 	}
 
-	subject := fmt.Sprintf("chat.messages.%s", msg.RoomId)
-	_, err = s.js.Publish(subject, data)
-	return err
+	ack, err := s.js.Publish(storedSubject(msg), data)
+	if err != nil {
+		return err
+	}
+
+	msg.Seq = ack.Sequence
+	return nil
 }
 
 func (s *JetStreamStore) GetMessages(roomID string, limit int) ([]*pb.Message, error) {
+	page, err := s.GetHistory(HistoryQuery{RoomID: roomID, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+func (s *JetStreamStore) GetHistory(query HistoryQuery) (*HistoryPage, error) {
+	page := &HistoryPage{}
+	if query.Limit <= 0 {
+		return page, nil
+	}
+
+	subject := messageSubject(query.RoomID)
+	if query.ThreadID != "" {
+		subject = threadSubject(query.RoomID, query.ThreadID)
+	}
+	last, err := s.js.GetLastMsg(messagesStream, subject)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return page, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Translate every bound into an inclusive sequence range [from, to].
+	from, to := query.AfterSeq+1, last.Sequence
+	if query.BeforeSeq > 0 && query.BeforeSeq-1 < to {
+		to = query.BeforeSeq - 1
+	}
+	if !query.After.IsZero() {
+		seq, ok, err := s.firstSeqAt(subject, query.After)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return page, nil
+		}
+		from = max(from, seq)
+	}
+	if !query.Before.IsZero() {
+		seq, ok, err := s.firstSeqAt(subject, query.Before)
+		if err != nil {
+			return nil, err
+		}
+		if ok && seq-1 < to {
+			to = seq - 1
+		}
+	}
+	if from > to {
+		return page, nil
+	}
+
+	if !query.NewestFirst {
+		err := s.scan(subject, from, to, func(msg *pb.Message) bool {
+			page.Messages = append(page.Messages, msg)
+			return len(page.Messages) <= query.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Messages) > query.Limit {
+			page.Messages = page.Messages[:query.Limit]
+			page.HasMore = true
+		}
+		return page, s.applyRevisions(query.RoomID, page.Messages)
+	}
+
+	// JetStream only reads forwards, so walk back from the upper bound in
+	// growing windows until one more message than requested was found.
 	var messages []*pb.Message
+	window := uint64(2 * query.Limit)
+	for end := to; ; window *= 2 {
+		start := from
+		if end-from+1 > window {
+			start = end - window + 1
+		}
+
+		var chunk []*pb.Message
+		err := s.scan(subject, start, end, func(msg *pb.Message) bool {
+			chunk = append(chunk, msg)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		messages = append(chunk, messages...)
+
+		if len(messages) > query.Limit || start == from {
+			break
+		}
+		end = start - 1
+	}
+
+	if len(messages) > query.Limit {
+		messages = messages[len(messages)-query.Limit:]
+		page.HasMore = true
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		page.Messages = append(page.Messages, messages[i])
+	}
+
+	return page, s.applyRevisions(query.RoomID, page.Messages)
+}
+
+func (s *JetStreamStore) GetMessage(roomID string, seq uint64) (*pb.Message, error) {
+	raw, err := s.js.GetMsg(messagesStream, seq)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The sequence may belong to a revision or another room's message.
+	var msg pb.Message
+	if proto.Unmarshal(raw.Data, &msg) != nil || msg.RoomId != roomID || raw.Subject != storedSubject(&msg) {
+		return nil, ErrNotFound
+	}
+	msg.Seq = raw.Sequence
 
-	sub, err := s.js.SubscribeSync(fmt.Sprintf("chat.messages.%s", roomID))
+	raw, err = s.js.GetLastMsg(messagesStream, revisionSubject(roomID, msg.Id))
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return &msg, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	var rev pb.MessageRevision
+	if err := proto.Unmarshal(raw.Data, &rev); err != nil {
+		return nil, err
+	}
+	applyRevision(&msg, &rev)
+	return &msg, nil
+}
+
+func (s *JetStreamStore) SaveRevision(rev *pb.MessageRevision) error {
+	data, err := proto.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	_, err = s.js.Publish(revisionSubject(rev.RoomId, rev.MessageId), data)
+	return err
+}
+
+// applyRevisions brings messages from roomID up to date. Each message's
+// revisions have a subject of their own, so a consumer delivering the last
+// record on each of them reads one revision per edited message, however old
+// the messages are.
+func (s *JetStreamStore) applyRevisions(roomID string, messages []*pb.Message) error {
+	byID := make(map[string]*pb.Message, len(messages))
+	var subjects []string
+	for _, msg := range messages {
+		if _, ok := byID[msg.Id]; !ok {
+			subjects = append(subjects, revisionSubject(roomID, msg.Id))
+		}
+		byID[msg.Id] = msg
+	}
+	if len(subjects) == 0 {
+		return nil
+	}
+
+	sub, err := s.js.PullSubscribe("", "",
+		nats.BindStream(messagesStream),
+		nats.ConsumerFilterSubjects(subjects...),
+		nats.DeliverLastPerSubject(),
+		nats.AckNone(),
+	)
+	if err != nil {
+		return err
+	}
+	return drain(sub, math.MaxUint64, func(data []byte, _ uint64) (bool, error) {
+		var rev pb.MessageRevision
+		if err := proto.Unmarshal(data, &rev); err != nil {
+			return false, err
+		}
+		if msg, ok := byID[rev.MessageId]; ok {
+			applyRevision(msg, &rev)
+		}
+		return true, nil
+	})
+}
+
+// scan passes the messages on subject with a stream sequence in [from, to]
+// to fn in order, until fn returns false.
+func (s *JetStreamStore) scan(subject string, from, to uint64, fn func(*pb.Message) bool) error {
+	return s.scanRaw(subject, from, to, func(data []byte, seq uint64) (bool, error) {
+		var msg pb.Message
+		if err := proto.Unmarshal(data, &msg); err != nil {
+			return false, err
+		}
+		msg.Seq = seq
+		return fn(&msg), nil
+	})
+}
+
+// scanRaw passes the data and stream sequence of every record on subject
+// in the messages stream with a sequence in [from, to] to fn in order, until
+// fn returns false or an error.
+func (s *JetStreamStore) scanRaw(subject string, from, to uint64, fn func(data []byte, seq uint64) (bool, error)) error {
+	return s.scanStream(messagesStream, subject, from, to, fn)
+}
+
+// scanStream is scanRaw for any stream. It reads through an ephemeral pull
+// consumer and stops once the consumer has nothing pending.
+func (s *JetStreamStore) scanStream(stream, subject string, from, to uint64, fn func(data []byte, seq uint64) (bool, error)) error {
+	sub, err := s.js.PullSubscribe(subject, "",
+		nats.BindStream(stream),
+		nats.StartSequence(from),
+		nats.AckNone(),
+	)
+	if err != nil {
+		return err
+	}
+	return drain(sub, to, fn)
+}
+
+// drain passes the data and stream sequence of what sub's consumer has
+// pending to fn in order, until a record past to, fn returning false or an
+// error. It unsubscribes when done.
+func drain(sub *nats.Subscription, to uint64, fn func(data []byte, seq uint64) (bool, error)) error {
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return err
+	}
+
+	for pending := info.NumPending; pending > 0; {
+		msgs, err := sub.Fetch(int(min(pending, scanBatch)), nats.MaxWait(fetchWait))
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			meta, err := m.Metadata()
+			if err != nil {
+				return err
+			}
+			if meta.Sequence.Stream > to {
+				return nil
+			}
+			pending = meta.NumPending
+
+			more, err := fn(m.Data, meta.Sequence.Stream)
+			if err != nil || !more {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// CountMessages reads the count off an ephemeral consumer's pending count,
+// so no messages have to be fetched.
+func (s *JetStreamStore) CountMessages(roomID string, afterSeq uint64) (uint64, error) {
+	start := nats.DeliverAll()
+	if afterSeq > 0 {
+		start = nats.StartSequence(afterSeq + 1)
+	}
+	sub, err := s.js.PullSubscribe(messageSubject(roomID), "",
+		nats.BindStream(messagesStream),
+		start,
+		nats.AckNone(),
+	)
+	if err != nil {
+		return 0, err
+	}
 	defer sub.Unsubscribe()
 
-	for i := 0; i < limit; i++ {
-		msg, err := sub.NextMsg(time.Second)
-		if err == nats.ErrTimeout {
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return 0, err
+	}
+	return info.NumPending, nil
+}
+
+// CountRoomMessages reads the counts off the stream's per-subject state,
+// like CountReplies, so a request covers every room, and another every
+// direct conversation.
+func (s *JetStreamStore) CountRoomMessages(roomIDs []string) (map[string]uint64, error) {
+	wanted := make(map[string]string, len(roomIDs))
+	filters := []string{"chat.messages.*"}
+	for _, roomID := range roomIDs {
+		wanted[messageSubject(roomID)] = roomID
+		if IsDirectRoom(roomID) && len(filters) == 1 {
+			filters = append(filters, "chat.dm.*")
+		}
+	}
+
+	counts := make(map[string]uint64)
+	for _, filter := range filters {
+		info, err := s.js.StreamInfo(messagesStream, &nats.StreamInfoRequest{SubjectsFilter: filter})
+		if err != nil {
+			return nil, err
+		}
+		for subject, count := range info.State.Subjects {
+			if roomID, ok := wanted[subject]; ok {
+				counts[roomID] = count
+			}
+		}
+	}
+	return counts, nil
+}
+
+// CountReplies reads the counts off the stream's per-subject state, so a
+// single request covers every thread in the room.
+func (s *JetStreamStore) CountReplies(roomID string) (map[string]uint64, error) {
+	prefix := threadSubject(roomID, "")
+	info, err := s.js.StreamInfo(messagesStream, &nats.StreamInfoRequest{SubjectsFilter: prefix + ">"})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]uint64, len(info.State.Subjects))
+	for subject, count := range info.State.Subjects {
+		counts[strings.TrimPrefix(subject, prefix)] = count
+	}
+	return counts, nil
+}
+
+func (s *JetStreamStore) GetReadMarker(roomID, userID string) (uint64, uint64, error) {
+	entry, err := s.reads.Get(readMarkerKey(roomID, userID))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	seq, err := strconv.ParseUint(string(entry.Value()), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return seq, entry.Revision(), nil
+}
+
+// GetReadMarkers reads the user's markers in every room with one watch.
+func (s *JetStreamStore) GetReadMarkers(userID string) (map[string]uint64, error) {
+	w, err := s.reads.Watch(readMarkerKey("*", userID), nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	markers := make(map[string]uint64)
+	for entry := range w.Updates() {
+		if entry == nil {
 			break
 		}
+		seq, err := strconv.ParseUint(string(entry.Value()), 10, 64)
 		if err != nil {
 			return nil, err
 		}
+		roomID, _, _ := strings.Cut(entry.Key(), ".")
+		markers[roomID] = seq
+	}
+	return markers, nil
+}
+
+func (s *JetStreamStore) CompareAndSaveReadMarker(roomID, userID string, seq, revision uint64) (uint64, error) {
+	value := []byte(strconv.FormatUint(seq, 10))
+	return compareAndPut(s.reads, readMarkerKey(roomID, userID), value, revision)
+}
+
+// firstSeqAt returns the sequence of the first message on subject stored at
+// or after t. ok is false when there is no such message.
+func (s *JetStreamStore) firstSeqAt(subject string, t time.Time) (seq uint64, ok bool, err error) {
+	sub, err := s.js.PullSubscribe(subject, "",
+		nats.BindStream(messagesStream),
+		nats.StartTime(t),
+		nats.AckNone(),
+	)
+	if err != nil {
+		return 0, false, err
+	}
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return 0, false, err
+	}
+	if info.NumPending == 0 {
+		return 0, false, nil
+	}
+
+	msgs, err := sub.Fetch(1, nats.MaxWait(fetchWait))
+	if err != nil {
+		return 0, false, err
+	}
+	meta, err := msgs[0].Metadata()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return meta.Sequence.Stream, true, nil
+}
+
+// messageSubject is the subject a room's messages are stored on. Direct
+// conversations have a namespace of their own, chat.dm.<room>.
+func messageSubject(roomID string) string {
+	if IsDirectRoom(roomID) {
+		return fmt.Sprintf("chat.dm.%s", roomID)
+	}
+	return fmt.Sprintf("chat.messages.%s", roomID)
+}
+
+// threadSubject is the subject the replies to a room's message are stored
+// on, chat.threads.<room>.<root>.
+func threadSubject(roomID, rootID string) string {
+	return fmt.Sprintf("chat.threads.%s.%s", roomID, rootID)
+}
+
+// storedSubject is the subject msg is stored on.
+func storedSubject(msg *pb.Message) string {
+	if msg.ThreadId != "" {
+		return threadSubject(msg.RoomId, msg.ThreadId)
+	}
+	return messageSubject(msg.RoomId)
+}
+
+// revisionSubject is the subject the revisions of a message are stored on,
+// chat.revisions.<room>.<message>, so the latest one can be read directly.
+func revisionSubject(roomID, messageID string) string {
+	return fmt.Sprintf("chat.revisions.%s.%s", roomID, messageID)
+}
+
+// PublishEvent sends ev over core NATS. Events addressed to a user go to
+// chat.events.user.<user>, room events to chat.events.room.<room> and
+// everything else to chat.events.global.
+func (s *JetStreamStore) PublishEvent(ev *pb.Event) error {
+	data, err := proto.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	subject := globalEventSubject
+	switch {
+	case ev.RecipientId != "":
+		subject = userEventSubject(ev.RecipientId)
+	case ev.RoomId != "":
+		subject = roomEventSubject(ev.RoomId)
+	}
+	return s.nc.Publish(subject, data)
+}
+
+func (s *JetStreamStore) SubscribeEvents(filter EventFilter, handler func(*pb.Event)) (func(), error) {
+	var subjects []string
+	if filter.Global {
+		subjects = append(subjects, globalEventSubject)
+	}
+	for _, roomID := range filter.RoomIDs {
+		subjects = append(subjects, roomEventSubject(roomID))
+	}
+	if filter.UserID != "" {
+		subjects = append(subjects, userEventSubject(filter.UserID))
+	}
+
+	var subs []*nats.Subscription
+	cancel := func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}
 
-		var pbMsg pb.Message
-		if err := proto.Unmarshal(msg.Data, &pbMsg); err != nil {
+	for _, subject := range subjects {
+		sub, err := s.nc.Subscribe(subject, func(msg *nats.Msg) {
+			var ev pb.Event
+			if err := proto.Unmarshal(msg.Data, &ev); err != nil {
+				log.Printf("Error unmarshaling event: %v", err)
+				return
+			}
+			handler(&ev)
+		})
+		if err != nil {
+			cancel()
 			return nil, err
 		}
-		messages = append(messages, &pbMsg)
+		subs = append(subs, sub)
+	}
+
+	return cancel, nil
+}
+
+func (s *JetStreamStore) PublishTyping(ind *pb.TypingIndicator) error {
+	data, err := proto.Marshal(ind)
+	if err != nil {
+		return err
+	}
+
+	return s.nc.Publish(TypingSubject(ind.RoomId), data)
+}
+
+func (s *JetStreamStore) SubscribeTyping(roomID string, handler func(*pb.TypingIndicator)) (func(), error) {
+	sub, err := s.nc.Subscribe(TypingSubject(roomID), func(msg *nats.Msg) {
+		var ind pb.TypingIndicator
+		if err := proto.Unmarshal(msg.Data, &ind); err != nil {
+			log.Printf("Error unmarshaling typing indicator: %v", err)
+			return
+		}
+		handler(&ind)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return messages, nil
+	return func() { sub.Unsubscribe() }, nil
+}
+
+// TypingSubject is the core NATS subject typing indicators for a room are
+// published on. It is outside the MESSAGES stream, so they are never stored.
+func TypingSubject(roomID string) string {
+	return fmt.Sprintf("chat.typing.%s", roomID)
+}
+
+const globalEventSubject = "chat.events.global"
+
+// RoomEventsSubject matches the subjects the events of every room are
+// published on.
+const RoomEventsSubject = "chat.events.room.*"
+
+func roomEventSubject(roomID string) string {
+	return fmt.Sprintf("chat.events.room.%s", roomID)
+}
+
+func userEventSubject(userID string) string {
+	return fmt.Sprintf("chat.events.user.%s", userID)
 }
 
 func (s *JetStreamStore) SaveUser(user *pb.User) error {
@@ -85,30 +703,21 @@ func (s *JetStreamStore) SaveUser(user *pb.User) error {
 		return err
 	}
 
-	_, err = s.js.Publish(fmt.Sprintf("chat.users.%s", user.Id), data)
+	_, err = s.users.Put(user.Id, data)
 	return err
 }
 
 func (s *JetStreamStore) GetUsers() ([]*pb.User, error) {
 	var users []*pb.User
 
-	sub, err := s.js.SubscribeSync("chat.users.>")
+	values, err := latestValues(s.users)
 	if err != nil {
 		return nil, err
 	}
-	defer sub.Unsubscribe()
-
-	for {
-		msg, err := sub.NextMsg(time.Second)
-		if err == nats.ErrTimeout {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
 
+	for _, data := range values {
 		var user pb.User
-		if err := proto.Unmarshal(msg.Data, &user); err != nil {
+		if err := proto.Unmarshal(data, &user); err != nil {
 			return nil, err
 		}
 		users = append(users, &user)
@@ -117,41 +726,607 @@ func (s *JetStreamStore) GetUsers() ([]*pb.User, error) {
 	return users, nil
 }
 
+func (s *JetStreamStore) GetUser(id string) (*pb.User, uint64, error) {
+	entry, err := s.users.Get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var user pb.User
+	if err := proto.Unmarshal(entry.Value(), &user); err != nil {
+		return nil, 0, err
+	}
+	return &user, entry.Revision(), nil
+}
+
+func (s *JetStreamStore) CompareAndSaveUser(user *pb.User, revision uint64) (uint64, error) {
+	data, err := proto.Marshal(user)
+	if err != nil {
+		return 0, err
+	}
+
+	return compareAndPut(s.users, user.Id, data, revision)
+}
+
+func (s *JetStreamStore) GetCredentials(username string) (*pb.Credentials, uint64, error) {
+	entry, err := s.creds.Get(credentialsKey(username))
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var creds pb.Credentials
+	if err := proto.Unmarshal(entry.Value(), &creds); err != nil {
+		return nil, 0, err
+	}
+	return &creds, entry.Revision(), nil
+}
+
+func (s *JetStreamStore) CompareAndSaveCredentials(creds *pb.Credentials, revision uint64) (uint64, error) {
+	data, err := proto.Marshal(creds)
+	if err != nil {
+		return 0, err
+	}
+
+	return compareAndPut(s.creds, credentialsKey(creds.Username), data, revision)
+}
+
+func (s *JetStreamStore) DeleteCredentials(username string) error {
+	return s.creds.Delete(credentialsKey(username))
+}
+
 func (s *JetStreamStore) SaveRoom(room *pb.ChatRoom) error {
 	data, err := proto.Marshal(room)
 	if err != nil {
 		return err
 	}
 
-	msgID := room.Id
-	_, err = s.js.Publish(fmt.Sprintf("chat.rooms.%s", room.Id), data, nats.MsgId(msgID))
+	_, err = s.rooms.Put(room.Id, data)
 	return err
 }
 
 func (s *JetStreamStore) GetRooms() ([]*pb.ChatRoom, error) {
 	var rooms []*pb.ChatRoom
 
-	sub, err := s.js.SubscribeSync("chat.rooms.>")
+	values, err := latestValues(s.rooms)
 	if err != nil {
 		return nil, err
 	}
-	defer sub.Unsubscribe()
 
-	for {
-		msg, err := sub.NextMsg(time.Second)
-		if err == nats.ErrTimeout {
-			break
+	for _, data := range values {
+		var room pb.ChatRoom
+		if err := proto.Unmarshal(data, &room); err != nil {
+			return nil, err
 		}
+		rooms = append(rooms, &room)
+	}
+
+	return rooms, nil
+}
+
+func (s *JetStreamStore) GetRoom(id string) (*pb.ChatRoom, uint64, error) {
+	entry, err := s.rooms.Get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var room pb.ChatRoom
+	if err := proto.Unmarshal(entry.Value(), &room); err != nil {
+		return nil, 0, err
+	}
+	return &room, entry.Revision(), nil
+}
+
+func (s *JetStreamStore) CompareAndSaveRoom(room *pb.ChatRoom, revision uint64) (uint64, error) {
+	data, err := proto.Marshal(room)
+	if err != nil {
+		return 0, err
+	}
+
+	return compareAndPut(s.rooms, room.Id, data, revision)
+}
+
+func (s *JetStreamStore) DeleteRoom(id string, revision uint64) error {
+	// Deleting the room first leaves nothing to purge if it changed.
+	err := s.rooms.Delete(id, nats.LastRevision(revision))
+	if errors.Is(err, nats.ErrKeyExists) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	err = s.js.PurgeStream(messagesStream, &nats.StreamPurgeRequest{Subject: messageSubject(id)})
+	if err != nil {
+		return fmt.Errorf("failed to purge messages: %v", err)
+	}
+
+	err = s.js.PurgeStream(messagesStream, &nats.StreamPurgeRequest{Subject: threadSubject(id, ">")})
+	if err != nil {
+		return fmt.Errorf("failed to purge threads: %v", err)
+	}
+	err = s.js.PurgeStream(messagesStream, &nats.StreamPurgeRequest{Subject: revisionSubject(id, ">")})
+	if err != nil {
+		return fmt.Errorf("failed to purge message revisions: %v", err)
+	}
+
+	// A bucket's backing stream stores key k on $KV.<bucket>.<k>.
+	err = s.js.PurgeStream("KV_"+ReadMarkersBucket, &nats.StreamPurgeRequest{
+		Subject: fmt.Sprintf("$KV.%s.%s.>", ReadMarkersBucket, id),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to purge read markers: %v", err)
+	}
+	err = s.js.PurgeStream("KV_"+ReactionsBucket, &nats.StreamPurgeRequest{
+		Subject: fmt.Sprintf("$KV.%s.%s.>", ReactionsBucket, id),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to purge reactions: %v", err)
+	}
+
+	hooks, err := s.GetWebhooks(id)
+	if err != nil {
+		return fmt.Errorf("failed to load webhooks: %v", err)
+	}
+	for _, hook := range hooks {
+		err = s.js.PurgeStream("KV_"+DeliveriesBucket, &nats.StreamPurgeRequest{
+			Subject: fmt.Sprintf("$KV.%s.%s.>", DeliveriesBucket, hook.Id),
+		})
 		if err != nil {
+			return fmt.Errorf("failed to purge webhook deliveries: %v", err)
+		}
+	}
+	err = s.js.PurgeStream("KV_"+WebhooksBucket, &nats.StreamPurgeRequest{
+		Subject: fmt.Sprintf("$KV.%s.%s.>", WebhooksBucket, id),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to purge webhooks: %v", err)
+	}
+
+	return nil
+}
+
+func (s *JetStreamStore) SaveNotification(n *pb.Notification) error {
+	data, err := proto.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	ack, err := s.js.Publish(inboxSubject(n.UserId), data)
+	if err != nil {
+		return err
+	}
+
+	n.Seq = ack.Sequence
+	return nil
+}
+
+func (s *JetStreamStore) GetNotifications(userID string, afterSeq uint64, limit int) ([]*pb.Notification, bool, error) {
+	var notices []*pb.Notification
+	hasMore := false
+	err := s.scanStream(notificationsStream, inboxSubject(userID), afterSeq+1, math.MaxUint64, func(data []byte, seq uint64) (bool, error) {
+		if len(notices) == limit {
+			hasMore = true
+			return false, nil
+		}
+		var n pb.Notification
+		if err := proto.Unmarshal(data, &n); err != nil {
+			return false, err
+		}
+		n.Seq = seq
+		notices = append(notices, &n)
+		return true, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return notices, hasMore, nil
+}
+
+func (s *JetStreamStore) DeleteNotifications(userID string, seq uint64) error {
+	if seq == 0 {
+		return s.js.PurgeStream(notificationsStream, &nats.StreamPurgeRequest{Subject: inboxSubject(userID)})
+	}
+
+	// Users may only remove notifications from their own inbox.
+	raw, err := s.js.GetMsg(notificationsStream, seq)
+	if errors.Is(err, nats.ErrMsgNotFound) || (err == nil && raw.Subject != inboxSubject(userID)) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return s.js.DeleteMsg(notificationsStream, seq)
+}
+
+// inboxSubject is the subject a user's notifications are stored on.
+func inboxSubject(userID string) string {
+	return fmt.Sprintf("chat.inbox.%s", userID)
+}
+
+func (s *JetStreamStore) GetReactions(roomID, messageID string) (*pb.Reactions, uint64, error) {
+	entry, err := s.reactions.Get(messageKey(roomID, messageID))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return &pb.Reactions{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var reactions pb.Reactions
+	if err := proto.Unmarshal(entry.Value(), &reactions); err != nil {
+		return nil, 0, err
+	}
+	return &reactions, entry.Revision(), nil
+}
+
+// GetReactionsOf reads the reactions to all the messages with a single
+// watch rather than a Get for each.
+func (s *JetStreamStore) GetReactionsOf(roomID string, messageIDs []string) (map[string]*pb.Reactions, error) {
+	found := make(map[string]*pb.Reactions)
+	// A consumer's filter subjects must not overlap.
+	var keys []string
+	for _, id := range messageIDs {
+		if key := messageKey(roomID, id); !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return found, nil
+	}
+
+	w, err := s.reactions.WatchFiltered(keys, nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		var reactions pb.Reactions
+		if err := proto.Unmarshal(entry.Value(), &reactions); err != nil {
 			return nil, err
 		}
+		found[strings.TrimPrefix(entry.Key(), roomID+".")] = &reactions
+	}
+	return found, nil
+}
 
-		var room pb.ChatRoom
-		if err := proto.Unmarshal(msg.Data, &room); err != nil {
+func (s *JetStreamStore) CompareAndSaveReactions(roomID, messageID string, reactions *pb.Reactions, revision uint64) (uint64, error) {
+	data, err := proto.Marshal(reactions)
+	if err != nil {
+		return 0, err
+	}
+	return compareAndPut(s.reactions, messageKey(roomID, messageID), data, revision)
+}
+
+func (s *JetStreamStore) GetTokenBucket(key string) (*pb.TokenBucket, uint64, error) {
+	entry, err := s.limits.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return &pb.TokenBucket{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var bucket pb.TokenBucket
+	if err := proto.Unmarshal(entry.Value(), &bucket); err != nil {
+		return nil, 0, err
+	}
+	return &bucket, entry.Revision(), nil
+}
+
+func (s *JetStreamStore) CompareAndSaveTokenBucket(key string, bucket *pb.TokenBucket, revision uint64) (uint64, error) {
+	data, err := proto.Marshal(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return compareAndPut(s.limits, key, data, revision)
+}
+
+func (s *JetStreamStore) GetInvite(code string) (*pb.InviteCode, uint64, error) {
+	entry, err := s.invites.Get(code)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var invite pb.InviteCode
+	if err := proto.Unmarshal(entry.Value(), &invite); err != nil {
+		return nil, 0, err
+	}
+	return &invite, entry.Revision(), nil
+}
+
+func (s *JetStreamStore) CompareAndSaveInvite(invite *pb.InviteCode, revision uint64) (uint64, error) {
+	data, err := proto.Marshal(invite)
+	if err != nil {
+		return 0, err
+	}
+
+	return compareAndPut(s.invites, invite.Code, data, revision)
+}
+
+func (s *JetStreamStore) SaveWebhook(hook *pb.Webhook) error {
+	data, err := proto.Marshal(hook)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.webhooks.Put(webhookKey(hook.RoomId, hook.Id), data)
+	return err
+}
+
+func (s *JetStreamStore) GetWebhooks(roomID string) ([]*pb.Webhook, error) {
+	values, err := latestValuesOf(s.webhooks, roomID+".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []*pb.Webhook
+	for _, data := range values {
+		var hook pb.Webhook
+		if err := proto.Unmarshal(data, &hook); err != nil {
 			return nil, err
 		}
-		rooms = append(rooms, &room)
+		hooks = append(hooks, &hook)
 	}
+	// Keys are listed in the order they were last written.
+	slices.SortFunc(hooks, func(a, b *pb.Webhook) int { return cmp.Compare(a.CreatedAt, b.CreatedAt) })
+	return hooks, nil
+}
 
-	return rooms, nil
+func (s *JetStreamStore) DeleteWebhook(roomID, id string) error {
+	key := webhookKey(roomID, id)
+	if _, err := s.webhooks.Get(key); errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return s.webhooks.Delete(key)
+}
+
+func (s *JetStreamStore) SaveDelivery(delivery *pb.WebhookDelivery) error {
+	data, err := proto.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.delivered.Put(webhookKey(delivery.WebhookId, delivery.Id), data)
+	return err
+}
+
+func (s *JetStreamStore) GetDeliveries(webhookID string, limit int) ([]*pb.WebhookDelivery, error) {
+	values, err := latestValuesOf(s.delivered, webhookID+".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []*pb.WebhookDelivery
+	for _, data := range values {
+		var delivery pb.WebhookDelivery
+		if err := proto.Unmarshal(data, &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	slices.SortFunc(deliveries, func(a, b *pb.WebhookDelivery) int { return strings.Compare(b.Id, a.Id) })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (s *JetStreamStore) GetRetries() ([]*pb.WebhookRetry, error) {
+	values, err := latestValues(s.retries)
+	if err != nil {
+		return nil, err
+	}
+
+	var retries []*pb.WebhookRetry
+	for _, data := range values {
+		var retry pb.WebhookRetry
+		if err := proto.Unmarshal(data, &retry); err != nil {
+			return nil, err
+		}
+		retries = append(retries, &retry)
+	}
+	return retries, nil
+}
+
+func (s *JetStreamStore) GetRetry(deliveryID string) (*pb.WebhookRetry, uint64, error) {
+	entry, err := s.retries.Get(deliveryID)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var retry pb.WebhookRetry
+	if err := proto.Unmarshal(entry.Value(), &retry); err != nil {
+		return nil, 0, err
+	}
+	return &retry, entry.Revision(), nil
+}
+
+func (s *JetStreamStore) CompareAndSaveRetry(retry *pb.WebhookRetry, revision uint64) (uint64, error) {
+	data, err := proto.Marshal(retry)
+	if err != nil {
+		return 0, err
+	}
+
+	return compareAndPut(s.retries, retry.GetDelivery().GetId(), data, revision)
+}
+
+func (s *JetStreamStore) DeleteRetry(deliveryID string) error {
+	err := s.retries.Delete(deliveryID)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *JetStreamStore) SaveBot(bot *pb.Bot) error {
+	data, err := proto.Marshal(bot)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.bots.Put(bot.Name, data)
+	return err
+}
+
+func (s *JetStreamStore) GetBot(name string) (*pb.Bot, error) {
+	entry, err := s.bots.Get(name)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bot pb.Bot
+	if err := proto.Unmarshal(entry.Value(), &bot); err != nil {
+		return nil, err
+	}
+	return &bot, nil
+}
+
+func (s *JetStreamStore) GetBots() ([]*pb.Bot, error) {
+	var bots []*pb.Bot
+
+	values, err := latestValues(s.bots)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, data := range values {
+		var bot pb.Bot
+		if err := proto.Unmarshal(data, &bot); err != nil {
+			return nil, err
+		}
+		bots = append(bots, &bot)
+	}
+
+	return bots, nil
+}
+
+// ServeBots answers requests on BotRequestsSubject. Every instance of the
+// service is in the same queue group, so each request is handled once.
+func (s *JetStreamStore) ServeBots(handler func(*pb.BotRequest) *pb.BotResponse) (func(), error) {
+	sub, err := s.nc.QueueSubscribe(BotRequestsSubject, "chat-service", func(msg *nats.Msg) {
+		var req pb.BotRequest
+		resp := &pb.BotResponse{Error: "Invalid request"}
+		if err := proto.Unmarshal(msg.Data, &req); err == nil {
+			resp = handler(&req)
+		}
+
+		data, err := proto.Marshal(resp)
+		if err != nil {
+			log.Printf("Error marshaling bot response: %v", err)
+			return
+		}
+		if err := msg.Respond(data); err != nil {
+			log.Printf("Error answering bot %s: %v", req.Bot, err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { sub.Unsubscribe() }, nil
+}
+
+func (s *JetStreamStore) CallBot(name string, cmd *pb.BotCommand, timeout time.Duration) (*pb.BotReply, error) {
+	data, err := proto.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := s.nc.Request(BotCommandsSubject(name), data, timeout)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reply pb.BotReply
+	if err := proto.Unmarshal(msg.Data, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// webhookKey is the KV key of a webhook within its room, or of a delivery
+// within its webhook.
+func webhookKey(parentID, id string) string {
+	return parentID + "." + id
+}
+
+// BotRequestsSubject is where bots send BotRequests to the service, which
+// answers each with a BotResponse.
+const BotRequestsSubject = "chat.bots.requests"
+
+// BotCommandsSubject is where the commands of the bot called name are sent.
+// Its instances should share a queue group and answer each with a BotReply.
+func BotCommandsSubject(name string) string {
+	return fmt.Sprintf("chat.bots.%s.commands", name)
+}
+
+// compareAndPut writes value under key only if the key's latest revision is
+// revision, or if the key does not exist when revision is 0.
+func compareAndPut(kv nats.KeyValue, key string, value []byte, revision uint64) (uint64, error) {
+	var (
+		rev uint64
+		err error
+	)
+	if revision == 0 {
+		rev, err = kv.Create(key, value)
+	} else {
+		rev, err = kv.Update(key, value, revision)
+	}
+	if errors.Is(err, nats.ErrKeyExists) {
+		return 0, ErrConflict
+	}
+	return rev, err
+}
+
+// latestValues returns the current value of every key in the bucket.
+func latestValues(kv nats.KeyValue) ([][]byte, error) {
+	return latestValuesOf(kv, ">")
+}
+
+// latestValuesOf returns the current value of every key matching keys, a
+// subject pattern. The watcher signals the end of the initial snapshot with
+// a nil entry, so this never has to wait on a timeout.
+func latestValuesOf(kv nats.KeyValue, keys string) ([][]byte, error) {
+	w, err := kv.Watch(keys, nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	var values [][]byte
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		values = append(values, entry.Value())
+	}
+
+	return values, nil
 }
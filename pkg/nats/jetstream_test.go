@@ -1,6 +1,9 @@
 package store
 
 import (
+	"fmt"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -9,6 +12,7 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func setupTestNATS(t *testing.T) *nats.Conn {
@@ -88,3 +92,647 @@ func TestSaveAndGetRoom(t *testing.T) {
 	assert.NoError(t, err, "Should retrieve rooms successfully")
 	assert.True(t, len(rooms) > 0, "Should have at least one room")
 }
+
+func TestGetRoomsReturnsLatestRevision(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	roomID := uuid.New().String()
+	require.NoError(t, store.SaveRoom(&pb.ChatRoom{Id: roomID, Name: "Before"}))
+	require.NoError(t, store.SaveRoom(&pb.ChatRoom{Id: roomID, Name: "After", Members: []string{"user1"}}))
+
+	rooms, err := store.GetRooms()
+	require.NoError(t, err)
+
+	var matches []*pb.ChatRoom
+	for _, room := range rooms {
+		if room.Id == roomID {
+			matches = append(matches, room)
+		}
+	}
+	require.Len(t, matches, 1, "Should return a single entry per room")
+	assert.Equal(t, "After", matches[0].Name)
+	assert.Equal(t, []string{"user1"}, matches[0].Members)
+}
+
+func TestGetHistory(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	roomID := uuid.New().String()
+	var seqs []uint64
+	for i := 0; i < 10; i++ {
+		msg := &pb.Message{Id: uuid.New().String(), RoomId: roomID, Content: fmt.Sprintf("msg-%d", i)}
+		require.NoError(t, store.SaveMessage(msg))
+		seqs = append(seqs, msg.Seq)
+		// Interleave another room so sequences are not contiguous.
+		require.NoError(t, store.SaveMessage(&pb.Message{Id: uuid.New().String(), RoomId: roomID + "-other"}))
+	}
+
+	page, err := store.GetHistory(HistoryQuery{RoomID: roomID, Limit: 3, NewestFirst: true})
+	require.NoError(t, err)
+	require.Len(t, page.Messages, 3)
+	assert.True(t, page.HasMore)
+	assert.Equal(t, "msg-9", page.Messages[0].Content)
+	assert.Equal(t, "msg-7", page.Messages[2].Content)
+	assert.Equal(t, seqs[7], page.Messages[2].Seq)
+
+	page, err = store.GetHistory(HistoryQuery{RoomID: roomID, Limit: 5, NewestFirst: true, BeforeSeq: seqs[2]})
+	require.NoError(t, err)
+	require.Len(t, page.Messages, 2)
+	assert.False(t, page.HasMore)
+	assert.Equal(t, "msg-1", page.Messages[0].Content)
+	assert.Equal(t, "msg-0", page.Messages[1].Content)
+
+	page, err = store.GetHistory(HistoryQuery{RoomID: roomID, Limit: 4, AfterSeq: seqs[5]})
+	require.NoError(t, err)
+	require.Len(t, page.Messages, 4)
+	assert.False(t, page.HasMore)
+	assert.Equal(t, "msg-6", page.Messages[0].Content)
+	assert.Equal(t, "msg-9", page.Messages[3].Content)
+
+	page, err = store.GetHistory(HistoryQuery{RoomID: roomID, Limit: 10, After: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	assert.Empty(t, page.Messages)
+
+	page, err = store.GetHistory(HistoryQuery{RoomID: uuid.New().String(), Limit: 10})
+	require.NoError(t, err)
+	assert.Empty(t, page.Messages)
+}
+
+func TestCompareAndSaveRoom(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	room := &pb.ChatRoom{Id: uuid.New().String(), Name: "Test Room"}
+	rev, err := store.CompareAndSaveRoom(room, 0)
+	require.NoError(t, err)
+
+	_, err = store.CompareAndSaveRoom(room, 0)
+	assert.ErrorIs(t, err, ErrConflict, "Creating an existing room should conflict")
+
+	room.Members = []string{"user1"}
+	_, err = store.CompareAndSaveRoom(room, rev)
+	require.NoError(t, err)
+
+	room.Members = []string{"user2"}
+	_, err = store.CompareAndSaveRoom(room, rev)
+	assert.ErrorIs(t, err, ErrConflict, "Saving a stale revision should conflict")
+
+	saved, _, err := store.GetRoom(room.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user1"}, saved.Members)
+
+	_, _, err = store.GetRoom(uuid.New().String())
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCredentialsCanBeReclaimed(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	creds := &pb.Credentials{UserId: uuid.New().String(), Username: "User-" + uuid.New().String()[:8]}
+	_, err = store.CompareAndSaveCredentials(creds, 0)
+	require.NoError(t, err)
+
+	_, err = store.CompareAndSaveCredentials(&pb.Credentials{Username: creds.Username}, 0)
+	assert.ErrorIs(t, err, ErrConflict, "Usernames should only be claimed once")
+
+	_, _, err = store.GetCredentials(creds.Username + ".")
+	assert.ErrorIs(t, err, ErrNotFound, "Names that aren't valid keys should not be found")
+	_, err = store.CompareAndSaveCredentials(&pb.Credentials{Username: creds.Username + "."}, 0)
+	assert.Error(t, err, "Names that aren't valid keys should not be saved")
+
+	saved, _, err := store.GetCredentials(strings.ToLower(creds.Username))
+	require.NoError(t, err)
+	assert.Equal(t, creds.UserId, saved.UserId, "Usernames should match case-insensitively")
+
+	require.NoError(t, store.DeleteCredentials(creds.Username))
+	_, _, err = store.GetCredentials(creds.Username)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = store.CompareAndSaveCredentials(creds, 0)
+	assert.NoError(t, err, "A released username should be claimable again")
+}
+
+func TestInviteCodes(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	invite := &pb.InviteCode{Code: uuid.New().String(), RoomId: "room", MaxUses: 2}
+	rev, err := store.CompareAndSaveInvite(invite, 0)
+	require.NoError(t, err)
+	_, err = store.CompareAndSaveInvite(invite, 0)
+	assert.ErrorIs(t, err, ErrConflict, "Codes should never be overwritten")
+
+	invite.Uses++
+	_, err = store.CompareAndSaveInvite(invite, rev)
+	require.NoError(t, err)
+
+	got, _, err := store.GetInvite(invite.Code)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), got.Uses)
+
+	_, _, err = store.GetInvite("not a valid key!")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestThreads(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	roomID := uuid.New().String()
+	root := &pb.Message{Id: uuid.New().String(), RoomId: roomID, Content: "root"}
+	require.NoError(t, store.SaveMessage(root))
+	for i := 0; i < 3; i++ {
+		reply := &pb.Message{
+			Id:        uuid.New().String(),
+			RoomId:    roomID,
+			Content:   fmt.Sprintf("reply %d", i),
+			ThreadId:  root.Id,
+			ThreadSeq: root.Seq,
+		}
+		require.NoError(t, store.SaveMessage(reply))
+
+		stored, err := store.GetMessage(roomID, reply.Seq)
+		require.NoError(t, err)
+		assert.Equal(t, reply.Content, stored.Content, "Replies should be found by sequence")
+	}
+
+	messages, err := store.GetMessages(roomID, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 1, "Replies should not be part of the room's history")
+
+	page, err := store.GetHistory(HistoryQuery{RoomID: roomID, ThreadID: root.Id, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Messages, 2)
+	assert.Equal(t, "reply 0", page.Messages[0].Content)
+	assert.True(t, page.HasMore)
+
+	counts, err := store.CountReplies(roomID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{root.Id: 3}, counts)
+	unread, err := store.CountMessages(roomID, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), unread)
+}
+
+func TestNotifications(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	alice, bob := uuid.New().String(), uuid.New().String()
+	var seqs []uint64
+	for i := 0; i < 3; i++ {
+		n := &pb.Notification{UserId: alice, Excerpt: fmt.Sprintf("mention %d", i)}
+		require.NoError(t, store.SaveNotification(n))
+		seqs = append(seqs, n.Seq)
+	}
+	require.NoError(t, store.SaveNotification(&pb.Notification{UserId: bob}))
+
+	notices, hasMore, err := store.GetNotifications(alice, 0, 2)
+	require.NoError(t, err)
+	require.Len(t, notices, 2)
+	assert.Equal(t, "mention 0", notices[0].Excerpt)
+	assert.Equal(t, seqs[0], notices[0].Seq)
+	assert.True(t, hasMore)
+
+	notices, hasMore, err = store.GetNotifications(alice, notices[1].Seq, 2)
+	require.NoError(t, err)
+	require.Len(t, notices, 1)
+	assert.False(t, hasMore)
+
+	assert.ErrorIs(t, store.DeleteNotifications(bob, seqs[0]), ErrNotFound, "Users can only delete their own notifications")
+	require.NoError(t, store.DeleteNotifications(alice, seqs[0]))
+	assert.ErrorIs(t, store.DeleteNotifications(alice, seqs[0]), ErrNotFound)
+
+	require.NoError(t, store.DeleteNotifications(alice, 0))
+	notices, _, err = store.GetNotifications(alice, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, notices)
+	notices, _, err = store.GetNotifications(bob, 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, notices, 1, "Other inboxes should be left alone")
+}
+
+func TestReactions(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	roomID, messageID := uuid.New().String(), uuid.New().String()
+	reactions, revision, err := store.GetReactions(roomID, messageID)
+	require.NoError(t, err)
+	assert.Empty(t, reactions.Reactions)
+	assert.Zero(t, revision)
+
+	reactions.Reactions = append(reactions.Reactions, &pb.Reactions_Reaction{Emoji: ":tada:", UserIds: []string{"user1"}})
+	revision, err = store.CompareAndSaveReactions(roomID, messageID, reactions, 0)
+	require.NoError(t, err)
+	_, err = store.CompareAndSaveReactions(roomID, messageID, reactions, 0)
+	assert.ErrorIs(t, err, ErrConflict)
+
+	stored, storedRevision, err := store.GetReactions(roomID, messageID)
+	require.NoError(t, err)
+	assert.Equal(t, revision, storedRevision)
+	require.Len(t, stored.Reactions, 1)
+	assert.Equal(t, []string{"user1"}, stored.Reactions[0].UserIds)
+
+	unreacted := uuid.New().String()
+	found, err := store.GetReactionsOf(roomID, []string{messageID, unreacted, messageID})
+	require.NoError(t, err)
+	require.Len(t, found, 1, "Messages nobody reacted to should be left out")
+	require.Contains(t, found, messageID)
+	assert.Equal(t, ":tada:", found[messageID].Reactions[0].Emoji)
+
+	require.NoError(t, store.SaveRoom(&pb.ChatRoom{Id: roomID}))
+	_, roomRevision, err := store.GetRoom(roomID)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteRoom(roomID, roomRevision))
+	stored, _, err = store.GetReactions(roomID, messageID)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Reactions, "Deleting a room should purge its reactions")
+}
+
+func TestTokenBuckets(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	key := "user." + uuid.New().String() + ".messages"
+	bucket, revision, err := store.GetTokenBucket(key)
+	require.NoError(t, err)
+	assert.Zero(t, revision, "Unused buckets should not exist yet")
+
+	bucket.Tokens, bucket.UpdatedAt = 4.5, 42
+	revision, err = store.CompareAndSaveTokenBucket(key, bucket, 0)
+	require.NoError(t, err)
+	_, err = store.CompareAndSaveTokenBucket(key, bucket, 0)
+	assert.ErrorIs(t, err, ErrConflict)
+
+	stored, storedRevision, err := store.GetTokenBucket(key)
+	require.NoError(t, err)
+	assert.Equal(t, revision, storedRevision)
+	assert.Equal(t, 4.5, stored.Tokens)
+}
+
+func TestBots(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	name := "bot-" + uuid.New().String()[:8]
+	_, err = store.GetBot(name)
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, store.SaveBot(&pb.Bot{Name: name, UserId: "u1", Commands: []*pb.BotCommandInfo{{Name: "roll"}}}))
+	bot, err := store.GetBot(name)
+	require.NoError(t, err)
+	assert.Equal(t, "roll", bot.Commands[0].Name)
+
+	cmd := &pb.BotCommand{Command: "roll", Args: "6"}
+	_, err = store.CallBot(name, cmd, time.Second)
+	assert.ErrorIs(t, err, ErrNotFound, "Calling a bot that is not running should fail fast")
+
+	sub, err := nc.Subscribe(BotCommandsSubject(name), func(msg *nats.Msg) {
+		var got pb.BotCommand
+		require.NoError(t, proto.Unmarshal(msg.Data, &got))
+		data, _ := proto.Marshal(&pb.BotReply{Text: "rolled " + got.Args})
+		msg.Respond(data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	reply, err := store.CallBot(name, cmd, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "rolled 6", reply.Text)
+}
+
+func TestWebhooks(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	room := &pb.ChatRoom{Id: uuid.New().String(), Name: "Hooked"}
+	require.NoError(t, store.SaveRoom(room))
+	first := &pb.Webhook{Id: uuid.New().String(), RoomId: room.Id, Url: "http://example.com/a", CreatedAt: 1}
+	second := &pb.Webhook{Id: uuid.New().String(), RoomId: room.Id, Url: "http://example.com/b", CreatedAt: 2}
+	require.NoError(t, store.SaveWebhook(second))
+	require.NoError(t, store.SaveWebhook(first))
+
+	hooks, err := store.GetWebhooks(room.Id)
+	require.NoError(t, err)
+	require.Len(t, hooks, 2)
+	assert.Equal(t, first.Id, hooks[0].Id, "Webhooks should be listed oldest first")
+
+	for i := range 3 {
+		id, err := uuid.NewV7()
+		require.NoError(t, err)
+		require.NoError(t, store.SaveDelivery(&pb.WebhookDelivery{Id: id.String(), WebhookId: first.Id, Attempts: int32(i + 1)}))
+	}
+	deliveries, err := store.GetDeliveries(first.Id, 2)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, int32(3), deliveries[0].Attempts, "Deliveries should be listed newest first")
+
+	retry := &pb.WebhookRetry{Delivery: deliveries[0], RoomId: room.Id}
+	revision, err := store.CompareAndSaveRetry(retry, 0)
+	require.NoError(t, err)
+	_, err = store.CompareAndSaveRetry(retry, 0)
+	assert.ErrorIs(t, err, ErrConflict, "Only one replica should claim a retry")
+	got, gotRevision, err := store.GetRetry(retry.Delivery.Id)
+	require.NoError(t, err)
+	assert.Equal(t, revision, gotRevision)
+	assert.Equal(t, room.Id, got.RoomId)
+	retries, err := store.GetRetries()
+	require.NoError(t, err)
+	assert.True(t, slices.ContainsFunc(retries, func(r *pb.WebhookRetry) bool { return r.Delivery.Id == retry.Delivery.Id }))
+	require.NoError(t, store.DeleteRetry(retry.Delivery.Id))
+	_, _, err = store.GetRetry(retry.Delivery.Id)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, store.DeleteWebhook(room.Id, second.Id))
+	assert.ErrorIs(t, store.DeleteWebhook(room.Id, second.Id), ErrNotFound)
+
+	_, roomRevision, err := store.GetRoom(room.Id)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteRoom(room.Id, roomRevision))
+	hooks, err = store.GetWebhooks(room.Id)
+	require.NoError(t, err)
+	assert.Empty(t, hooks, "Deleting a room should delete its webhooks")
+	deliveries, err = store.GetDeliveries(first.Id, 10)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries, "Deleting a room should delete its webhooks' deliveries")
+}
+
+func TestReadMarkersAndCounts(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	room := &pb.ChatRoom{Id: uuid.New().String(), Name: "Counted"}
+	require.NoError(t, store.SaveRoom(room))
+
+	var seqs []uint64
+	for i := 0; i < 3; i++ {
+		msg := &pb.Message{Id: uuid.New().String(), RoomId: room.Id, Content: fmt.Sprintf("msg-%d", i)}
+		require.NoError(t, store.SaveMessage(msg))
+		seqs = append(seqs, msg.Seq)
+	}
+
+	count, err := store.CountMessages(room.Id, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), count)
+	count, err = store.CountMessages(room.Id, seqs[0])
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), count)
+
+	dmID := DirectRoomID(uuid.New().String(), uuid.New().String())
+	require.NoError(t, store.SaveMessage(&pb.Message{Id: uuid.New().String(), RoomId: dmID, Content: "psst"}))
+	counts, err := store.CountRoomMessages([]string{room.Id, dmID, uuid.New().String()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{room.Id: 3, dmID: 1}, counts)
+
+	seq, rev, err := store.GetReadMarker(room.Id, "user1")
+	require.NoError(t, err)
+	assert.Zero(t, seq, "Missing markers should read as 0")
+
+	rev, err = store.CompareAndSaveReadMarker(room.Id, "user1", seqs[1], rev)
+	require.NoError(t, err)
+	_, err = store.CompareAndSaveReadMarker(room.Id, "user1", seqs[2], rev-1)
+	assert.ErrorIs(t, err, ErrConflict)
+
+	seq, _, err = store.GetReadMarker(room.Id, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, seqs[1], seq)
+	markers, err := store.GetReadMarkers("user1")
+	require.NoError(t, err)
+	assert.Equal(t, seqs[1], markers[room.Id])
+
+	_, roomRevision, err := store.GetRoom(room.Id)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteRoom(room.Id, roomRevision))
+	seq, rev, err = store.GetReadMarker(room.Id, "user1")
+	require.NoError(t, err)
+	assert.Zero(t, seq, "Deleting a room should purge its read markers")
+	assert.Zero(t, rev)
+}
+
+func TestPublishAndSubscribeEvents(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	roomID := uuid.New().String()
+	events := make(chan *pb.Event, 10)
+	cancel, err := store.SubscribeEvents(EventFilter{RoomIDs: []string{roomID}}, func(ev *pb.Event) {
+		events <- ev
+	})
+	require.NoError(t, err)
+	defer cancel()
+
+	require.NoError(t, store.PublishEvent(&pb.Event{Type: pb.Event_USER_JOINED, RoomId: uuid.New().String()}))
+	require.NoError(t, store.PublishEvent(&pb.Event{Type: pb.Event_ROOM_CREATED}))
+	require.NoError(t, store.PublishEvent(&pb.Event{Type: pb.Event_USER_LEFT, RoomId: roomID}))
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, pb.Event_USER_LEFT, ev.Type, "Only the subscribed room's events should arrive")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+}
+
+func TestDirectMessagesHaveOwnSubjects(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	alice, bob := uuid.New().String(), uuid.New().String()
+	roomID := DirectRoomID(alice, bob)
+	assert.Equal(t, roomID, DirectRoomID(bob, alice), "The ID should not depend on who asks")
+	assert.True(t, IsDirectRoom(roomID))
+
+	msg := &pb.Message{Id: uuid.New().String(), RoomId: roomID, UserId: alice, Content: "psst"}
+	require.NoError(t, store.SaveMessage(msg))
+
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	stored, err := js.GetLastMsg(messagesStream, "chat.dm."+roomID)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Seq, stored.Sequence)
+
+	events := make(chan *pb.Event, 10)
+	cancel, err := store.SubscribeEvents(EventFilter{UserID: bob}, func(ev *pb.Event) {
+		events <- ev
+	})
+	require.NoError(t, err)
+	defer cancel()
+
+	require.NoError(t, store.PublishEvent(&pb.Event{Type: pb.Event_MESSAGE_SENT, RoomId: roomID}))
+	require.NoError(t, store.PublishEvent(&pb.Event{Type: pb.Event_MESSAGE_SENT, RoomId: roomID, RecipientId: alice}))
+	require.NoError(t, store.PublishEvent(&pb.Event{Type: pb.Event_MESSAGE_SENT, RoomId: roomID, RecipientId: bob}))
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, bob, ev.RecipientId, "Only events addressed to the user should arrive")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+}
+
+func TestTypingIsNotPersisted(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	roomID := uuid.New().String()
+	indicators := make(chan *pb.TypingIndicator, 10)
+	cancel, err := store.SubscribeTyping(roomID, func(ind *pb.TypingIndicator) {
+		indicators <- ind
+	})
+	require.NoError(t, err)
+	defer cancel()
+
+	require.NoError(t, store.PublishTyping(&pb.TypingIndicator{RoomId: uuid.New().String(), UserId: "other"}))
+	require.NoError(t, store.PublishTyping(&pb.TypingIndicator{RoomId: roomID, UserId: "user1", Typing: true}))
+
+	select {
+	case ind := <-indicators:
+		assert.Equal(t, "user1", ind.UserId, "Only the subscribed room's indicators should arrive")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for typing indicator")
+	}
+
+	page, err := store.GetHistory(HistoryQuery{RoomID: roomID})
+	require.NoError(t, err)
+	assert.Empty(t, page.Messages, "Typing indicators should not be stored")
+}
+
+func TestDeleteRoomPurgesMessages(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	room := &pb.ChatRoom{Id: uuid.New().String(), Name: "Doomed"}
+	require.NoError(t, store.SaveRoom(room))
+	require.NoError(t, store.SaveMessage(&pb.Message{Id: uuid.New().String(), RoomId: room.Id, Content: "hello"}))
+
+	_, revision, err := store.GetRoom(room.Id)
+	require.NoError(t, err)
+	room.Name = "Renamed"
+	require.NoError(t, store.SaveRoom(room))
+	assert.ErrorIs(t, store.DeleteRoom(room.Id, revision), ErrConflict, "Rooms changed since they were read should not be deleted")
+	_, revision, err = store.GetRoom(room.Id)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteRoom(room.Id, revision))
+
+	_, _, err = store.GetRoom(room.Id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	messages, err := store.GetMessages(room.Id, 10)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+
+	rooms, err := store.GetRooms()
+	require.NoError(t, err)
+	for _, r := range rooms {
+		assert.NotEqual(t, room.Id, r.Id, "Deleted room should not be listed")
+	}
+}
+
+func TestMessageRevisions(t *testing.T) {
+	nc := setupTestNATS(t)
+	defer nc.Close()
+
+	store, err := NewJetStreamStore(nc)
+	require.NoError(t, err)
+
+	roomID := uuid.New().String()
+	var messages []*pb.Message
+	for _, content := range []string{"first", "second", "third"} {
+		msg := &pb.Message{Id: uuid.New().String(), RoomId: roomID, Content: content}
+		require.NoError(t, store.SaveMessage(msg))
+		messages = append(messages, msg)
+	}
+
+	revisions := []*pb.MessageRevision{
+		{MessageId: messages[1].Id, RoomId: roomID, Content: "second, edited", Timestamp: 1},
+		{MessageId: messages[1].Id, RoomId: roomID, Content: "second, edited again", Timestamp: 2},
+		{MessageId: messages[2].Id, RoomId: roomID, Deleted: true, Timestamp: 3},
+	}
+	for _, rev := range revisions {
+		require.NoError(t, store.SaveRevision(rev))
+	}
+
+	msg, err := store.GetMessage(roomID, messages[1].Seq)
+	require.NoError(t, err)
+	assert.Equal(t, "second, edited again", msg.Content)
+	assert.Equal(t, int64(2), msg.EditedAt)
+
+	_, err = store.GetMessage(uuid.New().String(), messages[1].Seq)
+	assert.ErrorIs(t, err, ErrNotFound, "Messages should only be found in their own room")
+
+	for _, newestFirst := range []bool{false, true} {
+		page, err := store.GetHistory(HistoryQuery{RoomID: roomID, Limit: 10, NewestFirst: newestFirst})
+		require.NoError(t, err)
+		require.Len(t, page.Messages, 3, "Revisions should not show up as messages")
+
+		byID := map[string]*pb.Message{}
+		for _, msg := range page.Messages {
+			byID[msg.Id] = msg
+		}
+		assert.Equal(t, "first", byID[messages[0].Id].Content)
+		assert.Zero(t, byID[messages[0].Id].EditedAt)
+		assert.Equal(t, "second, edited again", byID[messages[1].Id].Content)
+		assert.True(t, byID[messages[2].Id].Deleted)
+		assert.Empty(t, byID[messages[2].Id].Content)
+	}
+
+	page, err := store.GetHistory(HistoryQuery{RoomID: roomID, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Messages, 2)
+	assert.Equal(t, "first", page.Messages[0].Content, "Pages should only pick up their own messages' revisions")
+	assert.Equal(t, "second, edited again", page.Messages[1].Content)
+
+	count, err := store.CountMessages(roomID, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), count, "Revisions should not count as unread messages")
+}
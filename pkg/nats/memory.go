@@ -0,0 +1,850 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// MemoryStore is an in-process Store. Values are copied on the way in and
+// out so callers can never mutate stored state behind the store's back.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	seq       uint64
+	messages  map[string][]storedMessage
+	users     map[string]*pb.User
+	userRevs  map[string]uint64
+	userOrder []string
+	rooms     map[string]*pb.ChatRoom
+	roomRevs  map[string]uint64
+	roomOrder []string
+	creds     map[string]*pb.Credentials
+	credRevs  map[string]uint64
+	reads     map[string]uint64
+	readRevs  map[string]uint64
+	invites   map[string]*pb.InviteCode
+	invRevs   map[string]uint64
+	revisions map[string]*pb.MessageRevision // latest revision by messageKey
+	reactions map[string]*pb.Reactions       // by messageKey
+	reactRevs map[string]uint64
+	notices   map[string][]*pb.Notification // by user ID, oldest first
+	limits    map[string]*pb.TokenBucket
+	limitRevs map[string]uint64
+	bots      map[string]*pb.Bot
+	webhooks  map[string][]*pb.Webhook         // by room ID, oldest first
+	delivered map[string][]*pb.WebhookDelivery // by webhook ID, oldest first
+	retries   map[string]*pb.WebhookRetry      // by delivery ID
+	retryRevs map[string]uint64
+	revision  uint64
+
+	subsMu     sync.Mutex
+	nextSub    int
+	subs       map[int]memorySubscription
+	typingSubs map[int]memoryTypingSubscription
+
+	botsMu      sync.Mutex
+	botServer   func(*pb.BotRequest) *pb.BotResponse
+	botHandlers map[string]func(*pb.BotCommand) *pb.BotReply
+}
+
+type memorySubscription struct {
+	filter  EventFilter
+	handler func(*pb.Event)
+}
+
+type memoryTypingSubscription struct {
+	roomID  string
+	handler func(*pb.TypingIndicator)
+}
+
+type storedMessage struct {
+	msg      *pb.Message
+	storedAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		messages:   make(map[string][]storedMessage),
+		users:      make(map[string]*pb.User),
+		userRevs:   make(map[string]uint64),
+		rooms:      make(map[string]*pb.ChatRoom),
+		roomRevs:   make(map[string]uint64),
+		creds:      make(map[string]*pb.Credentials),
+		credRevs:   make(map[string]uint64),
+		reads:      make(map[string]uint64),
+		readRevs:   make(map[string]uint64),
+		invites:    make(map[string]*pb.InviteCode),
+		invRevs:    make(map[string]uint64),
+		revisions:  make(map[string]*pb.MessageRevision),
+		reactions:  make(map[string]*pb.Reactions),
+		reactRevs:  make(map[string]uint64),
+		notices:    make(map[string][]*pb.Notification),
+		limits:     make(map[string]*pb.TokenBucket),
+		limitRevs:  make(map[string]uint64),
+		bots:       make(map[string]*pb.Bot),
+		webhooks:   make(map[string][]*pb.Webhook),
+		delivered:  make(map[string][]*pb.WebhookDelivery),
+		retries:    make(map[string]*pb.WebhookRetry),
+		retryRevs:  make(map[string]uint64),
+		subs:       make(map[int]memorySubscription),
+		typingSubs: make(map[int]memoryTypingSubscription),
+
+		botHandlers: make(map[string]func(*pb.BotCommand) *pb.BotReply),
+	}
+}
+
+func (s *MemoryStore) SaveMessage(msg *pb.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	msg.Seq = s.seq
+	s.messages[msg.RoomId] = append(s.messages[msg.RoomId], storedMessage{
+		msg:      proto.Clone(msg).(*pb.Message),
+		storedAt: time.Now(),
+	})
+	return nil
+}
+
+func (s *MemoryStore) GetMessages(roomID string, limit int) ([]*pb.Message, error) {
+	page, err := s.GetHistory(HistoryQuery{RoomID: roomID, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return page.Messages, nil
+}
+
+func (s *MemoryStore) GetHistory(query HistoryQuery) (*HistoryPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := &HistoryPage{}
+	if query.Limit <= 0 {
+		return page, nil
+	}
+
+	var matches []*pb.Message
+	for _, stored := range s.messages[query.RoomID] {
+		if stored.msg.ThreadId != query.ThreadID {
+			continue
+		}
+		seq := stored.msg.Seq
+		if seq <= query.AfterSeq || (query.BeforeSeq > 0 && seq >= query.BeforeSeq) {
+			continue
+		}
+		if !query.After.IsZero() && stored.storedAt.Before(query.After) {
+			continue
+		}
+		if !query.Before.IsZero() && !stored.storedAt.Before(query.Before) {
+			continue
+		}
+		matches = append(matches, stored.msg)
+	}
+
+	if query.NewestFirst {
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	}
+	if len(matches) > query.Limit {
+		matches = matches[:query.Limit]
+		page.HasMore = true
+	}
+	for _, msg := range matches {
+		page.Messages = append(page.Messages, s.revised(msg))
+	}
+
+	return page, nil
+}
+
+func (s *MemoryStore) GetMessage(roomID string, seq uint64) (*pb.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, stored := range s.messages[roomID] {
+		if stored.msg.Seq == seq {
+			return s.revised(stored.msg), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) SaveRevision(rev *pb.MessageRevision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revisions[messageKey(rev.RoomId, rev.MessageId)] = proto.Clone(rev).(*pb.MessageRevision)
+	return nil
+}
+
+// revised returns a copy of msg as of its latest revision. The caller must
+// hold s.mu.
+func (s *MemoryStore) revised(msg *pb.Message) *pb.Message {
+	msg = proto.Clone(msg).(*pb.Message)
+	if rev, ok := s.revisions[messageKey(msg.RoomId, msg.Id)]; ok {
+		applyRevision(msg, rev)
+	}
+	return msg
+}
+
+func (s *MemoryStore) CountMessages(roomID string, afterSeq uint64) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count uint64
+	for _, stored := range s.messages[roomID] {
+		if stored.msg.ThreadId == "" && stored.msg.Seq > afterSeq {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) CountRoomMessages(roomIDs []string) (map[string]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]uint64)
+	for _, roomID := range roomIDs {
+		for _, stored := range s.messages[roomID] {
+			if stored.msg.ThreadId == "" {
+				counts[roomID]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+func (s *MemoryStore) CountReplies(roomID string) (map[string]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]uint64)
+	for _, stored := range s.messages[roomID] {
+		if stored.msg.ThreadId != "" {
+			counts[stored.msg.ThreadId]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *MemoryStore) GetReadMarker(roomID, userID string) (uint64, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := readMarkerKey(roomID, userID)
+	return s.reads[key], s.readRevs[key], nil
+}
+
+func (s *MemoryStore) GetReadMarkers(userID string) (map[string]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	markers := make(map[string]uint64)
+	for key, seq := range s.reads {
+		if roomID, user, _ := strings.Cut(key, "."); user == userID {
+			markers[roomID] = seq
+		}
+	}
+	return markers, nil
+}
+
+func (s *MemoryStore) CompareAndSaveReadMarker(roomID, userID string, seq, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := readMarkerKey(roomID, userID)
+	if s.readRevs[key] != revision {
+		return 0, ErrConflict
+	}
+
+	s.revision++
+	s.reads[key] = seq
+	s.readRevs[key] = s.revision
+	return s.revision, nil
+}
+
+func (s *MemoryStore) SaveUser(user *pb.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.putUser(user)
+	return nil
+}
+
+func (s *MemoryStore) CompareAndSaveUser(user *pb.User, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.userRevs[user.Id] != revision {
+		return 0, ErrConflict
+	}
+	return s.putUser(user), nil
+}
+
+// putUser stores a copy of user and returns its new revision. The caller
+// must hold s.mu.
+func (s *MemoryStore) putUser(user *pb.User) uint64 {
+	if _, ok := s.users[user.Id]; !ok {
+		s.userOrder = append(s.userOrder, user.Id)
+	}
+	s.revision++
+	s.users[user.Id] = proto.Clone(user).(*pb.User)
+	s.userRevs[user.Id] = s.revision
+	return s.revision
+}
+
+func (s *MemoryStore) GetUser(id string) (*pb.User, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return proto.Clone(user).(*pb.User), s.userRevs[id], nil
+}
+
+func (s *MemoryStore) GetUsers() ([]*pb.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []*pb.User
+	for _, id := range s.userOrder {
+		users = append(users, proto.Clone(s.users[id]).(*pb.User))
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) GetCredentials(username string) (*pb.Credentials, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := credentialsKey(username)
+	creds, ok := s.creds[key]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return proto.Clone(creds).(*pb.Credentials), s.credRevs[key], nil
+}
+
+func (s *MemoryStore) CompareAndSaveCredentials(creds *pb.Credentials, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := credentialsKey(creds.Username)
+	if s.credRevs[key] != revision {
+		return 0, ErrConflict
+	}
+
+	s.revision++
+	s.creds[key] = proto.Clone(creds).(*pb.Credentials)
+	s.credRevs[key] = s.revision
+	return s.revision, nil
+}
+
+func (s *MemoryStore) DeleteCredentials(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := credentialsKey(username)
+	delete(s.creds, key)
+	delete(s.credRevs, key)
+	return nil
+}
+
+func (s *MemoryStore) SaveRoom(room *pb.ChatRoom) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.putRoom(room)
+	return nil
+}
+
+func (s *MemoryStore) GetRoom(id string) (*pb.ChatRoom, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, ok := s.rooms[id]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return proto.Clone(room).(*pb.ChatRoom), s.roomRevs[id], nil
+}
+
+func (s *MemoryStore) CompareAndSaveRoom(room *pb.ChatRoom, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.roomRevs[room.Id] != revision {
+		return 0, ErrConflict
+	}
+	return s.putRoom(room), nil
+}
+
+func (s *MemoryStore) DeleteRoom(id string, revision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[id]; !ok || s.roomRevs[id] != revision {
+		return ErrConflict
+	}
+
+	delete(s.rooms, id)
+	delete(s.roomRevs, id)
+	delete(s.messages, id)
+	for _, hook := range s.webhooks[id] {
+		delete(s.delivered, hook.Id)
+	}
+	delete(s.webhooks, id)
+	for key := range s.reads {
+		if strings.HasPrefix(key, id+".") {
+			delete(s.reads, key)
+			delete(s.readRevs, key)
+		}
+	}
+	for key := range s.revisions {
+		if strings.HasPrefix(key, id+".") {
+			delete(s.revisions, key)
+		}
+	}
+	for key := range s.reactions {
+		if strings.HasPrefix(key, id+".") {
+			delete(s.reactions, key)
+			delete(s.reactRevs, key)
+		}
+	}
+	for i, roomID := range s.roomOrder {
+		if roomID == id {
+			s.roomOrder = append(s.roomOrder[:i], s.roomOrder[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveNotification(n *pb.Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	n.Seq = s.seq
+	s.notices[n.UserId] = append(s.notices[n.UserId], proto.Clone(n).(*pb.Notification))
+	return nil
+}
+
+func (s *MemoryStore) GetNotifications(userID string, afterSeq uint64, limit int) ([]*pb.Notification, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var notices []*pb.Notification
+	for _, n := range s.notices[userID] {
+		if n.Seq <= afterSeq {
+			continue
+		}
+		if len(notices) == limit {
+			return notices, true, nil
+		}
+		notices = append(notices, proto.Clone(n).(*pb.Notification))
+	}
+	return notices, false, nil
+}
+
+func (s *MemoryStore) DeleteNotifications(userID string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq == 0 {
+		delete(s.notices, userID)
+		return nil
+	}
+	for i, n := range s.notices[userID] {
+		if n.Seq == seq {
+			s.notices[userID] = append(s.notices[userID][:i], s.notices[userID][i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) GetReactions(roomID, messageID string) (*pb.Reactions, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := messageKey(roomID, messageID)
+	reactions, ok := s.reactions[key]
+	if !ok {
+		return &pb.Reactions{}, 0, nil
+	}
+	return proto.Clone(reactions).(*pb.Reactions), s.reactRevs[key], nil
+}
+
+func (s *MemoryStore) GetReactionsOf(roomID string, messageIDs []string) (map[string]*pb.Reactions, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]*pb.Reactions)
+	for _, id := range messageIDs {
+		if reactions, ok := s.reactions[messageKey(roomID, id)]; ok {
+			found[id] = proto.Clone(reactions).(*pb.Reactions)
+		}
+	}
+	return found, nil
+}
+
+func (s *MemoryStore) CompareAndSaveReactions(roomID, messageID string, reactions *pb.Reactions, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := messageKey(roomID, messageID)
+	if s.reactRevs[key] != revision {
+		return 0, ErrConflict
+	}
+
+	s.revision++
+	s.reactions[key] = proto.Clone(reactions).(*pb.Reactions)
+	s.reactRevs[key] = s.revision
+	return s.revision, nil
+}
+
+func (s *MemoryStore) GetTokenBucket(key string) (*pb.TokenBucket, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bucket, ok := s.limits[key]
+	if !ok {
+		return &pb.TokenBucket{}, 0, nil
+	}
+	return proto.Clone(bucket).(*pb.TokenBucket), s.limitRevs[key], nil
+}
+
+func (s *MemoryStore) CompareAndSaveTokenBucket(key string, bucket *pb.TokenBucket, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limitRevs[key] != revision {
+		return 0, ErrConflict
+	}
+
+	s.revision++
+	s.limits[key] = proto.Clone(bucket).(*pb.TokenBucket)
+	s.limitRevs[key] = s.revision
+	return s.revision, nil
+}
+
+func (s *MemoryStore) GetInvite(code string) (*pb.InviteCode, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	invite, ok := s.invites[code]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return proto.Clone(invite).(*pb.InviteCode), s.invRevs[code], nil
+}
+
+func (s *MemoryStore) CompareAndSaveInvite(invite *pb.InviteCode, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.invRevs[invite.Code] != revision {
+		return 0, ErrConflict
+	}
+
+	s.revision++
+	s.invites[invite.Code] = proto.Clone(invite).(*pb.InviteCode)
+	s.invRevs[invite.Code] = s.revision
+	return s.revision, nil
+}
+
+func (s *MemoryStore) SaveWebhook(hook *pb.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook = proto.Clone(hook).(*pb.Webhook)
+	hooks := s.webhooks[hook.RoomId]
+	if i := slices.IndexFunc(hooks, func(h *pb.Webhook) bool { return h.Id == hook.Id }); i >= 0 {
+		hooks[i] = hook
+		return nil
+	}
+	s.webhooks[hook.RoomId] = append(hooks, hook)
+	return nil
+}
+
+func (s *MemoryStore) GetWebhooks(roomID string) ([]*pb.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var hooks []*pb.Webhook
+	for _, hook := range s.webhooks[roomID] {
+		hooks = append(hooks, proto.Clone(hook).(*pb.Webhook))
+	}
+	return hooks, nil
+}
+
+func (s *MemoryStore) DeleteWebhook(roomID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hooks := s.webhooks[roomID]
+	i := slices.IndexFunc(hooks, func(h *pb.Webhook) bool { return h.Id == id })
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.webhooks[roomID] = slices.Delete(hooks, i, i+1)
+	return nil
+}
+
+// SaveDelivery keeps deliveries forever rather than for a week.
+func (s *MemoryStore) SaveDelivery(delivery *pb.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery = proto.Clone(delivery).(*pb.WebhookDelivery)
+	deliveries := s.delivered[delivery.WebhookId]
+	if i := slices.IndexFunc(deliveries, func(d *pb.WebhookDelivery) bool { return d.Id == delivery.Id }); i >= 0 {
+		deliveries[i] = delivery
+		return nil
+	}
+	s.delivered[delivery.WebhookId] = append(deliveries, delivery)
+	return nil
+}
+
+func (s *MemoryStore) GetDeliveries(webhookID string, limit int) ([]*pb.WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deliveries := s.delivered[webhookID]
+	var newest []*pb.WebhookDelivery
+	for i := len(deliveries) - 1; i >= 0 && len(newest) < limit; i-- {
+		newest = append(newest, proto.Clone(deliveries[i]).(*pb.WebhookDelivery))
+	}
+	return newest, nil
+}
+
+func (s *MemoryStore) GetRetries() ([]*pb.WebhookRetry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var retries []*pb.WebhookRetry
+	for _, retry := range s.retries {
+		retries = append(retries, proto.Clone(retry).(*pb.WebhookRetry))
+	}
+	return retries, nil
+}
+
+func (s *MemoryStore) GetRetry(deliveryID string) (*pb.WebhookRetry, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	retry, ok := s.retries[deliveryID]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return proto.Clone(retry).(*pb.WebhookRetry), s.retryRevs[deliveryID], nil
+}
+
+func (s *MemoryStore) CompareAndSaveRetry(retry *pb.WebhookRetry, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := retry.GetDelivery().GetId()
+	if s.retryRevs[id] != revision {
+		return 0, ErrConflict
+	}
+
+	s.revision++
+	s.retries[id] = proto.Clone(retry).(*pb.WebhookRetry)
+	s.retryRevs[id] = s.revision
+	return s.revision, nil
+}
+
+func (s *MemoryStore) DeleteRetry(deliveryID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.retries, deliveryID)
+	delete(s.retryRevs, deliveryID)
+	return nil
+}
+
+func (s *MemoryStore) SaveBot(bot *pb.Bot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bots[bot.Name] = proto.Clone(bot).(*pb.Bot)
+	return nil
+}
+
+func (s *MemoryStore) GetBot(name string) (*pb.Bot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bot, ok := s.bots[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(bot).(*pb.Bot), nil
+}
+
+// GetBots returns the bots sorted by name.
+func (s *MemoryStore) GetBots() ([]*pb.Bot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var bots []*pb.Bot
+	for _, bot := range s.bots {
+		bots = append(bots, proto.Clone(bot).(*pb.Bot))
+	}
+	slices.SortFunc(bots, func(a, b *pb.Bot) int { return strings.Compare(a.Name, b.Name) })
+	return bots, nil
+}
+
+func (s *MemoryStore) ServeBots(handler func(*pb.BotRequest) *pb.BotResponse) (func(), error) {
+	s.botsMu.Lock()
+	defer s.botsMu.Unlock()
+
+	s.botServer = handler
+	return func() {
+		s.botsMu.Lock()
+		defer s.botsMu.Unlock()
+		s.botServer = nil
+	}, nil
+}
+
+// CallBot runs the handler registered with HandleBotCommands for name.
+func (s *MemoryStore) CallBot(name string, cmd *pb.BotCommand, timeout time.Duration) (*pb.BotReply, error) {
+	s.botsMu.Lock()
+	handler := s.botHandlers[name]
+	s.botsMu.Unlock()
+	if handler == nil {
+		return nil, ErrNotFound
+	}
+
+	replies := make(chan *pb.BotReply, 1)
+	go func() { replies <- handler(proto.Clone(cmd).(*pb.BotCommand)) }()
+	select {
+	case reply := <-replies:
+		return proto.Clone(reply).(*pb.BotReply), nil
+	case <-time.After(timeout):
+		return nil, errors.New("timed out waiting for bot")
+	}
+}
+
+// SendBotRequest plays the part of a bot and passes req to the handler
+// given to ServeBots, returning ErrNotFound if there is none.
+func (s *MemoryStore) SendBotRequest(req *pb.BotRequest) (*pb.BotResponse, error) {
+	s.botsMu.Lock()
+	server := s.botServer
+	s.botsMu.Unlock()
+	if server == nil {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(server(proto.Clone(req).(*pb.BotRequest))).(*pb.BotResponse), nil
+}
+
+// HandleBotCommands plays the part of the bot called name and answers the
+// commands sent to it with handler until the returned function is called.
+func (s *MemoryStore) HandleBotCommands(name string, handler func(*pb.BotCommand) *pb.BotReply) func() {
+	s.botsMu.Lock()
+	defer s.botsMu.Unlock()
+
+	s.botHandlers[name] = handler
+	return func() {
+		s.botsMu.Lock()
+		defer s.botsMu.Unlock()
+		delete(s.botHandlers, name)
+	}
+}
+
+// putRoom stores a copy of room and returns its new revision. The caller
+// must hold s.mu.
+func (s *MemoryStore) putRoom(room *pb.ChatRoom) uint64 {
+	if _, ok := s.rooms[room.Id]; !ok {
+		s.roomOrder = append(s.roomOrder, room.Id)
+	}
+	s.revision++
+	s.rooms[room.Id] = proto.Clone(room).(*pb.ChatRoom)
+	s.roomRevs[room.Id] = s.revision
+	return s.revision
+}
+
+func (s *MemoryStore) GetRooms() ([]*pb.ChatRoom, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var rooms []*pb.ChatRoom
+	for _, id := range s.roomOrder {
+		rooms = append(rooms, proto.Clone(s.rooms[id]).(*pb.ChatRoom))
+	}
+	return rooms, nil
+}
+
+// PublishEvent delivers ev synchronously to every matching subscriber.
+func (s *MemoryStore) PublishEvent(ev *pb.Event) error {
+	s.subsMu.Lock()
+	var handlers []func(*pb.Event)
+	for _, sub := range s.subs {
+		if sub.filter.matches(ev) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	s.subsMu.Unlock()
+
+	for _, handler := range handlers {
+		handler(proto.Clone(ev).(*pb.Event))
+	}
+	return nil
+}
+
+func (s *MemoryStore) SubscribeEvents(filter EventFilter, handler func(*pb.Event)) (func(), error) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	id := s.nextSub
+	s.nextSub++
+	s.subs[id] = memorySubscription{filter: filter, handler: handler}
+
+	return func() {
+		s.subsMu.Lock()
+		defer s.subsMu.Unlock()
+		delete(s.subs, id)
+	}, nil
+}
+
+func (s *MemoryStore) PublishTyping(ind *pb.TypingIndicator) error {
+	s.subsMu.Lock()
+	var handlers []func(*pb.TypingIndicator)
+	for _, sub := range s.typingSubs {
+		if sub.roomID == ind.RoomId {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	s.subsMu.Unlock()
+
+	for _, handler := range handlers {
+		handler(proto.Clone(ind).(*pb.TypingIndicator))
+	}
+	return nil
+}
+
+func (s *MemoryStore) SubscribeTyping(roomID string, handler func(*pb.TypingIndicator)) (func(), error) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	id := s.nextSub
+	s.nextSub++
+	s.typingSubs[id] = memoryTypingSubscription{roomID: roomID, handler: handler}
+
+	return func() {
+		s.subsMu.Lock()
+		defer s.subsMu.Unlock()
+		delete(s.typingSubs, id)
+	}, nil
+}
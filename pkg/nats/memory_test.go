@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySaveAndGetMessage(t *testing.T) {
+	store := NewMemoryStore()
+
+	for i, content := range []string{"first", "second", "third"} {
+		err := store.SaveMessage(&pb.Message{
+			Id:        uuid.New().String(),
+			RoomId:    "test-room",
+			UserId:    "user1",
+			Content:   content,
+			Timestamp: time.Now().Unix() + int64(i),
+		})
+		require.NoError(t, err)
+	}
+
+	messages, err := store.GetMessages("test-room", 2)
+	assert.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "first", messages[0].Content)
+	assert.Equal(t, "second", messages[1].Content)
+
+	messages, err = store.GetMessages("other-room", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestMemorySaveUserOverwrites(t *testing.T) {
+	store := NewMemoryStore()
+
+	require.NoError(t, store.SaveUser(&pb.User{Id: "user1", Username: "testuser", Presence: pb.User_ONLINE}))
+	require.NoError(t, store.SaveUser(&pb.User{Id: "user1", Username: "testuser", Presence: pb.User_OFFLINE}))
+
+	users, err := store.GetUsers()
+	assert.NoError(t, err)
+	require.Len(t, users, 1, "Should keep only the latest revision of a user")
+	assert.Equal(t, pb.User_OFFLINE, users[0].Presence)
+}
+
+func TestMemoryRoomIsCopied(t *testing.T) {
+	store := NewMemoryStore()
+
+	room := &pb.ChatRoom{Id: "room1", Name: "Test Room"}
+	require.NoError(t, store.SaveRoom(room))
+	room.Members = append(room.Members, "user1")
+
+	rooms, err := store.GetRooms()
+	assert.NoError(t, err)
+	require.Len(t, rooms, 1)
+	assert.Empty(t, rooms[0].Members, "Mutating the saved value should not change the store")
+
+	rooms[0].Name = "changed"
+	rooms, err = store.GetRooms()
+	assert.NoError(t, err)
+	assert.Equal(t, "Test Room", rooms[0].Name, "Mutating a returned value should not change the store")
+}
+
+func TestMemoryGetHistory(t *testing.T) {
+	store := NewMemoryStore()
+
+	var seqs []uint64
+	for i := 0; i < 5; i++ {
+		msg := &pb.Message{Id: uuid.New().String(), RoomId: "test-room", Content: fmt.Sprintf("msg-%d", i)}
+		require.NoError(t, store.SaveMessage(msg))
+		seqs = append(seqs, msg.Seq)
+	}
+
+	page, err := store.GetHistory(HistoryQuery{RoomID: "test-room", Limit: 2, NewestFirst: true})
+	require.NoError(t, err)
+	require.Len(t, page.Messages, 2)
+	assert.True(t, page.HasMore)
+	assert.Equal(t, "msg-4", page.Messages[0].Content)
+	assert.Equal(t, "msg-3", page.Messages[1].Content)
+
+	page, err = store.GetHistory(HistoryQuery{RoomID: "test-room", Limit: 2, AfterSeq: seqs[1], BeforeSeq: seqs[4]})
+	require.NoError(t, err)
+	require.Len(t, page.Messages, 2)
+	assert.False(t, page.HasMore)
+	assert.Equal(t, "msg-2", page.Messages[0].Content)
+	assert.Equal(t, "msg-3", page.Messages[1].Content)
+
+	page, err = store.GetHistory(HistoryQuery{RoomID: "test-room", Limit: 10, Before: time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+	assert.Empty(t, page.Messages)
+}
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	pb "github.com/amirhlashgari/snapp-chat/proto"
+)
+
+// Store is the persistence backend used by the chat service. JetStreamStore
+// is the production implementation; MemoryStore keeps everything in process
+// and is meant for tests and local development.
+type Store interface {
+	// SaveMessage persists msg and sets msg.Seq to its assigned sequence.
+	// Replies, messages with a ThreadId, are kept apart from the room's
+	// history and only read back by querying their thread.
+	SaveMessage(msg *pb.Message) error
+	GetMessages(roomID string, limit int) ([]*pb.Message, error)
+	GetHistory(query HistoryQuery) (*HistoryPage, error)
+	// CountMessages returns how many of a room's messages have a sequence
+	// above afterSeq. Replies are not counted.
+	CountMessages(roomID string, afterSeq uint64) (uint64, error)
+	// CountRoomMessages returns how many messages each of roomIDs has,
+	// keyed by room ID, leaving out rooms without any. Replies are not
+	// counted.
+	CountRoomMessages(roomIDs []string) (map[string]uint64, error)
+	// CountReplies returns how many replies each thread in roomID has, keyed
+	// by the ID of the thread's root message.
+	CountReplies(roomID string) (map[string]uint64, error)
+	// GetMessage returns the message or reply with sequence seq in roomID.
+	GetMessage(roomID string, seq uint64) (*pb.Message, error)
+	// SaveRevision appends an edit of, or tombstone for, an earlier message.
+	// GetMessage, GetMessages and GetHistory return every message as of its
+	// latest revision.
+	SaveRevision(rev *pb.MessageRevision) error
+
+	// GetReadMarker returns the sequence of the last message userID has read
+	// in roomID together with the marker's revision. Both are 0 if the user
+	// has not read anything there yet.
+	GetReadMarker(roomID, userID string) (seq uint64, revision uint64, err error)
+	// GetReadMarkers returns the sequences of userID's read markers, keyed
+	// by room ID.
+	GetReadMarkers(userID string) (map[string]uint64, error)
+	// CompareAndSaveReadMarker saves a read marker with the same revision
+	// semantics as CompareAndSaveRoom.
+	CompareAndSaveReadMarker(roomID, userID string, seq, revision uint64) (uint64, error)
+
+	SaveUser(user *pb.User) error
+	GetUsers() ([]*pb.User, error)
+	// GetUser returns a user together with its current revision.
+	GetUser(id string) (*pb.User, uint64, error)
+	// CompareAndSaveUser saves user with the same revision semantics as
+	// CompareAndSaveRoom.
+	CompareAndSaveUser(user *pb.User, revision uint64) (uint64, error)
+
+	// GetCredentials returns the login record for a username, which is
+	// matched case-insensitively, together with its revision.
+	GetCredentials(username string) (*pb.Credentials, uint64, error)
+	// CompareAndSaveCredentials saves creds under their username with the
+	// same revision semantics as CompareAndSaveRoom. Creating with revision
+	// 0 is how username uniqueness is enforced.
+	CompareAndSaveCredentials(creds *pb.Credentials, revision uint64) (uint64, error)
+	// DeleteCredentials releases a username so it can be claimed again.
+	DeleteCredentials(username string) error
+
+	SaveRoom(room *pb.ChatRoom) error
+	GetRooms() ([]*pb.ChatRoom, error)
+	// GetRoom returns a room together with its current revision.
+	GetRoom(id string) (*pb.ChatRoom, uint64, error)
+	// CompareAndSaveRoom saves room only if its stored revision still equals
+	// revision, where 0 means the room must not exist yet. It returns the new
+	// revision, or ErrConflict if the room was changed in the meantime.
+	CompareAndSaveRoom(room *pb.ChatRoom, revision uint64) (uint64, error)
+	// DeleteRoom removes a room if its stored revision still equals
+	// revision, and purges its message history, read markers, reactions,
+	// webhooks and their deliveries. It returns ErrConflict if the room was
+	// changed or deleted in the meantime.
+	DeleteRoom(id string, revision uint64) error
+
+	// SaveNotification appends n to the inbox of n.UserId and sets n.Seq to
+	// its assigned sequence.
+	SaveNotification(n *pb.Notification) error
+	// GetNotifications returns up to limit of userID's notifications with a
+	// sequence above afterSeq, oldest first, and whether there are more.
+	GetNotifications(userID string, afterSeq uint64, limit int) ([]*pb.Notification, bool, error)
+	// DeleteNotifications removes userID's notification with sequence seq,
+	// or all of them if seq is 0. It returns ErrNotFound if userID has no
+	// notification with that sequence.
+	DeleteNotifications(userID string, seq uint64) error
+
+	// GetReactions returns the reactions to a message together with their
+	// revision. Both are empty if nobody has reacted yet.
+	GetReactions(roomID, messageID string) (*pb.Reactions, uint64, error)
+	// GetReactionsOf returns the reactions to those of a room's messages
+	// with the given IDs that anyone reacted to, keyed by message ID.
+	GetReactionsOf(roomID string, messageIDs []string) (map[string]*pb.Reactions, error)
+	// CompareAndSaveReactions saves the reactions to a message with the same
+	// revision semantics as CompareAndSaveRoom.
+	CompareAndSaveReactions(roomID, messageID string, reactions *pb.Reactions, revision uint64) (uint64, error)
+
+	// GetTokenBucket returns the rate limit bucket stored under key together
+	// with its revision, or an empty bucket and revision 0 if there is none.
+	GetTokenBucket(key string) (*pb.TokenBucket, uint64, error)
+	// CompareAndSaveTokenBucket saves a rate limit bucket with the same
+	// semantics as CompareAndSaveRoom.
+	CompareAndSaveTokenBucket(key string, bucket *pb.TokenBucket, revision uint64) (uint64, error)
+
+	// GetInvite returns an invite code together with its revision.
+	GetInvite(code string) (*pb.InviteCode, uint64, error)
+	// CompareAndSaveInvite saves an invite code with the same revision
+	// semantics as CompareAndSaveRoom.
+	CompareAndSaveInvite(invite *pb.InviteCode, revision uint64) (uint64, error)
+
+	// SaveWebhook stores a webhook under its room and ID.
+	SaveWebhook(hook *pb.Webhook) error
+	// GetWebhooks returns the webhooks of roomID, oldest first.
+	GetWebhooks(roomID string) ([]*pb.Webhook, error)
+	// DeleteWebhook removes a webhook. It returns ErrNotFound if roomID has
+	// no webhook with that ID.
+	DeleteWebhook(roomID, id string) error
+	// SaveDelivery stores the latest state of a webhook delivery. Delivery
+	// IDs must sort in the order the deliveries were created.
+	SaveDelivery(delivery *pb.WebhookDelivery) error
+	// GetDeliveries returns up to limit of a webhook's deliveries, newest
+	// first. Deliveries are kept for a week after their last change.
+	GetDeliveries(webhookID string, limit int) ([]*pb.WebhookDelivery, error)
+	// GetRetries returns every webhook delivery waiting to be attempted.
+	GetRetries() ([]*pb.WebhookRetry, error)
+	// GetRetry returns the retry of a delivery together with its revision.
+	GetRetry(deliveryID string) (*pb.WebhookRetry, uint64, error)
+	// CompareAndSaveRetry saves a retry under its delivery's ID with the
+	// same revision semantics as CompareAndSaveRoom.
+	CompareAndSaveRetry(retry *pb.WebhookRetry, revision uint64) (uint64, error)
+	// DeleteRetry removes the retry of a delivery that is settled, if there
+	// is one.
+	DeleteRetry(deliveryID string) error
+
+	// SaveBot stores a bot's registration under its name.
+	SaveBot(bot *pb.Bot) error
+	// GetBot returns the registration of the bot called name.
+	GetBot(name string) (*pb.Bot, error)
+	// GetBots returns every bot that ever registered, including those whose
+	// registration has lapsed.
+	GetBots() ([]*pb.Bot, error)
+	// ServeBots answers the requests bots send with what handler returns
+	// until the returned cancel function is called.
+	ServeBots(handler func(*pb.BotRequest) *pb.BotResponse) (cancel func(), err error)
+	// CallBot sends cmd to the bot called name and waits up to timeout for
+	// its reply. It returns ErrNotFound if no instance of the bot is
+	// listening.
+	CallBot(name string, cmd *pb.BotCommand, timeout time.Duration) (*pb.BotReply, error)
+
+	// PublishEvent broadcasts ev to current subscribers. Events are not
+	// persisted; subscribers that are offline simply miss them.
+	PublishEvent(ev *pb.Event) error
+	// SubscribeEvents calls handler for every published event matching
+	// filter until the returned cancel function is called.
+	SubscribeEvents(filter EventFilter, handler func(*pb.Event)) (cancel func(), err error)
+
+	// PublishTyping broadcasts a typing indicator to the room's current
+	// subscribers. Like events, indicators are not persisted.
+	PublishTyping(ind *pb.TypingIndicator) error
+	// SubscribeTyping calls handler for every typing indicator published in
+	// roomID until the returned cancel function is called.
+	SubscribeTyping(roomID string, handler func(*pb.TypingIndicator)) (cancel func(), err error)
+}
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("revision conflict")
+)
+
+var (
+	_ Store = (*JetStreamStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// HistoryQuery selects a page of a room's messages. Sequence bounds are
+// exclusive, Before is exclusive and After is inclusive; times refer to when
+// the message was stored. Zero values leave that side unbounded.
+type HistoryQuery struct {
+	RoomID string
+	// ThreadID selects the replies to the message with this ID instead of
+	// the room's own messages.
+	ThreadID    string
+	Limit       int
+	NewestFirst bool
+	BeforeSeq   uint64
+	AfterSeq    uint64
+	Before      time.Time
+	After       time.Time
+}
+
+// HistoryPage holds up to Limit messages in the requested order. HasMore
+// reports whether further messages exist in the paging direction.
+type HistoryPage struct {
+	Messages []*pb.Message
+	HasMore  bool
+}
+
+// EventFilter selects events for SubscribeEvents. Events with a RecipientId
+// are only matched by a filter for that UserID. Other events with a RoomId
+// are matched against RoomIDs; events without one are global.
+type EventFilter struct {
+	RoomIDs []string
+	Global  bool
+	UserID  string
+}
+
+func (f EventFilter) matches(ev *pb.Event) bool {
+	if ev.RecipientId != "" {
+		return f.UserID != "" && ev.RecipientId == f.UserID
+	}
+	if ev.RoomId == "" {
+		return f.Global
+	}
+	for _, id := range f.RoomIDs {
+		if id == ev.RoomId {
+			return true
+		}
+	}
+	return false
+}
+
+// directRoomPrefix starts the ID of every direct conversation, which is how
+// their messages are kept apart from those of shared rooms.
+const directRoomPrefix = "dm-"
+
+// DirectRoomID returns the ID of the direct conversation between two users.
+// It is the same whichever of them is passed first, so both end up in the
+// same room without having to look it up.
+func DirectRoomID(userA, userB string) string {
+	if userA > userB {
+		userA, userB = userB, userA
+	}
+	sum := sha256.Sum256([]byte(userA + "\n" + userB))
+	return directRoomPrefix + hex.EncodeToString(sum[:16])
+}
+
+// IsDirectRoom reports whether roomID belongs to a direct conversation.
+func IsDirectRoom(roomID string) bool {
+	return strings.HasPrefix(roomID, directRoomPrefix)
+}
+
+// applyRevision brings msg up to date with rev, its latest revision.
+func applyRevision(msg *pb.Message, rev *pb.MessageRevision) {
+	msg.Content = rev.Content
+	msg.Deleted = rev.Deleted
+	msg.EditedAt = rev.Timestamp
+}
+
+// messageKey identifies a message's revisions and reactions. Like read
+// markers, all keys of a room share a prefix.
+func messageKey(roomID, messageID string) string {
+	return roomID + "." + messageID
+}
+
+// readMarkerKey is the key of a user's read marker in a room. Room and user
+// IDs are valid subject tokens, so all markers of a room share a prefix.
+func readMarkerKey(roomID, userID string) string {
+	return roomID + "." + userID
+}
+
+// credentialsKey maps a username to its case-insensitive credentials key.
+func credentialsKey(username string) string {
+	return strings.ToLower(username)
+}